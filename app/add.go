@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The below function adds the sources of an ADD instruction to the image at
+// dest. It works like COPY from the build context, except that URLs are
+// downloaded and local tar archives, compressed or not, are extracted into
+// dest. checksum, when given, is the digest the content of every URL has to have
+func (b *builder) add(srcs []string, dest, checksum, createdBy string) error {
+	dest, toDir := b.copyDest(dest)
+	local := []string{}
+	urls := []string{}
+	for _, src := range srcs {
+		if isURL(src) {
+			urls = append(urls, src)
+		} else {
+			local = append(local, src)
+		}
+	}
+	if checksum != "" && len(local) > 0 {
+		return fmt.Errorf("--checksum can only be used with URLs")
+	}
+
+	matches := []string{}
+	if len(local) > 0 {
+		var err error
+		matches, err = matchSources(b.context, b.ignore, local)
+		if err != nil {
+			return err
+		}
+	}
+	if len(matches)+len(urls) > 1 && !toDir {
+		return fmt.Errorf("When adding several files the destination has to be a directory ending with /")
+	}
+
+	sources := []copySource{}
+	for _, match := range matches {
+		// an archive is extracted into dest whether it ends with "/" or not
+		if archive, err := isArchive(match); err != nil {
+			return err
+		} else if archive {
+			sources = append(sources, copySource{path: match, name: dest, archive: true})
+			continue
+		}
+		name, err := copyName(match, dest, toDir)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, copySource{path: match, name: name})
+	}
+
+	if len(urls) > 0 {
+		dir, err := os.MkdirTemp(b.dir, "add-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for i, rawURL := range urls {
+			name := dest
+			if toDir {
+				base, err := urlFileName(rawURL)
+				if err != nil {
+					return err
+				}
+				name = path.Join(dest, base)
+			}
+			file := filepath.Join(dir, fmt.Sprint(i))
+			err = downloadURL(rawURL, file, checksum)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, copySource{path: file, name: name})
+		}
+	}
+	return b.addSources(sources, b.ignore, createdBy)
+}
+
+// This function reports whether the source of an ADD is a URL to download
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// This function returns the name of the file a URL points to, the last
+// element of its path
+func urlFileName(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	base := path.Base(parsed.Path)
+	if base == "." || base == "/" {
+		return "", fmt.Errorf("Cannot determine a file name from %s, give one in the destination", rawURL)
+	}
+	return base, nil
+}
+
+// The below function downloads rawURL to file. The file gets the permissions
+// docker gives it (0600) and the modification time the server tells, and its
+// content has to match checksum when one is given
+func downloadURL(rawURL, file, checksum string) error {
+	resp, err := blobClient.Get(rawURL)
+	if err != nil {
+		return fmt.Errorf("Error downloading %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error downloading %s: %s", rawURL, resp.Status)
+	}
+
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error downloading %s: %v", rawURL, err)
+	}
+	if got := fmt.Sprintf("sha256:%x", hash.Sum(nil)); checksum != "" && got != checksum {
+		return fmt.Errorf("Checksum of %s does not match: expected %s, got %s", rawURL, checksum, got)
+	}
+
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		return os.Chtimes(file, modified, modified)
+	}
+	return nil
+}
+
+// The below function reports whether the file is a tar archive, plain or
+// compressed in a way decompress understands
+func isArchive(src string) (bool, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	r, err := decompress(file)
+	if err != nil {
+		return false, nil
+	}
+	_, err = tar.NewReader(r).Next()
+	return err == nil, nil
+}
+
+// The below function writes the entries of the tar archive at src to the tar
+// stream, moved under dest. Owners and permissions are kept as they are in the
+// archive
+func writeArchiveTar(tw *tar.Writer, src, dest string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := decompress(file)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %v", filepath.Base(src), err)
+		}
+		name, err := entryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		// the root of the archive would change dest itself
+		if name == "." {
+			continue
+		}
+		// untar would take them for whiteouts and delete what they name
+		if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			return fmt.Errorf("Cannot add %s: names starting with %s are reserved for whiteouts", header.Name, whiteoutPrefix)
+		}
+		header.Name = path.Join(dest, name)
+		if header.Typeflag == tar.TypeLink {
+			target, err := entryPath(header.Linkname)
+			if err != nil {
+				return err
+			}
+			header.Linkname = path.Join(dest, target)
+		}
+		header.Format = tar.FormatPAX
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
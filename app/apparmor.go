@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// On hosts with AppArmor, containers run confined by the mydocker-default
+// profile, the one of docker under our name: it lets the container do what
+// it wants with its files and the network, but not mount, write to most of
+// /proc and /sys or trace processes of other profiles. The profile is loaded
+// with apparmor_parser the first time a container needs it.
+// --security-opt apparmor=<profile> confines the container with a profile
+// already loaded instead, apparmor=unconfined runs it unconfined
+
+// defaultAppArmorProfile is the name of the profile containers get
+const defaultAppArmorProfile = "mydocker-default"
+
+// defaultAppArmorTemplate is the default profile, the one of docker
+const defaultAppArmorTemplate = `#include <tunables/global>
+
+profile mydocker-default flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+  signal (receive) peer=unconfined,
+  signal (send,receive) peer=mydocker-default,
+
+  deny @{PROC}/* w,
+  deny @{PROC}/{[^1-9],[^1-9][^0-9],[^1-9s][^0-9y][^0-9s],[^1-9][^0-9][^0-9][^0-9/]*}/** w,
+  deny @{PROC}/sys/[^k]** w,
+  deny @{PROC}/sys/kernel/{?,??,[^s][^h][^m]**} w,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/kcore rwklx,
+
+  deny mount,
+
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+
+  ptrace (trace,read,tracedby,readby) peer=mydocker-default,
+}
+`
+
+// This function reports whether the host confines processes with AppArmor
+func appArmorEnabled() bool {
+	data, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(data)) == "Y"
+}
+
+// The below function returns the profile a container run with the value of
+// --security-opt apparmor is confined by, empty for none. The default one is
+// loaded when the host doesn't have it yet, which takes root: containers of
+// users only get a profile they ask for
+func containerAppArmorProfile(option string) (string, error) {
+	if option == "unconfined" {
+		return "", nil
+	}
+	if !appArmorEnabled() {
+		if option != "" {
+			return "", fmt.Errorf("Cannot confine the container with AppArmor profile %s: AppArmor is not enabled on this host", option)
+		}
+		return "", nil
+	}
+	if option != "" {
+		if !appArmorLoaded(option) {
+			return "", fmt.Errorf("AppArmor profile %s is not loaded", option)
+		}
+		return option, nil
+	}
+	if rootless {
+		return "", nil
+	}
+	if !appArmorLoaded(defaultAppArmorProfile) {
+		cmd := exec.Command("apparmor_parser", "-Kr")
+		cmd.Stdin = strings.NewReader(defaultAppArmorTemplate)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("AppArmor enabled on system but the %s profile could not be loaded: %v: %s", defaultAppArmorProfile, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return defaultAppArmorProfile, nil
+}
+
+// The below function reports whether the profile is loaded, the kernel lists
+// the loaded ones as "<name> (<mode>)". Only root may read the list, a user
+// takes the profile it asks for is there
+func appArmorLoaded(profile string) bool {
+	data, err := os.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return rootless
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, _, _ := strings.Cut(line, " ("); name == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// The below function makes the calling thread change to profile when it
+// executes the container process. The interface of the kernel moved under
+// attr/apparmor, the older one is the one of whichever module is the first
+func applyAppArmorProfile(profile string) error {
+	value := []byte("exec " + profile)
+	err := os.WriteFile("/proc/thread-self/attr/apparmor/exec", value, 0)
+	if os.IsNotExist(err) {
+		err = os.WriteFile("/proc/thread-self/attr/exec", value, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("Error applying AppArmor profile %s: %v", profile, err)
+	}
+	return nil
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveManifest is an entry of the manifest.json of a docker-archive, the
+// format of `docker save`. Paths are relative to the root of the archive
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// savedImage is an image picked for saving, with the tag it was asked for if any
+type savedImage struct {
+	tag      string
+	digest   string
+	manifest *ManifestResponse
+}
+
+// Usage: your_docker.sh save [-o file] [--format docker-archive|oci|oci-dir] <image|id> ...
+// the archive is written to stdout when -o isn't given, oci-dir writes an OCI
+// layout into the directory -o names and adds to the layout already there
+func saveCommand(args []string) error {
+	flags := flag.NewFlagSet("save", flag.ContinueOnError)
+	output := flags.String("o", "", "write to a file instead of stdout")
+	format := flags.String("format", "docker-archive", "docker-archive, oci (an OCI layout tarball) or oci-dir")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: save [-o file] [--format docker-archive|oci|oci-dir] <image|id> ...")
+	}
+	var write func(w io.Writer, store *imageStore, images []savedImage) error
+	switch *format {
+	case "docker-archive", "docker":
+		write = writeDockerArchive
+	case "oci", "oci-archive":
+		write = func(w io.Writer, store *imageStore, images []savedImage) error {
+			tw := tar.NewWriter(w)
+			err := writeOCILayout(&tarLayout{tw: tw}, store, images, &ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex})
+			if err != nil {
+				return err
+			}
+			return tw.Close()
+		}
+	case "oci-dir":
+		if *output == "" {
+			return fmt.Errorf("--format oci-dir needs the directory to write to with -o")
+		}
+	default:
+		return fmt.Errorf("Unknown format %q: expected docker-archive, oci or oci-dir", *format)
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	images, err := store.selectImages(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	if *format == "oci-dir" {
+		index, err := readOCIIndex(*output)
+		if err != nil {
+			return err
+		}
+		err = writeOCILayout(&dirLayout{dir: *output}, store, images, index)
+		if err != nil {
+			return fmt.Errorf("Error saving images: %v", err)
+		}
+		return nil
+	}
+	if *output == "" {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("Cowardly refusing to save to a terminal. Use the -o flag or redirect")
+		}
+		return write(os.Stdout, store, images)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	err = write(file, store, images)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return fmt.Errorf("Error saving images: %v", err)
+	}
+	return nil
+}
+
+// The below function resolves the names given to save, a reference keeps its tag
+// in the archive while an image id is saved without one
+func (s *imageStore) selectImages(names []string) ([]savedImage, error) {
+	repositories, err := s.loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	images := []savedImage{}
+	for _, name := range names {
+		keys, err := s.matchImage(repositories, name)
+		if err != nil {
+			return nil, err
+		}
+		image := savedImage{digest: repositories[keys[0]]}
+		if ref, err := parseReference(name); err == nil && ref.tag != "" && ref.digest == "" && keys[0] == ref.String() {
+			image.tag = ref.String()
+		}
+		ref, err := parseReference(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		image.manifest, err = localImage(s, ref)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// The below function writes the images as a docker-archive: every config as
+// <hex>.json, every layer uncompressed as <diff id hex>/layer.tar and a
+// manifest.json tying them together. Layers shared by images are written once
+func writeDockerArchive(w io.Writer, store *imageStore, images []savedImage) error {
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	entries := []*archiveManifest{}
+	byConfig := map[string]*archiveManifest{}
+	repositories := map[string]map[string]string{}
+
+	for _, image := range images {
+		configDigest := image.manifest.Config.Digest
+		entry, ok := byConfig[configDigest]
+		if !ok {
+			config, err := store.readConfig(configDigest)
+			if err != nil {
+				return err
+			}
+			if len(config.RootFS.DiffIDs) != len(image.manifest.Layers) {
+				return fmt.Errorf("Image %s has %d layers but %d diff ids", configDigest, len(image.manifest.Layers), len(config.RootFS.DiffIDs))
+			}
+
+			entry = &archiveManifest{Config: strings.TrimPrefix(configDigest, "sha256:") + ".json", RepoTags: []string{}}
+			if !written[entry.Config] {
+				data, err := store.readBlob(configDigest)
+				if err != nil {
+					return err
+				}
+				err = writeTarFile(tw, entry.Config, int64(len(data)), bytes.NewReader(data))
+				if err != nil {
+					return err
+				}
+				written[entry.Config] = true
+			}
+			for i, layer := range image.manifest.Layers {
+				dir := strings.TrimPrefix(config.RootFS.DiffIDs[i], "sha256:")
+				name := dir + "/layer.tar"
+				entry.Layers = append(entry.Layers, name)
+				if written[name] {
+					continue
+				}
+				err = writeArchiveLayer(tw, store, layer.MediaType, layer.Digest, config.RootFS.DiffIDs[i], dir)
+				if err != nil {
+					return err
+				}
+				written[name] = true
+			}
+			byConfig[configDigest] = entry
+			entries = append(entries, entry)
+		}
+
+		if image.tag != "" {
+			entry.RepoTags = append(entry.RepoTags, image.tag)
+			ref, _ := parseReference(image.tag)
+			if repositories[ref.name()] == nil {
+				repositories[ref.name()] = map[string]string{}
+			}
+			top := entry.Layers[len(entry.Layers)-1]
+			repositories[ref.name()][ref.tag] = filepath.Dir(top)
+		}
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, "manifest.json", int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(repositories) > 0 {
+		data, err = json.Marshal(repositories)
+		if err != nil {
+			return err
+		}
+		err = writeTarFile(tw, "repositories", int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// The below function adds a layer to the archive uncompressed. The size of the
+// tar entry has to be known up front, so the layer is read twice: once to
+// measure it and check it against its diff id and once to write it
+func writeArchiveLayer(tw *tar.Writer, store *imageStore, mediaType, digest, diffID, dir string) error {
+	layer, err := openLayer(store, mediaType, digest)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, layer)
+	layer.Close()
+	if err != nil {
+		return fmt.Errorf("Error reading layer %s: %v", digest, err)
+	}
+	if got := fmt.Sprintf("sha256:%x", hash.Sum(nil)); got != diffID {
+		return fmt.Errorf("Layer %s does not match its diff id: expected %s, got %s", digest, diffID, got)
+	}
+
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: time.Unix(0, 0)})
+	if err != nil {
+		return err
+	}
+	layer, err = openLayer(store, mediaType, digest)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	return writeTarFile(tw, dir+"/layer.tar", size, layer)
+}
+
+// This function adds a regular file to the archive
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: time.Unix(0, 0)})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+// The below function opens a layer blob of the store and returns its
+// uncompressed content, the media type says how it was compressed
+func openLayer(store *imageStore, mediaType, digest string) (io.ReadCloser, error) {
+	file, err := os.Open(store.blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error decompressing layer %s: %v", digest, err)
+		}
+		return &layerReader{Reader: gz, file: file}, nil
+	case strings.HasSuffix(mediaType, "tar"):
+		return file, nil
+	default:
+		file.Close()
+		return nil, fmt.Errorf("Unsupported layer media type %s", mediaType)
+	}
+}
+
+// layerReader reads a decompressed layer and closes the blob underneath when done
+type layerReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (l *layerReader) Close() error {
+	return l.file.Close()
+}
+
+// Usage: your_docker.sh load [-i file|dir]
+// the archive is read from stdin when -i isn't given, docker-archives and OCI
+// layouts (as a tarball or a directory) are both understood
+func loadCommand(args []string) error {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	input := flags.String("i", "", "read from a tar archive file instead of stdin")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: load [-i file|dir]")
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	var images []loadedImage
+	if info, err := os.Stat(*input); *input != "" && err == nil && info.IsDir() {
+		images, err = loadOCILayout(store, *input)
+		if err != nil {
+			return err
+		}
+	} else {
+		r := io.Reader(os.Stdin)
+		if *input != "" {
+			file, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		images, err = loadArchive(store, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, image := range images {
+		if len(image.names) == 0 {
+			fmt.Printf("Loaded image ID: %s\n", image.id)
+			continue
+		}
+		for _, name := range image.names {
+			err = store.setTag(name, image.digest)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Loaded image: %s\n", name)
+		}
+	}
+	return nil
+}
+
+// loadedImage is an image added to the store from an archive, names are the
+// references the archive has for it and refName the OCI ref.name annotation
+type loadedImage struct {
+	digest  string
+	id      string
+	names   []string
+	refName string
+}
+
+// The below function adds the images of a docker-archive or OCI layout tarball
+// to the store, without tagging them
+func loadArchive(store *imageStore, r io.Reader) ([]loadedImage, error) {
+	// the archive is unpacked next to the blobs so that nothing is copied across file systems
+	staging, err := os.MkdirTemp(store.root, "load-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	err = unpackArchive(r, staging)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(staging, ociLayoutFile)); err == nil {
+		return loadOCILayout(store, staging)
+	}
+	return loadDockerArchive(store, staging)
+}
+
+// The below function unpacks the regular files of the archive into dir, the
+// entries of an image archive are only ever files and the directories they are in
+func unpackArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		path, err := archivePath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The below function returns where the file name of an archive is in the
+// directory it was unpacked in, names leading out of it are refused
+func archivePath(dir, name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path %q in archive", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// The below function adds the images of an unpacked docker-archive to the store.
+// Layers are saved gzip compressed the way they would have been pulled, and a
+// manifest is made for every image since the archive doesn't keep one
+func loadDockerArchive(store *imageStore, dir string) ([]loadedImage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker archive: %v", err)
+	}
+	var entries []archiveManifest
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker archive manifest.json: %v", err)
+	}
+
+	images := []loadedImage{}
+	for _, entry := range entries {
+		configPath, err := archivePath(dir, entry.Config)
+		if err != nil {
+			return nil, err
+		}
+		configData, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid docker archive: %v", err)
+		}
+		var config ImageConfig
+		err = json.Unmarshal(configData, &config)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid image config %s: %v", entry.Config, err)
+		}
+		if len(config.RootFS.DiffIDs) != len(entry.Layers) {
+			return nil, fmt.Errorf("Image %s has %d layers but %d diff ids", entry.Config, len(entry.Layers), len(config.RootFS.DiffIDs))
+		}
+
+		var manifest ManifestResponse
+		manifest.SchemaVersion = 2
+		manifest.MediaType = mediaTypeDockerManifest
+		manifest.Config.MediaType = mediaTypeDockerConfig
+		manifest.Config.Size = int64(len(configData))
+		manifest.Config.Digest, err = store.putBlob(configData)
+		if err != nil {
+			return nil, err
+		}
+		for i, layerPath := range entry.Layers {
+			path, err := archivePath(dir, layerPath)
+			if err != nil {
+				return nil, err
+			}
+			digest, size, err := store.importLayer(path, config.RootFS.DiffIDs[i])
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, Descriptor{MediaType: mediaTypeDockerLayer, Size: size, Digest: digest})
+		}
+
+		rawManifest, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		manifestDigest, err := store.putBlob(rawManifest)
+		if err != nil {
+			return nil, err
+		}
+		image := loadedImage{digest: manifestDigest, id: manifest.Config.Digest}
+		for _, tag := range entry.RepoTags {
+			ref, err := parseReference(tag)
+			if err != nil {
+				return nil, err
+			}
+			image.names = append(image.names, ref.String())
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// The below function saves a layer of an archive as a gzip compressed blob and
+// returns its digest and size. The layer may already be compressed, either way
+// its uncompressed content has to match diffID
+func (s *imageStore) importLayer(path, diffID string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 2)
+	n, _ := io.ReadFull(file, magic)
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, err
+	}
+
+	compressed := path
+	if n < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		compressed = path + ".gz"
+		out, err := os.Create(compressed)
+		if err != nil {
+			return "", 0, err
+		}
+		gz := gzip.NewWriter(out)
+		_, err = io.Copy(gz, file)
+		if err == nil {
+			err = gz.Close()
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	blob, err := os.Open(compressed)
+	if err != nil {
+		return "", 0, err
+	}
+	defer blob.Close()
+	hash := sha256.New()
+	gz, err := gzip.NewReader(io.TeeReader(blob, hash))
+	if err != nil {
+		return "", 0, err
+	}
+	uncompressed := sha256.New()
+	_, err = io.Copy(uncompressed, gz)
+	if err != nil {
+		return "", 0, err
+	}
+	// the rest of the stream after the gzip trailer is part of the blob too
+	_, err = io.Copy(hash, blob)
+	if err != nil {
+		return "", 0, err
+	}
+	if got := fmt.Sprintf("sha256:%x", uncompressed.Sum(nil)); got != diffID {
+		return "", 0, fmt.Errorf("Layer %s does not match its diff id: expected %s, got %s", filepath.Base(path), diffID, got)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	size, err := blob.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if !s.hasBlob(digest) {
+		_, err = blob.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", 0, err
+		}
+		err = s.writeBlob(digest, blob)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return digest, size, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Descriptor points to a blob or a manifest, artifacts add an artifact type and
+// annotations to it and image indexes a platform
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+// ArtifactManifest is an OCI image manifest used to carry an artifact (SBOM,
+// signature, provenance...) attached to an image with the subject field
+type ArtifactManifest struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       Descriptor        `json:"config"`
+	Layers       []Descriptor      `json:"layers"`
+	Subject      *Descriptor       `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Usage: your_docker.sh artifacts ls [--artifact-type type] <image>
+//
+//	your_docker.sh artifacts get [-o dir] <image> <artifact digest>
+func artifactsCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: artifacts ls|get ...")
+	}
+	if offline {
+		return fmt.Errorf("Cannot fetch artifacts: running in offline mode")
+	}
+	switch args[0] {
+	case "ls":
+		return artifactsListCommand(args[1:])
+	case "get":
+		return artifactsGetCommand(args[1:])
+	default:
+		return fmt.Errorf("Unknown artifacts command: %s", args[0])
+	}
+}
+
+// Usage: your_docker.sh artifacts ls [--artifact-type type] <image>
+func artifactsListCommand(args []string) error {
+	flags := flag.NewFlagSet("artifacts ls", flag.ContinueOnError)
+	artifactType := flags.String("artifact-type", "", "only list artifacts of this type")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: artifacts ls [--artifact-type type] <image>")
+	}
+
+	ref, err := parseReference(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	reg, err := connectRegistry(ref, "pull")
+	if err != nil {
+		return err
+	}
+	digest, err := reg.manifestDigest(ref.path, ref.identifier())
+	if err != nil {
+		return err
+	}
+
+	referrers, err := listReferrers(reg, ref.path, digest, *artifactType)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(writer, "DIGEST\tARTIFACT TYPE\tSIZE\tCREATED")
+	for _, referrer := range referrers {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\n", referrer.Digest, referrer.ArtifactType, referrer.Size, referrer.Annotations["org.opencontainers.image.created"])
+	}
+	return writer.Flush()
+}
+
+// The below function lists the artifacts whose subject is the manifest digest,
+// registries without the referrers api are read through the fallback tag
+// "sha256-<hex>" that clients push the referrers index to
+func listReferrers(reg *registry, repository, digest, artifactType string) ([]Descriptor, error) {
+	referrersURL := reg.url(fmt.Sprintf("/v2/%s/referrers/%s", repository, digest))
+	if artifactType != "" {
+		referrersURL += "?artifactType=" + url.QueryEscape(artifactType)
+	}
+	resp, err := reg.get(referrersURL, mediaTypeOCIIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var index struct {
+		Manifests []Descriptor `json:"manifests"`
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&index)
+		if err != nil {
+			return nil, err
+		}
+	case http.StatusNotFound:
+		raw, _, err := reg.fetchRawManifest(repository, strings.Replace(digest, ":", "-", 1), mediaTypeOCIIndex)
+		if err != nil {
+			// no fallback tag means no artifacts
+			return nil, nil
+		}
+		err = json.Unmarshal(raw, &index)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Error listing referrers: %v", resp.Status)
+	}
+
+	// the registry may ignore the filter (and the fallback index can't filter)
+	referrers := []Descriptor{}
+	for _, descriptor := range index.Manifests {
+		if artifactType == "" || descriptor.ArtifactType == artifactType {
+			referrers = append(referrers, descriptor)
+		}
+	}
+	return referrers, nil
+}
+
+// Usage: your_docker.sh artifacts get [-o dir] <image> <artifact digest>
+// without -o the content of a single layer artifact is written to stdout
+func artifactsGetCommand(args []string) error {
+	flags := flag.NewFlagSet("artifacts get", flag.ContinueOnError)
+	output := flags.String("o", "", "directory to write the artifact files to")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: artifacts get [-o dir] <image> <artifact digest>")
+	}
+
+	ref, err := parseReference(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	reg, err := connectRegistry(ref, "pull")
+	if err != nil {
+		return err
+	}
+	artifact, err := fetchArtifact(reg, ref.path, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		if len(artifact.Layers) != 1 {
+			return fmt.Errorf("Artifact has %d files, use -o to write them to a directory", len(artifact.Layers))
+		}
+		data, err := reg.fetchBlob(ref.path, artifact.Layers[0].Digest)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	err = os.MkdirAll(*output, 0755)
+	if err != nil {
+		return err
+	}
+	for _, layer := range artifact.Layers {
+		data, err := reg.fetchBlob(ref.path, layer.Digest)
+		if err != nil {
+			return err
+		}
+		// files are named after their title annotation when they have one
+		name := filepath.Base(layer.Annotations["org.opencontainers.image.title"])
+		if name == "." || name == "/" || name == "" {
+			name = strings.TrimPrefix(layer.Digest, "sha256:")
+		}
+		err = os.WriteFile(filepath.Join(*output, name), data, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Println(filepath.Join(*output, name))
+	}
+	return nil
+}
+
+// This function fetches and parses the manifest of an artifact
+func fetchArtifact(reg *registry, repository, digest string) (*ArtifactManifest, error) {
+	raw, _, err := reg.fetchRawManifest(repository, digest, mediaTypeOCIManifest)
+	if err != nil {
+		return nil, err
+	}
+	var artifact ArtifactManifest
+	err = json.Unmarshal(raw, &artifact)
+	if err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
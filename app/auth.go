@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dockerHubHost is the host of the docker hub registry api
+const dockerHubHost = "registry.hub.docker.com"
+
+// insecureRegistries are spoken to over plain http, set by --insecure-registry.
+// Registries on the loopback interface are always insecure, like in docker
+var insecureRegistries []string
+
+// registry is a registry host we talk to, along with the authorization we got
+// for it from its token service
+type registry struct {
+	host          string
+	scheme        string
+	authKey       string
+	authorization string
+}
+
+// This function returns a registry client for host, insecure registries are
+// spoken to over plain http
+func newRegistry(host string, insecure bool) *registry {
+	scheme := "https"
+	if insecure || isInsecureRegistry(host) {
+		scheme = "http"
+	}
+	authKey := host
+	if host == dockerHubHost {
+		authKey = dockerHubAuthKey
+	}
+	return &registry{host: host, scheme: scheme, authKey: authKey}
+}
+
+// The below function returns a registry client for the registry of ref,
+// authorized for actions ("pull" or "pull,push") on its repository
+func connectRegistry(ref reference, actions string) (*registry, error) {
+	if offline {
+		return nil, fmt.Errorf("Cannot reach %s: running in offline mode", ref.domain)
+	}
+	host := ref.domain
+	if host == defaultDomain {
+		host = dockerHubHost
+	}
+	r := newRegistry(host, false)
+	err := r.login(fmt.Sprintf("repository:%s:%s", ref.path, actions))
+	if err != nil {
+		return nil, fmt.Errorf("Error authenticating to %s: %v", ref.domain, err)
+	}
+	return r, nil
+}
+
+// This function reports whether host is in --insecure-registry or on the loopback interface
+func isInsecureRegistry(host string) bool {
+	for _, insecure := range insecureRegistries {
+		if insecure == host {
+			return true
+		}
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.Trim(hostname, "[]")
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The below function returns the url of path on the registry
+func (r *registry) url(path string) string {
+	return fmt.Sprintf("%s://%s%s", r.scheme, r.host, path)
+}
+
+// The below function gets a token for scope up front, from the challenge the
+// registry answers /v2/ with. Registries without authentication answer 200
+func (r *registry) login(scope string) error {
+	resp, err := httpClient.Get(r.url("/v2/"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	return r.authorize(resp.Header.Get("WWW-Authenticate"), scope)
+}
+
+// The below function sends the request with our authorization, when the registry
+// still answers 401 the challenge it sends back is answered and the request is
+// retried once, if its body can be sent again
+func (r *registry) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if r.authorization != "" {
+		req.Header.Set("Authorization", r.authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	err = r.authorize(challenge, "")
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", r.authorization)
+	return client.Do(retry)
+}
+
+// The below function sends a GET request to the registry
+func (r *registry) get(rawURL, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return r.do(httpClient, req)
+}
+
+// The below function answers a WWW-Authenticate challenge, Basic challenges are
+// answered with the saved credentials, Bearer ones with a token from the realm.
+// scope replaces the scope of the challenge when it's set
+func (r *registry) authorize(challenge, scope string) error {
+	scheme, params := parseChallenge(challenge)
+	username, password, err := registryCredentials(r.authKey)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return fmt.Errorf("Registry %s requires a login", r.host)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		r.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return fmt.Errorf("Invalid token realm in challenge: %s", challenge)
+		}
+		if scope == "" {
+			scope = params["scope"]
+		}
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		if scope != "" {
+			query.Set("scope", scope)
+		}
+		realm.RawQuery = query.Encode()
+
+		req, err := http.NewRequest("GET", realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Error getting token: %v", resp.Status)
+		}
+		var tokenResponse TokenResponse
+		err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+		if err != nil {
+			return err
+		}
+		token := tokenResponse.Token
+		if token == "" {
+			token = tokenResponse.AccessToken
+		}
+		r.authorization = "Bearer " + token
+		return nil
+	default:
+		return fmt.Errorf("Unsupported authentication challenge: %q", challenge)
+	}
+}
+
+// This function splits a WWW-Authenticate header like
+// `Bearer realm="https://auth.example.com/token",service="registry"` into the
+// scheme and its parameters
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return scheme, params
+}
@@ -0,0 +1,803 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Usage: your_docker.sh build [-t name:tag] ... [-f Dockerfile] <context>
+// builds an image from the Dockerfile (<context>/Dockerfile by default) and
+// tags it with every -t. RUN instructions run in a container of their own,
+// COPY takes its files from the context directory or, with --from, from an
+// earlier stage or another image, ADD also downloads URLs and extracts tar
+// archives. The image is the last stage. --build-arg
+// gives a value to the ARGs of the Dockerfile, a name alone takes the value of
+// our environment. The layers of RUN, COPY and ADD are reused from earlier
+// builds when nothing they depend on changed, unless --no-cache is given.
+// --squash flattens the layers of the image into one. --output writes the
+// image to a tarball or its file system to a directory, the image is only kept
+// in the store when it's given a name with -t too. --platform builds for
+// another platform, RUN then needs qemu registered with binfmt_misc
+func buildCommand(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	var tags stringList
+	flags.Var(&tags, "t", "name of the image, can be given several times")
+	var buildArgs stringList
+	flags.Var(&buildArgs, "build-arg", "set a build argument, NAME=value or NAME to take it from the environment")
+	file := flags.String("f", "", "the Dockerfile, <context>/Dockerfile by default")
+	noCache := flags.Bool("no-cache", false, "run every instruction instead of reusing the layers of earlier builds")
+	squash := flags.Bool("squash", false, "flatten the image into a single layer")
+	platform := flags.String("platform", "", "build for another platform, e.g. linux/arm64")
+	outputFlag := flags.String("output", "", "write the image to type=oci|docker,dest=<tarball> or its file system to type=local,dest=<dir>")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: build [-t name:tag] [-f Dockerfile] [--build-arg NAME=value] [--no-cache] [--squash] [--output type=...,dest=...] [--platform os/arch] <context>")
+	}
+	if *platform != "" {
+		targetPlatform, err = parsePlatform(*platform)
+		if err != nil {
+			return err
+		}
+	}
+	var output *buildOutput
+	if *outputFlag != "" {
+		output, err = parseBuildOutput(*outputFlag)
+		if err != nil {
+			return err
+		}
+	}
+	// an image without a tag would be pruned as soon as it is built
+	if len(tags) == 0 && output == nil {
+		return fmt.Errorf("build needs a name for the image, give it one with -t name:tag or write it out with --output")
+	}
+	refs := []reference{}
+	for _, tag := range tags {
+		ref, err := parseReference(tag)
+		if err != nil {
+			return err
+		}
+		if ref.digest != "" {
+			return fmt.Errorf("Refusing to create a tag with a digest reference: %s", tag)
+		}
+		refs = append(refs, ref)
+	}
+
+	context, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(context); err != nil || !info.IsDir() {
+		return fmt.Errorf("Build context %s is not a directory", flags.Arg(0))
+	}
+	if *file == "" {
+		*file = filepath.Join(context, "Dockerfile")
+	}
+	dockerfile, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	instructions, err := parseDockerfile(dockerfile)
+	dockerfile.Close()
+	if err != nil {
+		return err
+	}
+	// only ARGs for the FROM lines may come before the first FROM
+	first := 0
+	for first < len(instructions) && instructions[first].command == "ARG" {
+		first++
+	}
+	if first == len(instructions) || instructions[first].command != "FROM" {
+		return fmt.Errorf("Dockerfile has to start with FROM")
+	}
+	values := map[string]string{}
+	for _, arg := range buildArgs {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			value, ok = os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+		}
+		values[name] = value
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	driver, err := selectStorageDriver()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dataRoot, "build"), 0700)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(filepath.Join(dataRoot, "build"), "build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// the containers of RUN are mounted in a mount namespace of their own, see runCommand
+	runtime.LockOSThread()
+	err = isolateProcess()
+	if err != nil {
+		return fmt.Errorf("Error isolating process: %v", err)
+	}
+
+	ignore, err := readDockerignore(context)
+	if err != nil {
+		return err
+	}
+	cache, err := store.openBuildCache()
+	if err != nil {
+		return err
+	}
+
+	b := &builder{store: store, driver: driver, context: context, ignore: ignore, dir: dir, cache: cache, noCache: *noCache, buildArgs: values, usedArgs: map[string]bool{}}
+	for i, inst := range instructions {
+		fmt.Printf("Step %d/%d : %s\n", i+1, len(instructions), inst.original)
+		err = b.execute(inst)
+		if err != nil {
+			return fmt.Errorf("Error in %s (Dockerfile line %d): %v", inst.command, inst.line, err)
+		}
+	}
+
+	unused := []string{}
+	for name := range values {
+		if !b.usedArgs[name] && !isProxyArg(name) {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fmt.Printf("[Warning] One or more build-args %v were not consumed\n", unused)
+	}
+
+	if *squash && len(b.layers) > 1 {
+		err = b.squash()
+		if err != nil {
+			return err
+		}
+	}
+
+	b.config.Created = time.Now().UTC()
+	digest, id, err := store.writeImage(b.layers, &b.config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully built %s\n", shortID(id))
+	if output != nil {
+		tag := ""
+		if len(refs) > 0 {
+			tag = refs[0].String()
+		}
+		err = output.write(b, digest, tag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Successfully wrote %s\n", output.dest)
+	}
+	for _, ref := range refs {
+		err = store.setTag(ref.String(), digest)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Successfully tagged %s\n", ref)
+	}
+	return nil
+}
+
+// builder holds the image being built, its layers and config grow with every
+// instruction. Every FROM starts a new stage, the ones before are kept in
+// stages for COPY --from and FROM to use
+type builder struct {
+	store   *imageStore
+	driver  StorageDriver
+	context string // the build context directory
+	ignore  *dockerignore
+	dir     string // where the containers of RUN are created
+	cache   *buildCache
+	noCache bool
+	name    string // the name of the stage given with FROM ... AS name
+	layers  []Descriptor
+	config  ImageConfig
+	// cmdSet is true once the Dockerfile sets CMD, until then the one of the
+	// base image is dropped by ENTRYPOINT like docker does
+	cmdSet bool
+	stages []buildStage
+	// buildArgs are the values given with --build-arg, usedArgs the ones an
+	// ARG asked for
+	buildArgs map[string]string
+	usedArgs  map[string]bool
+	// globalArgs are the ARGs before the first FROM, they are only seen by
+	// the FROM lines and by the ARGs of a stage naming them without a value.
+	// args are the ARGs of the stage as NAME=value
+	globalArgs []string
+	args       []string
+}
+
+// instructionFlags are the --name=value flags the instructions take
+var instructionFlags = map[string][]string{
+	"ADD":  {"checksum"},
+	"COPY": {"from"},
+}
+
+// This function reports whether the instruction takes the flag
+func hasFlag(command, name string) bool {
+	for _, flag := range instructionFlags[command] {
+		if flag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyArgs are the build arguments every Dockerfile has without an ARG, they
+// are given to RUN but kept out of the image like docker does
+var proxyArgs = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy",
+	"NO_PROXY", "no_proxy",
+	"ALL_PROXY", "all_proxy",
+}
+
+// This function reports whether name is one of the predefined proxyArgs
+func isProxyArg(name string) bool {
+	for _, proxy := range proxyArgs {
+		if proxy == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildStage is a stage of a multi-stage build that is done
+type buildStage struct {
+	name   string
+	layers []Descriptor
+	config ImageConfig
+}
+
+// The below function applies a single instruction to the image
+func (b *builder) execute(inst instruction) error {
+	for name := range inst.flags {
+		if !hasFlag(inst.command, name) {
+			return fmt.Errorf("Unknown flag --%s", name)
+		}
+	}
+	// the ARGs before the first FROM are global and don't go in any image
+	if inst.command == "ARG" && b.config.OS == "" {
+		var err error
+		b.globalArgs, err = b.arg(b.globalArgs, inst.rest, b.globalArgs)
+		return err
+	}
+	// the ENV of the image wins over the ARGs
+	env := append(append([]string{}, b.args...), b.config.Config.Env...)
+	switch inst.command {
+	case "FROM":
+		words, err := shellWords(inst.rest, b.globalArgs)
+		if err != nil {
+			return err
+		}
+		name := ""
+		if len(words) == 3 && strings.EqualFold(words[1], "AS") {
+			name = strings.ToLower(words[2])
+			words = words[:1]
+		}
+		if len(words) != 1 {
+			return fmt.Errorf("FROM takes an image and optionally a stage name: FROM image [AS name]")
+		}
+		return b.from(words[0], name)
+	case "ARG":
+		var err error
+		b.args, err = b.arg(b.args, inst.rest, env)
+		if err != nil {
+			return err
+		}
+	case "RUN":
+		argv := inst.json
+		if argv == nil {
+			argv = []string{"/bin/sh", "-c", inst.rest}
+		}
+		return b.run(argv, inst.original)
+	case "COPY":
+		var err error
+		words := inst.json
+		if words == nil {
+			words, err = shellWords(inst.rest, env)
+			if err != nil {
+				return err
+			}
+		}
+		if len(words) < 2 {
+			return fmt.Errorf("COPY needs at least a source and a destination")
+		}
+		root, ignore := b.context, b.ignore
+		if from, ok := inst.flags["from"]; ok {
+			var unmount func()
+			root, unmount, err = b.mountStage(from)
+			if err != nil {
+				return err
+			}
+			defer unmount()
+			ignore = nil
+		}
+		return b.copy(root, ignore, words[:len(words)-1], words[len(words)-1], inst.original)
+	case "ADD":
+		var err error
+		words := inst.json
+		if words == nil {
+			words, err = shellWords(inst.rest, env)
+			if err != nil {
+				return err
+			}
+		}
+		if len(words) < 2 {
+			return fmt.Errorf("ADD needs at least a source and a destination")
+		}
+		return b.add(words[:len(words)-1], words[len(words)-1], inst.flags["checksum"], inst.original)
+	case "ENV":
+		words, err := shellWords(inst.rest, env)
+		if err != nil {
+			return err
+		}
+		if len(words) == 0 {
+			return fmt.Errorf("ENV needs at least one variable")
+		}
+		// the old form sets a single variable to the rest of the line: ENV NAME value
+		if !strings.Contains(words[0], "=") {
+			if len(words) < 2 {
+				return fmt.Errorf("ENV %s needs a value", words[0])
+			}
+			words = []string{words[0] + "=" + strings.Join(words[1:], " ")}
+		}
+		for _, word := range words {
+			name, value, ok := strings.Cut(word, "=")
+			if !ok || !isVarName(name) {
+				return fmt.Errorf("Invalid variable %q, expected NAME=value", word)
+			}
+			b.config.Config.Env = setEnv(b.config.Config.Env, name, value)
+		}
+	case "WORKDIR":
+		words, err := shellWords(inst.rest, env)
+		if err != nil {
+			return err
+		}
+		if len(words) != 1 {
+			return fmt.Errorf("WORKDIR takes a single directory")
+		}
+		dir := words[0]
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", b.config.Config.WorkingDir, dir)
+		}
+		b.config.Config.WorkingDir = path.Clean(dir)
+	case "CMD", "ENTRYPOINT":
+		argv := inst.json
+		if argv == nil {
+			argv = []string{"/bin/sh", "-c", inst.rest}
+		}
+		if inst.command == "CMD" {
+			b.config.Config.Cmd = argv
+			b.cmdSet = true
+		} else {
+			b.config.Config.Entrypoint = argv
+			if !b.cmdSet {
+				b.config.Config.Cmd = nil
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown instruction %s", inst.command)
+	}
+	b.addHistory(inst.original, true)
+	return nil
+}
+
+// The below function declares the build arguments of an ARG instruction,
+// NAME=default or NAME, in args and returns them. A value given with
+// --build-arg wins over the default, a NAME alone in a stage gets the value of
+// the global ARG with the name
+func (b *builder) arg(args []string, rest string, env []string) ([]string, error) {
+	words, err := shellWords(rest, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("ARG needs at least one name")
+	}
+	for _, word := range words {
+		name, value, hasDefault := strings.Cut(word, "=")
+		if !isVarName(name) {
+			return nil, fmt.Errorf("Invalid build argument %q, expected NAME or NAME=default", word)
+		}
+		b.usedArgs[name] = true
+		if given, ok := b.buildArgs[name]; ok {
+			value = given
+		} else if !hasDefault {
+			if value, ok = lookupEnv(b.globalArgs, name); !ok {
+				continue
+			}
+		}
+		args = setEnv(args, name, value)
+	}
+	return args, nil
+}
+
+// The below function returns the environment RUN is given: the env of the
+// image on top of the ARGs of the stage and the proxy build arguments
+func (b *builder) runEnv() []string {
+	env := []string{}
+	for _, name := range proxyArgs {
+		if value, ok := b.buildArgs[name]; ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	for _, kv := range append(append([]string{}, b.args...), b.config.Config.Env...) {
+		name, value, _ := strings.Cut(kv, "=")
+		env = setEnv(env, name, value)
+	}
+	return containerEnv(env)
+}
+
+// This function records an instruction in the history of the image
+func (b *builder) addHistory(createdBy string, emptyLayer bool) {
+	b.config.History = append(b.config.History, HistoryEntry{Created: time.Now().UTC(), CreatedBy: createdBy, EmptyLayer: emptyLayer})
+}
+
+// This function adds a layer created by an instruction to the image
+func (b *builder) addLayer(layer Descriptor, diffID, createdBy string) {
+	b.layers = append(b.layers, layer)
+	b.config.RootFS.Type = "layers"
+	b.config.RootFS.DiffIDs = append(b.config.RootFS.DiffIDs, diffID)
+	b.addHistory(createdBy, false)
+}
+
+// The below function starts a stage named name, the one before is kept. The
+// stage starts from an earlier stage, a base image pulled if it's not in the
+// store or from nothing for scratch
+func (b *builder) from(image, name string) error {
+	if b.config.OS != "" {
+		b.stages = append(b.stages, buildStage{name: b.name, layers: b.layers, config: b.config})
+	}
+	b.name = name
+	b.cmdSet = false
+	b.args = nil
+
+	if image == "scratch" {
+		b.layers = nil
+		b.config = ImageConfig{Architecture: targetPlatform.Architecture, OS: targetPlatform.OS, Variant: targetPlatform.Variant}
+		b.config.RootFS.Type = "layers"
+		return nil
+	}
+	if stage, ok := b.stage(image); ok {
+		b.layers = stage.layers
+		b.config = stage.config
+	} else {
+		manifest, config, err := b.image(image)
+		if err != nil {
+			return err
+		}
+		b.layers = manifest.Layers
+		b.config = *config
+	}
+	// the stage appends to them, what it starts from must not see it
+	b.layers = append([]Descriptor{}, b.layers...)
+	b.config.Config.Env = append([]string{}, b.config.Config.Env...)
+	b.config.RootFS.DiffIDs = append([]string{}, b.config.RootFS.DiffIDs...)
+	b.config.History = append([]HistoryEntry{}, b.config.History...)
+	return nil
+}
+
+// This function returns the earlier stage with the name, or at the index
+// counting from 0, as COPY --from names them
+func (b *builder) stage(name string) (buildStage, bool) {
+	for i, stage := range b.stages {
+		if (stage.name != "" && stage.name == strings.ToLower(name)) || strconv.Itoa(i) == name {
+			return stage, true
+		}
+	}
+	return buildStage{}, false
+}
+
+// This function returns the manifest and config of an image, pulled if it's
+// not in the store
+func (b *builder) image(name string) (*ManifestResponse, *ImageConfig, error) {
+	ref, err := parseReference(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := getImage(b.store, ref, pullMissing)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error getting image: %v", err)
+	}
+	config, err := b.store.readConfig(manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading image config: %v", err)
+	}
+	if config.Architecture != "" && !config.platform().matches(targetPlatform) {
+		return nil, nil, fmt.Errorf("Image %s is for %s, not %s", name, config.platform(), targetPlatform)
+	}
+	return manifest, config, nil
+}
+
+// The below function mounts the file system of an earlier stage, or of an
+// image when no stage has the name, for COPY --from to copy from. The returned
+// function unmounts it
+func (b *builder) mountStage(name string) (string, func(), error) {
+	manifest := &ManifestResponse{}
+	var config *ImageConfig
+	if stage, ok := b.stage(name); ok {
+		manifest.Layers = stage.layers
+		config = &stage.config
+	} else {
+		var err error
+		manifest, config, err = b.image(name)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	dir, err := os.MkdirTemp(b.dir, "from-")
+	if err != nil {
+		return "", nil, err
+	}
+	root, err := b.driver.mountImage(b.store, manifest, config, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return root, func() {
+		b.driver.unmount(root)
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// The below function flattens the layers of the image into a single one
+func (b *builder) squash() error {
+	dir, err := os.MkdirTemp(b.dir, "squash-")
+	if err != nil {
+		return err
+	}
+	manifest := &ManifestResponse{Layers: b.layers}
+	root, err := b.driver.mountImage(b.store, manifest, &b.config, dir)
+	if err != nil {
+		return err
+	}
+	defer b.driver.unmount(root)
+	count := len(b.layers)
+	layer, err := b.store.squash(root, &b.config)
+	if err != nil {
+		return err
+	}
+	b.layers = []Descriptor{layer}
+	b.config.History = append(b.config.History, HistoryEntry{Created: time.Now().UTC(), Comment: fmt.Sprintf("squashed %d layers", count)})
+	return nil
+}
+
+// The below function runs argv in a container of the image as it is so far,
+// with its env, working directory and user, and adds what it changed as a layer
+func (b *builder) run(argv []string, createdBy string) error {
+	key := b.cacheKey(createdBy, "")
+	if b.useCache(key, createdBy) {
+		return nil
+	}
+	err := checkEmulation(b.config.Architecture)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(b.dir, "run-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	manifest := &ManifestResponse{Layers: b.layers}
+	rootfs, err := b.driver.mount(b.store, manifest, &b.config, dir, "")
+	if err != nil {
+		return err
+	}
+	defer b.driver.unmount(rootfs)
+
+	workDir := b.config.Config.WorkingDir
+	if workDir == "" {
+		workDir = "/"
+	}
+	err = os.MkdirAll(filepath.Join(rootfs, workDir), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating working directory: %v", err)
+	}
+	var credential *syscall.Credential
+	if b.config.Config.User != "" {
+		credential, _, err = resolveUser(rootfs, b.config.Config.User)
+		if err != nil {
+			return fmt.Errorf("Error resolving user: %v", err)
+		}
+	}
+
+	err = execContainer(&initConfig{Rootfs: rootfs, Args: argv, Env: b.runEnv(), WorkDir: workDir, User: credential, ShmSize: defaultShmSize, UserNamespace: true}, nil, nil)
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return fmt.Errorf("The command '%s' returned a non-zero code: %d", strings.Join(argv, " "), exitError.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+
+	// the overlay drivers have the changes in the upper directory, with vfs the
+	// copy is compared with the image
+	var write func(tw *tar.Writer) error
+	if upper := filepath.Join(dir, "upper"); fileExists(upper) {
+		write = func(tw *tar.Writer) error {
+			return writeLayerTar(tw, upper)
+		}
+	} else {
+		image, err := b.driver.mountImage(b.store, manifest, &b.config, dir)
+		if err != nil {
+			return err
+		}
+		defer b.driver.unmount(image)
+		changes, err := treeChanges(rootfs, image)
+		if err != nil {
+			return err
+		}
+		sortChanges(changes)
+		write = func(tw *tar.Writer) error {
+			return writeChangesTar(tw, rootfs, changes)
+		}
+	}
+	layer, diffID, err := b.store.createLayer(func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		err := write(tw)
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating layer: %v", err)
+	}
+	b.addLayer(layer, diffID, createdBy)
+	return b.cache.add(key, layer, diffID)
+}
+
+// The below function adds the files matching srcs in root, the build context
+// or the file system of another stage, to the image at dest, which is relative
+// to the working directory. A directory has its content copied, several
+// sources need dest to be a directory ending in "/". What ignore excludes is
+// left out
+func (b *builder) copy(root string, ignore *dockerignore, srcs []string, dest, createdBy string) error {
+	dest, toDir := b.copyDest(dest)
+	matches, err := matchSources(root, ignore, srcs)
+	if err != nil {
+		return err
+	}
+	if len(matches) > 1 && !toDir {
+		return fmt.Errorf("When copying several files the destination has to be a directory ending with /")
+	}
+	sources := []copySource{}
+	for _, match := range matches {
+		name, err := copyName(match, dest, toDir)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, copySource{path: match, name: name})
+	}
+	return b.addSources(sources, ignore, createdBy)
+}
+
+// copySource is a file or directory COPY and ADD put in the image
+type copySource struct {
+	path    string // where it is on our side
+	name    string // its path in the image, relative to the root
+	archive bool   // a tar archive ADD extracts at name
+}
+
+// This function returns the destination of COPY and ADD relative to the root
+// of the image, and whether it's a directory
+func (b *builder) copyDest(dest string) (string, bool) {
+	toDir := strings.HasSuffix(dest, "/")
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", b.config.Config.WorkingDir, dest)
+	}
+	return strings.TrimPrefix(path.Clean(dest), "/"), toDir
+}
+
+// The below function returns the files matching the patterns of srcs in root,
+// with the symlinks on their way resolved inside root. A pattern matching
+// nothing, or only what ignore excludes, is an error
+func matchSources(root string, ignore *dockerignore, srcs []string) ([]string, error) {
+	matches := []string{}
+	for _, src := range srcs {
+		found, err := filepath.Glob(filepath.Join(root, filepath.Clean("/"+src)))
+		if err != nil {
+			return nil, err
+		}
+		kept := []string{}
+		for _, match := range found {
+			if !ignore.excluded(match) {
+				kept = append(kept, match)
+			}
+		}
+		if len(kept) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", src)
+		}
+		for _, match := range kept {
+			// symlinks are followed inside root only
+			rel, err := filepath.Rel(root, match)
+			if err != nil {
+				return nil, err
+			}
+			resolved, err := containerPath(root, rel)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, resolved)
+		}
+	}
+	return matches, nil
+}
+
+// This function returns the name a file copied to dest gets in the image: a
+// directory has its content copied into dest and a file goes in it when it's
+// a directory
+func copyName(src, dest string, toDir bool) (string, error) {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() && dest == "" {
+		return ".", nil
+	}
+	if !info.IsDir() && toDir {
+		return path.Join(dest, filepath.Base(src)), nil
+	}
+	return dest, nil
+}
+
+// The below function adds a layer with the sources to the image, archives are
+// extracted and what ignore excludes is left out. The layer is taken from the
+// cache when the sources didn't change
+func (b *builder) addSources(sources []copySource, ignore *dockerignore, createdBy string) error {
+	content, err := hashSources(sources, ignore)
+	if err != nil {
+		return err
+	}
+	key := b.cacheKey(createdBy, content)
+	if b.useCache(key, createdBy) {
+		return nil
+	}
+	layer, diffID, err := b.store.createLayer(func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		for _, source := range sources {
+			var err error
+			if source.archive {
+				err = writeArchiveTar(tw, source.path, source.name)
+			} else {
+				err = writeCopyTar(tw, source.path, source.name, 0, 0, ignore)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating layer: %v", err)
+	}
+	b.addLayer(layer, diffID, createdBy)
+	return b.cache.add(key, layer, diffID)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// buildCache remembers the layers created by the RUN, COPY and ADD
+// instructions of builds, keyed by everything that went into them, so a
+// rebuild only runs the instructions that changed. It's kept in the image
+// store as buildcache.json
+type buildCache struct {
+	path   string
+	Layers map[string]cachedLayer `json:"layers"`
+}
+
+// cachedLayer is a layer created by an instruction
+type cachedLayer struct {
+	Layer  Descriptor `json:"layer"`
+	DiffID string     `json:"diffId"`
+}
+
+// This function loads the build cache of the store, a missing cache is empty
+func (s *imageStore) openBuildCache() (*buildCache, error) {
+	cache := &buildCache{path: filepath.Join(s.root, "buildcache.json"), Layers: map[string]cachedLayer{}}
+	data, err := os.ReadFile(cache.path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing build cache: %v", err)
+	}
+	if cache.Layers == nil {
+		cache.Layers = map[string]cachedLayer{}
+	}
+	return cache, nil
+}
+
+// The below function returns the layer cached for key, as long as its blob is
+// still in the store: removing images may have deleted it
+func (c *buildCache) lookup(store *imageStore, key string) (cachedLayer, bool) {
+	cached, ok := c.Layers[key]
+	if !ok || !store.hasBlob(cached.Layer.Digest) {
+		return cachedLayer{}, false
+	}
+	return cached, true
+}
+
+// This function records the layer created for key and saves the cache
+func (c *buildCache) add(key string, layer Descriptor, diffID string) error {
+	c.Layers[key] = cachedLayer{Layer: layer, DiffID: diffID}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// The below function returns the cache key of an instruction run on the image
+// as it is so far: its platform, layers, config and the ARGs of the stage, the
+// instruction itself and content, the hash of the files it copies
+func (b *builder) cacheKey(createdBy, content string) string {
+	data, _ := json.Marshal(struct {
+		Platform  string          `json:"platform"`
+		Parent    []string        `json:"parent"`
+		Config    ContainerConfig `json:"config"`
+		Args      []string        `json:"args"`
+		CreatedBy string          `json:"createdBy"`
+		Content   string          `json:"content"`
+	}{b.config.platform().String(), b.config.RootFS.DiffIDs, b.config.Config, b.args, createdBy, content})
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// The below function adds the layer cached for key to the image, it reports
+// false when there is none or --no-cache is given
+func (b *builder) useCache(key, createdBy string) bool {
+	if b.noCache {
+		return false
+	}
+	cached, ok := b.cache.lookup(b.store, key)
+	if !ok {
+		return false
+	}
+	fmt.Println(" ---> Using cache")
+	b.addLayer(cached.Layer, cached.DiffID, createdBy)
+	return true
+}
+
+// The below function hashes what the sources put in the image: their names,
+// modes, link targets and content, what ignore excludes left out. Times and
+// owners are not part of it, like with docker
+func hashSources(sources []copySource, ignore *dockerignore) (string, error) {
+	hash := sha256.New()
+	for _, source := range sources {
+		fmt.Fprintf(hash, "%s %t\n", source.name, source.archive)
+		err := filepath.Walk(source.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if ignore.excluded(path) {
+				if info.IsDir() && !ignore.exceptions {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(source.path, path)
+			if err != nil {
+				return err
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, err = os.Readlink(path)
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(hash, "%s %o %d %s\n", rel, info.Mode(), info.Size(), link)
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(hash, file)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
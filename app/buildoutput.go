@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildOutput is where --output sends the image built: an OCI layout or a
+// docker-archive tarball, or the file system of the image in a directory
+type buildOutput struct {
+	kind string // oci, docker or local
+	dest string // the tarball or the directory
+}
+
+// The below function parses the value of --output, e.g. type=oci,dest=img.tar
+// or type=local,dest=dir
+func parseBuildOutput(value string) (*buildOutput, error) {
+	output := &buildOutput{}
+	for _, field := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid --output %q: expected key=value pairs", value)
+		}
+		switch key {
+		case "type":
+			output.kind = val
+		case "dest":
+			output.dest = val
+		default:
+			return nil, fmt.Errorf("Invalid --output %q: unknown key %s", value, key)
+		}
+	}
+	switch output.kind {
+	case "oci", "docker", "local":
+	case "":
+		return nil, fmt.Errorf("Invalid --output %q: type is missing", value)
+	default:
+		return nil, fmt.Errorf("Unknown output type %q: expected oci, docker or local", output.kind)
+	}
+	if output.dest == "" {
+		return nil, fmt.Errorf("Invalid --output %q: dest is missing", value)
+	}
+	// RUN leaves us in another directory, the path is taken from where we started
+	dest, err := filepath.Abs(output.dest)
+	if err != nil {
+		return nil, err
+	}
+	output.dest = dest
+	return output, nil
+}
+
+// The below function writes the image built by b, saved in the store with the
+// manifest digest, to the output. tag names the image in the tarball
+func (o *buildOutput) write(b *builder, digest, tag string) error {
+	if o.kind == "local" {
+		return b.exportRootfs(o.dest)
+	}
+	manifest, err := b.store.readManifest(digest)
+	if err != nil {
+		return err
+	}
+	images := []savedImage{{tag: tag, digest: digest, manifest: manifest}}
+	write := func(w io.Writer) error {
+		if o.kind == "docker" {
+			return writeDockerArchive(w, b.store, images)
+		}
+		tw := tar.NewWriter(w)
+		err := writeOCILayout(&tarLayout{tw: tw}, b.store, images, &ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex})
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+	file, err := os.Create(o.dest)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(o.dest)
+		return fmt.Errorf("Error writing %s: %v", o.dest, err)
+	}
+	return nil
+}
+
+// The below function copies the file system of the image built into the
+// directory dest, which is created if needed
+func (b *builder) exportRootfs(dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(b.dir, "output-")
+	if err != nil {
+		return err
+	}
+	root, err := b.driver.mountImage(b.store, &ManifestResponse{Layers: b.layers}, &b.config, dir)
+	if err != nil {
+		return err
+	}
+	defer b.driver.unmount(root)
+	return copyPath(root, true, dest, "", -1, -1)
+}
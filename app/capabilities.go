@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Root in a container only keeps the capabilities docker gives containers,
+// the ones it takes to run what images run: changing owners and users, binding
+// low ports, sending raw packets and the like. The others are dropped from
+// the bounding set of the container process, so nothing it executes, setuid
+// or with file capabilities, gets them back. --cap-add and --cap-drop change
+// the set, ALL being every capability
+
+// capabilityNames are the capabilities of linux, by number
+var capabilityNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK",
+	"CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE", "CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD", "CAP_LEASE", "CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL", "CAP_SETFCAP", "CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG",
+	"CAP_WAKE_ALARM", "CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// defaultCapabilities are the capabilities of containers, the same as docker's
+var defaultCapabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FSETID", "CAP_FOWNER", "CAP_MKNOD",
+	"CAP_NET_RAW", "CAP_SETGID", "CAP_SETUID", "CAP_SETFCAP", "CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// The below function returns the capabilities of a container run with
+// --cap-add add and --cap-drop drop, the way docker makes them: ALL in add is
+// every capability but the dropped ones, ALL in drop only the added ones.
+// Otherwise the dropped ones are taken out of the default set and the added
+// ones put in, a capability both added and dropped is added
+func containerCapabilities(add, drop []string) ([]string, error) {
+	add, err := normalizeCapabilities(add)
+	if err != nil {
+		return nil, err
+	}
+	drop, err = normalizeCapabilities(drop)
+	if err != nil {
+		return nil, err
+	}
+	caps := []string{}
+	switch {
+	case containsString(add, "ALL"):
+		for _, c := range capabilityNames {
+			if !containsString(drop, c) {
+				caps = append(caps, c)
+			}
+		}
+		return caps, nil
+	case containsString(drop, "ALL"):
+		return add, nil
+	}
+	for _, c := range defaultCapabilities {
+		if !containsString(drop, c) {
+			caps = append(caps, c)
+		}
+	}
+	for _, c := range add {
+		if !containsString(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
+
+// The below function returns names as CAP_ names, docker takes them in any
+// case and without the prefix
+func normalizeCapabilities(names []string) ([]string, error) {
+	var caps []string
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		if name != "ALL" && !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		if name != "ALL" && !containsString(capabilityNames, name) {
+			return nil, fmt.Errorf("Unknown capability: %q", name)
+		}
+		caps = append(caps, name)
+	}
+	return caps, nil
+}
+
+// This function returns the number of the last capability the kernel has
+func lastCapability() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	return last
+}
+
+// The below function drops the capabilities not in caps from the bounding set
+// of the calling thread, which takes CAP_SETPCAP. The ones the kernel doesn't
+// have are left out
+func dropBoundingSet(caps []string) error {
+	last := lastCapability()
+	for number, name := range capabilityNames {
+		if number > last || containsString(caps, name) {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(number), 0)
+		if errno != 0 {
+			return fmt.Errorf("Error dropping %s: %v", name, errno)
+		}
+	}
+	return nil
+}
+
+// capUserHeader and capUserData are the arguments of capset, version 3 takes
+// two of the data for 64 capabilities
+type capUserHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capUserData struct {
+	effective, permitted, inheritable uint32
+}
+
+const linuxCapabilityVersion3 = 0x20080522
+
+// The below function makes caps the effective and permitted capabilities of
+// the calling thread, and leaves it none to inherit. Root executing a program
+// is then given the ones of the bounding set again
+func setCapabilities(caps []string) error {
+	var data [2]capUserData
+	last := lastCapability()
+	for number, name := range capabilityNames {
+		if number <= last && containsString(caps, name) {
+			data[number/32].effective |= 1 << (number % 32)
+			data[number/32].permitted |= 1 << (number % 32)
+		}
+	}
+	header := capUserHeader{version: linuxCapabilityVersion3}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("Error setting the capabilities: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Usage: your_docker.sh catalog [--insecure] [--page-size n] [--last name] <registry>
+func catalogCommand(args []string) error {
+	flags := flag.NewFlagSet("catalog", flag.ContinueOnError)
+	insecure := flags.Bool("insecure", false, "talk to the registry over plain http")
+	pageSize := flags.Int("page-size", 100, "number of repositories asked for in every request")
+	last := flags.String("last", "", "start listing after this repository")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: catalog [--insecure] [--page-size n] [--last name] <registry>")
+	}
+	if offline {
+		return fmt.Errorf("Cannot list catalog of %s: running in offline mode", flags.Arg(0))
+	}
+
+	reg := newRegistry(flags.Arg(0), *insecure)
+	query := url.Values{}
+	query.Set("n", fmt.Sprint(*pageSize))
+	if *last != "" {
+		query.Set("last", *last)
+	}
+
+	// every page links to the next one, the last page has no Link header
+	pageURL := reg.url("/v2/_catalog?" + query.Encode())
+	for pageURL != "" {
+		resp, err := reg.get(pageURL, "")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("Error listing catalog: %v", resp.Status)
+		}
+
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, repository := range page.Repositories {
+			fmt.Println(repository)
+		}
+
+		pageURL, err = nextPageURL(resp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
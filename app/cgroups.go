@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The resources of a container are limited with a cgroup of its own, like
+// docker does with its cgroupfs driver: run creates it under
+// /sys/fs/cgroup/mydocker/<id> in the unified hierarchy of cgroup v2, or under
+// /sys/fs/cgroup/<controller>/mydocker/<id> in the hierarchy of every
+// controller it needs on hosts still on cgroup v1 (see cgroupsv1.go). It
+// writes the limits, puts the container init in it before it executes the
+// container process and removes it once the container exits
+
+// cgroupRoot is where the cgroup hierarchies are mounted, the unified one
+// itself or a directory of the ones of cgroup v1
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupParent is the cgroup the cgroups of containers go in
+const cgroupParent = "mydocker"
+
+// cgroup2SuperMagic is the file system type of cgroup v2 in statfs
+const cgroup2SuperMagic = 0x63677270
+
+// minMemory is the smallest memory limit, the one docker takes
+const minMemory = 6 << 20
+
+// Resources is what the cgroup of a container limits it to
+type Resources struct {
+	Memory int64 `json:",omitempty"` // bytes, -m
+	// the memory and the swap together in bytes, -1 for unlimited swap. Without
+	// it the container may swap as much as its memory limit, like docker
+	MemorySwap int64 `json:",omitempty"`
+	// 0 to 100, cgroup v1 only, v2 has no swappiness of its own
+	MemorySwappiness *int64 `json:",omitempty"`
+	// --cpus in billionths of a cpu, or the quota of every period in
+	// microseconds of --cpu-quota and --cpu-period
+	NanoCPUs  int64 `json:",omitempty"`
+	CPUPeriod int64 `json:",omitempty"`
+	CPUQuota  int64 `json:",omitempty"`
+	// the weight of the container against the others when the cpus are busy,
+	// 1024 is the one of every container without --cpu-shares
+	CPUShares int64 `json:",omitempty"`
+	// the cpus and the memory nodes the container runs on, lists like 0-3,5
+	CpusetCpus string `json:",omitempty"`
+	CpusetMems string `json:",omitempty"`
+	// how many processes the container may have at once, unlimited unless
+	// above 0
+	PidsLimit int64 `json:",omitempty"`
+	// the bytes and the operations a second the container may read from and
+	// write to block devices
+	BlkioDeviceReadBps   []ThrottleDevice `json:",omitempty"`
+	BlkioDeviceWriteBps  []ThrottleDevice `json:",omitempty"`
+	BlkioDeviceReadIOps  []ThrottleDevice `json:",omitempty"`
+	BlkioDeviceWriteIOps []ThrottleDevice `json:",omitempty"`
+}
+
+// ThrottleDevice is a block device and its rate, a value of --device-read-bps
+// and the like
+type ThrottleDevice struct {
+	Path  string
+	Rate  uint64
+	Major int64 `json:"-"`
+	Minor int64 `json:"-"`
+}
+
+// defaultCPUPeriod is the period of the cpu quota in microseconds when there
+// is no --cpu-period, the one of the kernel
+const defaultCPUPeriod = 100000
+
+// the range of --cpu-shares, the one of cgroup v1 the kernel clamps to
+const (
+	minCPUShares = 2
+	maxCPUShares = 262144
+)
+
+// This function reports whether any limit is set, a container without any
+// doesn't get a cgroup
+func (r Resources) given() bool {
+	return len(r.controllers()) > 0
+}
+
+// cgroup is the cgroup of a container
+type cgroup struct {
+	// the directory of the cgroup in the hierarchy of every controller it
+	// uses, the same one for all of them on cgroup v2
+	dirs map[string]string
+	// the scope of the systemd driver, systemd creates the cgroup when the
+	// container init is put in it (see cgroupssystemd.go)
+	unit      string
+	bus       *dbusConn
+	resources Resources
+}
+
+// This function reports whether the host is on cgroup v2, with the unified
+// hierarchy alone
+func cgroupV2() bool {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(cgroupRoot, &fs)
+	return err == nil && fs.Type == cgroup2SuperMagic
+}
+
+// The below function creates the cgroup of the container with the id and
+// writes the limits of resources to it, with the cgroup version of the host
+func createCgroup(id string, resources Resources) (*cgroup, error) {
+	if cgroupDriver == "systemd" {
+		return createScope(id, resources)
+	}
+	if !cgroupV2() {
+		return createCgroupV1(id, resources)
+	}
+
+	// the controllers the limits need are enabled for the children of the root
+	// and of the parent cgroup first
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating cgroup %s: %v", parent, err)
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		err = enableControllers(dir, resources.controllers())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dir := filepath.Join(parent, id)
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating cgroup %s: %v", dir, err)
+	}
+	c := &cgroup{dirs: map[string]string{}}
+	for _, controller := range resources.controllers() {
+		c.dirs[controller] = dir
+	}
+	err = c.writeLimits(resources)
+	if err != nil {
+		c.remove()
+		return nil, err
+	}
+	return c, nil
+}
+
+// The below function writes the limits of resources to the files of the
+// controllers of cgroup v2
+func (c *cgroup) writeLimits(resources Resources) error {
+	var err error
+	if resources.Memory > 0 {
+		err = c.write("memory.max", strconv.FormatInt(resources.Memory, 10))
+	}
+	if err == nil && resources.Memory > 0 {
+		err = c.writeSwap(resources)
+	}
+	if err == nil && resources.limitsCPU() {
+		err = c.write("cpu.max", resources.cpuMax())
+	}
+	if err == nil && resources.CPUShares > 0 {
+		err = c.write("cpu.weight", strconv.FormatInt(cpuWeight(resources.CPUShares), 10))
+	}
+	if err == nil && resources.CpusetCpus != "" {
+		err = c.write("cpuset.cpus", resources.CpusetCpus)
+	}
+	if err == nil && resources.CpusetMems != "" {
+		err = c.write("cpuset.mems", resources.CpusetMems)
+	}
+	if err == nil && resources.PidsLimit > 0 {
+		err = c.write("pids.max", strconv.FormatInt(resources.PidsLimit, 10))
+	}
+	// every line of io.max sets one limit of a device and leaves the others be
+	throttles := map[string][]ThrottleDevice{
+		"rbps":  resources.BlkioDeviceReadBps,
+		"wbps":  resources.BlkioDeviceWriteBps,
+		"riops": resources.BlkioDeviceReadIOps,
+		"wiops": resources.BlkioDeviceWriteIOps,
+	}
+	for _, key := range []string{"rbps", "wbps", "riops", "wiops"} {
+		for _, device := range throttles[key] {
+			if err == nil {
+				err = c.write("io.max", fmt.Sprintf("%d:%d %s=%d", device.Major, device.Minor, key, device.Rate))
+			}
+		}
+	}
+	return err
+}
+
+// The below function writes the swap the container may use, memory.swap.max of
+// cgroup v2 is the swap alone. Kernels without swap accounting don't have it,
+// the container swaps as it likes there
+func (c *cgroup) writeSwap(resources Resources) error {
+	swap := strconv.FormatInt(resources.Memory, 10)
+	if resources.MemorySwap == -1 {
+		swap = "max"
+	} else if resources.MemorySwap > 0 {
+		swap = strconv.FormatInt(resources.MemorySwap-resources.Memory, 10)
+	}
+	if _, err := os.Stat(filepath.Join(c.dirs["memory"], "memory.swap.max")); os.IsNotExist(err) {
+		if resources.MemorySwap != 0 {
+			fmt.Fprintf(os.Stderr, "[Warning] Your kernel does not support swap limit capabilities, memory limited without swap\n")
+		}
+		return nil
+	}
+	return c.write("memory.swap.max", swap)
+}
+
+// The below function checks the memory limits of run the way docker does: the
+// swap needs the memory limit and is at least as much, the swappiness is a
+// percentage
+func (r Resources) validateMemory() error {
+	if r.MemorySwap != 0 && r.Memory == 0 {
+		return fmt.Errorf("You should always set the Memory limit when using Memoryswap limit, see usage")
+	}
+	if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+		return fmt.Errorf("Minimum memoryswap limit should be larger than memory limit, see usage")
+	}
+	if r.MemorySwappiness != nil && (*r.MemorySwappiness < 0 || *r.MemorySwappiness > 100) {
+		return fmt.Errorf("Invalid value: %d, valid memory swappiness range is 0-100", *r.MemorySwappiness)
+	}
+	return nil
+}
+
+// The below function checks the cpu limits of run the way docker does: --cpus
+// goes without --cpu-period and --cpu-quota, and neither is under 1ms
+func (r Resources) validateCPU() error {
+	if r.NanoCPUs != 0 && r.CPUPeriod != 0 {
+		return fmt.Errorf("Conflicting options: Nano CPUs and CPU Period cannot both be set")
+	}
+	if r.NanoCPUs != 0 && r.CPUQuota != 0 {
+		return fmt.Errorf("Conflicting options: Nano CPUs and CPU Quota cannot both be set")
+	}
+	if cpus := int64(runtime.NumCPU()); r.NanoCPUs < 0 || r.NanoCPUs > 0 && r.NanoCPUs < 1e7 || r.NanoCPUs > cpus*1e9 {
+		return fmt.Errorf("Range of CPUs is from 0.01 to %d.00, as there are only %d CPUs available", cpus, cpus)
+	}
+	if r.CPUPeriod != 0 && (r.CPUPeriod < 1000 || r.CPUPeriod > 1000000) {
+		return fmt.Errorf("CPU cfs period can not be less than 1ms (i.e. 1000) or larger than 1 second (i.e. 1000000)")
+	}
+	if r.CPUQuota != 0 && r.CPUQuota < 1000 {
+		return fmt.Errorf("CPU cfs quota can not be less than 1ms (i.e. 1000)")
+	}
+	return nil
+}
+
+// This function reports whether the cpu time of the container is limited
+func (r Resources) limitsCPU() bool {
+	return r.NanoCPUs > 0 || r.CPUQuota > 0 || r.CPUPeriod > 0
+}
+
+// The below function returns the cpu time in microseconds the container may
+// use every period, -1 for no limit, and the period. --cpus is a quota of the
+// default period
+func (r Resources) cpuQuota() (int64, int64) {
+	period := r.CPUPeriod
+	if period == 0 {
+		period = defaultCPUPeriod
+	}
+	quota := int64(-1)
+	if r.NanoCPUs > 0 {
+		quota = r.NanoCPUs * period / 1e9
+	} else if r.CPUQuota > 0 {
+		quota = r.CPUQuota
+	}
+	return quota, period
+}
+
+// This function returns the cpu.max of the limits, the quota and the period
+func (r Resources) cpuMax() string {
+	quota, period := r.cpuQuota()
+	if quota == -1 {
+		return "max " + strconv.FormatInt(period, 10)
+	}
+	return strconv.FormatInt(quota, 10) + " " + strconv.FormatInt(period, 10)
+}
+
+// The below function converts cpu shares of cgroup v1 to the cpu.weight of
+// cgroup v2, the range 2 to 262144 is mapped on 1 to 10000 like runc does.
+// The default 1024 becomes 39, not quite the default weight 100
+func cpuWeight(shares int64) int64 {
+	if shares < minCPUShares {
+		shares = minCPUShares
+	}
+	if shares > maxCPUShares {
+		shares = maxCPUShares
+	}
+	return 1 + (shares-2)*9999/262142
+}
+
+// The below function checks that the cpus or memory nodes of a list like 0-3,5
+// of --cpuset-cpus or --cpuset-mems are online, the ones of the online file of
+// /sys/devices/system/cpu or node
+func validateCpuset(flag, list, online string) error {
+	requested, err := parseCpuset(list)
+	if err != nil {
+		return fmt.Errorf("Invalid --%s %q: expected a list like 0-3,5", flag, list)
+	}
+	data, err := os.ReadFile(online)
+	if err != nil {
+		// a kernel without NUMA has node 0 alone
+		data = []byte("0")
+	}
+	available, err := parseCpuset(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", online, err)
+	}
+	what := "CPUs"
+	if flag == "cpuset-mems" {
+		what = "memory nodes"
+	}
+	for n := range requested {
+		if !available[n] {
+			return fmt.Errorf("Requested %s are not available - requested %s, available: %s", what, list, strings.TrimSpace(string(data)))
+		}
+	}
+	return nil
+}
+
+// The below function parses a list of cpus or memory nodes like 0-3,5, the
+// format of cpuset.cpus
+func parseCpuset(list string) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		low, err := strconv.Atoi(first)
+		if err != nil || low < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q", list)
+		}
+		high := low
+		if isRange {
+			high, err = strconv.Atoi(last)
+			if err != nil || high < low {
+				return nil, fmt.Errorf("invalid cpuset %q", list)
+			}
+		}
+		for n := low; n <= high; n++ {
+			set[n] = true
+		}
+	}
+	return set, nil
+}
+
+// The below function parses a value of --device-read-bps and the like,
+// <device>:<rate>. The rate is a size like 1mb for the bytes a second and a
+// number for the operations
+func parseThrottleDevice(flag, value string) (ThrottleDevice, error) {
+	path, rate, ok := strings.Cut(value, ":")
+	if !ok || !strings.HasPrefix(path, "/dev/") {
+		return ThrottleDevice{}, fmt.Errorf("Invalid --%s %q: expected <device>:<rate>, e.g. /dev/sda:1mb", flag, value)
+	}
+	device := ThrottleDevice{Path: path}
+	var err error
+	if strings.HasSuffix(flag, "-bps") {
+		var size int64
+		size, err = parseSize(rate)
+		device.Rate = uint64(size)
+	} else {
+		device.Rate, err = strconv.ParseUint(rate, 10, 64)
+	}
+	if err != nil || device.Rate == 0 {
+		return ThrottleDevice{}, fmt.Errorf("Invalid --%s %q: invalid rate %s", flag, value, rate)
+	}
+	var stat syscall.Stat_t
+	err = syscall.Stat(path, &stat)
+	if err != nil {
+		return ThrottleDevice{}, fmt.Errorf("Invalid --%s %q: %v", flag, value, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return ThrottleDevice{}, fmt.Errorf("Invalid --%s %q: %s is not a block device", flag, value, path)
+	}
+	device.Major, device.Minor = splitDev(uint64(stat.Rdev))
+	return device, nil
+}
+
+// This function returns the controllers the limits are enforced by
+func (r Resources) controllers() []string {
+	var controllers []string
+	if r.Memory > 0 || r.MemorySwappiness != nil {
+		controllers = append(controllers, "memory")
+	}
+	if r.limitsCPU() || r.CPUShares > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if r.CpusetCpus != "" || r.CpusetMems != "" {
+		controllers = append(controllers, "cpuset")
+	}
+	if r.PidsLimit > 0 {
+		controllers = append(controllers, "pids")
+	}
+	if len(r.BlkioDeviceReadBps)+len(r.BlkioDeviceWriteBps)+len(r.BlkioDeviceReadIOps)+len(r.BlkioDeviceWriteIOps) > 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+// The below function enables the controllers for the children of the cgroup
+// at dir, the ones already enabled are left alone
+func enableControllers(dir string, controllers []string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("Error reading the controllers of cgroup %s: %v", dir, err)
+	}
+	enabled := map[string]bool{}
+	for _, controller := range strings.Fields(string(data)) {
+		enabled[controller] = true
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("Error reading the controllers of cgroup %s: %v", dir, err)
+	}
+	available := strings.Fields(string(data))
+	for _, controller := range controllers {
+		if enabled[controller] {
+			continue
+		}
+		if !containsString(available, controller) {
+			return fmt.Errorf("Error limiting resources: the %s controller is not available in cgroup %s", controller, dir)
+		}
+		err = os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+		if err != nil {
+			return fmt.Errorf("Error enabling the %s controller of cgroup %s: %v", controller, dir, err)
+		}
+	}
+	return nil
+}
+
+// The below function writes the value to a file of the cgroup, the one of the
+// directory of the controller the name of the file starts with
+func (c *cgroup) write(name, value string) error {
+	controller, _, _ := strings.Cut(name, ".")
+	path := filepath.Join(c.dirs[controller], name)
+	err := os.WriteFile(path, []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// This function moves the process with the pid into the cgroup, in every
+// hierarchy it is in
+func (c *cgroup) add(pid int) error {
+	if c.unit != "" {
+		return c.startScope(pid)
+	}
+	for _, dir := range c.uniqueDirs() {
+		path := filepath.Join(dir, "cgroup.procs")
+		err := os.WriteFile(path, []byte(strconv.Itoa(pid)), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// This function returns the directories of the cgroup, each one once
+func (c *cgroup) uniqueDirs() []string {
+	var dirs []string
+	for _, dir := range c.dirs {
+		if !containsString(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// The below function removes the cgroup. The processes of the container are
+// killed with its init but they may take a moment to leave, the cgroup is busy
+// until they have
+func (c *cgroup) remove() error {
+	if c.unit != "" {
+		return c.stopScope()
+	}
+	for _, dir := range c.uniqueDirs() {
+		var err error
+		for i := 0; i < 100; i++ {
+			err = os.Remove(dir)
+			if err == nil || os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing cgroup %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// This function reports whether the list has the string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The below function mounts the cgroups the container sees at dir, read-only:
+// the unified hierarchy on cgroup v2, a tmpfs with the hierarchies of
+// /proc/self/cgroup on v1. In a cgroup namespace of its own the root of them
+// is the cgroup of the container. A container in a user namespace can't mount
+// the cgroups of the namespace of the host, it gets the ones of the host
+func mountCgroups(dir string) error {
+	flags := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if cgroupV2() {
+		err := syscall.Mount("cgroup2", dir, "cgroup2", flags, "")
+		if err == syscall.EPERM {
+			err = bindReadOnly(cgroupRoot, dir)
+		}
+		return err
+	}
+
+	err := syscall.Mount("cgroup", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=755")
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return err
+	}
+	// hierarchy-id:controllers:path, 0 is the unified hierarchy
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 || fields[1] == "" {
+			continue
+		}
+		name := strings.TrimPrefix(fields[1], "name=")
+		target := filepath.Join(dir, name)
+		err = os.Mkdir(target, 0755)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount("cgroup", target, "cgroup", flags, fields[1])
+		if err == syscall.EPERM {
+			err = bindReadOnly(filepath.Join(cgroupRoot, name), target)
+		}
+		if err != nil {
+			return err
+		}
+		// controllers mounted together have a link of each, cpu -> cpu,cpuacct
+		if strings.Contains(name, ",") {
+			for _, controller := range strings.Split(name, ",") {
+				err = os.Symlink(name, filepath.Join(dir, controller))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return syscall.Mount("", dir, "", syscall.MS_REMOUNT|flags, "mode=755")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestCPUMax(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources Resources
+		want      string
+	}{
+		{"no limit", Resources{}, "max 100000"},
+		{"half a cpu", Resources{NanoCPUs: 5e8}, "50000 100000"},
+		{"one cpu and a half", Resources{NanoCPUs: 1.5e9}, "150000 100000"},
+		{"smallest cpus", Resources{NanoCPUs: 1e7}, "1000 100000"},
+		{"quota", Resources{CPUQuota: 20000}, "20000 100000"},
+		{"quota and period", Resources{CPUQuota: 20000, CPUPeriod: 50000}, "20000 50000"},
+		{"period alone", Resources{CPUPeriod: 50000}, "max 50000"},
+	}
+	for _, test := range tests {
+		if got := test.resources.cpuMax(); got != test.want {
+			t.Errorf("%s: cpuMax() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateCPU(t *testing.T) {
+	cpus := float64(runtime.NumCPU())
+	tests := []struct {
+		name      string
+		cpus      float64
+		resources Resources
+		valid     bool
+	}{
+		{"no limit", 0, Resources{}, true},
+		{"smallest cpus", 0.01, Resources{}, true},
+		{"under the smallest cpus", 0.009, Resources{}, false},
+		{"every cpu", cpus, Resources{}, true},
+		{"more cpus than there are", cpus + 0.01, Resources{}, false},
+		{"negative cpus", -1, Resources{}, false},
+		{"cpus and period", 1, Resources{CPUPeriod: 50000}, false},
+		{"cpus and quota", 1, Resources{CPUQuota: 50000}, false},
+		{"smallest period", 0, Resources{CPUPeriod: 1000}, true},
+		{"period under 1ms", 0, Resources{CPUPeriod: 999}, false},
+		{"largest period", 0, Resources{CPUPeriod: 1000000}, true},
+		{"period over 1s", 0, Resources{CPUPeriod: 1000001}, false},
+		{"smallest quota", 0, Resources{CPUQuota: 1000}, true},
+		{"quota under 1ms", 0, Resources{CPUQuota: 999}, false},
+	}
+	for _, test := range tests {
+		// the same conversion as run's --cpus
+		test.resources.NanoCPUs = int64(test.cpus * 1e9)
+		err := test.resources.validateCPU()
+		if test.valid && err != nil {
+			t.Errorf("%s: validateCPU(): %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: validateCPU() succeeded, want an error", test.name)
+		}
+	}
+}
+
+func TestCPUWeight(t *testing.T) {
+	tests := []struct {
+		shares int64
+		want   int64
+	}{
+		{2, 1},
+		{1024, 39},
+		{262144, 10000},
+		// out of range shares are clamped like the kernel does
+		{1, 1},
+		{1 << 20, 10000},
+	}
+	for _, test := range tests {
+		if got := cpuWeight(test.shares); got != test.want {
+			t.Errorf("cpuWeight(%d) = %d, want %d", test.shares, got, test.want)
+		}
+	}
+}
+
+func TestParseCpuset(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+	}{
+		{"0", []int{0}},
+		{"0-3", []int{0, 1, 2, 3}},
+		{"3-3", []int{3}},
+		{"1,3", []int{1, 3}},
+		{"0-2,5,7-8", []int{0, 1, 2, 5, 7, 8}},
+		{"2,0-2", []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		got, err := parseCpuset(test.list)
+		if err != nil {
+			t.Errorf("parseCpuset(%q): %v", test.list, err)
+			continue
+		}
+		want := map[int]bool{}
+		for _, n := range test.want {
+			want[n] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCpuset(%q) = %v, want %v", test.list, got, want)
+		}
+	}
+
+	for _, list := range []string{"3-1", "a", "", "1-", "-1", "0-a", "1,,2", "0-3,"} {
+		if got, err := parseCpuset(list); err == nil {
+			t.Errorf("parseCpuset(%q) = %v, want an error", list, got)
+		}
+	}
+}
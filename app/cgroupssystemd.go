@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With --cgroup-driver systemd the cgroup of a container is a transient scope
+// systemd creates, mydocker-<id>.scope in system.slice, the way docker does it
+// with native.cgroupdriver=systemd. systemd knows about it and doesn't move
+// its processes away. The scope is delegated to us, the limits are written to
+// its cgroup like with the cgroupfs driver once the container init is in it
+
+// cgroupDriver is set by --cgroup-driver, cgroupfs or systemd
+var cgroupDriver = "cgroupfs"
+
+// scopeTimeout is how long systemd gets to start the scope of a container
+const scopeTimeout = 5 * time.Second
+
+// The below function connects to systemd for the scope of the container with
+// the id, which is started with the container init in it by add
+func createScope(id string, resources Resources) (*cgroup, error) {
+	bus, err := dialDBus(systemdBusAddress())
+	if err != nil {
+		return nil, fmt.Errorf("Error using the systemd cgroup driver: %v", err)
+	}
+	return &cgroup{unit: "mydocker-" + id + ".scope", bus: bus, resources: resources}, nil
+}
+
+// The below function returns the bus systemd is on for us, the system one for
+// root and the one of the session of everyone else, whose systemd manages the
+// cgroups it was delegated
+func systemdBusAddress() string {
+	if rootless {
+		if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+			return address
+		}
+		return filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "bus")
+	}
+	if address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); address != "" {
+		return address
+	}
+	return "/run/dbus/system_bus_socket"
+}
+
+// The below function starts the scope with the process with the pid in it,
+// waits for systemd to have moved it there and writes the limits to the cgroup
+// of the scope
+func (c *cgroup) startScope(pid int) error {
+	body := &dbusEncoder{}
+	body.string(c.unit)
+	body.string("fail")
+	body.array(8, func() {
+		property(body, "Description", "s", func() { body.string("mydocker container " + c.unit) })
+		if !rootless {
+			property(body, "Slice", "s", func() { body.string("system.slice") })
+		}
+		property(body, "Delegate", "b", func() { body.boolean(true) })
+		property(body, "PIDs", "au", func() {
+			body.array(4, func() { body.uint32(uint32(pid)) })
+		})
+	})
+	// no auxiliary units
+	body.array(8, func() {})
+	err := c.bus.call("org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", "StartTransientUnit", "ssa(sv)a(sa(sv))", body.buf)
+	if err != nil {
+		return fmt.Errorf("Error starting the systemd scope %s: %v", c.unit, err)
+	}
+
+	// the scope is started by a job of systemd, the process is in it then
+	deadline := time.Now().Add(scopeTimeout)
+	for {
+		c.dirs, err = scopeDirs(pid, c.unit, c.resources.controllers())
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("Error starting the systemd scope %s: %v", c.unit, err)
+	}
+	if cgroupV2() {
+		return c.writeLimits(c.resources)
+	}
+	if dir, ok := c.dirs["cpuset"]; ok {
+		err = inheritCpuset(dir)
+		if err != nil {
+			return fmt.Errorf("Error setting up cgroup %s: %v", dir, err)
+		}
+	}
+	return c.writeLimitsV1(c.resources)
+}
+
+// This function marshals a property of a unit, a struct of its name and a
+// variant whose value value writes
+func property(e *dbusEncoder, name, signature string, value func()) {
+	e.align(8)
+	e.string(name)
+	e.signature(signature)
+	value()
+}
+
+// The below function returns the directories of the cgroup of the process with
+// the pid in the hierarchies of the controllers, from /proc/<pid>/cgroup. It
+// fails until the process is in the scope
+func scopeDirs(pid int, unit string, controllers []string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	// hierarchy-id:controllers:path, the unified hierarchy is 0 and has none
+	paths := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	dirs := map[string]string{}
+	for _, controller := range controllers {
+		path, dir := paths[""], filepath.Join(cgroupRoot, paths[""])
+		if !cgroupV2() {
+			controller = v1Controller(controller)
+			path = paths[controller]
+			dir = filepath.Join(cgroupRoot, controller, path)
+		}
+		if filepath.Base(path) != unit {
+			return nil, fmt.Errorf("process %d is not in the scope", pid)
+		}
+		dirs[controller] = dir
+	}
+	return dirs, nil
+}
+
+// The below function stops the scope. systemd removes it by itself once the
+// processes of the container are gone, which they mostly are by then
+func (c *cgroup) stopScope() error {
+	defer c.bus.Close()
+	body := &dbusEncoder{}
+	body.string(c.unit)
+	body.string("replace")
+	err := c.bus.call("org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", "StopUnit", "ss", body.buf)
+	var remote *dbusRemoteError
+	if errors.As(err, &remote) && remote.Name == "org.freedesktop.systemd1.NoSuchUnit" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error stopping the systemd scope %s: %v", c.unit, err)
+	}
+	return nil
+}
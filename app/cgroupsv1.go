@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Hosts on cgroup v1 have a hierarchy of every controller mounted under
+// /sys/fs/cgroup, or a few controllers together with a link of every one of
+// them (cpu -> cpu,cpuacct). The cgroup of a container is a directory in the
+// hierarchy of each controller its limits need, with the files of v1
+
+// cgroupSuperMagic is the file system type of cgroup v1 in statfs
+const cgroupSuperMagic = 0x27e0eb
+
+// The below function creates the cgroup of the container with the id in the
+// hierarchies of cgroup v1 and writes the limits of resources to it
+func createCgroupV1(id string, resources Resources) (*cgroup, error) {
+	c := &cgroup{dirs: map[string]string{}}
+	for _, controller := range resources.controllers() {
+		controller = v1Controller(controller)
+		root := filepath.Join(cgroupRoot, controller)
+		var fs syscall.Statfs_t
+		err := syscall.Statfs(root, &fs)
+		if err != nil || fs.Type != cgroupSuperMagic {
+			c.remove()
+			return nil, fmt.Errorf("Error limiting resources: neither cgroup v2 nor the %s controller of cgroup v1 is mounted on %s", controller, cgroupRoot)
+		}
+		dir := filepath.Join(root, cgroupParent, id)
+		err = os.MkdirAll(dir, 0755)
+		if err == nil && controller == "cpuset" {
+			// a cpuset cgroup without cpus or memory nodes takes no process,
+			// the new ones get the ones of their parents
+			err = inheritCpuset(filepath.Dir(dir))
+			if err == nil {
+				err = inheritCpuset(dir)
+			}
+		}
+		if err != nil {
+			c.remove()
+			return nil, fmt.Errorf("Error creating cgroup %s: %v", dir, err)
+		}
+		c.dirs[controller] = dir
+	}
+	err := c.writeLimitsV1(resources)
+	if err != nil {
+		c.remove()
+		return nil, err
+	}
+	return c, nil
+}
+
+// This function returns the name on cgroup v1 of a controller of cgroup v2,
+// the io one is blkio there
+func v1Controller(controller string) string {
+	if controller == "io" {
+		return "blkio"
+	}
+	return controller
+}
+
+// This function gives the cpuset cgroup at dir the cpus and memory nodes of
+// its parent when it has none
+func inheritCpuset(dir string) error {
+	for _, name := range []string{"cpuset.cpus", "cpuset.mems"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(data)) != "" {
+			continue
+		}
+		data, err = os.ReadFile(filepath.Join(filepath.Dir(dir), name))
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, name), data, 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The below function writes the limits of resources to the files of the
+// controllers of cgroup v1. The swap is limited together with the memory
+// there, and the cpu weight is in shares
+func (c *cgroup) writeLimitsV1(resources Resources) error {
+	var err error
+	if resources.Memory > 0 {
+		err = c.write("memory.limit_in_bytes", strconv.FormatInt(resources.Memory, 10))
+	}
+	if err == nil && resources.Memory > 0 {
+		err = c.writeSwapV1(resources)
+	}
+	if err == nil && resources.MemorySwappiness != nil {
+		err = c.write("memory.swappiness", strconv.FormatInt(*resources.MemorySwappiness, 10))
+	}
+	if err == nil && resources.limitsCPU() {
+		quota, period := resources.cpuQuota()
+		err = c.write("cpu.cfs_period_us", strconv.FormatInt(period, 10))
+		if err == nil {
+			err = c.write("cpu.cfs_quota_us", strconv.FormatInt(quota, 10))
+		}
+	}
+	if err == nil && resources.CPUShares > 0 {
+		err = c.write("cpu.shares", strconv.FormatInt(resources.CPUShares, 10))
+	}
+	if err == nil && resources.CpusetCpus != "" {
+		err = c.write("cpuset.cpus", resources.CpusetCpus)
+	}
+	if err == nil && resources.CpusetMems != "" {
+		err = c.write("cpuset.mems", resources.CpusetMems)
+	}
+	if err == nil && resources.PidsLimit > 0 {
+		err = c.write("pids.max", strconv.FormatInt(resources.PidsLimit, 10))
+	}
+	throttles := map[string][]ThrottleDevice{
+		"blkio.throttle.read_bps_device":   resources.BlkioDeviceReadBps,
+		"blkio.throttle.write_bps_device":  resources.BlkioDeviceWriteBps,
+		"blkio.throttle.read_iops_device":  resources.BlkioDeviceReadIOps,
+		"blkio.throttle.write_iops_device": resources.BlkioDeviceWriteIOps,
+	}
+	for name, devices := range throttles {
+		for _, device := range devices {
+			if err == nil {
+				err = c.write(name, fmt.Sprintf("%d:%d %d", device.Major, device.Minor, device.Rate))
+			}
+		}
+	}
+	return err
+}
+
+// The below function writes memory.memsw.limit_in_bytes, the memory and the
+// swap together on cgroup v1. Kernels without swap accounting don't have it
+func (c *cgroup) writeSwapV1(resources Resources) error {
+	swap := strconv.FormatInt(2*resources.Memory, 10)
+	if resources.MemorySwap != 0 {
+		swap = strconv.FormatInt(resources.MemorySwap, 10)
+	}
+	if _, err := os.Stat(filepath.Join(c.dirs["memory"], "memory.memsw.limit_in_bytes")); os.IsNotExist(err) {
+		if resources.MemorySwap != 0 {
+			fmt.Fprintf(os.Stderr, "[Warning] Your kernel does not support swap limit capabilities, memory limited without swap\n")
+		}
+		return nil
+	}
+	return c.write("memory.memsw.limit_in_bytes", swap)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Usage: your_docker.sh commit [-m message] [-a author] [--squash] <container> <image>
+// the changes of the container become a new layer on top of its image, the new
+// image is tagged with the given name and its id is printed. With --squash the
+// image gets a single layer with the whole file system of the container instead
+func commitCommand(args []string) error {
+	flags := flag.NewFlagSet("commit", flag.ContinueOnError)
+	message := flags.String("m", "", "commit message")
+	author := flags.String("a", "", "author, e.g. \"John Hannibal Smith <hannibal@a-team.com>\"")
+	squash := flags.Bool("squash", false, "flatten the image into a single layer")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: commit [-m message] [-a author] [--squash] <container> <image>")
+	}
+	target, err := parseReference(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if target.digest != "" {
+		return fmt.Errorf("Refusing to create a tag with a digest reference: %s", flags.Arg(1))
+	}
+
+	container, err := findContainer(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	upper := filepath.Join(containerDir(container.Id), "upper")
+	if _, err := os.Stat(upper); err != nil && !*squash {
+		return fmt.Errorf("Container %s has no writable layer to commit, it was run with the %s storage driver", container.Id, container.Driver)
+	}
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	config, err := store.readConfig(container.ImageId)
+	if err != nil {
+		return fmt.Errorf("Error reading image config: %v", err)
+	}
+
+	var layers []Descriptor
+	if *squash {
+		rootfs, cleanup, err := container.mountRootfs(store)
+		if err != nil {
+			return err
+		}
+		layer, err := store.squash(rootfs, config)
+		cleanup()
+		if err != nil {
+			return err
+		}
+		layers = []Descriptor{layer}
+	} else {
+		layer, diffID, err := store.createLayer(func(w io.Writer) error {
+			tw := tar.NewWriter(w)
+			err := writeLayerTar(tw, upper)
+			if err != nil {
+				return err
+			}
+			return tw.Close()
+		})
+		if err != nil {
+			return fmt.Errorf("Error creating layer: %v", err)
+		}
+		layers = append(append([]Descriptor{}, container.ImageLayers...), layer)
+		config.RootFS.Type = "layers"
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+
+	now := time.Now().UTC()
+	config.Created = now
+	if *author != "" {
+		config.Author = *author
+	}
+	config.History = append(config.History, HistoryEntry{
+		Created:   now,
+		CreatedBy: strings.Join(append([]string{container.Path}, container.Args...), " "),
+		Author:    *author,
+		Comment:   *message,
+	})
+	digest, id, err := store.writeImage(layers, config)
+	if err != nil {
+		return err
+	}
+
+	err = store.setTag(target.String(), digest)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+// The below function writes the content of dir to the tar stream as a layer.
+// The overlayfs whiteouts of a writable layer become OCI whiteout markers, hard
+// links are kept and so are the owners, modes, times and extended attributes
+func writeLayerTar(tw *tar.Writer, dir string) error {
+	// the first path of every inode with several links, the others link to it
+	links := map[uint64]string{}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		if isOverlayWhiteout(info) {
+			marker := filepath.ToSlash(filepath.Join(filepath.Dir(rel), whiteoutPrefix+info.Name()))
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: marker, Mode: 0600, ModTime: info.ModTime(), Format: tar.FormatPAX})
+		}
+
+		err = writeTarEntry(tw, path, name, info, links)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && isOverlayOpaque(path) {
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name + "/" + whiteoutOpaque, Mode: 0600, ModTime: info.ModTime(), Format: tar.FormatPAX})
+		}
+		return nil
+	})
+}
+
+// The below function writes a single file to the tar stream as name, with its
+// content when it's a regular file. links records the first name of files with
+// several hard links, the next ones are written as links to it
+func writeTarEntry(tw *tar.Writer, path, name string, info os.FileInfo, links map[uint64]string) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Format = tar.FormatPAX
+	// owners are kept by id, the names would be the ones of our /etc/passwd
+	header.Uname = ""
+	header.Gname = ""
+	// only the modification time is part of a layer
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+		if first, ok := links[stat.Ino]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = first
+			header.Size = 0
+		} else {
+			links[stat.Ino] = name
+		}
+	}
+	// symlinks have no extended attributes of their own we could read
+	if link == "" {
+		err = addXattrs(header, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeReg && header.Size > 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, file, header.Size)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The below function records the extended attributes of path in the PAX
+// records of the header, except the ones overlayfs keeps for itself
+func addXattrs(header *tar.Header, path string) error {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size <= 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(path, list)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		value := make([]byte, 64*1024)
+		n, err := syscall.Getxattr(path, name, value)
+		if err != nil {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[paxXattrPrefix+name] = string(value[:n])
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Containers are kept under the data root next to the image store, they stay
+// there after they exited:
+//
+//	<data root>/containers/<id>/config.json      what was run and how it ended
+//	<data root>/containers/<id>/<id>-json.log    the output of the container
+//	<data root>/containers/<id>/...              its root file system while it runs
+//	<data root>/volumes/<name>                   volumes (see volumes.go)
+//	<data root>/networks/<name>.json             networks (see network.go)
+
+// Container is the config.json of a container
+type Container struct {
+	Id   string
+	Name string `json:",omitempty"` // --name, the name of the container on its network
+	// the hostname in the uts namespace of the container
+	Hostname string `json:",omitempty"`
+	Created  time.Time
+	Image    string // the image as it was given to run
+	ImageId  string // the digest of the image config
+	// the layers of the image, the container writes on top of them
+	ImageLayers []Descriptor
+	Driver      string // the storage driver of the root file system
+	Path        string
+	Args        []string
+	State       ContainerState
+	NetworkMode string // bridge, host, none or container:<id>
+	IpcMode     string `json:",omitempty"` // private, shareable, host or container:<id>
+	// the network the container is connected to, nil unless it's bridge
+	NetworkSettings *NetworkSettings `json:",omitempty"`
+	// the limits of --memory and the like
+	Resources Resources
+	// the SELinux labels of the container process and of its files
+	ProcessLabel string `json:",omitempty"`
+	MountLabel   string `json:",omitempty"`
+	// the volumes mounted in the container
+	Volumes []VolumeMount `json:",omitempty"`
+}
+
+// ContainerState tells whether a container is running and how it ended
+type ContainerState struct {
+	Running    bool
+	Pid        int // the container process on the host, while it runs
+	ExitCode   int
+	Error      string `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// The below function returns the directory of a container
+func containerDir(id string) string {
+	return filepath.Join(dataRoot, "containers", id)
+}
+
+// This function returns a new random id, 64 hex digits like docker's
+func randomID() (string, error) {
+	id := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// This function creates a container for the image with a new random id
+func createContainer(image string, manifest *ManifestResponse) (*Container, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	container := &Container{Id: id, Created: time.Now().UTC(), Image: image, ImageId: manifest.Config.Digest, ImageLayers: manifest.Layers}
+	err = os.MkdirAll(containerDir(container.Id), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return container, container.save()
+}
+
+// The below function finds a container by its id, its name or a prefix of its
+// id, like docker does. Exited containers keep their names, so several may
+// have the name: the running one wins, then the one created last
+func findContainer(id string) (*Container, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "*?[\\/") {
+		return nil, fmt.Errorf("No such container: %s", id)
+	}
+	if _, err := os.Stat(filepath.Join(containerDir(id), "config.json")); err == nil {
+		return readContainer(containerDir(id))
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(dataRoot, "containers", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var named *Container
+	for _, dir := range dirs {
+		container, err := readContainer(dir)
+		if err != nil || container.Name != id {
+			continue
+		}
+		running := container.State.Running && processExists(container.State.Pid)
+		if running {
+			return container, nil
+		}
+		if named == nil || container.Created.After(named.Created) {
+			named = container
+		}
+	}
+	if named != nil {
+		return named, nil
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dataRoot, "containers", id+"*"))
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("No such container: %s", id)
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("Ambiguous container id %s, it matches %d containers", id, len(matches))
+	}
+	return readContainer(matches[0])
+}
+
+// This function reads the config.json of the container in dir
+func readContainer(dir string) (*Container, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var container Container
+	err = json.Unmarshal(data, &container)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid container %s: %v", filepath.Base(dir), err)
+	}
+	return &container, nil
+}
+
+// The below function checks that a container may be named name: the name is
+// one docker takes and no running container has it. The ones that exited
+// keep their names but don't hold them, until rm removes them
+func checkContainerName(name string) error {
+	if !validName(name) {
+		return fmt.Errorf("Invalid container name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	dirs, err := filepath.Glob(filepath.Join(dataRoot, "containers", "*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		container, err := findContainer(filepath.Base(dir))
+		if err != nil || container.Name != name || !container.State.Running {
+			continue
+		}
+		if container.State.Pid == 0 || processExists(container.State.Pid) {
+			return fmt.Errorf("Conflict. The container name %q is already in use by container %s", name, container.Id[:12])
+		}
+	}
+	return nil
+}
+
+// The below function writes the config.json of the container
+func (c *Container) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(containerDir(c.Id), "config.json")
+	err = os.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// The below function removes the root file system of a container that exited,
+// its config, log and writable layer are kept. The writable layer is the upper
+// directory of the overlay drivers, it holds what the container changed and
+// can be turned into an image by commit. The vfs driver keeps the whole copy
+func (c *Container) removeRootfs() error {
+	entries, err := os.ReadDir(containerDir(c.Id))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "config.json", c.Id + "-json.log", "upper", "rootfs":
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(containerDir(c.Id), entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The below function mounts the root file system of a container that isn't
+// running with the storage driver it was created with, changes included. The
+// mount is made in a mount namespace of the calling thread so that it never
+// shows up on the host, the returned function unmounts it
+func (c *Container) mountRootfs(store *imageStore) (string, func(), error) {
+	driver, manifest, config, err := c.image(store)
+	if err != nil {
+		return "", nil, err
+	}
+	err = privateMountNamespace()
+	if err != nil {
+		return "", nil, err
+	}
+	rootfs, err := driver.mount(store, manifest, config, containerDir(c.Id), c.MountLabel)
+	if err != nil {
+		return "", nil, err
+	}
+	return rootfs, func() {
+		driver.unmount(rootfs)
+		os.RemoveAll(filepath.Join(containerDir(c.Id), "work"))
+		os.RemoveAll(filepath.Join(containerDir(c.Id), "merged"))
+	}, nil
+}
+
+// The below function returns the storage driver of the container and the
+// manifest and config of the image it was created from
+func (c *Container) image(store *imageStore) (StorageDriver, *ManifestResponse, *ImageConfig, error) {
+	driver, err := storageDriverByName(c.Driver)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	config, err := store.readConfig(c.ImageId)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error reading image config: %v", err)
+	}
+	manifest := &ManifestResponse{Layers: c.ImageLayers}
+	manifest.Config.Digest = c.ImageId
+	return driver, manifest, config, nil
+}
+
+// The below function moves the calling thread into a mount namespace of its
+// own, for commands mounting what they need to look at without the host
+// seeing it. The mounts go away with the process
+func privateMountNamespace() error {
+	runtime.LockOSThread()
+	err := syscall.Unshare(syscall.CLONE_NEWNS)
+	if err == nil {
+		err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating mount namespace: %v", err)
+	}
+	return nil
+}
+
+// containerLog writes the output of a container the way docker's json-file
+// log driver does: a JSON object per line with the stream it was written to
+type containerLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// logEntry is a line of a container log
+type logEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// This function opens the log of the container for appending
+func (c *Container) openLog() (*containerLog, error) {
+	file, err := os.OpenFile(filepath.Join(containerDir(c.Id), c.Id+"-json.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &containerLog{file: file}, nil
+}
+
+// This function returns a writer logging everything written to it as stream
+func (l *containerLog) writer(stream string) io.Writer {
+	return logStream{l, stream}
+}
+
+func (l *containerLog) Close() error {
+	return l.file.Close()
+}
+
+type logStream struct {
+	log    *containerLog
+	stream string
+}
+
+func (s logStream) Write(p []byte) (int, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	now := time.Now().UTC()
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		data, err := json.Marshal(logEntry{Log: string(line), Stream: s.stream, Time: now})
+		if err != nil {
+			return 0, err
+		}
+		_, err = s.log.file.Write(append(data, '\n'))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Usage: your_docker.sh cp [-a] <container>:<path> <host path>
+//
+//	your_docker.sh cp [-a] <host path> <container>:<path>
+//
+// copies files out of or into a container that isn't running, like cp -r. A
+// source ending in "/." copies the content of the directory. Copied files
+// belong to root in the container and to us on the host unless -a keeps the
+// owners they had. Paths in the container are resolved inside its root, its
+// symlinks never lead to the host
+func cpCommand(args []string) error {
+	flags := flag.NewFlagSet("cp", flag.ContinueOnError)
+	archive := flags.Bool("a", false, "keep the owners of the files")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: cp [-a] <container>:<path> <host path> | <host path> <container>:<path>")
+	}
+	srcContainer, srcPath := splitContainerPath(flags.Arg(0))
+	dstContainer, dstPath := splitContainerPath(flags.Arg(1))
+	if (srcContainer == "") == (dstContainer == "") {
+		return fmt.Errorf("Exactly one of the paths has to be in a container, like <container>:<path>")
+	}
+	name := srcContainer + dstContainer
+
+	container, err := findContainer(name)
+	if err != nil {
+		return err
+	}
+	if container.State.Running {
+		return fmt.Errorf("Container %s is running, copy once it exited", container.Id)
+	}
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	rootfs, unmount, err := container.mountRootfs(store)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	// ownership goes to root in the container and to us on the host
+	uid, gid := -1, -1
+	if srcContainer != "" {
+		src, err := containerPath(rootfs, srcPath)
+		if err != nil {
+			return err
+		}
+		if !*archive {
+			uid, gid = os.Getuid(), os.Getgid()
+		}
+		return copyPath(src, contentOnly(srcPath), dstPath, "", uid, gid)
+	}
+	if !*archive {
+		uid, gid = 0, 0
+	}
+	return copyPath(srcPath, contentOnly(srcPath), dstPath, rootfs, uid, gid)
+}
+
+// This function splits "container:path" into its parts, local paths can contain
+// ":" when they are absolute or start with "."
+func splitContainerPath(arg string) (string, string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	container, path, ok := strings.Cut(arg, ":")
+	if !ok {
+		return "", arg
+	}
+	return container, path
+}
+
+// This function reports whether a copy source asks for the content of the
+// directory rather than the directory itself
+func contentOnly(path string) bool {
+	return path == "." || strings.HasSuffix(path, "/.")
+}
+
+// The below function resolves a path of the container to the host, symlinks on
+// the way are followed inside rootfs but the last component is left as it is:
+// a symlink is copied as a symlink
+func containerPath(rootfs, path string) (string, error) {
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return rootfs, nil
+	}
+	parent, err := secureJoin(rootfs, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(path)), nil
+}
+
+// The below function copies src to dst following the rules of cp -r: into dst
+// when it's a directory and as dst otherwise. When rootfs is set, dst is a
+// path of the container resolved inside it and the files are written with the
+// symlink checks of layer extraction. uid and gid replace the owners of the
+// files unless they are -1
+func copyPath(src string, content bool, dst, rootfs string, uid, gid int) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if content && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+
+	resolve := func(path string) (string, error) {
+		if rootfs == "" {
+			return path, nil
+		}
+		return secureJoin(rootfs, filepath.Clean("/"+path))
+	}
+	dir, err := resolve(dst)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(src)
+	if target, err := os.Stat(dir); err != nil || !target.IsDir() {
+		if err == nil && info.IsDir() {
+			return fmt.Errorf("Cannot copy the directory %s over the file %s", src, dst)
+		}
+		// dst is the new name of what is copied
+		dir, err = resolve(filepath.Dir(filepath.Clean(dst)))
+		if err != nil {
+			return err
+		}
+		if target, err := os.Stat(dir); err != nil || !target.IsDir() {
+			return fmt.Errorf("No such directory: %s", filepath.Dir(filepath.Clean(dst)))
+		}
+		name = filepath.Base(filepath.Clean(dst))
+		content = false
+	}
+	if content {
+		name = "."
+	}
+
+	// the files go through a tar stream so that untar writes them
+	pr, pw := io.Pipe()
+	write := func() error {
+		tw := tar.NewWriter(pw)
+		err := writeCopyTar(tw, src, name, uid, gid, nil)
+		if err == nil {
+			err = tw.Close()
+		}
+		return err
+	}
+	// the mounts only exist in the mount namespace of this thread, the side
+	// in the mounted root file system has to stay on it. Without rootfs that
+	// is src
+	if rootfs == "" {
+		done := make(chan error, 1)
+		go func() {
+			err := untar(pr, dir)
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		err = write()
+		pw.CloseWithError(err)
+		if untarErr := <-done; err == nil {
+			err = untarErr
+		}
+		return err
+	}
+	go func() {
+		pw.CloseWithError(write())
+	}()
+	err = untar(pr, dir)
+	pr.CloseWithError(err)
+	return err
+}
+
+// The below function writes src and what is under it to the tar stream, named
+// name instead of its own name. The root of a content copy only brings what
+// is in it. What ignore excludes is left out
+func writeCopyTar(tw *tar.Writer, src, name string, uid, gid int, ignore *dockerignore) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if name == "." && rel == "." {
+			return nil
+		}
+		if ignore.excluded(path) {
+			// what an exception brings back may be under the directory
+			if info.IsDir() && !ignore.exceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// untar would take them for whiteouts and delete what they name
+		if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			return fmt.Errorf("Cannot copy %s: names starting with %s are reserved for whiteouts", path, whiteoutPrefix)
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, rel))
+		header.Uname = ""
+		header.Gname = ""
+		if uid != -1 {
+			header.Uid = uid
+			header.Gid = gid
+		}
+		err = tw.WriteHeader(header)
+		if err != nil || header.Typeflag != tar.TypeReg {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.CopyN(tw, file, header.Size)
+		return err
+	})
+}
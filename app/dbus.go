@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The systemd cgroup driver talks to systemd over D-Bus. Only what that needs
+// is here: authenticating as our uid, and calling methods whose arguments are
+// marshalled by the caller with dbusEncoder. Replies are checked for errors,
+// their bodies are not read
+
+// the types of D-Bus messages
+const (
+	dbusMethodCall = 1
+	dbusError      = 3
+)
+
+// the codes of the header fields of D-Bus messages
+const (
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+)
+
+// dbusConn is a connection to a D-Bus bus
+type dbusConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	serial uint32
+}
+
+// dbusRemoteError is an error message a method call was answered with
+type dbusRemoteError struct {
+	Name    string
+	Message string
+}
+
+func (e *dbusRemoteError) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// The below function connects to the bus at the unix socket and says hello,
+// the bus gives us a name then. The address may be a D-Bus address like
+// unix:path=/run/dbus/system_bus_socket
+func dialDBus(address string) (*dbusConn, error) {
+	path := address
+	for _, part := range strings.Split(strings.TrimPrefix(address, "unix:"), ",") {
+		if value, ok := cutPrefix(part, "path="); ok {
+			path = value
+		}
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to D-Bus at %s: %v", path, err)
+	}
+	c := &dbusConn{conn: conn, reader: bufio.NewReader(conn)}
+	err = c.authenticate()
+	if err == nil {
+		err = c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error connecting to D-Bus at %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// This function returns s without the prefix and whether it had it
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// The below function authenticates with the EXTERNAL mechanism, the bus
+// checks the uid we give against the credentials of the socket
+func (c *dbusConn) authenticate() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Geteuid())))
+	_, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid)
+	if err != nil {
+		return err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("authentication rejected: %s", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(c.conn, "BEGIN\r\n")
+	return err
+}
+
+// This function closes the connection
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// The below function calls a method and waits for its reply, an error message
+// is returned as a *dbusRemoteError. The body holds the arguments marshalled
+// after the signature
+func (c *dbusConn) call(destination, path, iface, member, signature string, body []byte) error {
+	c.serial++
+	header := &dbusEncoder{}
+	header.bytes('l', dbusMethodCall, 0, 1)
+	header.uint32(uint32(len(body)))
+	header.uint32(c.serial)
+	header.array(8, func() {
+		header.field(dbusFieldPath, "o", path)
+		header.field(dbusFieldInterface, "s", iface)
+		header.field(dbusFieldMember, "s", member)
+		header.field(dbusFieldDestination, "s", destination)
+		if signature != "" {
+			header.field(dbusFieldSignature, "g", signature)
+		}
+	})
+	header.align(8)
+	_, err := c.conn.Write(append(header.buf, body...))
+	if err != nil {
+		return err
+	}
+
+	// signals and whatever else comes before the reply are skipped
+	for {
+		kind, fields, body, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if fields[dbusFieldReplySerial] != strconv.FormatUint(uint64(c.serial), 10) {
+			continue
+		}
+		if kind == dbusError {
+			remote := &dbusRemoteError{Name: fields[dbusFieldErrorName]}
+			// the message of an error is its first argument, a string
+			if strings.HasPrefix(fields[dbusFieldSignature], "s") && len(body) >= 4 {
+				order := binary.ByteOrder(binary.LittleEndian)
+				if fields[0] == "B" {
+					order = binary.BigEndian
+				}
+				size := order.Uint32(body)
+				if uint64(size)+4 <= uint64(len(body)) {
+					remote.Message = string(body[4 : 4+size])
+				}
+			}
+			return remote
+		}
+		return nil
+	}
+}
+
+// The below function reads a message and returns its type, the header fields
+// of string and uint32 types as strings, and the body. The byte order of the
+// message is the field 0
+func (c *dbusConn) readMessage() (byte, map[byte]string, []byte, error) {
+	fixed := make([]byte, 16)
+	_, err := io.ReadFull(c.reader, fixed)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if fixed[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodySize := order.Uint32(fixed[4:])
+	fieldsSize := order.Uint32(fixed[12:])
+	if bodySize > 1<<27 || fieldsSize > 1<<27 {
+		return 0, nil, nil, fmt.Errorf("D-Bus message too large")
+	}
+	// the header fields are padded to 8 bytes, the body follows
+	padded := (fieldsSize + 7) &^ 7
+	rest := make([]byte, padded+bodySize)
+	_, err = io.ReadFull(c.reader, rest)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	fields := map[byte]string{0: string(fixed[0])}
+	data := rest[:fieldsSize]
+	offset := 0
+	// the offsets of the array start at 16 bytes in the message, aligned to 8
+	for offset < len(data) {
+		offset = (offset + 7) &^ 7
+		if offset+3 > len(data) {
+			break
+		}
+		code := data[offset]
+		signatureSize := int(data[offset+1])
+		if offset+2+signatureSize+1 > len(data) {
+			break
+		}
+		signature := string(data[offset+2 : offset+2+signatureSize])
+		offset += 2 + signatureSize + 1
+		switch signature {
+		case "s", "o":
+			offset = (offset + 3) &^ 3
+			if offset+4 > len(data) {
+				return 0, nil, nil, fmt.Errorf("Malformed D-Bus message")
+			}
+			size := int(order.Uint32(data[offset:]))
+			if offset+4+size > len(data) {
+				return 0, nil, nil, fmt.Errorf("Malformed D-Bus message")
+			}
+			fields[code] = string(data[offset+4 : offset+4+size])
+			offset += 4 + size + 1
+		case "g":
+			size := int(data[offset])
+			if offset+1+size > len(data) {
+				return 0, nil, nil, fmt.Errorf("Malformed D-Bus message")
+			}
+			fields[code] = string(data[offset+1 : offset+1+size])
+			offset += 1 + size + 1
+		case "u":
+			offset = (offset + 3) &^ 3
+			if offset+4 > len(data) {
+				return 0, nil, nil, fmt.Errorf("Malformed D-Bus message")
+			}
+			fields[code] = strconv.FormatUint(uint64(order.Uint32(data[offset:])), 10)
+			offset += 4
+		default:
+			return 0, nil, nil, fmt.Errorf("Unexpected D-Bus header field type %s", signature)
+		}
+	}
+	return fixed[1], fields, rest[padded:], nil
+}
+
+// dbusEncoder marshals D-Bus values in little endian. The alignment of every
+// value is the one it has from the start of the message, a body starts
+// aligned to 8 so an encoder of its own works for it
+type dbusEncoder struct {
+	buf []byte
+}
+
+// This function pads the buffer with zeros to a multiple of n
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) bytes(values ...byte) {
+	e.buf = append(e.buf, values...)
+}
+
+func (e *dbusEncoder) boolean(value bool) {
+	if value {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (e *dbusEncoder) uint32(value uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, value)
+}
+
+func (e *dbusEncoder) uint64(value uint64) {
+	e.align(8)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, value)
+}
+
+// This function marshals a string or an object path, they are the same
+func (e *dbusEncoder) string(value string) {
+	e.uint32(uint32(len(value)))
+	e.buf = append(e.buf, value...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) signature(value string) {
+	e.buf = append(e.buf, byte(len(value)))
+	e.buf = append(e.buf, value...)
+	e.buf = append(e.buf, 0)
+}
+
+// The below function marshals an array whose elements fill writes, their
+// alignment is the one given. The size of the array doesn't count the padding
+// ahead of the first element
+func (e *dbusEncoder) array(alignment int, fill func()) {
+	e.uint32(0)
+	sizeAt := len(e.buf) - 4
+	e.align(alignment)
+	start := len(e.buf)
+	fill()
+	binary.LittleEndian.PutUint32(e.buf[sizeAt:], uint32(len(e.buf)-start))
+}
+
+// This function marshals a header field, a struct of its code and a variant
+// of a string, object path or signature
+func (e *dbusEncoder) field(code byte, signature, value string) {
+	e.align(8)
+	e.bytes(code)
+	e.signature(signature)
+	if signature == "g" {
+		e.signature(value)
+	} else {
+		e.string(value)
+	}
+}
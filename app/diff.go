@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// change is a path of a container that differs from its image, kind is A for
+// added, C for changed and D for deleted like docker diff prints them
+type change struct {
+	kind byte
+	path string
+}
+
+// Usage: your_docker.sh diff <container>
+// lists the files the container added, changed or deleted compared to its image
+func diffCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: diff <container>")
+	}
+	container, err := findContainer(args[0])
+	if err != nil {
+		return err
+	}
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	changes, err := container.changes(store)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Printf("%c %s\n", c.kind, c.path)
+	}
+	return nil
+}
+
+// The below function compares the container with its image, sorted by path.
+// The overlay drivers keep the changes in the upper directory already, for vfs
+// the copy of the container is compared with the image file by file
+func (c *Container) changes(store *imageStore) ([]change, error) {
+	driver, manifest, config, err := c.image(store)
+	if err != nil {
+		return nil, err
+	}
+	dir := containerDir(c.Id)
+	upper := filepath.Join(dir, "upper")
+	rootfs := filepath.Join(dir, "rootfs")
+	if _, err := os.Stat(upper); err != nil {
+		if _, err := os.Stat(rootfs); err != nil {
+			return nil, fmt.Errorf("Container %s has no file system left to compare", c.Id)
+		}
+	}
+
+	err = privateMountNamespace()
+	if err != nil {
+		return nil, err
+	}
+	image, err := driver.mountImage(store, manifest, config, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(filepath.Join(dir, "image"))
+	defer driver.unmount(image)
+
+	var changes []change
+	if _, err := os.Stat(upper); err == nil {
+		changes, err = upperChanges(upper, image)
+	} else {
+		changes, err = treeChanges(rootfs, image)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+// This function sorts changes by path
+func sortChanges(changes []change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].path < changes[j].path
+	})
+}
+
+// The below function writes the changes of a full copy of a file system to the
+// tar stream as a layer: what was added or changed as it is in rootfs and what
+// was deleted as whiteout markers. changes have to be sorted
+func writeChangesTar(tw *tar.Writer, rootfs string, changes []change) error {
+	links := map[uint64]string{}
+	for _, c := range changes {
+		rel := strings.TrimPrefix(c.path, "/")
+		if c.kind == 'D' {
+			marker := path.Join(path.Dir(rel), whiteoutPrefix+path.Base(rel))
+			err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: marker, Mode: 0600, ModTime: time.Unix(0, 0), Format: tar.FormatPAX})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		file := filepath.Join(rootfs, filepath.FromSlash(rel))
+		info, err := os.Lstat(file)
+		if err != nil {
+			return err
+		}
+		err = writeTarEntry(tw, file, rel, info, links)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The below function lists the changes recorded in the upper directory of an
+// overlayfs: whiteouts are deleted paths, everything else was added unless the
+// image has it too. The content of the image under an opaque directory is gone
+func upperChanges(upper, image string) ([]change, error) {
+	changes := []change{}
+	err := filepath.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		// fuse-overlayfs without privileges writes OCI markers instead of whiteouts
+		switch {
+		case isOverlayWhiteout(info):
+			changes = append(changes, change{'D', "/" + filepath.ToSlash(rel)})
+			return nil
+		case info.Name() == whiteoutOpaque:
+			return nil
+		case strings.HasPrefix(info.Name(), whiteoutPrefix):
+			deleted := filepath.Join(filepath.Dir(rel), strings.TrimPrefix(info.Name(), whiteoutPrefix))
+			changes = append(changes, change{'D', "/" + filepath.ToSlash(deleted)})
+			return nil
+		}
+
+		kind := byte('A')
+		if _, err := os.Lstat(filepath.Join(image, rel)); err == nil {
+			kind = 'C'
+		}
+		changes = append(changes, change{kind, "/" + filepath.ToSlash(rel)})
+		if kind == 'C' && info.IsDir() && (isOverlayOpaque(path) || fileExists(filepath.Join(path, whiteoutOpaque))) {
+			entries, err := os.ReadDir(filepath.Join(image, rel))
+			if err != nil {
+				return nil
+			}
+			for _, entry := range entries {
+				if _, err := os.Lstat(filepath.Join(path, entry.Name())); os.IsNotExist(err) {
+					changes = append(changes, change{'D', "/" + filepath.ToSlash(filepath.Join(rel, entry.Name()))})
+				}
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// The below function compares a full copy of the file system with the image:
+// paths only the copy has were added, paths only the image has were deleted
+// and the ones whose type, owner, mode, size, time or link differ were changed
+func treeChanges(rootfs, image string) ([]change, error) {
+	changes := []change{}
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		original, err := os.Lstat(filepath.Join(image, rel))
+		if err != nil {
+			changes = append(changes, change{'A', "/" + filepath.ToSlash(rel)})
+			return nil
+		}
+		if !sameFile(path, info, filepath.Join(image, rel), original) {
+			changes = append(changes, change{'C', "/" + filepath.ToSlash(rel)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(image, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(image, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(rootfs, rel)); os.IsNotExist(err) {
+			changes = append(changes, change{'D', "/" + filepath.ToSlash(rel)})
+			// the content of a deleted directory isn't listed
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// This function reports whether two files look the same without reading them,
+// the way docker compares file systems when it has no layer to go by
+func sameFile(path string, info os.FileInfo, originalPath string, original os.FileInfo) bool {
+	if info.Mode() != original.Mode() || !info.ModTime().Equal(original.ModTime()) {
+		return false
+	}
+	stat, ok1 := info.Sys().(*syscall.Stat_t)
+	originalStat, ok2 := original.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && (stat.Uid != originalStat.Uid || stat.Gid != originalStat.Gid || stat.Rdev != originalStat.Rdev) {
+		return false
+	}
+	if info.IsDir() {
+		return true
+	}
+	if info.Size() != original.Size() {
+		return false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, _ := os.Readlink(path)
+		originalLink, _ := os.Readlink(originalPath)
+		return link == originalLink
+	}
+	return true
+}
+
+// This function reports whether something exists at path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
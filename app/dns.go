@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Containers on a network made with network create find each other by name:
+// every run of such a container serves DNS on port 53 of the gateway of the
+// network, and the container gets a resolv.conf pointing there (see hosts.go). There is no
+// daemon, the runs of the containers of a network all listen on the same port
+// with SO_REUSEPORT and the kernel hands every query to one of them. The names
+// of the network are the names, --network-alias aliases and short ids of its
+// containers, the others are forwarded to the name servers of the host or to
+// the ones of --dns
+
+// the DNS record types and flags we answer with
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+
+	dnsFlagResponse      = 1 << 15
+	dnsFlagAuthoritative = 1 << 10
+	dnsFlagRecursion     = 1<<8 | 1<<7 // desired and available
+	dnsRcodeServFail     = 2
+
+	// dnsTTL is the ttl of the addresses of containers, the one docker gives
+	dnsTTL = 600
+)
+
+// soReusePort is SO_REUSEPORT, which syscall doesn't have. It's 15 on every
+// architecture but mips
+const soReusePort = 15
+
+// dnsForwardTimeout is how long a name server of the host gets to answer
+const dnsForwardTimeout = 5 * time.Second
+
+// The below function serves DNS for the containers of the network on its
+// gateway until the returned function is called
+func (n *Network) serveDNS() (func(), error) {
+	address := net.JoinHostPort(n.Gateway, "53")
+	config := net.ListenConfig{Control: func(network, address string, conn syscall.RawConn) error {
+		var err error
+		conn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		return err
+	}}
+	udp, err := config.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error serving DNS on %s: %v", address, err)
+	}
+	tcp, err := config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("Error serving DNS on %s: %v", address, err)
+	}
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			size, client, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte{}, buf[:size]...)
+			go func() {
+				answer := n.answerDNS(query, "udp", client)
+				if answer != nil {
+					udp.WriteTo(answer, client)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go n.serveDNSConn(conn)
+		}
+	}()
+	return func() {
+		udp.Close()
+		tcp.Close()
+	}, nil
+}
+
+// This function answers the queries of a DNS over TCP connection, each comes
+// with its length ahead of it
+func (n *Network) serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readDNSMessage(reader)
+		if err != nil {
+			return
+		}
+		answer := n.answerDNS(query, "tcp", conn.RemoteAddr())
+		if answer == nil {
+			return
+		}
+		_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// This function reads a DNS message with its length ahead of it, the way TCP
+// carries them
+func readDNSMessage(reader io.Reader) ([]byte, error) {
+	var size uint16
+	err := binary.Read(reader, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, size)
+	_, err = io.ReadFull(reader, message)
+	return message, err
+}
+
+// The below function answers a DNS query of client: the names of containers
+// of the network get their addresses, A and AAAA records, or an empty answer
+// for the other types, and every other query goes to the name servers of the
+// container asking, the ones of --dns or of the host. It returns nil for what
+// isn't a query at all
+func (n *Network) answerDNS(query []byte, protocol string, client net.Addr) []byte {
+	name, qtype, end, ok := parseDNSQuestion(query)
+	if !ok {
+		return nil
+	}
+	containers, err := n.endpoints()
+	if err != nil {
+		containers = nil
+	}
+	if settings := lookupContainer(containers, name); settings != nil {
+		flags := binary.BigEndian.Uint16(query[2:]) & (1 << 8)
+		answer := append([]byte{}, query[:end]...)
+		binary.BigEndian.PutUint16(answer[2:], dnsFlagResponse|dnsFlagAuthoritative|dnsFlagRecursion|flags)
+		// no answers but the ones below, and no authority nor additional records
+		binary.BigEndian.PutUint16(answer[6:], 0)
+		binary.BigEndian.PutUint32(answer[8:], 0)
+		var records []net.IP
+		if qtype == dnsTypeA || qtype == dnsTypeANY {
+			records = append(records, net.ParseIP(settings.IPAddress).To4())
+		}
+		if (qtype == dnsTypeAAAA || qtype == dnsTypeANY) && settings.GlobalIPv6Address != "" {
+			records = append(records, net.ParseIP(settings.GlobalIPv6Address))
+		}
+		for _, ip := range records {
+			rtype := uint16(dnsTypeA)
+			if len(ip) == net.IPv6len {
+				rtype = dnsTypeAAAA
+			}
+			// the name is a pointer to the one of the question, right after the header
+			answer = append(answer, 0xc0, 12)
+			answer = binary.BigEndian.AppendUint16(answer, rtype)
+			answer = binary.BigEndian.AppendUint16(answer, 1) // IN
+			answer = binary.BigEndian.AppendUint32(answer, dnsTTL)
+			answer = binary.BigEndian.AppendUint16(answer, uint16(len(ip)))
+			answer = append(answer, ip...)
+		}
+		binary.BigEndian.PutUint16(answer[6:], uint16(len(records)))
+		return answer
+	}
+
+	// every run of the network serves the queries of every container, the
+	// name servers are the ones of the container with the address of client
+	var upstreams []string
+	clientIP, _, _ := net.SplitHostPort(client.String())
+	for _, container := range containers {
+		settings := container.NetworkSettings
+		if settings.IPAddress == clientIP || settings.GlobalIPv6Address == clientIP {
+			upstreams = settings.DNSServers
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = readResolvConf(hostResolvConf).servers(false)
+	}
+	answer, err := forwardDNS(query, protocol, upstreams)
+	if err != nil {
+		answer = append([]byte{}, query[:end]...)
+		flags := binary.BigEndian.Uint16(query[2:]) & (1 << 8)
+		binary.BigEndian.PutUint16(answer[2:], dnsFlagResponse|dnsFlagRecursion|flags|dnsRcodeServFail)
+		binary.BigEndian.PutUint16(answer[6:], 0)
+		binary.BigEndian.PutUint32(answer[8:], 0)
+	}
+	return answer
+}
+
+// The below function parses the question of a DNS query, the one queries
+// have. It returns the name asked for in lower case and without the final
+// dot, the type asked for and where the question ends
+func parseDNSQuestion(query []byte) (string, uint16, int, bool) {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[2:])&dnsFlagResponse != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return "", 0, 0, false
+	}
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return "", 0, 0, false
+		}
+		size := int(query[offset])
+		offset++
+		if size == 0 {
+			break
+		}
+		// queries have no compression pointers, the labels are at most 63 long
+		if size > 63 || offset+size > len(query) {
+			return "", 0, 0, false
+		}
+		labels = append(labels, string(query[offset:offset+size]))
+		offset += size
+	}
+	if offset+4 > len(query) {
+		return "", 0, 0, false
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	return strings.ToLower(strings.Join(labels, ".")), qtype, offset + 4, true
+}
+
+// The below function returns the network settings of the container with the
+// name, alias or id among the containers of a network, nil if there is none
+func lookupContainer(containers []*Container, name string) *NetworkSettings {
+	if name == "" {
+		return nil
+	}
+	for _, container := range containers {
+		names := append([]string{container.Name, container.Id[:12], container.Id}, container.NetworkSettings.Aliases...)
+		for _, candidate := range names {
+			if strings.ToLower(candidate) == name {
+				return container.NetworkSettings
+			}
+		}
+	}
+	return nil
+}
+
+// The below function sends the query to the name servers of the host in turn
+// and returns the first answer
+func forwardDNS(query []byte, protocol string, upstreams []string) ([]byte, error) {
+	err := fmt.Errorf("no name server")
+	for _, upstream := range upstreams {
+		var conn net.Conn
+		conn, err = net.DialTimeout(protocol, net.JoinHostPort(upstream, "53"), dnsForwardTimeout)
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+		var answer []byte
+		if protocol == "tcp" {
+			_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+			if err == nil {
+				answer, err = readDNSMessage(conn)
+			}
+		} else {
+			_, err = conn.Write(query)
+			if err == nil {
+				buf := make([]byte, 65535)
+				var size int
+				size, err = conn.Read(buf)
+				answer = buf[:size]
+			}
+		}
+		conn.Close()
+		if err == nil {
+			return answer, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// instruction is a line of a Dockerfile, continuation lines joined
+type instruction struct {
+	line     int
+	command  string            // upper case, e.g. RUN
+	flags    map[string]string // the --name=value flags before the arguments
+	rest     string            // the arguments as written, without the flags
+	json     []string          // the arguments in exec form, nil in shell form
+	original string            // the instruction as written, for the history
+}
+
+// The below function parses a Dockerfile into its instructions. Comments and
+// empty lines are skipped, a "\" at the end of a line continues the instruction
+// on the next one and comment lines in between are ignored
+func parseDockerfile(r io.Reader) ([]instruction, error) {
+	instructions := []instruction{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	current := ""
+	start := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") || (trimmed == "" && current == "") {
+			continue
+		}
+		if current == "" {
+			start = lineNumber
+		}
+		if strings.HasSuffix(trimmed, "\\") {
+			current += strings.TrimSuffix(strings.TrimRightFunc(line, unicode.IsSpace), "\\")
+			continue
+		}
+		current += line
+		inst, err := parseInstruction(strings.TrimSpace(current))
+		if err != nil {
+			return nil, fmt.Errorf("Dockerfile line %d: %v", start, err)
+		}
+		inst.line = start
+		instructions = append(instructions, inst)
+		current = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(current) != "" {
+		return nil, fmt.Errorf("Dockerfile line %d: the last instruction ends with a line continuation", start)
+	}
+	return instructions, nil
+}
+
+// The below function splits an instruction into its command, its flags and its
+// arguments, which are in exec form when they are a JSON array of strings
+func parseInstruction(text string) (instruction, error) {
+	command, rest, _ := strings.Cut(text, " ")
+	inst := instruction{command: strings.ToUpper(command), flags: map[string]string{}, original: text}
+	rest = strings.TrimSpace(rest)
+	for strings.HasPrefix(rest, "--") {
+		flag, after, _ := strings.Cut(rest, " ")
+		name, value, ok := strings.Cut(flag[2:], "=")
+		if !ok {
+			return inst, fmt.Errorf("Flag %s of %s needs a value, like %s=value", flag, inst.command, flag)
+		}
+		inst.flags[name] = value
+		rest = strings.TrimSpace(after)
+	}
+	inst.rest = rest
+	if strings.HasPrefix(rest, "[") {
+		var args []string
+		if json.Unmarshal([]byte(rest), &args) == nil {
+			inst.json = args
+		}
+	}
+	return inst, nil
+}
+
+// The below function splits the arguments of an instruction into words the way
+// a shell would, expanding the variables of env on the way: $NAME, ${NAME},
+// ${NAME:-default} and ${NAME:+alternative}. Single quotes keep everything as
+// it is, double quotes keep spaces and a backslash escapes the next character
+func shellWords(s string, env []string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated single quote in %s", s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				switch {
+				case s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$", s[i+1]) >= 0:
+					i++
+					word.WriteByte(s[i])
+				case s[i] == '$':
+					value, n, err := expandVar(s[i:], env)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(value)
+					i += n - 1
+				default:
+					word.WriteByte(s[i])
+				}
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("Unterminated double quote in %s", s)
+			}
+			inWord = true
+		case c == '$':
+			value, n, err := expandVar(s[i:], env)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			i += n - 1
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// The below function expands the variable s starts with and returns its value
+// and how many bytes of s it took. A "$" not followed by a name is kept
+func expandVar(s string, env []string) (string, int, error) {
+	if len(s) > 1 && s[1] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", 0, fmt.Errorf("Missing } in %s", s)
+		}
+		expr := s[2:end]
+		name, word, modifier := expr, "", ""
+		if i := strings.Index(expr, ":"); i >= 0 && i+1 < len(expr) {
+			name, modifier, word = expr[:i], expr[i:i+2], expr[i+2:]
+		}
+		if !isVarName(name) {
+			return "", 0, fmt.Errorf("Invalid variable ${%s}", expr)
+		}
+		value, set := lookupEnv(env, name)
+		switch modifier {
+		case ":-":
+			if !set || value == "" {
+				value = word
+			}
+		case ":+":
+			if set && value != "" {
+				value = word
+			} else {
+				value = ""
+			}
+		case "":
+		default:
+			return "", 0, fmt.Errorf("Unsupported modifier %s in ${%s}", modifier, expr)
+		}
+		return value, end + 1, nil
+	}
+
+	n := 1
+	for n < len(s) && (s[n] == '_' || unicode.IsLetter(rune(s[n])) || (n > 1 && unicode.IsDigit(rune(s[n])))) {
+		n++
+	}
+	if n == 1 {
+		return "$", 1, nil
+	}
+	value, _ := lookupEnv(env, s[1:n])
+	return value, n, nil
+}
+
+// This function reports whether name can be the name of a variable
+func isVarName(name string) bool {
+	for i, c := range name {
+		if c != '_' && !unicode.IsLetter(c) && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// This function returns the value of the variable in a KEY=value list, the
+// last one wins like in an environment
+func lookupEnv(env []string, name string) (string, bool) {
+	value, set := "", false
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+			value, set = v, true
+		}
+	}
+	return value, set
+}
+
+// This function sets the variable in a KEY=value list, replacing it if it's there
+func setEnv(env []string, name, value string) []string {
+	result := []string{}
+	for _, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k != name {
+			result = append(result, kv)
+		}
+	}
+	return append(result, name+"="+value)
+}
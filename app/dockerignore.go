@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dockerignore holds the patterns of the .dockerignore file of a build
+// context, the files they match are left out of COPY and ADD
+type dockerignore struct {
+	root     string // the build context
+	patterns []ignorePattern
+	// exceptions is true when a pattern starts with "!", the directories that
+	// are excluded then still have to be looked into
+	exceptions bool
+}
+
+// ignorePattern is a line of .dockerignore, a "!" in front of the pattern
+// brings back what the patterns before it excluded
+type ignorePattern struct {
+	regexp    *regexp.Regexp
+	exception bool
+}
+
+// The below function reads the .dockerignore file at the root of the build
+// context, a context without one excludes nothing. Lines starting with # are
+// comments, the patterns are those of filepath.Match with ** matching any
+// number of directories, and the last pattern matching a file decides
+func readDockerignore(context string) (*dockerignore, error) {
+	ignore := &dockerignore{root: context}
+	file, err := os.Open(filepath.Join(context, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return ignore, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exception := strings.HasPrefix(line, "!")
+		if exception {
+			line = strings.TrimSpace(line[1:])
+			ignore.exceptions = true
+		}
+		// patterns are relative to the context, with or without a leading /
+		pattern := strings.TrimPrefix(filepath.Clean("/"+line), "/")
+		re, err := ignoreRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid .dockerignore pattern %q: %v", line, err)
+		}
+		ignore.patterns = append(ignore.patterns, ignorePattern{regexp: re, exception: exception})
+	}
+	return ignore, scanner.Err()
+}
+
+// The below function turns a .dockerignore pattern into a regular expression
+// matching the whole path: * and ? don't match "/", ** matches anything
+// including "/" and a "**/" at the start or in the middle may match nothing
+func ignoreRegexp(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				i++
+				if strings.HasPrefix(pattern[i+1:], "/") {
+					i++
+					expr.WriteString("(.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// This function reports whether the file at path, inside the build context,
+// is excluded. A pattern matching a directory matches everything under it
+func (d *dockerignore) excluded(path string) bool {
+	if d == nil || len(d.patterns) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(d.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	excluded := false
+	for _, pattern := range d.patterns {
+		if pattern.exception != excluded {
+			continue
+		}
+		for dir := rel; dir != "."; dir = filepath.Dir(dir) {
+			if pattern.regexp.MatchString(dir) {
+				excluded = !pattern.exception
+				break
+			}
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// blobs can be hundreds of megabytes, so unlike httpClient there is no overall
+// timeout here, only for the registry to start answering
+var blobClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// blobs bigger than this are downloaded in parallel ranged chunks
+const chunkedDownloadThreshold = 64 << 20
+
+var (
+	// downloadConcurrency is the number of ranged requests issued for a single blob
+	downloadConcurrency = 4
+	// downloadLimiter caps the bandwidth shared by all downloads, nil means no cap
+	downloadLimiter *rateLimiter
+)
+
+// rateLimiter spreads reads over time so that at most rate bytes are read per second
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// This function blocks until n more bytes may be read
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedReader is an io.Reader that goes through the rate limiter
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.limiter != nil && len(p) > 32<<10 {
+		// small reads keep the transfer smooth instead of bursty
+		p = p[:32<<10]
+	}
+	n, err := r.r.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// The below function downloads the blob at url into the store, big blobs are
+// fetched with several ranged requests in parallel when the registry supports it
+func downloadBlob(store *imageStore, url, authorization, digest string, size int64) error {
+	if size >= chunkedDownloadThreshold && downloadConcurrency > 1 {
+		err := downloadBlobChunked(store, url, authorization, digest, size)
+		if err != errRangeNotSupported {
+			return err
+		}
+	}
+
+	resp, err := getBlob(url, authorization, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error getting blob: %v", resp.Status)
+	}
+
+	// the digest is verified while writing
+	return store.writeBlob(digest, &limitedReader{r: resp.Body, limiter: downloadLimiter})
+}
+
+// This function sends a GET for the blob with our authorization, rangeHeader is optional
+func getBlob(url, authorization, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	return blobClient.Do(req)
+}
+
+var errRangeNotSupported = fmt.Errorf("Range requests are not supported")
+
+// The below function splits the blob in downloadConcurrency parts, downloads them
+// in parallel into one file and renames it into the store once the digest matches
+func downloadBlobChunked(store *imageStore, url, authorization, digest string, size int64) error {
+	tmpFile, err := os.CreateTemp(filepath.Join(store.root, "blobs"), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	err = tmpFile.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := (size + int64(downloadConcurrency) - 1) / int64(downloadConcurrency)
+	errs := make(chan error, downloadConcurrency)
+	var wg sync.WaitGroup
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			errs <- downloadChunk(tmpFile, url, authorization, start, end)
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+	// a registry ignoring ranges makes the whole download fall back to a
+	// single request, whatever the other chunks failed with first
+	var chunkErr error
+	for err := range errs {
+		if err == errRangeNotSupported {
+			return err
+		}
+		if chunkErr == nil {
+			chunkErr = err
+		}
+	}
+	if chunkErr != nil {
+		return chunkErr
+	}
+
+	// verify the assembled blob before it's visible in the store
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, tmpFile)
+	if err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("Digest mismatch: expected %s, got %s", digest, got)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), store.blobPath(digest))
+}
+
+// This function downloads bytes start-end (inclusive) of the blob into the same
+// offsets of file
+func downloadChunk(file *os.File, url, authorization string, start, end int64) error {
+	resp, err := getBlob(url, authorization, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// the registry ignored the range and is sending the whole blob
+		return errRangeNotSupported
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Error getting blob chunk: %v", resp.Status)
+	}
+
+	n, err := io.Copy(&offsetWriter{file: file, offset: start}, &limitedReader{r: resp.Body, limiter: downloadLimiter})
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("Short chunk: expected %d bytes, got %d", end-start+1, n)
+	}
+	return nil
+}
+
+// offsetWriter writes sequentially into file starting at offset, several of them
+// can write to different parts of the same file concurrently
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
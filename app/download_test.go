@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The below function returns an image store in a temporary directory and a
+// blob with its digest to download into it
+func testBlobStore(t *testing.T) (*imageStore, []byte, string) {
+	root := dataRoot
+	dataRoot = t.TempDir()
+	t.Cleanup(func() { dataRoot = root })
+	store, err := openImageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := bytes.Repeat([]byte("layer "), 1000)
+	return store, blob, fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+}
+
+func TestDownloadBlobChunked(t *testing.T) {
+	store, blob, digest := testBlobStore(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+
+	err := downloadBlobChunked(store, server.URL, "", digest, int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(store.blobPath(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Errorf("the downloaded blob differs from the one served")
+	}
+}
+
+func TestDownloadBlobChunkedRangeNotSupported(t *testing.T) {
+	store, blob, digest := testBlobStore(t)
+	// the first chunk fails before the others find out that the ranges are
+	// ignored, the download still has to fall back to a single request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write(blob)
+	}))
+	defer server.Close()
+
+	err := downloadBlobChunked(store, server.URL, "", digest, int64(len(blob)))
+	if err != errRangeNotSupported {
+		t.Errorf("downloadBlobChunked() = %v, want %v", err, errRangeNotSupported)
+	}
+	if store.hasBlob(digest) {
+		t.Errorf("the blob is in the store after a failed download")
+	}
+	entries, err := os.ReadDir(filepath.Join(store.root, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "tmp-") {
+			t.Errorf("the download left %s behind", entry.Name())
+		}
+	}
+}
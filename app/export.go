@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Usage: your_docker.sh export [-o file] <container>
+// the whole file system of the container, its image and its changes, is written
+// as a single flat tarball, to stdout when -o isn't given
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "write to a file instead of stdout")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	// the flags may come after the container too: export <container> -o file
+	if flags.NArg() > 1 {
+		name := flags.Arg(0)
+		err = flags.Parse(flags.Args()[1:])
+		if err != nil {
+			return err
+		}
+		args = append([]string{name}, flags.Args()...)
+	} else {
+		args = flags.Args()
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: export [-o file] <container>")
+	}
+
+	container, err := findContainer(args[0])
+	if err != nil {
+		return err
+	}
+	if container.State.Running {
+		return fmt.Errorf("Container %s is running, export it once it exited", container.Id)
+	}
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	rootfs, unmount, err := container.mountRootfs(store)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	write := func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		err := writeLayerTar(tw, rootfs)
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+	if *output == "" {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("Cowardly refusing to export to a terminal. Use the -o flag or redirect")
+		}
+		return write(os.Stdout)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return fmt.Errorf("Error exporting container: %v", err)
+	}
+	return nil
+}
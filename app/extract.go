@@ -0,0 +1,368 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// magic numbers of the compressions a layer may come in
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// The below function returns the uncompressed content of a layer, the
+// compression is recognized from the first bytes so the media type doesn't
+// have to be trusted
+func decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		return nil, fmt.Errorf("zstd compressed layers are not supported")
+	default:
+		return buffered, nil
+	}
+}
+
+// The below function extracts the layer blob at src into dest and checks
+// that its uncompressed content matches diffID, all while reading the blob once
+func extractTar(src, dest, diffID string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	uncompressed, err := decompress(file)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	r := io.TeeReader(uncompressed, hash)
+	err = untar(r, dest)
+	if err != nil {
+		return err
+	}
+	// the end of archive marker and padding are part of the diff id too
+	_, err = io.Copy(io.Discard, r)
+	if err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("sha256:%x", hash.Sum(nil)); got != diffID {
+		return fmt.Errorf("Layer does not match its diff id: expected %s, got %s", diffID, got)
+	}
+	return nil
+}
+
+// The below function writes the entries of the tar stream into dest
+func untar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	// the times of directories are set last, extracting their content changes them
+	type directory struct {
+		path   string
+		header *tar.Header
+	}
+	directories := []directory{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading layer: %v", err)
+		}
+
+		name, err := entryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		// symlinks on the way to the entry are followed inside dest only, the
+		// entry itself is replaced and never followed
+		parent, err := secureJoin(dest, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("Error extracting %s: %v", header.Name, err)
+		}
+		path := dest
+		if base := filepath.Base(name); strings.HasPrefix(base, whiteoutPrefix) {
+			err = os.MkdirAll(parent, 0755)
+			if err == nil {
+				err = writeWhiteout(parent, base)
+			}
+			if err != nil {
+				return fmt.Errorf("Error extracting %s: %v", header.Name, err)
+			}
+			continue
+		}
+		// the root of the layer only brings its metadata
+		if name != "." {
+			path = filepath.Join(parent, filepath.Base(name))
+			err = os.MkdirAll(parent, 0755)
+			if err != nil {
+				return err
+			}
+			err = extractEntry(tr, header, path, dest)
+			if err != nil {
+				return fmt.Errorf("Error extracting %s: %v", header.Name, err)
+			}
+		}
+		// hard links share the metadata of their target
+		if header.Typeflag == tar.TypeLink {
+			continue
+		}
+		err = applyMetadata(header, path)
+		if err != nil {
+			return fmt.Errorf("Error extracting %s: %v", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			directories = append(directories, directory{path, header})
+		}
+	}
+
+	for i := len(directories) - 1; i >= 0; i-- {
+		err := setTimes(directories[i].header, directories[i].path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxSymlinks is how many symlinks secureJoin follows before giving up, like
+// the kernel's limit on a single lookup
+const maxSymlinks = 255
+
+// The below function resolves rel inside root the way it would be resolved if
+// root was "/": symlinks are followed, with absolute targets taken relative to
+// root, and ".." never climbs above root. The returned path is always inside
+// root, whatever the symlinks on the way point to. Components that don't exist
+// are kept as they are
+func secureJoin(root, rel string) (string, error) {
+	resolved := ""
+	remaining := filepath.ToSlash(rel)
+	followed := 0
+	for remaining != "" {
+		var component string
+		component, remaining, _ = strings.Cut(remaining, "/")
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir("/" + resolved)[1:]
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			return "", fmt.Errorf("Too many levels of symbolic links in %s", rel)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// This function cleans the name of a tar entry into a path relative to the
+// extraction root, names climbing out of it are refused
+func entryPath(name string) (string, error) {
+	if clean := filepath.Clean(name); clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path %q in layer", name)
+	}
+	rel := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if rel == "" {
+		return ".", nil
+	}
+	return rel, nil
+}
+
+// The below function creates a single entry of the layer at path, its owner,
+// mode and times are applied afterwards by applyMetadata
+func extractEntry(tr *tar.Reader, header *tar.Header, path, dest string) error {
+	// anything but a directory replaces what is there, a directory is only
+	// replaced by a directory
+	if existing, err := os.Lstat(path); err == nil {
+		if header.Typeflag == tar.TypeDir && existing.IsDir() {
+			return nil
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.Mkdir(path, 0700)
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case tar.TypeSymlink:
+		return os.Symlink(header.Linkname, path)
+	case tar.TypeLink:
+		target, err := entryPath(header.Linkname)
+		if err != nil {
+			return err
+		}
+		parent, err := secureJoin(dest, filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		return os.Link(filepath.Join(parent, filepath.Base(target)), path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(syscall.S_IFIFO)
+		if header.Typeflag == tar.TypeChar {
+			mode = syscall.S_IFCHR
+		} else if header.Typeflag == tar.TypeBlock {
+			mode = syscall.S_IFBLK
+		}
+		err := syscall.Mknod(path, mode|0600, int(mkdev(header.Devmajor, header.Devminor)))
+		// only root can create devices, without them most images still run
+		if err == syscall.EPERM && os.Geteuid() != 0 {
+			return nil
+		}
+		return err
+	default:
+		return nil
+	}
+}
+
+// overlayOpaqueXattr marks a directory hiding the content of the lower layers
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// The below function turns an OCI whiteout marker into the whiteout overlayfs
+// understands, so that extracted layers can be used as lower directories as
+// they are: a 0/0 character device in place of a deleted file and an xattr on
+// opaque directories. Without the privileges for those the marker is kept
+func writeWhiteout(dir, marker string) error {
+	var err error
+	if marker == whiteoutOpaque {
+		err = syscall.Setxattr(dir, overlayOpaqueXattr, []byte("y"), 0)
+	} else {
+		path := filepath.Join(dir, strings.TrimPrefix(marker, whiteoutPrefix))
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mknod(path, syscall.S_IFCHR, 0)
+	}
+	if err != syscall.EPERM && err != syscall.ENOTSUP {
+		return err
+	}
+	file, err := os.Create(filepath.Join(dir, marker))
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// This function reports whether the file is an overlayfs whiteout
+func isOverlayWhiteout(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+// This function reports whether the directory is an opaque overlayfs directory
+func isOverlayOpaque(path string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(path, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// The below function gives the extracted entry the owner, mode (with the setuid,
+// setgid and sticky bits), extended attributes and times of the tar header.
+// Symlinks only get their owner, the rest would apply to what they point to
+func applyMetadata(header *tar.Header, path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		// a device we were not allowed to create
+		return nil
+	}
+
+	// chown drops the setuid bits and file capabilities, it comes first
+	err := os.Lchown(path, header.Uid, header.Gid)
+	if err != nil && !(os.IsPermission(err) && os.Geteuid() != 0) {
+		return err
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	err = syscall.Chmod(path, uint32(header.Mode)&07777)
+	if err != nil {
+		return err
+	}
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		err = syscall.Setxattr(path, strings.TrimPrefix(key, paxXattrPrefix), []byte(value), 0)
+		// trusted.* and security.* need privileges and some file systems have no xattrs
+		if err != nil && err != syscall.EPERM && err != syscall.ENOTSUP {
+			return fmt.Errorf("Error setting extended attribute %s: %v", key, err)
+		}
+	}
+	if header.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimes(header, path)
+}
+
+// paxXattrPrefix is how tar keeps extended attributes in PAX records
+const paxXattrPrefix = "SCHILY.xattr."
+
+// This function sets the access and modification times of the header on path
+func setTimes(header *tar.Header, path string) error {
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	return os.Chtimes(path, atime, header.ModTime)
+}
+
+// The below function encodes a device number the way linux does, with the
+// minor number split around the major one
+func mkdev(major, minor int64) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
+
+// This function splits a device number into its major and minor numbers, the
+// reverse of mkdev
+func splitDev(dev uint64) (int64, int64) {
+	major := (dev>>8)&0x00000fff | (dev>>32)&0xfffff000
+	minor := dev&0x000000ff | (dev>>12)&0xffffff00
+	return int64(major), int64(minor)
+}
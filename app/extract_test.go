@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// testEntry is an entry of the tar streams the tests extract
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+// The below function writes the entries into an in memory tar stream, like a
+// layer blob once uncompressed
+func testTar(t *testing.T, entries ...testEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		err := tw.WriteHeader(header)
+		if err == nil {
+			_, err = tw.Write([]byte(entry.content))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"etc/passwd", "etc/passwd"},
+		{"./etc/passwd", "etc/passwd"},
+		{"etc/", "etc"},
+		{"/etc/passwd", "etc/passwd"},
+		{"etc/../bin/sh", "bin/sh"},
+		{"/../etc/passwd", "etc/passwd"},
+		{".", "."},
+		{"./", "."},
+		{"/", "."},
+	}
+	for _, test := range tests {
+		got, err := entryPath(test.name)
+		if err != nil {
+			t.Errorf("entryPath(%q): %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("entryPath(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	for _, name := range []string{"..", "../etc/passwd", "../../etc/passwd", "etc/../../passwd", "./../passwd"} {
+		if got, err := entryPath(name); err == nil {
+			t.Errorf("entryPath(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "etc", "ssl"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"absolute": "/etc",
+		"relative": "etc/ssl",
+		"climbing": "../../../../etc",
+		"host":     "/",
+		"chain":    "absolute/ssl",
+		"loop":     "loop",
+		"dangling": "/nonexistent/dir",
+	}
+	for name, target := range links {
+		err = os.Symlink(target, filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{"etc/passwd", "etc/passwd"},
+		{"/etc/passwd", "etc/passwd"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"etc/../../../passwd", "passwd"},
+		{"absolute/passwd", "etc/passwd"},
+		{"relative/certs", "etc/ssl/certs"},
+		{"climbing/passwd", "etc/passwd"},
+		{"host/etc/passwd", "etc/passwd"},
+		{"host/..", ""},
+		{"chain/certs", "etc/ssl/certs"},
+		{"dangling/file", "nonexistent/dir/file"},
+		{"missing/../etc", "etc"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, err := secureJoin(root, test.rel)
+		if err != nil {
+			t.Errorf("secureJoin(%q): %v", test.rel, err)
+			continue
+		}
+		if want := filepath.Join(root, test.want); got != want {
+			t.Errorf("secureJoin(%q) = %q, want %q", test.rel, got, want)
+		}
+	}
+
+	if got, err := secureJoin(root, "loop/file"); err == nil {
+		t.Errorf("secureJoin(%q) = %q, want an error", "loop/file", got)
+	}
+}
+
+func TestUntarStaysInRoot(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "rootfs")
+	outside := filepath.Join(dir, "outside")
+	for _, path := range []string{dest, outside} {
+		err := os.Mkdir(path, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret := filepath.Join(outside, "secret")
+	err := os.WriteFile(secret, []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each layer tries to write to or link outside of the rootfs and must
+	// either be refused or stay inside it
+	tests := []struct {
+		name    string
+		entries []testEntry
+		fails   bool
+		inside  string // where the written file has to end up
+	}{
+		{
+			name:    "parent in the name",
+			entries: []testEntry{{name: "../outside/evil", typeflag: tar.TypeReg, content: "evil"}},
+			fails:   true,
+		},
+		{
+			name:    "parent in the middle of the name",
+			entries: []testEntry{{name: "etc/../../outside/evil", typeflag: tar.TypeReg, content: "evil"}},
+			fails:   true,
+		},
+		{
+			name:    "absolute name",
+			entries: []testEntry{{name: filepath.Join(outside, "evil"), typeflag: tar.TypeReg, content: "evil"}},
+			inside:  filepath.Join(outside, "evil"),
+		},
+		{
+			name: "absolute symlink",
+			entries: []testEntry{
+				{name: "out", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "out/evil", typeflag: tar.TypeReg, content: "evil"},
+			},
+			inside: filepath.Join(outside, "evil"),
+		},
+		{
+			name: "relative symlink",
+			entries: []testEntry{
+				{name: "etc", typeflag: tar.TypeDir},
+				{name: "etc/out", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+				{name: "etc/out/evil", typeflag: tar.TypeReg, content: "evil"},
+			},
+			inside: "outside/evil",
+		},
+		{
+			name: "symlink replaced by a file",
+			entries: []testEntry{
+				{name: "evil", typeflag: tar.TypeSymlink, linkname: filepath.Join(outside, "evil")},
+				{name: "evil", typeflag: tar.TypeReg, content: "evil"},
+			},
+			inside: "evil",
+		},
+		{
+			name:    "hardlink target with parents",
+			entries: []testEntry{{name: "evil", typeflag: tar.TypeLink, linkname: "../outside/secret"}},
+			fails:   true,
+		},
+		{
+			name: "hardlink target through a symlink",
+			entries: []testEntry{
+				{name: "out", typeflag: tar.TypeSymlink, linkname: "../outside"},
+				{name: "evil", typeflag: tar.TypeLink, linkname: "out/secret"},
+			},
+			fails: true,
+		},
+		{
+			name:    "absolute hardlink target",
+			entries: []testEntry{{name: "evil", typeflag: tar.TypeLink, linkname: secret}},
+			fails:   true,
+		},
+	}
+	for _, test := range tests {
+		err := os.RemoveAll(dest)
+		if err == nil {
+			err = os.Mkdir(dest, 0755)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = untar(testTar(t, test.entries...), dest)
+		if test.fails && err == nil {
+			t.Errorf("%s: untar succeeded, want an error", test.name)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("%s: untar: %v", test.name, err)
+		}
+		if test.inside != "" {
+			if _, err := os.Lstat(filepath.Join(dest, test.inside)); err != nil {
+				t.Errorf("%s: the file is not at %s in the rootfs: %v", test.name, test.inside, err)
+			}
+		}
+
+		entries, err := os.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("%s: untar wrote outside of the rootfs: %v", test.name, entries)
+		}
+		info, err := os.Stat(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Sys().(*syscall.Stat_t).Nlink != 1 {
+			t.Errorf("%s: untar linked to a file outside of the rootfs", test.name)
+		}
+	}
+}
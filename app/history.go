@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// createdByWidth is how much of the CREATED BY column is shown without --no-trunc
+const createdByWidth = 45
+
+// Usage: your_docker.sh history [--no-trunc] <image|id>
+// the size of a layer is the size of its compressed blob, that's all the store knows
+func historyCommand(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	noTrunc := flags.Bool("no-trunc", false, "don't truncate the output")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: history [--no-trunc] <image|id>")
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	repositories, err := store.loadRepositories()
+	if err != nil {
+		return err
+	}
+	keys, err := store.matchImage(repositories, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	manifest, err := store.readManifest(repositories[keys[0]])
+	if err != nil {
+		return fmt.Errorf("Error reading manifest: %v", err)
+	}
+	config, err := store.readConfig(manifest.Config.Digest)
+	if err != nil {
+		return fmt.Errorf("Error reading image config: %v", err)
+	}
+
+	// every history entry that isn't an empty layer matches the next layer
+	type row struct {
+		created, createdBy, size, comment string
+	}
+	rows := []row{}
+	layer := 0
+	for _, entry := range config.History {
+		r := row{created: timeAgo(entry.Created), createdBy: entry.CreatedBy, size: "0B", comment: entry.Comment}
+		if !entry.EmptyLayer && layer < len(manifest.Layers) {
+			r.size = formatSize(manifest.Layers[layer].Size)
+			layer++
+		}
+		rows = append(rows, r)
+	}
+	// images built without history still have their layers
+	for ; layer < len(manifest.Layers); layer++ {
+		rows = append(rows, row{created: "N/A", size: formatSize(manifest.Layers[layer].Size)})
+	}
+
+	id := shortID(manifest.Config.Digest)
+	if *noTrunc {
+		id = manifest.Config.Digest
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(writer, "IMAGE\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+	// newest first, only the top entry is the image itself
+	for i := len(rows) - 1; i >= 0; i-- {
+		r := rows[i]
+		createdBy := strings.Join(strings.Fields(r.createdBy), " ")
+		if !*noTrunc && len(createdBy) > createdByWidth {
+			createdBy = createdBy[:createdByWidth-3] + "..."
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", id, r.created, createdBy, r.size, r.comment)
+		id = "<missing>"
+	}
+	return writer.Flush()
+}
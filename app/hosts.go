@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Like docker, the files of /etc that tell a container its name and how to
+// find hosts by name are written for each container into its directory and
+// bind mounted over the ones of the image, which it ships with or without them
+
+// defaultHosts is the /etc/hosts of containers with a network namespace of
+// their own, the one docker gives
+const defaultHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+ff00::0	ip6-mcastprefix
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`
+
+// hostGateway is the address of --add-host that stands for the host, the
+// gateway of the default bridge network
+const hostGateway = "host-gateway"
+
+// hostEntry is an --add-host, a line of /etc/hosts
+type hostEntry struct {
+	Name string
+	IP   string // an address or host-gateway
+}
+
+// The below function parses the value of --add-host: name:ip, or name=ip the
+// way newer docker takes it too. The ip is an address or host-gateway
+func parseAddHost(value string) (hostEntry, error) {
+	name, ip, ok := strings.Cut(value, "=")
+	if !ok {
+		name, ip, ok = strings.Cut(value, ":")
+	}
+	// an IPv6 address may come in brackets
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return hostEntry{}, fmt.Errorf("Invalid --add-host %q: expected name:ip", value)
+	}
+	if ip != hostGateway && net.ParseIP(ip) == nil {
+		return hostEntry{}, fmt.Errorf("Invalid --add-host %q: invalid address %s", value, ip)
+	}
+	return hostEntry{Name: name, IP: ip}, nil
+}
+
+// The below function returns the hostname of the container with the id: the
+// one of --hostname, the one of the container whose network it shares or the
+// one of the host when it shares the network of the host. Otherwise it's the
+// short id, like docker does
+func containerHostname(id, networkMode, hostname string) (string, error) {
+	if target := strings.TrimPrefix(networkMode, "container:"); target != networkMode {
+		container, err := findContainer(target)
+		if err != nil {
+			return "", err
+		}
+		return container.Hostname, nil
+	}
+	if hostname != "" {
+		return hostname, nil
+	}
+	if networkMode == "host" {
+		return os.Hostname()
+	}
+	return id[:12], nil
+}
+
+// This function reports whether the name can be a hostname: labels of
+// letters, digits and dashes separated by dots, at most 64 characters like
+// sethostname takes
+func validHostname(name string) bool {
+	if len(name) > 64 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The below function writes the /etc/hosts, /etc/hostname and
+// /etc/resolv.conf of the container and returns the mounts giving them to it.
+// A container sharing the network of another one shares its files too, they
+// are about the network
+func etcMounts(container *Container, network *Network, hostname string, entries []hostEntry, dns dnsConfig) ([]containerMount, error) {
+	if id := strings.TrimPrefix(container.NetworkMode, "container:"); id != container.NetworkMode {
+		var mounts []containerMount
+		for _, name := range []string{"hosts", "hostname", "resolv.conf"} {
+			path := filepath.Join(containerDir(id), name)
+			if _, err := os.Stat(path); err == nil {
+				mounts = append(mounts, etcMount(path, name))
+			}
+		}
+		return mounts, nil
+	}
+
+	hosts, err := writeHosts(container, hostname, entries)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(containerDir(container.Id), "hostname")
+	err = os.WriteFile(path, []byte(hostname+"\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+	// containers on a network made with network create use the DNS of the network
+	embeddedDNS := ""
+	if network != nil && network.Name != defaultNetworkName {
+		embeddedDNS = network.Gateway
+	}
+	resolvConf, err := writeResolvConf(container, embeddedDNS, dns)
+	if err != nil {
+		return nil, err
+	}
+	return []containerMount{etcMount(hosts, "hosts"), etcMount(path, "hostname"), etcMount(resolvConf, "resolv.conf")}, nil
+}
+
+// This function returns the mount of a file of the container directory on the
+// one of /etc with the name
+func etcMount(path, name string) containerMount {
+	return containerMount{Type: "bind", Source: path, Target: "/etc/" + name, Propagation: "rprivate"}
+}
+
+// The below function writes the /etc/hosts of the container: the entries of
+// --add-host follow the ones every host has, and the addresses of the
+// container come last with its hostname. A container sharing the network of
+// the host gets the hosts of the host
+func writeHosts(container *Container, hostname string, entries []hostEntry) (string, error) {
+	content := defaultHosts
+	if container.NetworkMode == "host" {
+		data, err := os.ReadFile("/etc/hosts")
+		if err == nil {
+			content = string(data)
+			if !strings.HasSuffix(content, "\n") {
+				content += "\n"
+			}
+		}
+	}
+	for _, entry := range entries {
+		ip := entry.IP
+		if ip == hostGateway {
+			gateway, err := hostGatewayIP()
+			if err != nil {
+				return "", err
+			}
+			ip = gateway
+		}
+		content += ip + "\t" + entry.Name + "\n"
+	}
+	if settings := container.NetworkSettings; settings != nil {
+		content += settings.IPAddress + "\t" + hostname + "\n"
+		if settings.GlobalIPv6Address != "" {
+			content += settings.GlobalIPv6Address + "\t" + hostname + "\n"
+		}
+	}
+	path := filepath.Join(containerDir(container.Id), "hosts")
+	return path, os.WriteFile(path, []byte(content), 0644)
+}
+
+// The below function returns the address host-gateway stands for, the gateway
+// of the default bridge network, or the one it will get when it isn't there
+// yet
+func hostGatewayIP() (string, error) {
+	network, err := readNetwork(defaultNetworkName)
+	if err == nil {
+		return network.Gateway, nil
+	}
+	address := bridgeIP
+	if address == "" {
+		address = defaultBridgeIP
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", fmt.Errorf("Invalid --bip %q: %v", address, err)
+	}
+	return ip.String(), nil
+}
+
+// hostResolvConf is where the host has its name servers
+const hostResolvConf = "/etc/resolv.conf"
+
+// resolvConf is what a resolv.conf says
+type resolvConf struct {
+	nameservers []string
+	search      []string
+	options     []string
+}
+
+// The below function reads the name servers, search domains and options of a
+// resolv.conf, a missing one has none
+func readResolvConf(path string) *resolvConf {
+	conf := &resolvConf{}
+	data, _ := os.ReadFile(path)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if net.ParseIP(fields[1]) != nil {
+				conf.nameservers = append(conf.nameservers, fields[1])
+			}
+		case "search", "domain":
+			// the last of them wins
+			conf.search = fields[1:]
+		case "options":
+			conf.options = append(conf.options, fields[1:]...)
+		}
+	}
+	return conf
+}
+
+// The below function returns the name servers of the resolv.conf, without the
+// loopback ones when they are for a network namespace other than the one of
+// the host, they are not there. The public ones of google are what is left
+// when none is, like docker does
+func (r *resolvConf) servers(ownNetwork bool) []string {
+	var servers []string
+	for _, server := range r.nameservers {
+		if ownNetwork && net.ParseIP(server).IsLoopback() {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		servers = []string{"8.8.8.8", "8.8.4.4"}
+	}
+	return servers
+}
+
+// dnsConfig is what --dns, --dns-search and --dns-option ask for, the ones of
+// the host are taken for what they don't give
+type dnsConfig struct {
+	Servers []string
+	Search  []string // "." alone for none
+	Options []string
+}
+
+// This function reports whether any of the flags was given
+func (c dnsConfig) given() bool {
+	return len(c.Servers) > 0 || len(c.Search) > 0 || len(c.Options) > 0
+}
+
+// The below function writes the resolv.conf of the container. Its name server
+// is the DNS of the network at embedded when there is one, the one we serve on
+// networks made with network create, the ones of --dns or of the host
+// otherwise
+func writeResolvConf(container *Container, embedded string, config dnsConfig) (string, error) {
+	host := readResolvConf(hostResolvConf)
+	servers := config.Servers
+	if embedded != "" {
+		servers = []string{embedded}
+	} else if len(servers) == 0 {
+		servers = host.servers(container.NetworkMode != "host")
+	}
+	search := host.search
+	if len(config.Search) > 0 {
+		search = config.Search
+		if len(search) == 1 && search[0] == "." {
+			search = nil
+		}
+	}
+	options := host.options
+	if len(config.Options) > 0 {
+		options = config.Options
+	}
+
+	content := ""
+	for _, server := range servers {
+		content += "nameserver " + server + "\n"
+	}
+	if len(search) > 0 {
+		content += "search " + strings.Join(search, " ") + "\n"
+	}
+	if len(options) > 0 {
+		content += "options " + strings.Join(options, " ") + "\n"
+	}
+	path := filepath.Join(containerDir(container.Id), "resolv.conf")
+	return path, os.WriteFile(path, []byte(content), 0644)
+}
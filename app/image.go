@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ImageConfig is the config blob referenced by the manifest, it describes how
+// containers of the image should be started and how the image was built
+type ImageConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Created      time.Time       `json:"created"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	Author  string         `json:"author,omitempty"`
+	History []HistoryEntry `json:"history,omitempty"`
+}
+
+// HistoryEntry is an instruction the image was built with, entries that
+// didn't change the file system have no layer
+type HistoryEntry struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// ContainerConfig holds the defaults for running the image
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// The below function reads and parses an image config kept in the store
+func (s *imageStore) readConfig(digest string) (*ImageConfig, error) {
+	data, err := s.readBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	var config ImageConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	// the diff ids name directories of the layer store
+	for _, diffID := range config.RootFS.DiffIDs {
+		if !sha256Regexp.MatchString(diffID) {
+			return nil, fmt.Errorf("Invalid diff id %q in config %s", diffID, digest)
+		}
+	}
+	return &config, nil
+}
+
+// This function returns the platform the image is for
+func (c *ImageConfig) platform() Platform {
+	return Platform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+}
+
+// The below function adds an image made of the layers and the config to the
+// store and returns the digest of its manifest and its id. The manifest is an
+// OCI one when the layers it builds on came in one, a docker one otherwise.
+// Layers without a media type are the gzip compressed ones we created
+func (s *imageStore) writeImage(layers []Descriptor, config *ImageConfig) (string, string, error) {
+	manifest := ManifestResponse{SchemaVersion: 2, MediaType: mediaTypeDockerManifest}
+	manifest.Config.MediaType = mediaTypeDockerConfig
+	layerType := mediaTypeDockerLayer
+	if len(layers) > 0 && strings.HasPrefix(layers[0].MediaType, "application/vnd.oci.") {
+		manifest.MediaType = mediaTypeOCIManifest
+		manifest.Config.MediaType = mediaTypeOCIConfig
+		layerType = mediaTypeOCILayer
+	}
+	for _, layer := range layers {
+		if layer.MediaType == "" {
+			layer.MediaType = layerType
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return "", "", err
+	}
+	manifest.Config.Size = int64(len(configData))
+	manifest.Config.Digest, err = s.putBlob(configData)
+	if err != nil {
+		return "", "", err
+	}
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return "", "", err
+	}
+	digest, err := s.putBlob(rawManifest)
+	if err != nil {
+		return "", "", err
+	}
+	return digest, manifest.Config.Digest, nil
+}
+
+// Usage: your_docker.sh image <subcommand> ...
+func imageCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: image exists|prune ...")
+	}
+	switch args[0] {
+	case "exists":
+		return imageExistsCommand(args[1:])
+	case "prune":
+		return imagePruneCommand(args[1:])
+	default:
+		return fmt.Errorf("Unknown image command: %s", args[0])
+	}
+}
+
+// Usage: your_docker.sh image exists <image>
+// exits with 0 when the tag exists in the registry and 1 when it doesn't, in
+// offline mode the local image store is checked instead
+func imageExistsCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: image exists <image>")
+	}
+
+	ref, err := parseReference(args[0])
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	if offline {
+		store, err := openImageStore()
+		if err != nil {
+			return fmt.Errorf("Error opening image store: %v", err)
+		}
+		_, err = localImage(store, ref)
+		if err != nil && !errors.Is(err, errNotInStore) {
+			return err
+		}
+		exists = err == nil
+	} else {
+		reg, err := connectRegistry(ref, "pull")
+		if err != nil {
+			return err
+		}
+		exists, err = reg.manifestExists(ref.path, ref.identifier())
+		if err != nil {
+			return err
+		}
+	}
+
+	if !exists {
+		os.Exit(1)
+	}
+	return nil
+}
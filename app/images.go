@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// localImageInfo is an image in the store as listed by `images`
+type localImageInfo struct {
+	repository string
+	tag        string
+	digest     string
+	id         string
+	created    time.Time
+	size       int64
+}
+
+// The below function lists every reference saved in the image store along with
+// the config and size of the image it points to
+func (s *imageStore) listImages() ([]localImageInfo, error) {
+	repositories, err := s.loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []localImageInfo{}
+	for key, digest := range repositories {
+		ref, err := parseReference(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid reference %q in the image store: %v", key, err)
+		}
+		manifest, err := s.readManifest(digest)
+		if err != nil {
+			// a half removed image, it's not usable so it's not listed
+			continue
+		}
+		info := localImageInfo{repository: ref.name(), tag: ref.tag, digest: digest, id: manifest.Config.Digest}
+		if config, err := s.readConfig(manifest.Config.Digest); err == nil {
+			info.created = config.Created
+		}
+		info.size = manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			info.size += layer.Size
+		}
+		images = append(images, info)
+	}
+
+	// newest first, like docker
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].created.Equal(images[j].created) {
+			return images[i].created.After(images[j].created)
+		}
+		if images[i].repository != images[j].repository {
+			return images[i].repository < images[j].repository
+		}
+		return images[i].tag < images[j].tag
+	})
+	return images, nil
+}
+
+// Usage: your_docker.sh images [-q] [--digests]
+func imagesCommand(args []string) error {
+	flags := flag.NewFlagSet("images", flag.ContinueOnError)
+	quiet := flags.Bool("q", false, "only show image IDs")
+	digests := flags.Bool("digests", false, "show manifest digests")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: images [-q] [--digests]")
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	images, err := store.listImages()
+	if err != nil {
+		return err
+	}
+
+	if *quiet {
+		seen := map[string]bool{}
+		for _, image := range images {
+			if !seen[image.id] {
+				seen[image.id] = true
+				fmt.Println(shortID(image.id))
+			}
+		}
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	if *digests {
+		fmt.Fprintln(writer, "REPOSITORY\tTAG\tDIGEST\tIMAGE ID\tCREATED\tSIZE")
+	} else {
+		fmt.Fprintln(writer, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+	}
+	for _, image := range images {
+		tag := image.tag
+		if tag == "" {
+			tag = "<none>"
+		}
+		if *digests {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", image.repository, tag, image.digest, shortID(image.id), timeAgo(image.created), formatSize(image.size))
+		} else {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", image.repository, tag, shortID(image.id), timeAgo(image.created), formatSize(image.size))
+		}
+	}
+	return writer.Flush()
+}
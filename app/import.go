@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Usage: your_docker.sh import [-m message] <file|-> <image>
+// the tarball (like the ones export writes, compressed or not) becomes the
+// single layer of a new image with an empty config, "-" reads it from stdin
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	message := flags.String("m", "", "commit message for the imported image")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: import [-m message] <file|-> <image>")
+	}
+	target, err := parseReference(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if target.digest != "" {
+		return fmt.Errorf("Refusing to create a tag with a digest reference: %s", flags.Arg(1))
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	uncompressed, err := decompress(r)
+	if err != nil {
+		return err
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	layer, diffID, err := store.createLayer(func(w io.Writer) error {
+		// the whole tarball is read through so a file that isn't one is refused
+		tee := io.TeeReader(uncompressed, w)
+		tr := tar.NewReader(tee)
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("Invalid tarball: %v", err)
+			}
+		}
+		_, err := io.Copy(io.Discard, tee)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error importing %s: %v", flags.Arg(0), err)
+	}
+
+	now := time.Now().UTC()
+	config := &ImageConfig{Architecture: runtime.GOARCH, OS: "linux", Created: now}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{diffID}
+	config.History = []HistoryEntry{{Created: now, CreatedBy: "import " + flags.Arg(0), Comment: *message}}
+	digest, id, err := store.writeImage([]Descriptor{layer}, config)
+	if err != nil {
+		return err
+	}
+	err = store.setTag(target.String(), digest)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
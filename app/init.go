@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+// initConfig is what the container init needs to start the container process,
+// run sends it through a pipe
+type initConfig struct {
+	Rootfs  string              `json:"rootfs"`
+	Args    []string            `json:"args"`
+	Env     []string            `json:"env"`
+	WorkDir string              `json:"workDir"`
+	User    *syscall.Credential `json:"user,omitempty"`
+	ShmSize int64               `json:"shmSize"` // the size of /dev/shm in bytes
+	Mounts  []containerMount    `json:"mounts,omitempty"`
+	// whether the container gets a user namespace, execContainer creates it
+	UserNamespace bool           `json:"userNamespace"`
+	Network       *networkConfig `json:"network,omitempty"`
+	// the network namespace of another container to join, e.g. /proc/<pid>/ns/net
+	NetworkNamespace string `json:"networkNamespace,omitempty"`
+	// the hostname set in the uts namespace of the container
+	Hostname string `json:"hostname,omitempty"`
+	// the ipc namespace of the host or of another container to join, e.g.
+	// /proc/<pid>/ns/ipc, the container gets one of its own otherwise
+	HostIPC      bool   `json:"hostIPC,omitempty"`
+	IPCNamespace string `json:"ipcNamespace,omitempty"`
+	// the /dev/shm to bind mount instead of a tmpfs of its own, the one of the
+	// ipc namespace joined
+	ShmSource string `json:"shmSource,omitempty"`
+	// whether the container gets a cgroup namespace, its cgroup is the root
+	// of the cgroups it sees
+	CgroupNamespace bool `json:"cgroupNamespace,omitempty"`
+	// the offsets of the clocks of the time namespace of the container, it
+	// only gets one with them
+	ClockOffsets []clockOffset `json:"clockOffsets,omitempty"`
+	// the seccomp filter loaded before executing the container process
+	Seccomp []syscall.SockFilter `json:"seccomp,omitempty"`
+	// the capabilities the container process keeps, nil for every one
+	Capabilities []string `json:"capabilities"`
+	// whether the container process may not gain privileges it doesn't have
+	NoNewPrivileges bool `json:"noNewPrivileges,omitempty"`
+	// the AppArmor profile the container process is confined by
+	AppArmorProfile string `json:"appArmorProfile,omitempty"`
+	// the SELinux labels of the container process and of its tmpfs
+	ProcessLabel string `json:"processLabel,omitempty"`
+	MountLabel   string `json:"mountLabel,omitempty"`
+	// whether the paths of /proc and /sys about the host are masked or read
+	// only, see maskSystemPaths
+	MaskSystemPaths bool `json:"maskSystemPaths,omitempty"`
+	// whether the root file system is read only, with a tmpfs on /tmp and /run
+	ReadonlyRootfs bool `json:"readonlyRootfs,omitempty"`
+	// whether the init stays PID 1 of the container, see reapContainer
+	Init bool `json:"init,omitempty"`
+}
+
+// the files execContainer gives the container init next to stdin, stdout and
+// stderr: the pipe its config comes through and the one it reports the error
+// through when the container process can't be started
+const (
+	initConfigFd = 3
+	initErrorFd  = 4
+)
+
+// Usage: your_docker.sh init
+// not meant to be run by hand: execContainer starts us with it in the new
+// namespaces of a container. We become the container process, which that way
+// is the first process of its pid namespace
+func initCommand(args []string) error {
+	var err error
+	if len(args) > 0 && args[0] == initReexecArg {
+		err = waitIDMappings()
+	} else {
+		err = containerInit()
+	}
+	// we are still here, the container process could not be started
+	errorPipe := os.NewFile(initErrorFd, "error")
+	fmt.Fprint(errorPipe, err)
+	errorPipe.Close()
+	return exitStatus(127)
+}
+
+// initReexecArg tells the container init its user namespace gets mappings
+// from newuidmap and newgidmap after it started
+const initReexecArg = "--reexec"
+
+// The below function waits for the mappings of the user namespace and executes
+// the container init again. The capabilities in a user namespace are given at
+// exec time to a process that is root there, we weren't yet when started.
+// execContainer writes a newline ahead of the config once it is done
+func waitIDMappings() error {
+	buf := make([]byte, 1)
+	n, err := syscall.Read(initConfigFd, buf)
+	if err != nil || n != 1 {
+		return fmt.Errorf("Error waiting for the user namespace mappings: %v", err)
+	}
+	return syscall.Exec("/proc/self/exe", []string{os.Args[0], "init"}, os.Environ())
+}
+
+// The below function sets the container up from the inside and executes the
+// container process, it only returns when that fails
+func containerInit() error {
+	// neither pipe must be left open in the container process, the error pipe
+	// closing is how execContainer knows the process started
+	syscall.CloseOnExec(initConfigFd)
+	syscall.CloseOnExec(initErrorFd)
+	var config initConfig
+	err := json.NewDecoder(os.NewFile(initConfigFd, "config")).Decode(&config)
+	if err != nil {
+		return fmt.Errorf("Error reading the container config: %v", err)
+	}
+	if len(config.Args) == 0 {
+		return fmt.Errorf("No command to run")
+	}
+
+	// the mount namespace is a copy of the one of run. Mounts made in the
+	// container must not propagate back to it, the ones the host makes and
+	// removes still reach the container so it doesn't keep them busy
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, "")
+	if err != nil {
+		return fmt.Errorf("Error making mounts slaves: %v", err)
+	}
+	// the cgroup namespace is made here and not when we were started, run puts
+	// us in the cgroup of the container before sending the config
+	if config.CgroupNamespace {
+		runtime.LockOSThread()
+		err = syscall.Unshare(cloneNewCgroup)
+		if err != nil {
+			return fmt.Errorf("Error creating the cgroup namespace: %v", err)
+		}
+	}
+	if len(config.ClockOffsets) > 0 {
+		runtime.LockOSThread()
+		err = unshareTime(config.ClockOffsets)
+		if err != nil {
+			return err
+		}
+	}
+	if config.NetworkNamespace != "" {
+		// only this thread joins it, it's the one executing the container process
+		runtime.LockOSThread()
+		err = setns(config.NetworkNamespace, syscall.CLONE_NEWNET)
+		if err != nil {
+			return err
+		}
+	}
+	if config.IPCNamespace != "" {
+		runtime.LockOSThread()
+		err = setns(config.IPCNamespace, syscall.CLONE_NEWIPC)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Network != nil {
+		err = configureNetwork(config.Network)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Hostname != "" {
+		err = syscall.Sethostname([]byte(config.Hostname))
+		if err != nil {
+			return fmt.Errorf("Error setting the hostname: %v", err)
+		}
+	}
+	err = mountContainerFilesystems(&config)
+	if err != nil {
+		return err
+	}
+	err = pivotRoot(config.Rootfs)
+	if err != nil {
+		return err
+	}
+	if config.ReadonlyRootfs {
+		err = remountRootReadonly()
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Chdir(config.WorkDir)
+	if err != nil {
+		return err
+	}
+
+	// with no_new_privs a process may only change to a label or profile its
+	// own bounds
+	if config.ProcessLabel != "" {
+		runtime.LockOSThread()
+		err = applyProcessLabel(config.ProcessLabel)
+		if err != nil {
+			return err
+		}
+	}
+	if config.AppArmorProfile != "" {
+		runtime.LockOSThread()
+		err = applyAppArmorProfile(config.AppArmorProfile)
+		if err != nil {
+			return err
+		}
+	}
+	if config.NoNewPrivileges {
+		runtime.LockOSThread()
+		err = setNoNewPrivileges()
+		if err != nil {
+			return err
+		}
+	}
+	// the filter goes on before the user is switched, a user other than root
+	// may not load one without no_new_privs. It only allows what comes next
+	if len(config.Seccomp) > 0 {
+		runtime.LockOSThread()
+		err = loadSeccomp(config.Seccomp)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the bounding set goes before the user is switched too, CAP_SETPCAP is
+	// needed for it
+	if config.Capabilities != nil {
+		runtime.LockOSThread()
+		err = dropBoundingSet(config.Capabilities)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the groups go first, without root we can't change them anymore
+	if config.User != nil {
+		groups := []int{}
+		for _, group := range config.User.Groups {
+			groups = append(groups, int(group))
+		}
+		// a user namespace of a user keeps the groups it was given
+		if setgroupsAllowed() {
+			err = syscall.Setgroups(groups)
+		}
+		if err == nil {
+			err = syscall.Setgid(int(config.User.Gid))
+		}
+		if err == nil {
+			err = syscall.Setuid(int(config.User.Uid))
+		}
+		if err != nil {
+			return fmt.Errorf("Error switching to user %d:%d: %v", config.User.Uid, config.User.Gid, err)
+		}
+	}
+	// a user other than root lost its capabilities switching to it
+	if config.Capabilities != nil && (config.User == nil || config.User.Uid == 0) {
+		err = setCapabilities(config.Capabilities)
+		if err != nil {
+			return err
+		}
+	}
+
+	path, err := lookPath(config.Args[0], config.Env)
+	if err != nil {
+		return err
+	}
+	if config.Init {
+		return reapContainer(path, config.Args, config.Env)
+	}
+	return syscall.Exec(path, config.Args, config.Env)
+}
+
+// The below function starts the container process as a child and stays PID 1
+// of the container, for --init: most programs make poor PID 1s, they don't
+// reap the orphans that end up theirs and ignore the signals they don't
+// handle. The signals we get are forwarded to the container process, the
+// zombies are reaped, and we exit with the status of the container process
+// once it exited, which takes down what is left in the container. The
+// container process is forked from this thread, it has everything the thread
+// was given: the security settings and the user. It only returns when the
+// container process could not be started
+func reapContainer(path string, args, env []string) error {
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	pid, err := syscall.ForkExec(path, args, &syscall.ProcAttr{Env: env, Files: []uintptr{0, 1, 2}})
+	if err != nil {
+		return fmt.Errorf("Error starting %s: %v", path, err)
+	}
+	// the container process runs, execContainer learns it from the error pipe
+	syscall.Close(initErrorFd)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+		// the go runtime preempts its goroutines with SIGURG
+		case syscall.SIGURG:
+			continue
+		default:
+			syscall.Kill(pid, sig.(syscall.Signal))
+			continue
+		}
+		for {
+			var status syscall.WaitStatus
+			reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || reaped <= 0 {
+				break
+			}
+			if reaped != pid {
+				continue
+			}
+			if status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			os.Exit(status.ExitStatus())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ImageInspect is what `inspect` prints for an image, the config of the image
+// along with the references the store has for it. Field names are the ones
+// available to --format
+type ImageInspect struct {
+	Id           string
+	RepoTags     []string
+	RepoDigests  []string
+	Created      time.Time
+	Architecture string
+	Os           string
+	Size         int64
+	Config       ContainerConfig
+	RootFS       struct {
+		Type   string
+		Layers []string
+	}
+}
+
+// inspectFuncs are the functions --format templates can use besides the builtins
+var inspectFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// Usage: your_docker.sh inspect [--format template] <image|id> ...
+func inspectCommand(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	format := flags.String("format", "", "format the output using a Go template, e.g. {{json .Config.Env}}")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: inspect [--format template] <image|id> ...")
+	}
+
+	var tmpl *template.Template
+	if *format != "" {
+		tmpl, err = template.New("format").Funcs(inspectFuncs).Parse(*format)
+		if err != nil {
+			return fmt.Errorf("Invalid format: %v", err)
+		}
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	images := []*ImageInspect{}
+	for _, name := range flags.Args() {
+		image, err := store.inspectImage(name)
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+	}
+
+	if tmpl != nil {
+		for _, image := range images {
+			err = tmpl.Execute(os.Stdout, image)
+			if err != nil {
+				return fmt.Errorf("Error executing format: %v", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+	data, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	return printJSON(data)
+}
+
+// The below function collects what is known about the image name (a reference
+// or an image id) from its manifest, its config and the references to it
+func (s *imageStore) inspectImage(name string) (*ImageInspect, error) {
+	repositories, err := s.loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.matchImage(repositories, name)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := s.readManifest(repositories[keys[0]])
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest of %s: %v", name, err)
+	}
+	config, err := s.readConfig(manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading image config of %s: %v", name, err)
+	}
+
+	image := &ImageInspect{
+		Id:           manifest.Config.Digest,
+		RepoTags:     []string{},
+		RepoDigests:  []string{},
+		Created:      config.Created,
+		Architecture: config.Architecture,
+		Os:           config.OS,
+		Size:         manifest.Config.Size,
+		Config:       config.Config,
+	}
+	image.RootFS.Type = config.RootFS.Type
+	image.RootFS.Layers = config.RootFS.DiffIDs
+	for _, layer := range manifest.Layers {
+		image.Size += layer.Size
+	}
+
+	// every reference to a manifest of the same config is the same image
+	digests := map[string]bool{}
+	for key, digest := range repositories {
+		other, err := s.readManifest(digest)
+		if err != nil || other.Config.Digest != image.Id {
+			continue
+		}
+		ref, err := parseReference(key)
+		if err != nil {
+			continue
+		}
+		if ref.tag != "" {
+			image.RepoTags = append(image.RepoTags, ref.name()+":"+ref.tag)
+		}
+		repoDigest := ref.name() + "@" + digest
+		if !digests[repoDigest] {
+			digests[repoDigest] = true
+			image.RepoDigests = append(image.RepoDigests, repoDigest)
+		}
+	}
+	sort.Strings(image.RepoTags)
+	sort.Strings(image.RepoDigests)
+	return image, nil
+}
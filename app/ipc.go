@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Containers get an IPC namespace of their own so the System V shared memory,
+// semaphores and message queues of one are not the ones of another or of the
+// host, and a /dev/shm of their own for the POSIX ones. --ipc shares them:
+// host gives the ones of the host, container:<id> the ones of a container run
+// with --ipc shareable. The /dev/shm of a shareable container is a tmpfs run
+// mounts on the host under the container directory, a mount of the mount
+// namespace of a container can't be bind mounted in the one of another
+
+// The below function parses the value of --ipc: private, the default,
+// shareable, host or container:<id>, whose id is made the full one
+func parseIpcMode(value string) (string, error) {
+	if ref := strings.TrimPrefix(value, "container:"); ref != value {
+		container, err := findContainer(ref)
+		if err != nil {
+			return "", err
+		}
+		return "container:" + container.Id, nil
+	}
+	switch value {
+	case "":
+		return "private", nil
+	case "private", "shareable", "host":
+		return value, nil
+	}
+	return "", fmt.Errorf("Invalid --ipc %q: expected private, shareable, host or container:<id>", value)
+}
+
+// The below function sets the IPC namespace and the /dev/shm the container
+// init makes or joins for the IPC mode of the container. Like the network
+// namespace of a container, its IPC namespace belongs to its user namespace
+// and only root on the host may join it from another one: the container goes
+// without a user namespace of its own
+func setupIPC(container *Container, process *initConfig) error {
+	if container.IpcMode == "host" {
+		process.HostIPC = true
+		process.ShmSource = "/dev/shm"
+		return nil
+	}
+	if container.IpcMode == "shareable" && !rootless {
+		process.ShmSource = shmDir(container.Id)
+		return nil
+	}
+	id := strings.TrimPrefix(container.IpcMode, "container:")
+	if id == container.IpcMode {
+		return nil
+	}
+	target, err := findContainer(id)
+	if err != nil {
+		return err
+	}
+	if !target.State.Running || target.State.Pid == 0 || !processExists(target.State.Pid) {
+		return fmt.Errorf("Cannot join the IPC namespace of container %s: it is not running", target.Id[:12])
+	}
+	switch target.IpcMode {
+	case "host":
+		process.HostIPC = true
+		process.ShmSource = "/dev/shm"
+		return nil
+	case "shareable":
+	default:
+		return fmt.Errorf("Cannot join the IPC namespace of container %s: it is not shareable, run it with --ipc shareable", target.Id[:12])
+	}
+	if rootless {
+		return fmt.Errorf("Cannot join the IPC namespace of container %s: it needs root", target.Id[:12])
+	}
+	if _, err := os.Stat(shmDir(target.Id)); err != nil {
+		return fmt.Errorf("Cannot join the IPC namespace of container %s: its /dev/shm is not shared", target.Id[:12])
+	}
+	process.IPCNamespace = fmt.Sprintf("/proc/%d/ns/ipc", target.State.Pid)
+	process.ShmSource = shmDir(target.Id)
+	process.UserNamespace = false
+	return nil
+}
+
+// This function returns where the /dev/shm of a shareable container is mounted
+func shmDir(id string) string {
+	return filepath.Join(containerDir(id), "shm")
+}
+
+// The below function mounts the /dev/shm of a shareable container of the size
+// on the host, run does it before it isolates itself so the containers joining
+// it see it too
+func mountShm(id string, size int64) error {
+	dir := shmDir(id)
+	err := os.Mkdir(dir, 01777)
+	if err == nil {
+		err = syscall.Mount("shm", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, fmt.Sprintf("mode=1777,size=%d", size))
+	}
+	if err != nil {
+		return fmt.Errorf("Error mounting /dev/shm: %v", err)
+	}
+	return nil
+}
+
+// The below function unmounts the /dev/shm of a shareable container. The
+// thread of run is in a mount namespace of its own by then, with a copy of the
+// mount unless the host propagated the unmount. The one of the host is
+// unmounted by a goroutine, which is on another thread, one of the host
+func unmountShm(id string) {
+	syscall.Unmount(shmDir(id), syscall.MNT_DETACH)
+	done := make(chan error)
+	go func() {
+		done <- syscall.Unmount(shmDir(id), syscall.MNT_DETACH)
+	}()
+	if err := <-done; err != nil {
+		fmt.Fprintf(os.Stderr, "[Warning] Error unmounting %s: %v\n", shmDir(id), err)
+	}
+}
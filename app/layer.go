@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Extracted layers are kept in the image store next to the blobs, keyed by
+// their diff id (the digest of the uncompressed layer) so that a layer shared
+// by several images, like a common base image, is only ever extracted once:
+//
+//	<root>/layers/sha256/<hex>   the content of the layer
+//	<root>/layers/tmp-*          layers being extracted
+
+// The below function returns the directory of an extracted layer. Diff ids
+// come from image configs, anything but a sha256 digest gets no path so it
+// never leads out of the store
+func (s *imageStore) layerPath(diffID string) string {
+	if !sha256Regexp.MatchString(diffID) {
+		return ""
+	}
+	return filepath.Join(s.root, "layers", "sha256", strings.TrimPrefix(diffID, "sha256:"))
+}
+
+// This function reports whether the layer has already been extracted
+func (s *imageStore) hasLayer(diffID string) bool {
+	path := s.layerPath(diffID)
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// The below function extracts the layer blob into the layer store unless a
+// layer with the same diff id is already there, and returns its directory.
+// The layer is extracted into a staging directory and only renamed into place
+// once it's complete and matches its diff id, so an interrupted or failed
+// extraction never leaves a half applied layer behind to be reused
+func (s *imageStore) extractLayer(blob Descriptor, diffID string) (string, error) {
+	dir := s.layerPath(diffID)
+	if dir == "" {
+		return "", fmt.Errorf("Invalid diff id %q", diffID)
+	}
+	if s.hasLayer(diffID) {
+		return dir, nil
+	}
+	err := os.MkdirAll(filepath.Dir(dir), 0700)
+	if err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(filepath.Join(s.root, "layers"), "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	// MkdirTemp makes it private, the root of a layer is like any directory
+	err = os.Chmod(staging, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	err = extractTar(s.blobPath(blob.Digest), staging, diffID)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(staging, dir)
+	// another run extracted the same layer in the meantime
+	if err != nil && s.hasLayer(diffID) {
+		return dir, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// The below function builds the root file system of a container in dest by
+// copying the layers of the image on top of each other, each layer is
+// extracted into the layer store first if it's the first image using it
+func (s *imageStore) assembleRootfs(manifest *ManifestResponse, config *ImageConfig, dest string) error {
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("Image %s has %d layers but %d diff ids", manifest.Config.Digest, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	for i, layer := range manifest.Layers {
+		dir, err := s.extractLayer(layer, config.RootFS.DiffIDs[i])
+		if err != nil {
+			return fmt.Errorf("Error extracting layer %s: %v", layer.Digest, err)
+		}
+		err = copyLayer(dir, dest)
+		if err != nil {
+			return fmt.Errorf("Error applying layer %s: %v", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// whiteout markers of the OCI layer format: ".wh.<name>" says <name> was deleted
+// by the layer and ".wh..wh..opq" that the directory replaces the one below it.
+// Extracted layers keep them in the overlayfs format instead when they can, see
+// writeWhiteout
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// The below function copies the content of an extracted layer into dest,
+// keeping owners, modes, times, extended attributes, hard links, symlinks and
+// devices. The whiteouts of the layer delete what the layers below put in dest
+// and are not copied themselves. The files go through a tar stream so that
+// untar writes them, with the same metadata and symlink checks as extraction
+func copyLayer(src, dest string) error {
+	markers, err := applyWhiteouts(src, dest)
+	if err != nil {
+		return err
+	}
+	whiteouts := map[string]bool{}
+	for _, marker := range markers {
+		whiteouts[marker] = true
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		links := map[uint64]string{}
+		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			// opaque directories are copied, without the xattr marking them
+			if whiteouts[rel] && !info.IsDir() {
+				return nil
+			}
+			return writeTarEntry(tw, path, filepath.ToSlash(rel), info, links)
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err = untar(pr, dest)
+	pr.CloseWithError(err)
+	return err
+}
+
+// The below function deletes from dest what the whiteouts of the layer in src
+// remove: the files they name and the whole content of opaque directories.
+// Both the OCI markers and the overlayfs whiteouts (0/0 character devices and
+// the opaque xattr) are understood. It returns the markers to drop once copied,
+// relative to the layer root
+func applyWhiteouts(src, dest string) ([]string, error) {
+	markers := []string{}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		var deleted, opaque string
+		name := info.Name()
+		switch {
+		case name == whiteoutOpaque:
+			markers = append(markers, rel)
+			opaque = filepath.Dir(rel)
+		case strings.HasPrefix(name, whiteoutPrefix):
+			markers = append(markers, rel)
+			deleted = filepath.Join(filepath.Dir(rel), strings.TrimPrefix(name, whiteoutPrefix))
+		case isOverlayWhiteout(info):
+			markers = append(markers, rel)
+			deleted = rel
+		case info.IsDir() && isOverlayOpaque(path):
+			markers = append(markers, rel)
+			opaque = rel
+		default:
+			return nil
+		}
+
+		// a path going through a symlink of the lower layers could point
+		// anywhere on the host, there is nothing of the rootfs to delete there
+		if opaque != "" {
+			if !isPlainPath(dest, opaque) {
+				return nil
+			}
+			children, err := os.ReadDir(filepath.Join(dest, opaque))
+			if err != nil {
+				return nil
+			}
+			for _, child := range children {
+				err = os.RemoveAll(filepath.Join(dest, opaque, child.Name()))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if !isPlainPath(dest, filepath.Dir(deleted)) {
+			return nil
+		}
+		return os.RemoveAll(filepath.Join(dest, deleted))
+	})
+	return markers, err
+}
+
+// This function reports whether every directory on the way from root to rel is
+// a real directory and not a symlink
+func isPlainPath(root, rel string) bool {
+	path := root
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		if component == "." || component == "" {
+			continue
+		}
+		path = filepath.Join(path, component)
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// The below function removes the extracted layers no image in repositories
+// uses anymore, it returns their diff ids and the space they took
+func (s *imageStore) deleteUnusedLayers(repositories map[string]string) ([]string, int64, error) {
+	used := map[string]bool{}
+	for _, digest := range repositories {
+		manifest, err := s.readManifest(digest)
+		if err != nil {
+			continue
+		}
+		config, err := s.readConfig(manifest.Config.Digest)
+		if err != nil {
+			continue
+		}
+		for _, diffID := range config.RootFS.DiffIDs {
+			used[diffID] = true
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.root, "layers", "sha256"))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	deleted := []string{}
+	reclaimed := int64(0)
+	for _, entry := range entries {
+		diffID := "sha256:" + entry.Name()
+		if used[diffID] || s.layerPath(diffID) == "" {
+			continue
+		}
+		size := dirSize(s.layerPath(diffID))
+		err = os.RemoveAll(s.layerPath(diffID))
+		if err != nil {
+			return deleted, reclaimed, err
+		}
+		deleted = append(deleted, diffID)
+		reclaimed += size
+	}
+
+	// staging directories are given an hour, they could belong to a run in progress
+	staging, _ := filepath.Glob(filepath.Join(s.root, "layers", "tmp-*"))
+	for _, dir := range staging {
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) < time.Hour {
+			continue
+		}
+		size := dirSize(dir)
+		if os.RemoveAll(dir) == nil {
+			reclaimed += size
+		}
+	}
+	return deleted, reclaimed, nil
+}
+
+// This function adds up the size of the regular files under dir
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// The below function adds a layer to the store, write gets the uncompressed
+// layer tar. The layer is saved as a gzip compressed blob, its descriptor
+// (without media type) and diff id are returned
+func (s *imageStore) createLayer(write func(w io.Writer) error) (Descriptor, string, error) {
+	tmpFile, err := os.CreateTemp(s.root, "layer-")
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := sha256.New()
+	gz := gzip.NewWriter(tmpFile)
+	err = write(io.MultiWriter(gz, hash))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	diffID := fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	digest, size, err := s.importLayer(tmpFile.Name(), diffID)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	return Descriptor{Digest: digest, Size: size}, diffID, nil
+}
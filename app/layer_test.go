@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The below function creates the files of a lower layer under root, the
+// names ending with a slash are directories and the values of the others
+// their content, or the target of a symlink when prefixed with "->"
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := files[name]
+		switch {
+		case name[len(name)-1] == '/':
+			err = os.MkdirAll(path, 0755)
+		case len(content) > 2 && content[:2] == "->":
+			err = os.Symlink(content[2:], path)
+		default:
+			err = os.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWhiteouts(t *testing.T) {
+	dir := t.TempDir()
+	lower := filepath.Join(dir, "lower")
+	layer := filepath.Join(dir, "layer")
+	outside := filepath.Join(dir, "outside")
+	writeTestFiles(t, dir, map[string]string{
+		"lower/keep":         "keep",
+		"lower/gone":         "gone",
+		"lower/gone-dir/a":   "a",
+		"lower/dir/old":      "old",
+		"lower/dir/sub/deep": "deep",
+		"lower/link":         "->" + outside,
+		"layer/":             "",
+		"outside/victim":     "victim",
+	})
+
+	err := untar(testTar(t,
+		testEntry{name: ".wh.gone", typeflag: tar.TypeReg},
+		testEntry{name: ".wh.gone-dir", typeflag: tar.TypeReg},
+		testEntry{name: "dir/", typeflag: tar.TypeDir},
+		testEntry{name: "dir/.wh..wh..opq", typeflag: tar.TypeReg},
+		testEntry{name: "dir/new", typeflag: tar.TypeReg, content: "new"},
+		// a whiteout under a symlink of the lower layer must not delete
+		// what it points to
+		testEntry{name: "link/.wh.victim", typeflag: tar.TypeReg},
+		testEntry{name: "missing/.wh.file", typeflag: tar.TypeReg},
+	), layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the markers are kept in the overlayfs format when we may create it
+	if info, err := os.Lstat(filepath.Join(layer, "gone")); err == nil {
+		if !isOverlayWhiteout(info) {
+			t.Errorf("the whiteout of gone is a %v, want a 0/0 character device", info.Mode())
+		}
+		if !isOverlayOpaque(filepath.Join(layer, "dir")) {
+			t.Errorf("dir is not marked opaque")
+		}
+	} else if _, err := os.Lstat(filepath.Join(layer, ".wh.gone")); err != nil {
+		t.Errorf("the layer has no whiteout for gone: %v", err)
+	}
+
+	markers, err := applyWhiteouts(layer, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(markers) != 5 {
+		t.Errorf("applyWhiteouts returned the markers %q, want 5 of them", markers)
+	}
+
+	for _, path := range []string{"keep", "dir", "link"} {
+		if _, err := os.Lstat(filepath.Join(lower, path)); err != nil {
+			t.Errorf("%s was deleted: %v", path, err)
+		}
+	}
+	for _, path := range []string{"gone", "gone-dir", "dir/old", "dir/sub"} {
+		if _, err := os.Lstat(filepath.Join(lower, path)); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", path)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "victim")); err != nil {
+		t.Errorf("a whiteout deleted a file outside of the rootfs: %v", err)
+	}
+}
+
+func TestIsPlainPath(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"usr/lib/file": "file",
+		"lib":          "->usr/lib",
+		"etc":          "->/etc",
+	})
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{".", true},
+		{"usr", true},
+		{"usr/lib", true},
+		{"lib", false},
+		{"etc", false},
+		{"usr/lib/file", false},
+		{"usr/missing", false},
+	}
+	for _, test := range tests {
+		if got := isPlainPath(root, test.rel); got != test.want {
+			t.Errorf("isPlainPath(%q) = %v, want %v", test.rel, got, test.want)
+		}
+	}
+}
+
+func TestCopyLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("owners and devices need root")
+	}
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "rootfs")
+	layer := filepath.Join(dir, "layer")
+	writeTestFiles(t, dir, map[string]string{
+		"rootfs/dir/old": "old",
+		"rootfs/gone":    "gone",
+		"rootfs/bin":     "bin",
+		"layer/":         "",
+	})
+
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 1000},
+		{Name: "dir/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "dir/new", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		{Name: ".wh.gone", Typeflag: tar.TypeReg, Mode: 0600},
+		// a directory replacing a file of a lower layer
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755, Uid: 0, Gid: 0, Size: 3, PAXRecords: map[string]string{paxXattrPrefix + "user.origin": "layer"}},
+		{Name: "bin/su-link", Typeflag: tar.TypeLink, Linkname: "bin/su"},
+		{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox", Uid: 1000, Gid: 1000},
+		{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0620, Uid: 1000, Gid: 100},
+	} {
+		header.ModTime = modTime
+		header.Format = tar.FormatPAX
+		err := tw.WriteHeader(header)
+		if err == nil && header.Size > 0 {
+			_, err = tw.Write([]byte("new"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err == nil {
+		err = untar(&buf, layer)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = copyLayer(layer, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		mode os.FileMode
+		uid  uint32
+		gid  uint32
+	}{
+		{"dir", os.ModeDir | 0750, 1000, 1000},
+		{"dir/new", 0644, 0, 0},
+		{"bin", os.ModeDir | 0755, 0, 0},
+		{"bin/su", os.ModeSetuid | 0755, 0, 0},
+		{"bin/sh", os.ModeSymlink | 0777, 1000, 1000},
+		{"null", os.ModeDevice | os.ModeCharDevice | 0666, 0, 0},
+		{"fifo", os.ModeNamedPipe | 0620, 1000, 100},
+	}
+	for _, test := range tests {
+		info, err := os.Lstat(filepath.Join(dest, test.path))
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if info.Mode() != test.mode || stat.Uid != test.uid || stat.Gid != test.gid {
+			t.Errorf("%s is %v %d:%d, want %v %d:%d", test.path, info.Mode(), stat.Uid, stat.Gid, test.mode, test.uid, test.gid)
+		}
+		if test.mode&os.ModeSymlink == 0 && !info.ModTime().Equal(modTime) {
+			t.Errorf("%s was modified at %v, want %v", test.path, info.ModTime(), modTime)
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, "bin/sh")); err != nil || target != "/bin/busybox" {
+		t.Errorf("bin/sh links to %q (%v), want /bin/busybox", target, err)
+	}
+	su, err := os.Stat(filepath.Join(dest, "bin/su"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Stat(filepath.Join(dest, "bin/su-link")); err != nil || !os.SameFile(su, link) {
+		t.Errorf("bin/su-link is not a hard link of bin/su: %v", err)
+	}
+	if stat := su.Sys().(*syscall.Stat_t); stat.Nlink != 2 {
+		t.Errorf("bin/su has %d links, want 2", stat.Nlink)
+	}
+	value := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(dest, "bin/su"), "user.origin", value)
+	if err != nil && err != syscall.ENOTSUP {
+		t.Errorf("bin/su has no xattr user.origin: %v", err)
+	} else if err == nil && string(value[:n]) != "layer" {
+		t.Errorf("bin/su has the xattr user.origin %q, want %q", value[:n], "layer")
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "null")); err == nil {
+		if major, minor := splitDev(uint64(info.Sys().(*syscall.Stat_t).Rdev)); major != 1 || minor != 3 {
+			t.Errorf("null is the device %d:%d, want 1:3", major, minor)
+		}
+	}
+
+	// the whiteouts apply to the rootfs and are not copied
+	for _, path := range []string{"gone", ".wh.gone", "dir/old", "dir/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); !os.IsNotExist(err) {
+			t.Errorf("%s is in the rootfs", path)
+		}
+	}
+	if isOverlayOpaque(filepath.Join(dest, "dir")) {
+		t.Errorf("dir is still marked opaque in the rootfs")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// lockFile records the manifest digest every image reference resolved to, so
+// that later pulls can be checked against it
+type lockFile struct {
+	path   string
+	locked bool
+	Images map[string]string `json:"images"`
+}
+
+// imageLock is set by --lockfile, nil when no lock file is used
+var imageLock *lockFile
+
+// This function loads the lock file at path, a missing file is an empty lock.
+// When locked is set the file is only checked and never written
+func openLockFile(path string, locked bool) (*lockFile, error) {
+	lock := &lockFile{path: path, locked: locked, Images: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if locked {
+			return nil, fmt.Errorf("Lock file %s does not exist", path)
+		}
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing lock file %s: %v", path, err)
+	}
+	if lock.Images == nil {
+		lock.Images = map[string]string{}
+	}
+	return lock, nil
+}
+
+// The below function checks the digest the reference resolved to against the
+// lock file, it only fails in locked mode
+func (l *lockFile) check(reference, digest string) error {
+	if l == nil || !l.locked {
+		return nil
+	}
+	locked, ok := l.Images[reference]
+	if !ok {
+		return fmt.Errorf("%s is not in lock file %s", reference, l.path)
+	}
+	if locked != digest {
+		return fmt.Errorf("%s resolved to %s but lock file %s has %s", reference, digest, l.path, locked)
+	}
+	return nil
+}
+
+// The below function records the digest the reference resolved to and saves the
+// lock file, nothing is written in locked mode
+func (l *lockFile) record(reference, digest string) error {
+	if l == nil || l.locked || l.Images[reference] == digest {
+		return nil
+	}
+	l.Images[reference] = digest
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := l.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.path)
+}
@@ -1,316 +1,267 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
-	"syscall"
-	"time"
 )
 
-var httpClient = &http.Client{
-	Timeout: 10 * time.Second,
-}
-
-type ManifestResponse struct {
-	SchemaVersion int    `json:"schemaVersion"`
-	MediaType     string `json:"mediaType"`
-	Config        struct {
-		MediaType string `json:"mediaType"`
-		Size      int    `json:"size"`
-		Digest    string `json:"digest"`
-	} `json:"config"`
-	Layers []struct {
-		MediaType string `json:"mediaType"`
-		Size      int    `json:"size"`
-		Digest    string `json:"digest"`
-	} `json:"layers"`
-}
-
-type TokenResponse struct {
-	Token       string    `json:"token"`
-	AccessToken string    `json:"access_token"`
-	ExpiresIn   int       `json:"expires_in"`
-	IssuedAt    time.Time `json:"issued_at"`
-}
-
-const (
-	getTokenURL       = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull"
-	getManifestURL    = "https://registry.hub.docker.com/v2/library/%s/manifests/%s"
-	getLayerURL       = "https://registry.hub.docker.com/v2/library/%s/blobs/%s"
-	contentTypeHeader = "application/vnd.docker.distribution.manifest.v2+json"
-)
+const usage = `Usage: your_docker.sh [options] <command> [arguments]
+
+Options:
+  --offline                     serve everything from the local image store, never touch the network
+  --max-concurrent-chunks <n>   parallel ranged requests per large blob (default 4)
+  --max-download-rate <size>    cap the total download bandwidth per second, e.g. 10m
+  --insecure-registry <host>    talk to the registry over plain http, can be given several times
+  --lockfile <path>             record the digest every pulled image resolved to
+  --locked                      fail when an image resolves to another digest than in the lock file
+  --data-root <dir>             where images and containers are kept (default /var/lib/mydocker,
+                                ~/.local/share/mydocker when not run as root)
+  --storage-driver <name>       overlay, fuse-overlayfs or vfs (default: the first one the system supports)
+  --bip <address/prefix>        address of the default bridge, its subnet is the one of containers
+                                (default 172.20.0.1/16)
+  --cgroup-driver <name>        cgroupfs, or systemd for scopes of systemd (default cgroupfs)
+
+Commands:
+  run [options] <image> [command] [arg1] [arg2] ...   run a command inside the image, or its default command
+      --pull=always|missing|never                     when to pull the image (default missing)
+      -u, --user <user>[:<group>]                     user of the container process, by name or id
+      --group-add <group>                             another group of the container process, by name or id
+      -e, --env KEY=value                             set an environment variable, KEY alone takes ours
+      --env-file <file>                               set the KEY=value or KEY lines of a file
+      --init                                          run an init as PID 1, forwarding signals and reaping zombies
+      --entrypoint <command>                          overwrite the default entrypoint of the image
+      --verify-key <key.pub>                          refuse images without a valid signature made with the key
+      --certificate-identity <id>                     refuse images without a valid keyless signature by id
+      --certificate-oidc-issuer <url>                 OIDC issuer keyless signatures have to come from
+      --certificate-chain <roots.pem>                 roots keyless signing certificates have to chain up to
+      --insecure-skip-verify                          run the image without checking its signature
+      --name <name>                                   name of the container, its containers on the network resolve it
+      -h, --hostname <name>                           hostname of the container (default its short id)
+      -m, --memory <size>                             memory limit of the container, e.g. 512m
+      --memory-swap <size>                            memory and swap limit, -1 for unlimited swap
+      --memory-swappiness <0-100>                     how eagerly memory is swapped, ignored on cgroup v2
+      --cpus <number>                                 number of cpus the container may use, e.g. 1.5
+      --cpu-period <us>, --cpu-quota <us>             cpu time the container may use every period
+      -c, --cpu-shares <weight>                       cpu weight against other containers (default 1024)
+      --cpuset-cpus <list>, --cpuset-mems <list>      cpus and memory nodes of the container, e.g. 0-3,5
+      --pids-limit <number>                           how many processes the container may have at once
+      --device-read-bps <device>:<size>               bytes a second the container may read from a device
+      --device-write-bps <device>:<size>              bytes a second the container may write to a device
+      --device-read-iops <device>:<number>            reads a second the container may make on a device
+      --device-write-iops <device>:<number>           writes a second the container may make on a device
+      --shm-size <size>                               size of /dev/shm, e.g. 1g (default 64m)
+      --read-only                                     read only root file system, with a tmpfs on /tmp and /run
+      --tmpfs <path>[:size=<size>,mode=<mode>]        mount a tmpfs, noexec, nosuid and nodev unless exec, suid or dev
+      -v, --volume <path>:<path>[:<options>]          bind mount a host path, ro, nosuid, nodev, z or Z to relabel it
+      -v, --volume <volume>:<path>[:<options>]        mount a volume, created when it doesn't exist
+      -v, --volume <path>                             mount an anonymous volume, like the VOLUME paths of the image
+      --volume-driver <driver>                        driver of the volumes created (default local)
+      --mount type=bind,src=<path>,dst=<path>[,ro]    bind mount a host path, nosuid, nodev, bind-propagation=r?private|r?slave
+      --mount ...,relabel=shared|private              give the source the SELinux label of the container
+      --mount type=volume,src=<volume>,dst=<path>     mount a volume
+      --ipc private|shareable|host|container:<id>     IPC namespace and /dev/shm (default private)
+      --cgroupns host|private                         cgroup namespace (default private on cgroup v2)
+      --cap-add <cap>, --cap-drop <cap>               capabilities added to or dropped from docker's, or ALL
+      --security-opt seccomp=unconfined               run without the default seccomp filter
+      --security-opt seccomp=<profile.json>           seccomp profile in the format of docker's instead
+      --security-opt no-new-privileges=false          let setuid programs gain privileges (default they can't)
+      --security-opt apparmor=<profile>               AppArmor profile instead of mydocker-default, or unconfined
+      --security-opt label=<option>                   SELinux label: user:, role:, type:, level:<level> or disable
+      --security-opt systempaths=unconfined           leave the paths of /proc and /sys about the host unmasked
+      --clock-offset monotonic|boottime=<duration>    time namespace with the clocks moved, e.g. boottime=4800h
+      --userns=host                                   no user namespace for the container, root only
+      --network bridge|host|none|container:<name|id>  network of the container (default bridge, host without root)
+      --network <network>                             connect the container to a network made with network create
+      --network-alias <alias>                         another name of the container on its network
+      --ip <address>, --ip6 <address>                 address of the container on its network, picked by default
+      --mac-address <address>                         MAC address of the container (default 02:42 and its IPv4 address)
+      --add-host <name>:<ip|host-gateway>             add a line to /etc/hosts, host-gateway is the host
+      --dns <ip>, --dns-search <domain>               name servers and search domains of the container
+      --dns-option <option>                           resolver options of the container, e.g. ndots:2
+      -p, --publish [[ip:][hostPort]:]port[/udp]      publish a port of the container on the host
+      -P, --publish-all                               publish every exposed port on a random host port
+      <image> can be docker-archive:<tar>[:ref], oci-archive:<tar>[:name] or oci:<dir>[:name]
+  build [-t name:tag] [-f Dockerfile] <context>       build an image from a Dockerfile
+      --build-arg NAME[=value]                        set a build argument, a name alone takes our value
+      --no-cache                                      run every instruction, without the build cache
+      --squash                                        flatten the image into a single layer
+      --output type=oci|docker|local,dest=<path>      write the image to a tarball or its files to a directory
+      --platform <os/arch[/variant]>                  build for another platform, RUN through qemu
+  commit [-m msg] [-a author] <container> <image>     create an image from the changes of a container
+      --squash                                        give the image a single layer with the whole file system
+  cp [-a] <container>:<path> <host path>              copy files out of a container
+  cp [-a] <host path> <container>:<path>              copy files into a container
+  diff <container>                                    list the files a container added (A), changed (C) or deleted (D)
+  export [-o file] <container>                        write the file system of a container to a tarball
+  rm [-v] <container> ...                             remove containers that exited, -v with their anonymous volumes
+  import [-m msg] <file|-> <image>                    create an image from a file system tarball
+  pull <image>                                        pull the image into the local image store
+  push <image>                                        push the image from the local image store to docker hub
+  images [-q] [--digests]                             list the images in the local image store
+  inspect [--format template] <image|id> ...          print the config and references of images as JSON
+  tag <image|id> <target image>                       add a reference to an image in the local image store
+  save [-o file] <image|id> ...                       save images to a docker-archive tarball
+      --format=docker-archive|oci|oci-dir             save an OCI layout tarball or directory instead
+  load [-i file|dir]                                  load images from a docker-archive or an OCI layout
+  history [--no-trunc] <image|id>                     show the instructions the image was built with
+  rmi [-f] <image|id> ...                             remove images and the layers no other image uses
+  tags [--page-size n] <image>                        list the tags of the image repository
+  search [--limit n] [--format template] <term>       search docker hub for images
+  manifest inspect [--verbose] <image>                print the manifest (or manifest list) of the image
+  image exists <image>                                exit with 0 if the image exists in the registry, 1 otherwise
+  image prune [-a] [--filter until=<duration>]        remove dangling (or with -a all) images and unused blobs
+  catalog [--insecure] [--page-size n] <registry>     list the repositories of a private registry
+  network create [options] <name>                     create a bridge network
+      --subnet <cidr>                                 subnet of the network (default a free one of 172.21-31.0.0/16),
+                                                      given twice for an IPv4 and an IPv6 one
+      --gateway <ip>                                  address of the bridge (default the first one of the subnet)
+      --ipv6                                          dual stack, with a random fdxx:xxxx:xxxx::/64 without an IPv6 --subnet
+      -o com.docker.network.bridge.name=<name>        name of the bridge interface (default br-<id>)
+  network ls [-q]                                     list the networks
+  network inspect <network> ...                       print networks and the containers connected to them as JSON
+  network rm <network> ...                            remove networks no container is connected to
+  volume create [-d driver] [-o key=value] [name]     create a volume, with the local driver or a volume plugin
+  volume ls [-q]                                      list the volumes
+  volume inspect <volume> ...                         print volumes as JSON
+  volume rm [-f] <volume> ...                         remove volumes no running container uses
+  artifacts ls <image>                                list the artifacts (SBOMs, signatures...) attached to the image
+  artifacts get [-o dir] <image> <digest>             download an artifact attached to the image
+`
+
+// offline is set by --offline, nothing is pulled and every image has to be in the store
+var offline bool
 
-// This function is used to get the token from docker hub
-func getToken(image string) (string, error) {
-	resp, err := httpClient.Get(fmt.Sprintf(getTokenURL, image))
-	if err != nil {
-		return "", err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Error getting token: %v", resp.Status)
-	}
-	defer resp.Body.Close()
-
-	var tokenResponse TokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
-	if err != nil {
-		return "", err
-	}
-
-	return tokenResponse.Token, nil
-}
-
-// This function is used to get the manifest from docker hub
-func getManifest(token, image, tag string) (*ManifestResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(getManifestURL, image, tag), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Set("Accept", contentTypeHeader)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Error getting manifest: %v", resp.Status)
-	}
-
-	defer resp.Body.Close()
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	var manifestResponse ManifestResponse
-	err = json.Unmarshal(bytes, &manifestResponse)
-	if err != nil {
-		return nil, err
-	}
-
-	return &manifestResponse, nil
-}
-
-// The below function will pull the first layer from manifest response and extract it to a tar file
-func pullLayer(token, image, digest string) (string, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(getLayerURL, image, digest), nil)
-	if err != nil {
-		fmt.Printf("Error creating request: %v\n", err)
-		return "", err
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-		return "", err
-	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Error getting layer: %v\n", resp.Status)
-		return "", fmt.Errorf("Error getting layer: %v", resp.Status)
-	}
-	defer resp.Body.Close()
-
-	// saving the layer to file
-	layerFile, err := os.Create(fmt.Sprintf("%s.tar.gz", digest[7:]))
-	if err != nil {
-		fmt.Printf("Error creating file: %v\n", err)
-		return "", err
-	}
-	defer layerFile.Close()
-	_, err = io.Copy(layerFile, resp.Body)
-	if err != nil {
-		fmt.Printf("Error copying file: %v\n", err)
-		return "", err
-	}
-
-	return layerFile.Name(), nil
-}
-
-// The below function will extract the tar file from src to directory dest
-func extractTar(src, dest string) error {
-	cmd := exec.Command("tar", "-xzf", src, "-C", dest)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error while applying layer: ", err)
-		os.Exit(1)
-	}
-	return nil
-}
-
-// The below function will extract image name and tag from the image string
-// example: ubuntu:latest will return "libary/ubuntu" and "latest"
-func parseImage(image string) (string, string) {
-	imageParts := strings.Split(image, ":")
-	if len(imageParts) == 1 {
-		return imageParts[0], "latest"
-	}
-	return imageParts[0], imageParts[1]
-}
-
-// Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...
 func main() {
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
-	imageName := os.Args[2]
-
-	// creating a new temporary directory
-	tempDir, err := os.MkdirTemp("", "my-docker")
-	if err != nil {
-		fmt.Printf("Error creating temporary directory: %v\n", err)
-		os.Exit(1)
+	flags := flag.NewFlagSet("your_docker.sh", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Print(usage) }
+	flags.BoolVar(&offline, "offline", false, "serve everything from the local image store")
+	flags.IntVar(&downloadConcurrency, "max-concurrent-chunks", downloadConcurrency, "parallel ranged requests per large blob")
+	maxDownloadRate := flags.String("max-download-rate", "", "cap the total download bandwidth per second")
+	flags.Var((*stringList)(&insecureRegistries), "insecure-registry", "talk to the registry over plain http")
+	lockPath := flags.String("lockfile", "", "record the digest every pulled image resolved to")
+	locked := flags.Bool("locked", false, "fail when an image resolves to another digest than in the lock file")
+	flags.StringVar(&dataRoot, "data-root", dataRoot, "where images and containers are kept")
+	flags.StringVar(&storageDriverName, "storage-driver", "", "driver building the root file system of containers")
+	flags.StringVar(&bridgeIP, "bip", "", "address and prefix length of the bridge of the default network")
+	flags.StringVar(&cgroupDriver, "cgroup-driver", cgroupDriver, "what creates the cgroups of containers, cgroupfs or systemd")
+	err := flags.Parse(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-	defer os.RemoveAll(tempDir) // clean up
-
-	// parse image and tag
-	image, tag := parseImage(imageName)
-
-	// get token
-	token, err := getToken(fmt.Sprintf("library/%s", image))
-	if err != nil {
-		fmt.Printf("Error getting token: %v\n", err)
+	if err != nil || flags.NArg() < 1 {
+		fmt.Print(usage)
 		os.Exit(1)
 	}
-	// get manifest
-	manifest, err := getManifest(token, image, tag)
-	if err != nil {
-		fmt.Printf("Error getting manifest: %v\n", err)
-		os.Exit(1)
-	}
-
-	// pull layers
-	layerNames := []string{}
-	for _, manifest := range manifest.Layers {
-		layerName, err := pullLayer(token, image, manifest.Digest)
+	if *maxDownloadRate != "" {
+		rate, err := parseSize(*maxDownloadRate)
 		if err != nil {
-			fmt.Printf("Error pulling layer: %v\n", err)
+			fmt.Printf("Error parsing --max-download-rate: %v\n", err)
 			os.Exit(1)
 		}
-		layerNames = append(layerNames, layerName)
+		downloadLimiter = newRateLimiter(rate)
 	}
-
-	// extract layers
-	for _, layerName := range layerNames {
-		err = extractTar(layerName, tempDir)
+	if cgroupDriver != "cgroupfs" && cgroupDriver != "systemd" {
+		fmt.Printf("Unknown cgroup driver %s, expected cgroupfs or systemd\n", cgroupDriver)
+		os.Exit(1)
+	}
+	if *locked && *lockPath == "" {
+		fmt.Println("--locked needs --lockfile")
+		os.Exit(1)
+	}
+	if *lockPath != "" {
+		imageLock, err = openLockFile(*lockPath, *locked)
 		if err != nil {
-			fmt.Printf("Error extracting layer: %v\n", err)
+			fmt.Println(err)
 			os.Exit(1)
 		}
 	}
-
-	// isolate file system
-	err = isolateFileSystem(tempDir)
-	if err != nil {
-		fmt.Printf("Error isolating file system: %v\n", err)
+	args := flags.Args()
+
+	switch args[0] {
+	case "run":
+		err = runCommand(args[1:])
+	case "build":
+		err = buildCommand(args[1:])
+	case "commit":
+		err = commitCommand(args[1:])
+	case "cp":
+		err = cpCommand(args[1:])
+	case "rm":
+		err = rmCommand(args[1:])
+	case "diff":
+		err = diffCommand(args[1:])
+	case "export":
+		err = exportCommand(args[1:])
+	case "import":
+		err = importCommand(args[1:])
+	case "pull":
+		err = pullCommand(args[1:])
+	case "push":
+		err = pushCommand(args[1:])
+	case "images":
+		err = imagesCommand(args[1:])
+	case "inspect":
+		err = inspectCommand(args[1:])
+	case "tag":
+		err = tagCommand(args[1:])
+	case "save":
+		err = saveCommand(args[1:])
+	case "load":
+		err = loadCommand(args[1:])
+	case "history":
+		err = historyCommand(args[1:])
+	case "rmi":
+		err = rmiCommand(args[1:])
+	case "tags":
+		err = tagsCommand(args[1:])
+	case "search":
+		err = searchCommand(args[1:])
+	case "manifest":
+		err = manifestCommand(args[1:])
+	case "image":
+		err = imageCommand(args[1:])
+	case "catalog":
+		err = catalogCommand(args[1:])
+	case "artifacts":
+		err = artifactsCommand(args[1:])
+	case "network":
+		err = networkCommand(args[1:])
+	case "volume":
+		err = volumeCommand(args[1:])
+	case "init":
+		// the container init, started by run and build and not by hand
+		err = initCommand(args[1:])
+	default:
+		fmt.Printf("Unknown command: %s\n", args[0])
+		fmt.Print(usage)
 		os.Exit(1)
 	}
-
-	// isolate process
-	err = isolateProcess()
-	if err != nil {
-		fmt.Printf("Error isolating process: %v\n", err)
-		os.Exit(1)
+	if errors.Is(err, flag.ErrHelp) {
+		// the flag package has already printed the usage of the command, -h
+		// asked for it so it's no failure, the same as the -h of main
+		os.Exit(0)
+	}
+	var status exitStatus
+	if errors.As(err, &status) {
+		os.Exit(int(status))
 	}
-
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	// we can also create new namespaces for the process
-	// cmd.SysProcAttr = &syscall.SysProcAttr{
-	// 	Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
-	// }
-	// instead of using unshare we can also use clone
-
-	err = cmd.Run()
 	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitError.ExitCode())
-		}
-		fmt.Printf("Err: %v", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
-
 }
 
-// This function isolates the process by creating new namespaces
-func isolateProcess() error {
-	// adding addtional namespace i.e., pid namespace, UTS namespace, mount namespace for more isolation
-	if syscall.Unshare(syscall.CLONE_NEWUTS|syscall.CLONE_NEWPID|syscall.CLONE_NEWNS) != nil {
-		return fmt.Errorf("Error unshareing")
-	}
-	return nil
-}
+// stringList is a flag that can be given several times, every value is appended
+type stringList []string
 
-// This was for final stage where we only needed to do chroot into directory
-func isolateFileSystem(tempDir string) error {
-	// now we chroot into the temporary directory
-	err := syscall.Chroot(tempDir)
-	if err != nil {
-		fmt.Printf("Error chrooting: %v\n", err)
-		return err
-	}
-	return nil
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-// This is for previous stages of the project where isolated binary was required since
-// we were not pulling any image from docker hub, in final stage we are pulling image
-// so we use only chroot
-func isolateFileSystemWithBinary(tempDir, binaryPath string) error {
-	// now we copy the binary to the temporary directory
-	destinationPath := filepath.Join(tempDir, binaryPath)
-
-	err := os.MkdirAll(filepath.Dir(destinationPath), 0600) // 0600 means only the owner can read/write
-	if err != nil {
-		fmt.Printf("Error creating directory: %v\n", err)
-		return err
-	}
-
-	// copy the binary to the temporary directory
-	binarySrc, err := os.Open(binaryPath)
-	if err != nil {
-		fmt.Printf("Error opening binary: %v\n", err)
-		return err
-	}
-	defer binarySrc.Close()
-
-	binaryDest, err := os.Create(destinationPath)
-	if err != nil {
-		fmt.Printf("Error creating binary: %v\n", err)
-		return err
-	}
-	defer binaryDest.Close()
-
-	// setting permissons for destination file
-	err = binaryDest.Chmod(0100)
-	if err != nil {
-		fmt.Printf("Error setting permissions: %v\n", err)
-		return err
-	}
-
-	// now we copy the binary to the temporary directory
-	_, err = io.Copy(binaryDest, binarySrc)
-	if err != nil {
-		fmt.Printf("Error copying binary: %v\n", err)
-		return err
-	}
-
-	// now we chroot into the temporary directory
-	err = syscall.Chroot(tempDir)
-	if err != nil {
-		fmt.Printf("Error chrooting: %v\n", err)
-		return err
-	}
-
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
 	return nil
 }
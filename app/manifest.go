@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// media types of manifests, manifest lists and the blobs they point to
+const (
+	mediaTypeDockerManifest     = contentTypeHeader
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCIConfig          = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer           = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// allManifestTypes is the Accept header used when any kind of manifest will do
+var allManifestTypes = strings.Join([]string{
+	mediaTypeDockerManifestList,
+	mediaTypeOCIIndex,
+	mediaTypeDockerManifest,
+	mediaTypeOCIManifest,
+}, ", ")
+
+// Platform is the os/architecture an entry of a manifest list is built for
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// ManifestList is a docker manifest list or an OCI image index, pointing to
+// one manifest per platform
+type ManifestList struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Manifests     []struct {
+		MediaType string    `json:"mediaType"`
+		Size      int       `json:"size"`
+		Digest    string    `json:"digest"`
+		Platform  *Platform `json:"platform,omitempty"`
+	} `json:"manifests"`
+}
+
+// This function reports whether the media type is a manifest list / image index
+func isManifestList(mediaType string) bool {
+	return mediaType == mediaTypeDockerManifestList || mediaType == mediaTypeOCIIndex
+}
+
+// Usage: your_docker.sh manifest inspect [--verbose] <image>
+func manifestCommand(args []string) error {
+	if len(args) < 1 || args[0] != "inspect" {
+		return fmt.Errorf("Usage: manifest inspect [--verbose] <image>")
+	}
+
+	flags := flag.NewFlagSet("manifest inspect", flag.ContinueOnError)
+	verbose := flags.Bool("verbose", false, "fetch the manifest of every platform of a manifest list too")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: manifest inspect [--verbose] <image>")
+	}
+	if offline {
+		return fmt.Errorf("Cannot inspect %s: running in offline mode", flags.Arg(0))
+	}
+
+	ref, err := parseReference(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	reg, err := connectRegistry(ref, "pull")
+	if err != nil {
+		return err
+	}
+
+	raw, mediaType, err := reg.fetchRawManifest(ref.path, ref.identifier(), allManifestTypes)
+	if err != nil {
+		return err
+	}
+	if !*verbose || !isManifestList(mediaType) {
+		return printJSON(raw)
+	}
+
+	// verbose: every platform with its own manifest
+	var list ManifestList
+	err = json.Unmarshal(raw, &list)
+	if err != nil {
+		return err
+	}
+	type platformManifest struct {
+		Ref        string          `json:"Ref"`
+		Descriptor interface{}     `json:"Descriptor"`
+		Manifest   json.RawMessage `json:"Manifest"`
+	}
+	entries := []platformManifest{}
+	for _, descriptor := range list.Manifests {
+		manifest, _, err := reg.fetchRawManifest(ref.path, descriptor.Digest, allManifestTypes)
+		if err != nil {
+			return fmt.Errorf("Error getting manifest %s: %v", descriptor.Digest, err)
+		}
+		entries = append(entries, platformManifest{
+			Ref:        fmt.Sprintf("%s/%s@%s", ref.domain, ref.path, descriptor.Digest),
+			Descriptor: descriptor,
+			Manifest:   manifest,
+		})
+	}
+	raw, err = json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return printJSON(raw)
+}
+
+// The below function prints JSON indented the way docker's inspect commands do
+func printJSON(raw []byte) error {
+	var out bytes.Buffer
+	err := json.Indent(&out, raw, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// containerDevice is a device node every container gets in its /dev
+type containerDevice struct {
+	name         string
+	major, minor int64
+	mode         uint32
+}
+
+// containerDevices are the devices of /dev, the same as docker gives
+var containerDevices = []containerDevice{
+	{"null", 1, 3, 0666},
+	{"zero", 1, 5, 0666},
+	{"full", 1, 7, 0666},
+	{"random", 1, 8, 0666},
+	{"urandom", 1, 9, 0666},
+	{"tty", 5, 0, 0666},
+	{"console", 5, 1, 0600},
+}
+
+// containerDevLinks are the symlinks of /dev, to what /proc has for the process
+var containerDevLinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"core", "/proc/kcore"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// defaultShmSize is the size of /dev/shm when --shm-size isn't given, like docker
+const defaultShmSize = 64 << 20
+
+// The below function mounts the file systems every container has on top of its
+// root file system: /proc of its pid namespace, a read-only /sys with the
+// cgroups the container sees, a /dev of its own with the paths of the host in
+// /proc and /sys masked, /dev/shm of the size asked for and the --mount ones. Images come with empty directories
+// there at best
+func mountContainerFilesystems(config *initConfig) error {
+	rootfs := config.Rootfs
+	proc, err := mountPoint(rootfs, "/proc")
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("Error mounting /proc: %v", err)
+	}
+	err = mountSys(rootfs)
+	if err != nil {
+		return err
+	}
+	dev, err := mountDev(rootfs, config.MountLabel)
+	if err != nil {
+		return err
+	}
+	if config.MaskSystemPaths {
+		err = maskSystemPaths(rootfs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// POSIX shared memory, browsers and databases need more of it than the
+	// 64m docker gives by default. Sharing the ipc namespace of the host or of
+	// another container is sharing its /dev/shm too
+	shm := filepath.Join(dev, "shm")
+	err = os.Mkdir(shm, 01777)
+	if err != nil {
+		return err
+	}
+	if config.ShmSource != "" {
+		err = syscall.Mount(config.ShmSource, shm, "", syscall.MS_BIND, "")
+	} else {
+		err = syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, mountLabelOption(fmt.Sprintf("mode=1777,size=%d", config.ShmSize), config.MountLabel))
+	}
+	if err != nil {
+		return fmt.Errorf("Error mounting /dev/shm: %v", err)
+	}
+
+	// a read only root file system still has the scratch space programs
+	// expect to write to
+	if config.ReadonlyRootfs {
+		for _, dir := range readonlyRootfsTmpfs {
+			err = mountTmpfs(rootfs, dir[0], syscall.MS_NOSUID|syscall.MS_NODEV, "mode="+dir[1], config.MountLabel)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the mounts asked for go last, they may hide what is above
+	for _, mount := range config.Mounts {
+		if mount.Type == "tmpfs" {
+			err = mountTmpfs(rootfs, mount.Target, mount.Flags, mount.Options, config.MountLabel)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = mountBind(rootfs, mount)
+		if err != nil {
+			return fmt.Errorf("Error mounting %s on %s: %v", mount.Source, mount.Target, err)
+		}
+	}
+	return nil
+}
+
+// readonlyRootfsTmpfs are the tmpfs containers with a read only root file
+// system get, with their modes
+var readonlyRootfsTmpfs = [][2]string{{"/tmp", "1777"}, {"/run", "755"}}
+
+// The below function mounts an empty tmpfs at path in rootfs, with the mount
+// flags and the options of tmpfs given
+func mountTmpfs(rootfs, path string, flags uintptr, options, mountLabel string) error {
+	target, err := mountPoint(rootfs, path)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("tmpfs", target, "tmpfs", flags, mountLabelOption(options, mountLabel))
+	if err != nil {
+		return fmt.Errorf("Error mounting a tmpfs on %s: %v", path, err)
+	}
+	return nil
+}
+
+// The below function returns the flags of the mount path is on a remount of
+// it has to give again. A mount that came from a mount namespace another user
+// namespace owns keeps them, they can't be cleared
+func lockedMountFlags(path string) (uintptr, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	// the ST_ flags of statfs are the MS_ ones of mount
+	return uintptr(stat.Flags) & (syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME), nil
+}
+
+// The below function makes the root file system the process is in read
+// only, what is mounted in it stays as it is
+func remountRootReadonly() error {
+	locked, err := lockedMountFlags("/")
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|locked, "")
+	if err != nil {
+		return fmt.Errorf("Error making the root file system read only: %v", err)
+	}
+	return nil
+}
+
+// containerMount is a file or directory of the host mounted in the container
+// with --mount, a volume, or a tmpfs of --tmpfs
+type containerMount struct {
+	Type string `json:"type"` // bind, volume or tmpfs
+	// the volume of a volume mount, its source is the path its driver gives
+	Name        string `json:"name,omitempty"`
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+	Propagation string `json:"propagation"`
+	// shared or private to give the source the SELinux label of the
+	// container, without its categories or with them
+	Relabel string `json:"relabel,omitempty"`
+	// the mount flags, nosuid and nodev of a bind mount, and the options of
+	// a tmpfs
+	Flags   uintptr `json:"flags,omitempty"`
+	Options string  `json:"options,omitempty"`
+}
+
+// tmpfsMountFlags are the mount flags --tmpfs takes, with whether they are
+// set or cleared
+var tmpfsMountFlags = map[string]struct {
+	flag  uintptr
+	clear bool
+}{
+	"ro":     {syscall.MS_RDONLY, false},
+	"rw":     {syscall.MS_RDONLY, true},
+	"noexec": {syscall.MS_NOEXEC, false},
+	"exec":   {syscall.MS_NOEXEC, true},
+	"nosuid": {syscall.MS_NOSUID, false},
+	"suid":   {syscall.MS_NOSUID, true},
+	"nodev":  {syscall.MS_NODEV, false},
+	"dev":    {syscall.MS_NODEV, true},
+}
+
+// The below function parses the value of --tmpfs, <path>[:<options>] with the
+// options separated by commas: the mount flags of tmpfsMountFlags and the
+// size, mode, uid, gid and nr_inodes of tmpfs. Like docker's, the tmpfs is noexec,
+// nosuid and nodev unless the options say otherwise
+func parseTmpfs(value string) (containerMount, error) {
+	target, options, _ := strings.Cut(value, ":")
+	if !filepath.IsAbs(target) || filepath.Clean(target) == "/" {
+		return containerMount{}, fmt.Errorf("Invalid --tmpfs %q: the path must be an absolute path other than /", value)
+	}
+	mount := containerMount{Type: "tmpfs", Target: filepath.Clean(target), Flags: syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV}
+	var data []string
+	for _, option := range strings.Split(options, ",") {
+		key, val, _ := strings.Cut(option, "=")
+		if flag, ok := tmpfsMountFlags[key]; ok {
+			if flag.clear {
+				mount.Flags &^= flag.flag
+			} else {
+				mount.Flags |= flag.flag
+			}
+			continue
+		}
+		var err error
+		switch key {
+		case "":
+			continue
+		case "size":
+			// the kernel takes a percentage of the memory too
+			if !strings.HasSuffix(val, "%") {
+				_, err = parseSize(val)
+			}
+		case "mode":
+			_, err = strconv.ParseUint(val, 8, 32)
+		case "uid", "gid", "nr_inodes":
+			_, err = strconv.ParseUint(val, 10, 64)
+		default:
+			return containerMount{}, fmt.Errorf("Invalid --tmpfs %q: unknown option %s", value, key)
+		}
+		if err != nil {
+			return containerMount{}, fmt.Errorf("Invalid --tmpfs %q: invalid value for %s: %s", value, key, val)
+		}
+		data = append(data, option)
+	}
+	mount.ReadOnly = mount.Flags&syscall.MS_RDONLY != 0
+	mount.Options = strings.Join(data, ",")
+	return mount, nil
+}
+
+// propagationFlags are the flags of the bind-propagation modes we support.
+// shared and rshared are not among them, mounts made in the container would
+// end up on the host
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+}
+
+// The below function parses the value of --mount, the way docker writes it:
+// type=bind,source=/src,target=/dst[,readonly][,bind-propagation=rslave], with
+// nosuid and nodev, and relabel=shared|private the way podman does. A
+// type=volume mount has the name of a volume for a source, or none for an
+// anonymous volume
+func parseMount(value string) (containerMount, error) {
+	mount := containerMount{Propagation: "rprivate"}
+	for _, field := range strings.Split(value, ",") {
+		key, val, hasValue := strings.Cut(field, "=")
+		switch key {
+		case "type":
+			mount.Type = val
+		case "source", "src":
+			mount.Source = val
+		case "target", "destination", "dst":
+			mount.Target = val
+		case "readonly", "ro":
+			if !hasValue {
+				val = "true"
+			}
+			switch val {
+			case "true", "1":
+				mount.ReadOnly = true
+			case "false", "0":
+				mount.ReadOnly = false
+			default:
+				return containerMount{}, fmt.Errorf("Invalid --mount %q: invalid value for %s: %s", value, key, val)
+			}
+		case "nosuid", "nodev":
+			if hasValue {
+				return containerMount{}, fmt.Errorf("Invalid --mount %q: %s takes no value", value, key)
+			}
+			mount.Flags |= tmpfsMountFlags[key].flag
+		case "bind-propagation":
+			mount.Propagation = val
+		case "relabel":
+			if val != "shared" && val != "private" {
+				return containerMount{}, fmt.Errorf("Invalid --mount %q: relabel must be shared or private", value)
+			}
+			mount.Relabel = val
+		default:
+			return containerMount{}, fmt.Errorf("Invalid --mount %q: unknown option %s", value, key)
+		}
+	}
+
+	switch mount.Type {
+	case "bind":
+	case "volume":
+		mount.Name = mount.Source
+	default:
+		return containerMount{}, fmt.Errorf("Invalid --mount %q: only type=bind and type=volume are supported", value)
+	}
+	err := checkBindMount(mount, "--mount", value)
+	if err != nil {
+		return containerMount{}, err
+	}
+	return mount, nil
+}
+
+// The below function parses the value of -v, <source>:<target>[:<options>]
+// with the options separated by commas: ro or rw, nosuid, nodev, z or Z to
+// relabel the source shared or private, and the propagation modes of
+// bind-propagation. A source that isn't a path is the name of a volume, a
+// target alone an anonymous volume
+func parseVolume(value string) (containerMount, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 1 {
+		mount := containerMount{Type: "volume", Target: parts[0], Propagation: "rprivate"}
+		err := checkBindMount(mount, "-v", value)
+		if err != nil {
+			return containerMount{}, err
+		}
+		return mount, nil
+	}
+	if len(parts) > 3 {
+		return containerMount{}, fmt.Errorf("Invalid -v %q: expected <host path or volume>:<container path>[:<options>]", value)
+	}
+	mount := containerMount{Type: "bind", Source: parts[0], Target: parts[1], Propagation: "rprivate"}
+	if !strings.ContainsAny(mount.Source, "/.~") {
+		mount.Type, mount.Name = "volume", mount.Source
+	}
+	if len(parts) == 3 {
+		for _, option := range strings.Split(parts[2], ",") {
+			switch {
+			case option == "ro":
+				mount.ReadOnly = true
+			case option == "rw":
+				mount.ReadOnly = false
+			case option == "nosuid", option == "nodev":
+				mount.Flags |= tmpfsMountFlags[option].flag
+			case option == "z":
+				mount.Relabel = "shared"
+			case option == "Z":
+				mount.Relabel = "private"
+			case option == "shared", option == "rshared", propagationFlags[option] != 0:
+				mount.Propagation = option
+			default:
+				return containerMount{}, fmt.Errorf("Invalid -v %q: unknown option %s", value, option)
+			}
+		}
+	}
+	err := checkBindMount(mount, "-v", value)
+	if err != nil {
+		return containerMount{}, err
+	}
+	return mount, nil
+}
+
+// The below function checks the bind mount parsed from the value of flag
+func checkBindMount(mount containerMount, flag, value string) error {
+	if _, ok := propagationFlags[mount.Propagation]; !ok {
+		if mount.Propagation == "shared" || mount.Propagation == "rshared" {
+			return fmt.Errorf("Invalid %s %q: bind-propagation=%s is not supported, mounts of the container never reach the host", flag, value, mount.Propagation)
+		}
+		return fmt.Errorf("Invalid %s %q: unknown bind-propagation %s", flag, value, mount.Propagation)
+	}
+	if !filepath.IsAbs(mount.Target) || filepath.Clean(mount.Target) == "/" {
+		return fmt.Errorf("Invalid %s %q: target must be an absolute path other than /", flag, value)
+	}
+	if mount.Type == "volume" {
+		// without a name it's an anonymous volume
+		if mount.Name != "" && !validName(mount.Name) {
+			return fmt.Errorf("Invalid %s %q: invalid volume name %q", flag, value, mount.Name)
+		}
+		return nil
+	}
+	if !filepath.IsAbs(mount.Source) {
+		return fmt.Errorf("Invalid %s %q: source must be an absolute path", flag, value)
+	}
+	if _, err := os.Stat(mount.Source); err != nil {
+		return fmt.Errorf("Invalid %s %q: bind source path does not exist: %s", flag, value, mount.Source)
+	}
+	return nil
+}
+
+// The below function bind mounts the source of mount on its target in rootfs,
+// with what is mounted below the source, and gives it the propagation asked
+// for. A file is mounted on a file, which is created when the image doesn't
+// have it
+func mountBind(rootfs string, mount containerMount) error {
+	info, err := os.Stat(mount.Source)
+	if err != nil {
+		return err
+	}
+	var target string
+	if info.IsDir() {
+		target, err = mountPoint(rootfs, mount.Target)
+		if err != nil {
+			return err
+		}
+	} else {
+		target, err = secureJoin(rootfs, mount.Target)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+
+	err = syscall.Mount(mount.Source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return err
+	}
+	// a bind mount takes the flags of its source, read only, nosuid and
+	// nodev need a remount
+	flags := mount.Flags
+	if mount.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if flags != 0 {
+		locked, err := lockedMountFlags(target)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags|locked, "")
+		if err != nil {
+			return err
+		}
+	}
+	return syscall.Mount("", target, "", propagationFlags[mount.Propagation], "")
+}
+
+// The below function returns where path of the container is on our side,
+// creating the directory if the image doesn't have it. Symlinks on the way are
+// resolved inside rootfs, a mount never lands outside of it
+func mountPoint(rootfs, path string) (string, error) {
+	dir, err := secureJoin(rootfs, path)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// The below function mounts /sys read-only, and the cgroups at /sys/fs/cgroup.
+// Only the owner of a network namespace may mount its sysfs, a container
+// sharing the one of the host in a user namespace gets the /sys of the host
+func mountSys(rootfs string) error {
+	sys, err := mountPoint(rootfs, "/sys")
+	if err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	err = syscall.Mount("sysfs", sys, "sysfs", flags, "")
+	if err == syscall.EPERM {
+		err = bindReadOnly("/sys", sys)
+	}
+	if err != nil {
+		return fmt.Errorf("Error mounting /sys: %v", err)
+	}
+	err = mountCgroups(filepath.Join(sys, "fs", "cgroup"))
+	if err != nil {
+		return fmt.Errorf("Error mounting /sys/fs/cgroup: %v", err)
+	}
+	return nil
+}
+
+// maskedPaths are the files and directories of /proc and /sys containers
+// don't see, the ones of the runtime spec of OCI: what they show or do is
+// about the host. Files are hidden by /dev/null, directories by an empty
+// tmpfs
+var maskedPaths = []string{
+	"/proc/asound", "/proc/acpi", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+	"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/proc/scsi",
+	"/sys/firmware", "/sys/devices/virtual/powercap",
+}
+
+// readonlyPaths are the ones of /proc containers may read but not write, the
+// kernel settings and triggers of the host
+var readonlyPaths = []string{"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger"}
+
+// The below function masks maskedPaths and makes readonlyPaths read only in
+// the container, /proc, /sys and /dev being mounted in rootfs. The ones the
+// kernel doesn't have are left out
+func maskSystemPaths(rootfs string) error {
+	for _, path := range maskedPaths {
+		target := filepath.Join(rootfs, path)
+		info, err := os.Stat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "")
+		} else {
+			err = syscall.Mount(filepath.Join(rootfs, "dev", "null"), target, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("Error masking %s: %v", path, err)
+		}
+	}
+	for _, path := range readonlyPaths {
+		target := filepath.Join(rootfs, path)
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			continue
+		}
+		err := bindReadOnly(target, target)
+		if err != nil {
+			return fmt.Errorf("Error making %s read only: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// This function bind mounts source on target read-only, a bind mount is made
+// read-only by remounting it
+func bindReadOnly(source, target string) error {
+	err := syscall.Mount(source, target, "", syscall.MS_BIND, "")
+	if err != nil {
+		return err
+	}
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+}
+
+// The below function mounts a tmpfs on /dev and populates it with the devices
+// and symlinks programs expect, with /dev/pts a devpts of its own so the
+// pseudo terminals of the container are not the ones of the host. The tmpfs
+// gets the SELinux label of the container if it has one. It returns the /dev
+// of the container on our side
+func mountDev(rootfs, mountLabel string) (string, error) {
+	dev, err := mountPoint(rootfs, "/dev")
+	if err != nil {
+		return "", err
+	}
+	err = syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, mountLabelOption("mode=755,size=65536k", mountLabel))
+	if err != nil {
+		return "", fmt.Errorf("Error mounting /dev: %v", err)
+	}
+
+	for _, device := range containerDevices {
+		err = createDevice(filepath.Join(dev, device.name), device)
+		if err != nil {
+			return "", fmt.Errorf("Error creating /dev/%s: %v", device.name, err)
+		}
+	}
+	for _, link := range containerDevLinks {
+		err = os.Symlink(link[1], filepath.Join(dev, link[0]))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	pts := filepath.Join(dev, "pts")
+	err = os.Mkdir(pts, 0755)
+	if err != nil {
+		return "", err
+	}
+	// gid 5 is the tty group of about every distribution, a user namespace
+	// of a user doesn't have it
+	err = syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620,gid=5")
+	if err == syscall.EINVAL {
+		err = syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620")
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error mounting /dev/pts: %v", err)
+	}
+	return dev, nil
+}
+
+// The below function creates the device node at path. Where we may not create
+// devices, in a user namespace, the one of the host is bind mounted instead
+func createDevice(path string, device containerDevice) error {
+	err := syscall.Mknod(path, syscall.S_IFCHR|device.mode, int(mkdev(device.major, device.minor)))
+	if err == nil {
+		// mknod leaves out what the umask has
+		return os.Chmod(path, os.FileMode(device.mode))
+	}
+	if err != syscall.EPERM {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return syscall.Mount(filepath.Join("/dev", device.name), path, "", syscall.MS_BIND, "")
+}
+
+// The below function makes rootfs the root of the mount namespace with
+// pivot_root, and detaches the old root so nothing of the host stays
+// reachable. chroot only changes where paths start, a process with
+// CAP_SYS_CHROOT gets out of it with a second chroot
+func pivotRoot(rootfs string) error {
+	// pivot_root wants the new root to be a mount point, a vfs root file
+	// system is a plain directory. The mounts made in it come along
+	err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("Error bind mounting the root file system: %v", err)
+	}
+	oldRoot, err := syscall.Open("/", syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(oldRoot)
+	err = os.Chdir(rootfs)
+	if err != nil {
+		return err
+	}
+	// with both the same, the old root ends up mounted on top of the new one,
+	// no directory has to be made in the image for it
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("Error pivoting to the root file system: %v", err)
+	}
+	err = syscall.Fchdir(oldRoot)
+	if err != nil {
+		return err
+	}
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("Error unmounting the old root: %v", err)
+	}
+	return os.Chdir("/")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// setnsTrap is the number of the setns system call, the syscall package only
+// knows it on the architectures that came after it
+var setnsTrap = map[string]uintptr{
+	"amd64":    308,
+	"386":      346,
+	"arm":      375,
+	"arm64":    268,
+	"riscv64":  268,
+	"ppc64le":  350,
+	"s390x":    339,
+	"mips64le": 5303,
+}[runtime.GOARCH]
+
+// cloneNewCgroup is CLONE_NEWCGROUP, which the syscall package of the go we
+// build with doesn't have yet
+const cloneNewCgroup = 0x2000000
+
+// The below function moves the calling thread into the namespace at path, e.g.
+// /proc/<pid>/ns/net. Only the thread changes namespace, the caller locks it
+// and executes what has to run in the namespace from it
+func setns(path string, nstype int) error {
+	if setnsTrap == 0 {
+		return fmt.Errorf("Joining namespaces is not supported on %s", runtime.GOARCH)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, _, errno := syscall.RawSyscall(setnsTrap, file.Fd(), uintptr(nstype), 0)
+	if errno != 0 {
+		return fmt.Errorf("Error joining namespace %s: %v", path, errno)
+	}
+	return nil
+}
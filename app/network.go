@@ -0,0 +1,813 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Containers of root are connected to the default bridge network or to one
+// made with network create: each gets a network namespace of its own with one
+// end of a veth pair as eth0, the other end is on a bridge of the host which
+// is the gateway of the subnet. Traffic leaving the subnet is masqueraded by
+// iptables. Networks are kept under the data root:
+//
+//	<data root>/networks/<name>.json   the subnet and bridge of the network
+//	<data root>/networks/<name>.lock   held while an address is picked
+
+// defaultNetworkName is the network containers are connected to by default
+const defaultNetworkName = "bridge"
+
+// bridgeIP is set by --bip, the address of the bridge of the default network
+// with the prefix length of its subnet. Empty keeps what the network has
+var bridgeIP string
+
+// defaultBridgeIP is the address of the default bridge when --bip is not given
+const defaultBridgeIP = "172.20.0.1/16"
+
+// Network is the <name>.json of a network
+type Network struct {
+	Name    string
+	Id      string
+	Created time.Time
+	Driver  string // bridge
+	Subnet  string // e.g. 172.20.0.0/16
+	Gateway string // the address of the bridge
+	Bridge  string // the bridge interface on the host
+	// dual stack networks have an IPv6 subnet too, e.g. fd3c:8f1a:5b2e:c4d0::/64
+	EnableIPv6  bool   `json:",omitempty"`
+	IPv6Subnet  string `json:",omitempty"`
+	IPv6Gateway string `json:",omitempty"`
+}
+
+// NetworkSettings tells how a container is connected to its network
+type NetworkSettings struct {
+	Network   string
+	IPAddress string
+	PrefixLen int
+	Gateway   string
+	// the end of the veth pair on the host, eth0 is the one in the container
+	HostVeth   string
+	MacAddress string        // the one of eth0
+	Ports      []PortBinding `json:",omitempty"`
+	// the names the container has on the network next to its own, --network-alias
+	Aliases []string `json:",omitempty"`
+	// --dns, where the DNS of a network made with network create sends the
+	// queries of the container instead of to the name servers of the host
+	DNSServers []string `json:",omitempty"`
+	// the IPv6 address of the container on a dual stack network
+	GlobalIPv6Address   string `json:",omitempty"`
+	GlobalIPv6PrefixLen int    `json:",omitempty"`
+	IPv6Gateway         string `json:",omitempty"`
+}
+
+// networkConfig is what the container init needs to configure the network
+// namespace of the container, nil shares the one of the host and without an
+// interface it only has loopback
+type networkConfig struct {
+	Interface string `json:"interface"` // eth0
+	Address   string `json:"address"`   // with the prefix length, e.g. 172.20.0.2/16
+	Gateway   string `json:"gateway"`
+	Address6  string `json:"address6,omitempty"` // on a dual stack network, e.g. fd3c:8f1a:5b2e:c4d0::2/64
+	Gateway6  string `json:"gateway6,omitempty"`
+}
+
+// endpointConfig is what run asks for the container on its network
+type endpointConfig struct {
+	Aliases     []string // --network-alias
+	IPv4Address string   // --ip, empty for the first free one
+	IPv6Address string   // --ip6
+	MacAddress  string   // --mac-address, empty for the one of the IPv4 address
+	DNS         []string // --dns
+}
+
+// The below function parses the value of --network: bridge, host, none,
+// container:<name|id> or the name or id of a network. The default is bridge for
+// root, containers of users share the network of the host since a user can't
+// plug a network namespace into it
+func parseNetworkMode(value string) (string, error) {
+	if strings.HasPrefix(value, "container:") {
+		container, err := findContainer(strings.TrimPrefix(value, "container:"))
+		if err != nil {
+			return "", err
+		}
+		return "container:" + container.Id, nil
+	}
+	switch value {
+	case "":
+		if rootless {
+			return "host", nil
+		}
+		return "bridge", nil
+	case "bridge":
+		if rootless {
+			return "", fmt.Errorf("--network bridge needs root, containers of users share the network of the host")
+		}
+		return value, nil
+	case "host", "none":
+		return value, nil
+	}
+	network, err := findNetwork(value)
+	if err != nil {
+		return "", err
+	}
+	if rootless {
+		return "", fmt.Errorf("--network %s needs root, containers of users share the network of the host", value)
+	}
+	return network.Name, nil
+}
+
+// This function reports whether the network mode is a network made with
+// network create, the ones containers get names and addresses of their choice on
+func userDefinedNetwork(mode string) bool {
+	switch mode {
+	case defaultNetworkName, "host", "none":
+		return false
+	}
+	return !strings.HasPrefix(mode, "container:")
+}
+
+// The below function gives the container the network of its mode: the host
+// one as it is, a namespace with loopback alone, the one of another container
+// or one on a bridge network with the ports published. The containers of a
+// network made with network create also find each other by name through the
+// DNS we serve. It sets the network the container init configures or joins
+// and returns the network the container is connected to, nil but for bridge
+// networks, and the function disconnecting it once the container exited
+func connectContainer(container *Container, process *initConfig, ports []PortBinding, endpoint endpointConfig) (*Network, func(), error) {
+	switch container.NetworkMode {
+	case "host":
+		return nil, func() {}, nil
+	case "none":
+		process.Network = &networkConfig{}
+		return nil, func() {}, nil
+	}
+	if id := strings.TrimPrefix(container.NetworkMode, "container:"); id != container.NetworkMode {
+		return nil, func() {}, joinContainerNetwork(process, id)
+	}
+	var network *Network
+	var err error
+	if container.NetworkMode == defaultNetworkName {
+		network, err = defaultNetwork()
+	} else {
+		network, err = readNetwork(container.NetworkMode)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	err = network.connect(container, endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	container.NetworkSettings.Ports = ports
+	unpublish, err := network.publishPorts(container.NetworkSettings)
+	if err != nil {
+		return nil, nil, err
+	}
+	process.Network = container.NetworkSettings.initConfig()
+	if network.Name == defaultNetworkName {
+		return network, unpublish, nil
+	}
+
+	// like docker, the default network has no names
+	stopDNS, err := network.serveDNS()
+	if err != nil {
+		unpublish()
+		return nil, nil, err
+	}
+	return network, func() {
+		stopDNS()
+		unpublish()
+	}, nil
+}
+
+// The below function makes the container share the network namespace of the
+// running container id, the init joins it. The namespace belongs to the user
+// namespace of that container and only root on the host may join it from
+// another one: the container goes without a user namespace of its own
+func joinContainerNetwork(process *initConfig, id string) error {
+	target, err := findContainer(id)
+	if err != nil {
+		return err
+	}
+	if !target.State.Running || target.State.Pid == 0 || !processExists(target.State.Pid) {
+		return fmt.Errorf("Cannot join the network of container %s: it is not running", target.Id[:12])
+	}
+	if target.NetworkMode == "host" {
+		return nil
+	}
+	if rootless {
+		return fmt.Errorf("Cannot join the network of container %s: it needs root", target.Id[:12])
+	}
+	process.NetworkNamespace = fmt.Sprintf("/proc/%d/ns/net", target.State.Pid)
+	process.UserNamespace = false
+	return nil
+}
+
+// The below function returns the path of a file of the network
+func networkPath(name, ext string) string {
+	return filepath.Join(dataRoot, "networks", name+ext)
+}
+
+// The below function finds a network by its name, or its id or a prefix of it
+func findNetwork(ref string) (*Network, error) {
+	if !validName(ref) {
+		return nil, fmt.Errorf("No such network: %s", ref)
+	}
+	if _, err := os.Stat(networkPath(ref, ".json")); err == nil {
+		return readNetwork(ref)
+	}
+	networks, err := listNetworks()
+	if err != nil {
+		return nil, err
+	}
+	var found *Network
+	for _, network := range networks {
+		if strings.HasPrefix(network.Id, ref) {
+			if found != nil {
+				return nil, fmt.Errorf("Ambiguous network id %s", ref)
+			}
+			found = network
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No such network: %s", ref)
+	}
+	return found, nil
+}
+
+// This function returns every network of the data root, sorted by name
+func listNetworks() ([]*Network, error) {
+	paths, err := filepath.Glob(filepath.Join(dataRoot, "networks", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	networks := []*Network{}
+	for _, path := range paths {
+		network, err := readNetwork(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// This function reports whether name can name a network or a container, the
+// way docker wants it
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !alnum && (i == 0 || !strings.ContainsRune("_.-", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// This function reads a network
+func readNetwork(name string) (*Network, error) {
+	data, err := os.ReadFile(networkPath(name, ".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var network Network
+	err = json.Unmarshal(data, &network)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid network %s: %v", name, err)
+	}
+	return &network, nil
+}
+
+// The below function writes the <name>.json of the network
+func (n *Network) save() error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	path := networkPath(n.Name, ".json")
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// The below function returns the default bridge network, created the first
+// time with the address of --bip. A later --bip moves the network to the new
+// subnet as long as no container is connected to it
+func defaultNetwork() (*Network, error) {
+	var network *Network
+	if _, err := os.Stat(networkPath(defaultNetworkName, ".json")); err == nil {
+		network, err = readNetwork(defaultNetworkName)
+		if err != nil {
+			return nil, err
+		}
+		if bridgeIP == "" || bridgeIP == network.bridgeAddress() {
+			// networks made before they had ids get one
+			if network.Id == "" {
+				network.Id, err = randomID()
+				if err == nil {
+					err = network.save()
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			return network, nil
+		}
+	}
+
+	address := bridgeIP
+	if address == "" {
+		address = defaultBridgeIP
+	}
+	ip, subnet, err := net.ParseCIDR(address)
+	if err != nil || ip.To4() == nil || ip.Equal(subnet.IP) {
+		return nil, fmt.Errorf("Invalid --bip %q: expected the address of the bridge and its prefix length, e.g. %s", address, defaultBridgeIP)
+	}
+	if network != nil {
+		used, err := network.addresses()
+		if err != nil {
+			return nil, err
+		}
+		if len(used) > 0 {
+			return nil, fmt.Errorf("Cannot move network %s to %s: %d containers are connected to it", network.Name, address, len(used))
+		}
+		// the bridge gets the new address when it's created again
+		if _, err := net.InterfaceByName(network.Bridge); err == nil {
+			err = runTool("ip", "link", "delete", network.Bridge)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	network = &Network{Name: defaultNetworkName, Id: id, Created: time.Now().UTC(), Driver: "bridge", Subnet: subnet.String(), Gateway: ip.String(), Bridge: "mydocker0"}
+	return network, network.save()
+}
+
+// This function returns the address of the bridge with the prefix length of
+// the subnet, the way --bip gives it
+func (n *Network) bridgeAddress() string {
+	_, prefixLen, _ := strings.Cut(n.Subnet, "/")
+	return n.Gateway + "/" + prefixLen
+}
+
+// The below function makes sure the bridge of the network is there and up with
+// the gateway address, that the host forwards packets and that the traffic of
+// the subnet is masqueraded
+func (n *Network) setup() error {
+	gateway := n.bridgeAddress()
+	bridge, err := net.InterfaceByName(n.Bridge)
+	created := false
+	if err != nil {
+		err = runTool("ip", "link", "add", "name", n.Bridge, "type", "bridge")
+		if err != nil {
+			return err
+		}
+		bridge, err = net.InterfaceByName(n.Bridge)
+		if err != nil {
+			return err
+		}
+		created = true
+	}
+	addrs, err := bridge.Addrs()
+	if err != nil {
+		return err
+	}
+	hasGateway := false
+	for _, addr := range addrs {
+		if addr.String() == gateway {
+			hasGateway = true
+		}
+	}
+	if !hasGateway {
+		err = runTool("ip", "addr", "add", gateway, "dev", n.Bridge)
+		if err != nil {
+			return err
+		}
+	}
+	if n.EnableIPv6 {
+		err = n.setupIPv6(addrs)
+		if err != nil {
+			return err
+		}
+	}
+	err = runTool("ip", "link", "set", n.Bridge, "up")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error enabling ip forwarding: %v", err)
+	}
+	// without NAT the containers still reach the host and each other
+	err = n.setupNAT()
+	if err != nil && created {
+		fmt.Fprintf(os.Stderr, "[Warning] %v, containers on network %s can't reach other hosts\n", err, n.Name)
+	}
+	if n.EnableIPv6 {
+		err = n.setupNAT6()
+		if err != nil && created {
+			fmt.Fprintf(os.Stderr, "[Warning] %v, containers on network %s can't reach other hosts over IPv6\n", err, n.Name)
+		}
+	}
+	return nil
+}
+
+// The below function gives the bridge of a dual stack network its IPv6
+// gateway address and makes the host forward IPv6 packets. The address skips
+// duplicate address detection, the bridge would not have it for a while
+func (n *Network) setupIPv6(addrs []net.Addr) error {
+	_, subnet, err := net.ParseCIDR(n.IPv6Subnet)
+	if err != nil {
+		return err
+	}
+	prefixLen, _ := subnet.Mask.Size()
+	gateway := fmt.Sprintf("%s/%d", n.IPv6Gateway, prefixLen)
+	hasGateway := false
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(net.ParseIP(n.IPv6Gateway)) {
+			hasGateway = true
+		}
+	}
+	if !hasGateway {
+		err = runTool("ip", "-6", "addr", "add", gateway, "dev", n.Bridge, "nodad")
+		if err != nil {
+			return err
+		}
+	}
+	err = os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error enabling IPv6 forwarding: %v", err)
+	}
+	return nil
+}
+
+// This function masquerades the traffic of the subnet leaving the host and
+// lets the bridge forward it
+func (n *Network) setupNAT() error {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return fmt.Errorf("iptables not found")
+	}
+	for _, rule := range n.natRules(n.Subnet) {
+		err := ensureIptablesRule("iptables", rule[0], rule[1], rule[2:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function is setupNAT for the IPv6 subnet of a dual stack network, with
+// ip6tables
+func (n *Network) setupNAT6() error {
+	if _, err := exec.LookPath("ip6tables"); err != nil {
+		return fmt.Errorf("ip6tables not found")
+	}
+	for _, rule := range n.natRules(n.IPv6Subnet) {
+		err := ensureIptablesRule("ip6tables", rule[0], rule[1], rule[2:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function returns the rules setupNAT adds for the subnet, the table and
+// chain first
+func (n *Network) natRules(subnet string) [][]string {
+	return [][]string{
+		{"nat", "POSTROUTING", "-s", subnet, "!", "-o", n.Bridge, "-j", "MASQUERADE"},
+		{"filter", "FORWARD", "-i", n.Bridge, "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-o", n.Bridge, "-j", "ACCEPT"},
+	}
+}
+
+// This function appends the rule to the chain of the table unless it is
+// there, with iptables or ip6tables
+func ensureIptablesRule(tool, table, chain string, rule ...string) error {
+	check := append([]string{"-t", table, "-C", chain}, rule...)
+	if exec.Command(tool, check...).Run() == nil {
+		return nil
+	}
+	return runTool(tool, append([]string{"-t", table, "-A", chain}, rule...)...)
+}
+
+// The below function returns the containers connected to the network. A
+// container that is running but whose process is gone was killed with run,
+// its address is free again
+func (n *Network) endpoints() ([]*Container, error) {
+	dirs, err := filepath.Glob(filepath.Join(dataRoot, "containers", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var containers []*Container
+	for _, dir := range dirs {
+		container, err := findContainer(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		settings := container.NetworkSettings
+		if settings == nil || settings.Network != n.Name || !container.State.Running {
+			continue
+		}
+		if container.State.Pid != 0 && !processExists(container.State.Pid) {
+			continue
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// This function returns the addresses of the containers connected to the
+// network, by container id
+func (n *Network) addresses() (map[string]string, error) {
+	containers, err := n.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]string{}
+	for _, container := range containers {
+		used[container.Id] = container.NetworkSettings.IPAddress
+	}
+	return used, nil
+}
+
+// This function reports whether a process with the pid is there
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// The below function connects the container to the network the way endpoint
+// asks for: it takes the address asked for, or picks the first address of the
+// subnet no other container has, and saves the container with it. The lock file keeps two runs from picking the same one
+func (n *Network) connect(container *Container, endpoint endpointConfig) error {
+	err := n.setup()
+	if err != nil {
+		return fmt.Errorf("Error setting up network %s: %v", n.Name, err)
+	}
+	lock, err := os.OpenFile(networkPath(n.Name, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+
+	if endpoint.IPv6Address != "" && !n.EnableIPv6 {
+		return fmt.Errorf("Invalid --ip6 %s: network %s has no IPv6 subnet", endpoint.IPv6Address, n.Name)
+	}
+	containers, err := n.endpoints()
+	if err != nil {
+		return err
+	}
+	taken := map[string]bool{n.Gateway: true}
+	macs := map[string]bool{}
+	for _, other := range containers {
+		taken[other.NetworkSettings.IPAddress] = true
+		if other.NetworkSettings.GlobalIPv6Address != "" {
+			taken[other.NetworkSettings.GlobalIPv6Address] = true
+		}
+		macs[other.NetworkSettings.MacAddress] = true
+	}
+	if macs[endpoint.MacAddress] && endpoint.MacAddress != "" {
+		return fmt.Errorf("MAC address %s is already in use on network %s", endpoint.MacAddress, n.Name)
+	}
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return err
+	}
+	prefixLen, _ := subnet.Mask.Size()
+	first, last := subnetHosts(subnet)
+	if first == nil {
+		return fmt.Errorf("Network %s has no IPv4 subnet with room for containers", n.Name)
+	}
+	address, err := n.pickAddress(endpoint.IPv4Address, first, last, taken)
+	if err != nil {
+		return err
+	}
+	container.NetworkSettings = &NetworkSettings{
+		Network:    n.Name,
+		IPAddress:  address,
+		PrefixLen:  prefixLen,
+		Gateway:    n.Gateway,
+		HostVeth:   "veth" + container.Id[:11],
+		MacAddress: endpoint.MacAddress,
+		Aliases:    endpoint.Aliases,
+		DNSServers: endpoint.DNS,
+	}
+	if settings := container.NetworkSettings; settings.MacAddress == "" {
+		settings.MacAddress = ipMacAddress(net.ParseIP(address))
+	}
+	if n.EnableIPv6 {
+		_, subnet6, err := net.ParseCIDR(n.IPv6Subnet)
+		if err != nil {
+			return err
+		}
+		taken[net.ParseIP(n.IPv6Gateway).String()] = true
+		address6, err := n.pickAddress6(endpoint.IPv6Address, subnet6, taken)
+		if err != nil {
+			return err
+		}
+		settings := container.NetworkSettings
+		settings.GlobalIPv6Address = address6
+		settings.GlobalIPv6PrefixLen, _ = subnet6.Mask.Size()
+		settings.IPv6Gateway = n.IPv6Gateway
+	}
+	return container.save()
+}
+
+// The below function returns the MAC address docker gives an interface with
+// the IPv4 address: 02:42 followed by the address, a locally administered one
+// that is unique on the network as long as the address is
+func ipMacAddress(ip net.IP) string {
+	return net.HardwareAddr(append([]byte{0x02, 0x42}, ip.To4()...)).String()
+}
+
+// The below function returns the address asked for once it's checked to be
+// one of the hosts of the subnet nobody has, or the first free one when none
+// is asked for
+func (n *Network) pickAddress(requested string, first, last net.IP, taken map[string]bool) (string, error) {
+	if requested != "" {
+		ip := net.ParseIP(requested).To4()
+		if ip == nil || ipToUint32(ip) < ipToUint32(first) || ipToUint32(ip) > ipToUint32(last) {
+			return "", fmt.Errorf("Invalid --ip %s: not an address of the containers of network %s (%s)", requested, n.Name, n.Subnet)
+		}
+		if ip.String() == n.Gateway {
+			return "", fmt.Errorf("Invalid --ip %s: it's the gateway of network %s", requested, n.Name)
+		}
+		if taken[ip.String()] {
+			return "", fmt.Errorf("Address %s is already in use on network %s", requested, n.Name)
+		}
+		return ip.String(), nil
+	}
+	for value := ipToUint32(first); value <= ipToUint32(last); value++ {
+		address := uint32ToIP(value).String()
+		if !taken[address] {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("No address left in network %s", n.Name)
+}
+
+// maxIPv6Candidates is how many addresses of an IPv6 subnet are tried for a
+// container before giving up, the subnets are far too large to go through
+const maxIPv6Candidates = 1 << 16
+
+// The below function is pickAddress for the IPv6 subnet of a dual stack
+// network. Its first address is the subnet itself, IPv6 has no broadcast
+func (n *Network) pickAddress6(requested string, subnet *net.IPNet, taken map[string]bool) (string, error) {
+	if requested != "" {
+		ip := net.ParseIP(requested)
+		if ip == nil || ip.To4() != nil || !subnet.Contains(ip) || ip.Equal(subnet.IP) {
+			return "", fmt.Errorf("Invalid --ip6 %s: not an address of the containers of network %s (%s)", requested, n.Name, n.IPv6Subnet)
+		}
+		if ip.Equal(net.ParseIP(n.IPv6Gateway)) {
+			return "", fmt.Errorf("Invalid --ip6 %s: it's the gateway of network %s", requested, n.Name)
+		}
+		if taken[ip.String()] {
+			return "", fmt.Errorf("Address %s is already in use on network %s", requested, n.Name)
+		}
+		return ip.String(), nil
+	}
+	for offset := uint64(1); offset <= maxIPv6Candidates; offset++ {
+		ip := ipv6Add(subnet.IP, offset)
+		if !subnet.Contains(ip) {
+			break
+		}
+		if !taken[ip.String()] {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("No IPv6 address left in network %s", n.Name)
+}
+
+// This function returns the IPv6 address offset addresses after ip
+func ipv6Add(ip net.IP, offset uint64) net.IP {
+	ip = append(net.IP{}, ip.To16()...)
+	low := binary.BigEndian.Uint64(ip[8:]) + offset
+	if low < offset {
+		// the carry goes to the high half
+		binary.BigEndian.PutUint64(ip[:8], binary.BigEndian.Uint64(ip[:8])+1)
+	}
+	binary.BigEndian.PutUint64(ip[8:], low)
+	return ip
+}
+
+// The below function returns the first and the last address of subnet a host
+// may have, the first address is the subnet itself and the last one
+// broadcasts. Both are nil for a subnet that isn't IPv4 or has no room
+func subnetHosts(subnet *net.IPNet) (net.IP, net.IP) {
+	prefixLen, bits := subnet.Mask.Size()
+	ip := subnet.IP.To4()
+	if ip == nil || bits != 32 || prefixLen > 30 {
+		return nil, nil
+	}
+	network := ipToUint32(ip)
+	size := uint32(1) << uint(bits-prefixLen)
+	return uint32ToIP(network + 1), uint32ToIP(network + size - 2)
+}
+
+// This function returns an IPv4 address as a number
+func ipToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+// This function returns the IPv4 address of a number
+func uint32ToIP(value uint32) net.IP {
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// The below function plugs the network namespace of the process pid into the
+// network: a veth pair is created with one end moved into the namespace as
+// eth0 and the other end on the bridge
+func (n *Network) attach(settings *NetworkSettings, pid int) error {
+	args := []string{"link", "add", settings.HostVeth, "type", "veth", "peer", "name", "eth0", "netns", fmt.Sprint(pid)}
+	if settings.MacAddress != "" {
+		args = append(args, "address", settings.MacAddress)
+	}
+	err := runTool("ip", args...)
+	if err != nil {
+		return err
+	}
+	err = runTool("ip", "link", "set", settings.HostVeth, "master", n.Bridge)
+	if err != nil {
+		return err
+	}
+	return runTool("ip", "link", "set", settings.HostVeth, "up")
+}
+
+// This function returns the config the container init needs for the settings
+func (s *NetworkSettings) initConfig() *networkConfig {
+	config := &networkConfig{Interface: "eth0", Address: fmt.Sprintf("%s/%d", s.IPAddress, s.PrefixLen), Gateway: s.Gateway}
+	if s.GlobalIPv6Address != "" {
+		config.Address6 = fmt.Sprintf("%s/%d", s.GlobalIPv6Address, s.GlobalIPv6PrefixLen)
+		config.Gateway6 = s.IPv6Gateway
+	}
+	return config
+}
+
+// The below function configures the network namespace of the container from
+// the inside, before the container init leaves the file system of the host
+// where ip is: loopback is brought up, and eth0 when the container has one
+func configureNetwork(config *networkConfig) error {
+	ip, err := lookPath("ip", nil)
+	if err != nil {
+		return err
+	}
+	commands := [][]string{{"link", "set", "lo", "up"}}
+	if config.Interface != "" {
+		commands = append(commands,
+			[]string{"addr", "add", config.Address, "dev", config.Interface},
+			[]string{"link", "set", config.Interface, "up"},
+			[]string{"route", "add", "default", "via", config.Gateway})
+	}
+	if config.Address6 != "" {
+		commands = append(commands,
+			[]string{"-6", "addr", "add", config.Address6, "dev", config.Interface, "nodad"},
+			[]string{"-6", "route", "add", "default", "via", config.Gateway6, "dev", config.Interface})
+	}
+	for _, args := range commands {
+		err = runTool(ip, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function runs a tool like ip or iptables, its output is part of the error
+func runTool(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error running %s %s: %v: %s", filepath.Base(name), strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
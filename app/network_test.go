@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// The below function makes dataRoot a temporary directory for the test and
+// saves the containers in it
+func saveTestContainers(t *testing.T, containers ...*Container) {
+	root := dataRoot
+	dataRoot = t.TempDir()
+	t.Cleanup(func() { dataRoot = root })
+	for _, container := range containers {
+		err := os.MkdirAll(containerDir(container.Id), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = container.save()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseNetworkModeContainerName(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	exited := &Container{Id: "aaaa1111", Name: "web", Created: created.Add(time.Hour)}
+	running := &Container{Id: "bbbb2222", Name: "web", Created: created, State: ContainerState{Running: true, Pid: os.Getpid()}}
+	other := &Container{Id: "cccc3333", Name: "db", Created: created}
+	saveTestContainers(t, exited, running, other)
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		// the running one wins over the one created last
+		{"container:web", "container:bbbb2222"},
+		{"container:db", "container:cccc3333"},
+		{"container:cccc3333", "container:cccc3333"},
+		{"container:aaaa", "container:aaaa1111"},
+	}
+	for _, test := range tests {
+		mode, err := parseNetworkMode(test.value)
+		if err != nil {
+			t.Errorf("parseNetworkMode(%q): %v", test.value, err)
+			continue
+		}
+		if mode != test.want {
+			t.Errorf("parseNetworkMode(%q) = %q, want %q", test.value, mode, test.want)
+		}
+	}
+
+	for _, value := range []string{"container:cache", "container:..", "container:"} {
+		if mode, err := parseNetworkMode(value); err == nil {
+			t.Errorf("parseNetworkMode(%q) = %q, want an error", value, mode)
+		}
+	}
+}
+
+func TestFindContainerExitedName(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	older := &Container{Id: "aaaa1111", Name: "job", Created: created}
+	newer := &Container{Id: "bbbb2222", Name: "job", Created: created.Add(time.Hour)}
+	saveTestContainers(t, older, newer)
+
+	container, err := findContainer("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.Id != newer.Id {
+		t.Errorf("findContainer(%q) = %s, want the one created last, %s", "job", container.Id, newer.Id)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// bridgeNameOption is the -o option of network create naming the bridge
+const bridgeNameOption = "com.docker.network.bridge.name"
+
+// NetworkInspect is what `network inspect` prints for a network, the network
+// along with the containers connected to it
+type NetworkInspect struct {
+	Network
+	Containers map[string]NetworkEndpoint
+}
+
+// NetworkEndpoint is a container connected to a network, its addresses come
+// with the prefix length of the subnet
+type NetworkEndpoint struct {
+	Name        string `json:",omitempty"`
+	IPv4Address string
+	IPv6Address string `json:",omitempty"`
+}
+
+// Usage: your_docker.sh network create|ls|inspect|rm ...
+func networkCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: network create|ls|inspect|rm ...")
+	}
+	switch args[0] {
+	case "create":
+		return networkCreateCommand(args[1:])
+	case "ls", "list":
+		return networkLsCommand(args[1:])
+	case "inspect":
+		return networkInspectCommand(args[1:])
+	case "rm", "remove":
+		return networkRmCommand(args[1:])
+	default:
+		return fmt.Errorf("Unknown network command: %s", args[0])
+	}
+}
+
+// Usage: your_docker.sh network create [--subnet cidr] [--gateway ip] [--ipv6] [-o com.docker.network.bridge.name=name] <name>
+// without --subnet the network gets a free one of 172.21.0.0/16 to
+// 172.31.0.0/16 or 192.168.0.0/16. A dual stack network, with --ipv6 or an
+// IPv6 --subnet, gets a random unique local /64 when none is given. The bridge
+// is created by the first run connecting a container to the network
+func networkCreateCommand(args []string) error {
+	flags := flag.NewFlagSet("network create", flag.ContinueOnError)
+	driver := flags.String("driver", "bridge", "driver of the network, only bridge")
+	flags.StringVar(driver, "d", "bridge", "driver of the network, only bridge")
+	var subnetFlags, gatewayFlags stringList
+	flags.Var(&subnetFlags, "subnet", "subnet of the network, e.g. 172.30.0.0/16, and its IPv6 one")
+	flags.Var(&gatewayFlags, "gateway", "address of the bridge in the subnet, the first one by default")
+	ipv6 := flags.Bool("ipv6", false, "give the network an IPv6 subnet too")
+	var options stringList
+	flags.Var(&options, "o", "driver option, com.docker.network.bridge.name=<name>")
+	flags.Var(&options, "opt", "driver option, com.docker.network.bridge.name=<name>")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: network create [--subnet cidr] [--gateway ip] [--ipv6] [-o %s=name] <name>", bridgeNameOption)
+	}
+	name := flags.Arg(0)
+	if !validName(name) {
+		return fmt.Errorf("Invalid network name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	if name == defaultNetworkName || name == "host" || name == "none" {
+		return fmt.Errorf("%s is a pre-defined network and cannot be created", name)
+	}
+	if _, err := os.Stat(networkPath(name, ".json")); err == nil {
+		return fmt.Errorf("Network with name %s already exists", name)
+	}
+	if *driver != "bridge" {
+		return fmt.Errorf("Unsupported driver %s: only bridge networks are supported", *driver)
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	network := &Network{Name: name, Id: id, Created: time.Now().UTC(), Driver: *driver, Bridge: "br-" + id[:12]}
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		if key != bridgeNameOption {
+			return fmt.Errorf("Unknown option %s: only %s is supported", key, bridgeNameOption)
+		}
+		// the kernel limits interface names to 15 characters
+		if value == "" || len(value) > 15 || strings.ContainsAny(value, "/ ") {
+			return fmt.Errorf("Invalid bridge name %q", value)
+		}
+		network.Bridge = value
+	}
+
+	// one subnet and gateway of each family at most
+	var subnet, subnet6 *net.IPNet
+	for _, value := range subnetFlags {
+		ip, parsed, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("Invalid --subnet %q: expected a subnet, e.g. 172.30.0.0/16", value)
+		}
+		target := &subnet
+		if ip.To4() == nil {
+			target = &subnet6
+		}
+		if *target != nil {
+			return fmt.Errorf("Invalid --subnet %q: only one subnet of each IP version is supported", value)
+		}
+		*target = parsed
+	}
+	var gateway, gateway6 net.IP
+	for _, value := range gatewayFlags {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("Invalid --gateway %q: expected an address", value)
+		}
+		target := &gateway
+		if ip.To4() == nil {
+			target = &gateway6
+		}
+		if *target != nil {
+			return fmt.Errorf("Invalid --gateway %q: only one gateway of each IP version is supported", value)
+		}
+		*target = ip
+	}
+	network.EnableIPv6 = *ipv6 || subnet6 != nil
+	if gateway6 != nil && !network.EnableIPv6 {
+		return fmt.Errorf("Invalid --gateway %s: the network has no IPv6 subnet, give it --ipv6", gateway6)
+	}
+
+	networks, err := listNetworks()
+	if err != nil {
+		return err
+	}
+	for _, other := range networks {
+		if other.Bridge == network.Bridge {
+			return fmt.Errorf("Bridge %s is the one of network %s", network.Bridge, other.Name)
+		}
+		if subnet != nil && subnetsOverlap(subnet, other.Subnet) {
+			return fmt.Errorf("Subnet %s overlaps with network %s (%s)", subnet, other.Name, other.Subnet)
+		}
+		if subnet6 != nil && subnetsOverlap(subnet6, other.IPv6Subnet) {
+			return fmt.Errorf("Subnet %s overlaps with network %s (%s)", subnet6, other.Name, other.IPv6Subnet)
+		}
+	}
+	if subnet == nil {
+		subnet, err = freeSubnet(networks)
+		if err != nil {
+			return err
+		}
+	}
+	network.Subnet = subnet.String()
+
+	first, last := subnetHosts(subnet)
+	if first == nil {
+		return fmt.Errorf("Subnet %s has no room for containers", subnet)
+	}
+	network.Gateway = first.String()
+	if gateway != nil {
+		if !subnet.Contains(gateway) || ipToUint32(gateway) < ipToUint32(first) || ipToUint32(gateway) > ipToUint32(last) {
+			return fmt.Errorf("Invalid --gateway %s: expected an address of subnet %s", gateway, subnet)
+		}
+		network.Gateway = gateway.String()
+	}
+
+	if network.EnableIPv6 {
+		if subnet6 == nil {
+			subnet6, err = uniqueLocalSubnet()
+			if err != nil {
+				return err
+			}
+		}
+		if prefixLen, _ := subnet6.Mask.Size(); prefixLen > 126 {
+			return fmt.Errorf("Subnet %s has no room for containers", subnet6)
+		}
+		network.IPv6Subnet = subnet6.String()
+		network.IPv6Gateway = ipv6Add(subnet6.IP, 1).String()
+		if gateway6 != nil {
+			if !subnet6.Contains(gateway6) || gateway6.Equal(subnet6.IP) {
+				return fmt.Errorf("Invalid --gateway %s: expected an address of subnet %s", gateway6, subnet6)
+			}
+			network.IPv6Gateway = gateway6.String()
+		}
+	}
+
+	err = network.save()
+	if err != nil {
+		return err
+	}
+	fmt.Println(network.Id)
+	return nil
+}
+
+// The below function returns a random /64 of the unique local addresses, the
+// way RFC 4193 has them picked: fd followed by a random global id of 40 bits
+func uniqueLocalSubnet() (*net.IPNet, error) {
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	_, err := io.ReadFull(rand.Reader, ip[1:6])
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}, nil
+}
+
+// The below function picks a subnet for a network from the pools docker uses,
+// the first one that doesn't overlap with another network or with an address
+// of the host
+func freeSubnet(networks []*Network) (*net.IPNet, error) {
+	var candidates []string
+	for i := 21; i <= 31; i++ {
+		candidates = append(candidates, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	for i := 0; i < 256; i += 16 {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d.0/20", i))
+	}
+	hostAddrs, _ := net.InterfaceAddrs()
+
+next:
+	for _, candidate := range candidates {
+		_, subnet, _ := net.ParseCIDR(candidate)
+		if defaultSubnet, err := defaultNetworkSubnet(); err == nil && subnetsOverlap(subnet, defaultSubnet) {
+			continue
+		}
+		for _, network := range networks {
+			if subnetsOverlap(subnet, network.Subnet) {
+				continue next
+			}
+		}
+		for _, addr := range hostAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && (subnet.Contains(ipNet.IP) || ipNet.Contains(subnet.IP)) {
+				continue next
+			}
+		}
+		return subnet, nil
+	}
+	return nil, fmt.Errorf("No free subnet left, give one with --subnet")
+}
+
+// This function returns the subnet the default network has or will get
+func defaultNetworkSubnet() (string, error) {
+	network, err := readNetwork(defaultNetworkName)
+	if err == nil {
+		return network.Subnet, nil
+	}
+	address := bridgeIP
+	if address == "" {
+		address = defaultBridgeIP
+	}
+	_, subnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", err
+	}
+	return subnet.String(), nil
+}
+
+// This function reports whether the subnets share addresses
+func subnetsOverlap(subnet *net.IPNet, other string) bool {
+	_, otherNet, err := net.ParseCIDR(other)
+	return err == nil && (subnet.Contains(otherNet.IP) || otherNet.Contains(subnet.IP))
+}
+
+// Usage: your_docker.sh network ls [-q]
+func networkLsCommand(args []string) error {
+	flags := flag.NewFlagSet("network ls", flag.ContinueOnError)
+	quiet := flags.Bool("q", false, "only show network IDs")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: network ls [-q]")
+	}
+	networks, err := listNetworks()
+	if err != nil {
+		return err
+	}
+	if *quiet {
+		for _, network := range networks {
+			fmt.Println(shortID(network.Id))
+		}
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(writer, "NETWORK ID\tNAME\tDRIVER\tSUBNET\tGATEWAY")
+	for _, network := range networks {
+		subnet, gateway := network.Subnet, network.Gateway
+		if network.EnableIPv6 {
+			subnet += "," + network.IPv6Subnet
+			gateway += "," + network.IPv6Gateway
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", shortID(network.Id), network.Name, network.Driver, subnet, gateway)
+	}
+	return writer.Flush()
+}
+
+// Usage: your_docker.sh network inspect <network> ...
+func networkInspectCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: network inspect <network> ...")
+	}
+	networks := []*NetworkInspect{}
+	for _, ref := range args {
+		network, err := findNetwork(ref)
+		if err != nil {
+			return err
+		}
+		containers, err := network.endpoints()
+		if err != nil {
+			return err
+		}
+		inspect := &NetworkInspect{Network: *network, Containers: map[string]NetworkEndpoint{}}
+		for _, container := range containers {
+			settings := container.NetworkSettings
+			endpoint := NetworkEndpoint{Name: container.Name, IPv4Address: fmt.Sprintf("%s/%d", settings.IPAddress, settings.PrefixLen)}
+			if settings.GlobalIPv6Address != "" {
+				endpoint.IPv6Address = fmt.Sprintf("%s/%d", settings.GlobalIPv6Address, settings.GlobalIPv6PrefixLen)
+			}
+			inspect.Containers[container.Id] = endpoint
+		}
+		networks = append(networks, inspect)
+	}
+	data, err := json.Marshal(networks)
+	if err != nil {
+		return err
+	}
+	return printJSON(data)
+}
+
+// Usage: your_docker.sh network rm <network> ...
+// networks containers are connected to are kept
+func networkRmCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: network rm <network> ...")
+	}
+	for _, ref := range args {
+		network, err := findNetwork(ref)
+		if err != nil {
+			return err
+		}
+		if network.Name == defaultNetworkName {
+			return fmt.Errorf("%s is a pre-defined network and cannot be removed", network.Name)
+		}
+		used, err := network.addresses()
+		if err != nil {
+			return err
+		}
+		if len(used) > 0 {
+			return fmt.Errorf("Error removing network %s: %d containers are connected to it", network.Name, len(used))
+		}
+		err = network.remove()
+		if err != nil {
+			return fmt.Errorf("Error removing network %s: %v", network.Name, err)
+		}
+		fmt.Println(ref)
+	}
+	return nil
+}
+
+// The below function removes the network: its bridge, its NAT rules and its
+// files in the data root
+func (n *Network) remove() error {
+	if _, err := net.InterfaceByName(n.Bridge); err == nil {
+		err = runTool("ip", "link", "delete", n.Bridge)
+		if err != nil {
+			return err
+		}
+	}
+	subnets := map[string]string{"iptables": n.Subnet}
+	if n.EnableIPv6 {
+		subnets["ip6tables"] = n.IPv6Subnet
+	}
+	for tool, subnet := range subnets {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		for _, rule := range n.natRules(subnet) {
+			exec.Command(tool, append([]string{"-t", rule[0], "-D", rule[1]}, rule[2:]...)...).Run()
+		}
+	}
+	os.Remove(networkPath(n.Name, ".lock"))
+	return os.Remove(networkPath(n.Name, ".json"))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// annotations naming the images of an OCI layout, ref.name is usually only the
+// tag while containerd keeps the whole reference in its own annotation
+const (
+	ociRefNameAnnotation      = "org.opencontainers.image.ref.name"
+	containerdImageAnnotation = "io.containerd.image.name"
+	ociLayoutFile             = "oci-layout"
+	ociLayoutVersion          = `{"imageLayoutVersion":"1.0.0"}`
+	ociIndexFile              = "index.json"
+	ociBlobsDir               = "blobs/sha256"
+)
+
+// ociIndex is the index.json of an OCI image layout
+type ociIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// layoutWriter writes the files of an OCI layout, either into a tar archive
+// or into a directory
+type layoutWriter interface {
+	writeFile(name string, size int64, r io.Reader) error
+}
+
+// tarLayout writes the layout as an oci-archive
+type tarLayout struct {
+	tw *tar.Writer
+}
+
+func (t *tarLayout) writeFile(name string, size int64, r io.Reader) error {
+	return writeTarFile(t.tw, name, size, r)
+}
+
+// dirLayout writes the layout into a directory
+type dirLayout struct {
+	dir string
+}
+
+func (d *dirLayout) writeFile(name string, size int64, r io.Reader) error {
+	path := filepath.Join(d.dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, r, size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// The below function writes the images as an OCI image layout: their blobs as
+// they are in the store under blobs/sha256 and an index.json naming them.
+// index holds the images the layout already has, they are kept unless one of
+// the images replaces their name
+func writeOCILayout(layout layoutWriter, store *imageStore, images []savedImage, index *ociIndex) error {
+	written := map[string]bool{}
+	writeBlob := func(digest string) error {
+		if written[digest] {
+			return nil
+		}
+		file, err := os.Open(store.blobPath(digest))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		written[digest] = true
+		return layout.writeFile(ociBlobsDir+"/"+strings.TrimPrefix(digest, "sha256:"), info.Size(), file)
+	}
+
+	for _, image := range images {
+		raw, err := store.readBlob(image.digest)
+		if err != nil {
+			return err
+		}
+		for _, blob := range append([]Descriptor{image.manifest.Config}, image.manifest.Layers...) {
+			err = writeBlob(blob.Digest)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeBlob(image.digest)
+		if err != nil {
+			return err
+		}
+
+		mediaType := image.manifest.MediaType
+		if mediaType == "" {
+			mediaType = mediaTypeOCIManifest
+		}
+		descriptor := Descriptor{MediaType: mediaType, Digest: image.digest, Size: int64(len(raw))}
+		if image.tag != "" {
+			ref, _ := parseReference(image.tag)
+			descriptor.Annotations = map[string]string{
+				ociRefNameAnnotation:      ref.tag,
+				containerdImageAnnotation: ref.canonical(),
+			}
+			// a name points to a single image
+			kept := []Descriptor{}
+			for _, existing := range index.Manifests {
+				if existing.Annotations[ociRefNameAnnotation] != ref.tag {
+					kept = append(kept, existing)
+				}
+			}
+			index.Manifests = kept
+		}
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+
+	err := layout.writeFile(ociLayoutFile, int64(len(ociLayoutVersion)), strings.NewReader(ociLayoutVersion))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return layout.writeFile(ociIndexFile, int64(len(data)), bytes.NewReader(data))
+}
+
+// This function reads the index.json of an OCI layout directory, an empty index
+// is returned when there is no layout there yet
+func readOCIIndex(dir string) (*ociIndex, error) {
+	index := &ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []Descriptor{}}
+	data, err := os.ReadFile(filepath.Join(dir, ociIndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OCI layout %s: %v", dir, err)
+	}
+	return index, nil
+}
+
+// The below function adds the images of an OCI layout directory to the store.
+// Blobs are copied as they are so the digests stay the same, images are named
+// after the reference containerd recorded or ref.name when it's a full reference
+func loadOCILayout(store *imageStore, dir string) ([]loadedImage, error) {
+	if _, err := os.Stat(filepath.Join(dir, ociLayoutFile)); err != nil {
+		return nil, fmt.Errorf("Invalid OCI layout %s: %v", dir, err)
+	}
+	index, err := readOCIIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	images := []loadedImage{}
+	for _, descriptor := range index.Manifests {
+		manifestDigest, err := copyOCIImage(store, dir, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := store.readManifest(manifestDigest)
+		if err != nil {
+			return nil, err
+		}
+		image := loadedImage{digest: manifestDigest, id: manifest.Config.Digest, refName: descriptor.Annotations[ociRefNameAnnotation]}
+		name := descriptor.Annotations[containerdImageAnnotation]
+		if name == "" && strings.ContainsAny(image.refName, ":/") {
+			name = image.refName
+		}
+		if name != "" {
+			ref, err := parseReference(name)
+			if err != nil {
+				return nil, err
+			}
+			image.names = []string{ref.String()}
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// The below function copies the image descriptor points to from an OCI layout
+// into the store and returns the digest of its manifest. For an image index
+// the manifest of the target platform is copied
+func copyOCIImage(store *imageStore, dir string, descriptor Descriptor) (string, error) {
+	copyBlob := func(digest string) error {
+		// the digest is a file name of the layout and of the store
+		if !sha256Regexp.MatchString(digest) {
+			return fmt.Errorf("Unsupported digest %s in OCI layout", digest)
+		}
+		if store.hasBlob(digest) {
+			return nil
+		}
+		file, err := os.Open(filepath.Join(dir, ociBlobsDir, strings.TrimPrefix(digest, "sha256:")))
+		if err != nil {
+			return fmt.Errorf("Invalid OCI layout %s: %v", dir, err)
+		}
+		defer file.Close()
+		return store.writeBlob(digest, file)
+	}
+
+	if !sha256Regexp.MatchString(descriptor.Digest) {
+		return "", fmt.Errorf("Unsupported digest %s in OCI layout", descriptor.Digest)
+	}
+	if isManifestList(descriptor.MediaType) {
+		data, err := os.ReadFile(filepath.Join(dir, ociBlobsDir, strings.TrimPrefix(descriptor.Digest, "sha256:")))
+		if err != nil {
+			return "", fmt.Errorf("Invalid OCI layout %s: %v", dir, err)
+		}
+		var nested ociIndex
+		err = json.Unmarshal(data, &nested)
+		if err != nil {
+			return "", err
+		}
+		for _, manifest := range nested.Manifests {
+			if manifest.Platform != nil && manifest.Platform.matches(targetPlatform) {
+				return copyOCIImage(store, dir, manifest)
+			}
+		}
+		return "", fmt.Errorf("No image for %s in index %s", targetPlatform, descriptor.Digest)
+	}
+
+	err := copyBlob(descriptor.Digest)
+	if err != nil {
+		return "", err
+	}
+	manifest, err := store.readManifest(descriptor.Digest)
+	if err != nil {
+		return "", err
+	}
+	err = checkDigests(manifest)
+	if err != nil {
+		return "", fmt.Errorf("Invalid OCI layout %s: %v", dir, err)
+	}
+	for _, blob := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+		err = copyBlob(blob.Digest)
+		if err != nil {
+			return "", err
+		}
+	}
+	return descriptor.Digest, nil
+}
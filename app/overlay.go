@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The below function extracts the layers of the image into the layer store if
+// they aren't there yet and returns their directories, the top layer first like
+// overlayfs wants them
+func (s *imageStore) layerDirs(manifest *ManifestResponse, config *ImageConfig) ([]string, error) {
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("Image %s has %d layers but %d diff ids", manifest.Config.Digest, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	lowers := []string{}
+	for i, layer := range manifest.Layers {
+		layerDir, err := s.extractLayer(layer, config.RootFS.DiffIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error extracting layer %s: %v", layer.Digest, err)
+		}
+		lowers = append([]string{layerDir}, lowers...)
+	}
+	return lowers, nil
+}
+
+// The below function prepares the directories of an overlayfs for the root
+// file system of a container: the extracted layers of the image are the read
+// only lower directories and dir/upper gets everything the container writes.
+// Shared base layers are used where they are in the layer store, nothing is
+// copied. It returns the mount point and the mount options
+func (s *imageStore) overlayDirs(manifest *ManifestResponse, config *ImageConfig, dir string) (string, string, error) {
+	lowers, err := s.layerDirs(manifest, config)
+	if err != nil {
+		return "", "", err
+	}
+
+	upper := filepath.Join(dir, "upper")
+	work := filepath.Join(dir, "work")
+	merged := filepath.Join(dir, "merged")
+	for _, d := range []string{upper, work, merged} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	// overlayfs needs a lower directory even for an image without layers
+	if len(lowers) == 0 {
+		empty := filepath.Join(dir, "empty")
+		err := os.MkdirAll(empty, 0755)
+		if err != nil {
+			return "", "", err
+		}
+		lowers = append(lowers, empty)
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work)
+	return merged, options, nil
+}
+
+// overlayDriver mounts the layers with the overlayfs of the kernel, which
+// needs root
+type overlayDriver struct{}
+
+func (d *overlayDriver) name() string {
+	return "overlay"
+}
+
+func (d *overlayDriver) supported() bool {
+	return os.Geteuid() == 0 && kernelHasFilesystem("overlay")
+}
+
+func (d *overlayDriver) mount(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir, mountLabel string) (string, error) {
+	merged, options, err := store.overlayDirs(manifest, config, dir)
+	if err != nil {
+		return "", err
+	}
+	options = mountLabelOption(options, mountLabel)
+	if len(options) >= os.Getpagesize() {
+		return "", fmt.Errorf("Image %s has too many layers to mount them with overlayfs", manifest.Config.Digest)
+	}
+	err = syscall.Mount("overlay", merged, "overlay", 0, options)
+	if err != nil {
+		return "", fmt.Errorf("Error mounting overlayfs: %v", err)
+	}
+	return merged, nil
+}
+
+func (d *overlayDriver) mountImage(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir string) (string, error) {
+	mountPoint, options, err := store.imageOverlayDirs(manifest, config, dir)
+	if err != nil || options == "" {
+		return mountPoint, err
+	}
+	if len(options) >= os.Getpagesize() {
+		return "", fmt.Errorf("Image %s has too many layers to mount them with overlayfs", manifest.Config.Digest)
+	}
+	err = syscall.Mount("overlay", mountPoint, "overlay", syscall.MS_RDONLY, options)
+	if err != nil {
+		return "", fmt.Errorf("Error mounting overlayfs: %v", err)
+	}
+	return mountPoint, nil
+}
+
+func (d *overlayDriver) unmount(rootfs string) error {
+	return syscall.Unmount(rootfs, syscall.MNT_DETACH)
+}
+
+// fuseOverlayDriver mounts the layers with fuse-overlayfs, an overlayfs in
+// user space that works without root. It understands the OCI whiteout markers
+// extracted layers keep when we couldn't write overlayfs whiteouts
+type fuseOverlayDriver struct{}
+
+func (d *fuseOverlayDriver) name() string {
+	return "fuse-overlayfs"
+}
+
+func (d *fuseOverlayDriver) supported() bool {
+	if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+		return false
+	}
+	_, err := os.Stat("/dev/fuse")
+	return err == nil
+}
+
+func (d *fuseOverlayDriver) mount(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir, mountLabel string) (string, error) {
+	merged, options, err := store.overlayDirs(manifest, config, dir)
+	if err != nil {
+		return "", err
+	}
+	options = mountLabelOption(options, mountLabel)
+	cmd := exec.Command("fuse-overlayfs", "-o", options, merged)
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Error mounting fuse-overlayfs: %v", err)
+	}
+	return merged, nil
+}
+
+func (d *fuseOverlayDriver) mountImage(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir string) (string, error) {
+	mountPoint, options, err := store.imageOverlayDirs(manifest, config, dir)
+	if err != nil || options == "" {
+		return mountPoint, err
+	}
+	cmd := exec.Command("fuse-overlayfs", "-o", options, mountPoint)
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Error mounting fuse-overlayfs: %v", err)
+	}
+	return mountPoint, nil
+}
+
+func (d *fuseOverlayDriver) unmount(rootfs string) error {
+	// fuse 3 comes with fusermount3, older systems only have fusermount
+	fusermount := "fusermount3"
+	if _, err := exec.LookPath(fusermount); err != nil {
+		fusermount = "fusermount"
+	}
+	return exec.Command(fusermount, "-u", rootfs).Run()
+}
+
+// The below function prepares the read only overlayfs of the image alone, used
+// to compare a container with its image. It returns the mount point and the
+// mount options, no options means there is nothing to mount: an image with a
+// single layer is that layer
+func (s *imageStore) imageOverlayDirs(manifest *ManifestResponse, config *ImageConfig, dir string) (string, string, error) {
+	lowers, err := s.layerDirs(manifest, config)
+	if err != nil {
+		return "", "", err
+	}
+	// overlayfs needs two lower directories when there is no upper one
+	switch len(lowers) {
+	case 0:
+		empty := filepath.Join(dir, "empty")
+		return empty, "", os.MkdirAll(empty, 0755)
+	case 1:
+		return lowers[0], "", nil
+	}
+	mountPoint := filepath.Join(dir, "image")
+	err = os.MkdirAll(mountPoint, 0755)
+	if err != nil {
+		return "", "", err
+	}
+	return mountPoint, "lowerdir=" + strings.Join(lowers, ":"), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// targetPlatform is the platform of the images we pull and build, ours unless
+// build --platform asks for another one
+var targetPlatform = Platform{OS: "linux", Architecture: runtime.GOARCH}
+
+// The below function parses a platform in the os/arch[/variant] form, e.g.
+// linux/arm64 or linux/arm/v7. Only linux is supported
+func parsePlatform(value string) (Platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("Invalid platform %q: expected os/arch[/variant]", value)
+	}
+	if parts[0] != "linux" {
+		return Platform{}, fmt.Errorf("Unsupported platform %s: only linux images can be run", value)
+	}
+	platform := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// This function reports whether an image of the platform is one of the target
+// platform, a variant only matters when the target asks for one
+func (p Platform) matches(target Platform) bool {
+	return p.OS == target.OS && p.Architecture == target.Architecture && (target.Variant == "" || p.Variant == target.Variant)
+}
+
+// The below function picks the manifest of the target platform in a manifest
+// list or image index and returns its digest
+func selectPlatform(raw []byte) (string, error) {
+	var list ManifestList
+	err := json.Unmarshal(raw, &list)
+	if err != nil {
+		return "", err
+	}
+	for _, manifest := range list.Manifests {
+		if manifest.Platform != nil && manifest.Platform.matches(targetPlatform) {
+			return manifest.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("No image for %s in the manifest list", targetPlatform)
+}
+
+// qemuArchitectures maps the architectures of images to the names qemu gives
+// its user mode emulators, qemu-<name>
+var qemuArchitectures = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i386",
+	"arm64":    "aarch64",
+	"arm":      "arm",
+	"ppc64le":  "ppc64le",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64le": "mips64el",
+}
+
+// binfmtDir is where the kernel lists the interpreters of foreign binaries
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// The below function checks that binaries of the architecture can run here:
+// ours and the ones the cpu runs as they are need nothing, the others need a
+// qemu user mode emulator registered with binfmt_misc. The emulator has to be
+// registered with the F flag, the kernel then opens it once for all and it
+// works from inside the root file system of a container too
+func checkEmulation(arch string) error {
+	if arch == runtime.GOARCH || (runtime.GOARCH == "amd64" && arch == "386") || (runtime.GOARCH == "arm64" && arch == "arm") {
+		return nil
+	}
+	qemuArch, ok := qemuArchitectures[arch]
+	if !ok {
+		return fmt.Errorf("Cannot run %s binaries: no qemu emulator is known for the architecture", arch)
+	}
+	setup := fmt.Sprintf("register qemu-user-static with binfmt_misc first, e.g. with `docker run --privileged --rm tonistiigi/binfmt --install %s`", arch)
+	entries, err := filepath.Glob(filepath.Join(binfmtDir, "qemu-"+qemuArch+"*"))
+	if err != nil || len(entries) == 0 {
+		return fmt.Errorf("Cannot run %s binaries on %s: %s", arch, runtime.GOARCH, setup)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(entry)
+		if err != nil {
+			continue
+		}
+		enabled, fixBinary := false, false
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "enabled" {
+				enabled = true
+			}
+			if strings.HasPrefix(line, "flags: ") && strings.Contains(strings.TrimPrefix(line, "flags: "), "F") {
+				fixBinary = true
+			}
+		}
+		if enabled && fixBinary {
+			return nil
+		}
+	}
+	return fmt.Errorf("Cannot run %s binaries on %s: the qemu-%s emulator is disabled or registered without the F flag, %s", arch, runtime.GOARCH, qemuArch, setup)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortBinding is a port of a container published on the host with -p or -P
+type PortBinding struct {
+	HostIP        string // empty for every address of the host
+	HostPort      int
+	ContainerPort int
+	Protocol      string // tcp or udp
+}
+
+func (b PortBinding) String() string {
+	hostIP := b.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", b.ContainerPort, b.Protocol, net.JoinHostPort(hostIP, strconv.Itoa(b.HostPort)))
+}
+
+// The below function parses the value of -p, the way docker writes it:
+// [[hostIP:][hostPort]:]containerPort[/protocol], e.g. 8080:80, 80/udp,
+// 127.0.0.1::80 or [::1]:8080:80. A missing host port is picked by publishPorts
+func parsePublish(value string) (PortBinding, error) {
+	spec, protocol, hasProtocol := strings.Cut(value, "/")
+	if !hasProtocol {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return PortBinding{}, fmt.Errorf("Invalid -p %q: unknown protocol %s", value, protocol)
+	}
+	binding := PortBinding{Protocol: protocol}
+
+	// an IPv6 host address comes in brackets, its colons are not separators
+	var parts []string
+	if address, rest, ok := strings.Cut(strings.TrimPrefix(spec, "["), "]:"); ok && strings.HasPrefix(spec, "[") {
+		parts = append([]string{address}, strings.Split(rest, ":")...)
+		if ip := net.ParseIP(address); ip == nil || ip.To4() != nil || len(parts) != 3 {
+			return PortBinding{}, fmt.Errorf("Invalid -p %q: expected [ipv6]:[hostPort]:containerPort[/protocol]", value)
+		}
+	} else {
+		parts = strings.Split(spec, ":")
+	}
+	var hostPort, containerPort string
+	switch len(parts) {
+	case 1:
+		containerPort = parts[0]
+	case 2:
+		hostPort, containerPort = parts[0], parts[1]
+	case 3:
+		binding.HostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+		if net.ParseIP(binding.HostIP) == nil {
+			return PortBinding{}, fmt.Errorf("Invalid -p %q: invalid host address %s", value, binding.HostIP)
+		}
+	default:
+		return PortBinding{}, fmt.Errorf("Invalid -p %q: expected [[hostIP:][hostPort]:]containerPort[/protocol]", value)
+	}
+	var err error
+	binding.ContainerPort, err = parsePort(containerPort)
+	if err != nil {
+		return PortBinding{}, fmt.Errorf("Invalid -p %q: %v", value, err)
+	}
+	if hostPort != "" {
+		binding.HostPort, err = parsePort(hostPort)
+		if err != nil {
+			return PortBinding{}, fmt.Errorf("Invalid -p %q: %v", value, err)
+		}
+	}
+	return binding, nil
+}
+
+// This function parses a port number
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
+
+// The below function returns the bindings -P gives: every port the image
+// exposes, on a port of the host picked by publishPorts
+func exposedPortBindings(exposed map[string]struct{}) ([]PortBinding, error) {
+	var bindings []PortBinding
+	for port := range exposed {
+		binding, err := parsePublish(port)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exposed port of the image: %v", err)
+		}
+		bindings = append(bindings, binding)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		return bindings[i].ContainerPort < bindings[j].ContainerPort
+	})
+	return bindings, nil
+}
+
+// The below function publishes the ports of the container on the host and
+// returns the function taking them back once the container exited. DNAT rules
+// send what comes to the host ports to the container, without iptables or
+// where it may not be changed the ports go through proxies of ours instead
+func (n *Network) publishPorts(settings *NetworkSettings) (func(), error) {
+	if len(settings.Ports) == 0 {
+		return func() {}, nil
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return proxyPorts(settings)
+	}
+	ports := append([]PortBinding{}, settings.Ports...)
+	err := n.addDNATRules(settings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[Warning] %v, the ports are published through a proxy\n", err)
+		// the proxies pick their own ports where none was given
+		settings.Ports = ports
+		return proxyPorts(settings)
+	}
+	return func() { n.unpublishPorts(settings) }, nil
+}
+
+// The below function adds the DNAT rules sending what comes to the host ports
+// to the container. Host ports that are not given are picked by the kernel,
+// and every host port is checked to be free first so that a conflict doesn't
+// go unnoticed. A container with an IPv6 address gets the ports of the IPv6
+// addresses of the host too, through ip6tables
+func (n *Network) addDNATRules(settings *NetworkSettings) error {
+	for i := range settings.Ports {
+		binding := &settings.Ports[i]
+		if ip := net.ParseIP(binding.HostIP); ip != nil && ip.To4() == nil && settings.GlobalIPv6Address == "" {
+			return fmt.Errorf("Cannot publish %s: the container has no IPv6 address", binding)
+		}
+		err := reserveHostPort(binding)
+		if err != nil {
+			return err
+		}
+	}
+
+	tools := []string{"iptables"}
+	if settings.GlobalIPv6Address != "" {
+		if _, err := exec.LookPath("ip6tables"); err == nil {
+			tools = append(tools, "ip6tables")
+		} else {
+			fmt.Fprintf(os.Stderr, "[Warning] ip6tables not found, the ports are only published on the IPv4 addresses of the host\n")
+		}
+	}
+	for _, tool := range tools {
+		// the chain gets what is sent to an address of the host, from outside
+		// and from the host itself
+		loopback := "127.0.0.0/8"
+		if tool == "ip6tables" {
+			loopback = "::1/128"
+		}
+		if exec.Command(tool, "-t", "nat", "-L", portsChain, "-n").Run() != nil {
+			err := runTool(tool, "-t", "nat", "-N", portsChain)
+			if err != nil {
+				return err
+			}
+		}
+		err := ensureIptablesRule(tool, "nat", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", portsChain)
+		if err == nil {
+			err = ensureIptablesRule(tool, "nat", "OUTPUT", "!", "-d", loopback, "-m", "addrtype", "--dst-type", "LOCAL", "-j", portsChain)
+		}
+		if err != nil {
+			return err
+		}
+		for _, binding := range settings.Ports {
+			rule := n.dnatRule(tool, settings, binding)
+			if rule == nil {
+				continue
+			}
+			err = runTool(tool, append([]string{"-t", "nat", "-A", portsChain}, rule...)...)
+			if err != nil {
+				n.unpublishPorts(settings)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// portsChain is the chain of the nat table with the rules of published ports
+const portsChain = "MYDOCKER"
+
+// This function returns the DNAT rule of a published port for iptables or
+// ip6tables, nil when the port isn't published on addresses of that family
+func (n *Network) dnatRule(tool string, settings *NetworkSettings, binding PortBinding) []string {
+	target := settings.IPAddress
+	hostIP := net.ParseIP(binding.HostIP)
+	if tool == "ip6tables" {
+		target = settings.GlobalIPv6Address
+		if target == "" || hostIP != nil && hostIP.To4() != nil {
+			return nil
+		}
+	} else if hostIP != nil && hostIP.To4() == nil {
+		return nil
+	}
+	rule := []string{"!", "-i", n.Bridge, "-p", binding.Protocol}
+	if binding.HostIP != "" {
+		rule = append(rule, "-d", binding.HostIP)
+	}
+	return append(rule, "--dport", strconv.Itoa(binding.HostPort), "-j", "DNAT",
+		"--to-destination", net.JoinHostPort(target, strconv.Itoa(binding.ContainerPort)))
+}
+
+// The below function removes the DNAT rules of the ports of the container once
+// it exited, rules that are already gone are fine
+func (n *Network) unpublishPorts(settings *NetworkSettings) {
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		for _, binding := range settings.Ports {
+			rule := n.dnatRule(tool, settings, binding)
+			if rule != nil {
+				exec.Command(tool, append([]string{"-t", "nat", "-D", portsChain}, rule...)...).Run()
+			}
+		}
+	}
+}
+
+// The below function makes sure the host port of the binding is free by
+// binding it for a moment, a binding without a host port gets the one the
+// kernel picks
+func reserveHostPort(binding *PortBinding) error {
+	address := net.JoinHostPort(binding.HostIP, strconv.Itoa(binding.HostPort))
+	var port int
+	if binding.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return fmt.Errorf("Cannot publish %s: %v", binding, err)
+		}
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+	} else {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return fmt.Errorf("Cannot publish %s: %v", binding, err)
+		}
+		port = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+	}
+	binding.HostPort = port
+	return nil
+}
+
+// This function reports whether a binding publishes the container port of
+// binding already
+func hasContainerPort(bindings []PortBinding, binding PortBinding) bool {
+	for _, b := range bindings {
+		if b.ContainerPort == binding.ContainerPort && b.Protocol == binding.Protocol {
+			return true
+		}
+	}
+	return false
+}
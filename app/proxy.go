@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpProxyTimeout is how long the proxy of a udp port keeps the flow of a
+// client once the container stopped answering
+const udpProxyTimeout = 90 * time.Second
+
+// The below function publishes the ports of the container with proxies in our
+// own process: the host port is listened on and every connection, or udp
+// flow, is forwarded to the container. It's what is left where we can't add
+// DNAT rules, the proxies stop with the returned function
+func proxyPorts(settings *NetworkSettings) (func(), error) {
+	var closers []io.Closer
+	stop := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+	for i := range settings.Ports {
+		binding := &settings.Ports[i]
+		address := net.JoinHostPort(binding.HostIP, strconv.Itoa(binding.HostPort))
+		target := net.JoinHostPort(settings.IPAddress, strconv.Itoa(binding.ContainerPort))
+		if binding.Protocol == "udp" {
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				stop()
+				return nil, fmt.Errorf("Cannot publish %s: %v", binding, err)
+			}
+			binding.HostPort = conn.LocalAddr().(*net.UDPAddr).Port
+			closers = append(closers, conn)
+			go proxyUDP(conn, target)
+			continue
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("Cannot publish %s: %v", binding, err)
+		}
+		binding.HostPort = listener.Addr().(*net.TCPAddr).Port
+		closers = append(closers, listener)
+		go proxyTCP(listener, target)
+	}
+	return stop, nil
+}
+
+// This function forwards the connections accepted by listener to target
+func proxyTCP(listener net.Listener, target string) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer client.Close()
+			backend, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer backend.Close()
+			// each side is closed for writing once the other one is done, the
+			// way half closed connections expect it
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				io.Copy(backend, client)
+				backend.(*net.TCPConn).CloseWrite()
+				wg.Done()
+			}()
+			go func() {
+				io.Copy(client, backend)
+				client.(*net.TCPConn).CloseWrite()
+				wg.Done()
+			}()
+			wg.Wait()
+		}()
+	}
+}
+
+// The below function forwards the datagrams conn receives to target, each
+// client gets a socket of its own so the answers of the container find their
+// way back to it
+func proxyUDP(conn net.PacketConn, target string) {
+	var mu sync.Mutex
+	backends := map[string]net.Conn{}
+	defer func() {
+		mu.Lock()
+		for _, backend := range backends {
+			backend.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		backend, ok := backends[client.String()]
+		if !ok {
+			backend, err = net.Dial("udp", target)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			backends[client.String()] = backend
+			go func(client net.Addr, backend net.Conn) {
+				reply := make([]byte, 65535)
+				for {
+					backend.SetReadDeadline(time.Now().Add(udpProxyTimeout))
+					n, err := backend.Read(reply)
+					if err != nil {
+						break
+					}
+					conn.WriteTo(reply[:n], client)
+				}
+				mu.Lock()
+				delete(backends, client.String())
+				mu.Unlock()
+				backend.Close()
+			}(client, backend)
+		}
+		mu.Unlock()
+		backend.Write(buf[:n])
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage: your_docker.sh image prune [-a] [--filter until=<duration|timestamp>]
+// without -a only dangling images are removed: the ones saved without a tag and
+// the old manifests a tag pointed to before it was pulled again
+func imagePruneCommand(args []string) error {
+	flags := flag.NewFlagSet("image prune", flag.ContinueOnError)
+	all := flags.Bool("a", false, "remove all images, not only dangling ones")
+	flags.BoolVar(all, "all", false, "remove all images, not only dangling ones")
+	var filters stringList
+	flags.Var(&filters, "filter", "only remove images matching the filter (until=<duration|timestamp>)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: image prune [-a] [--filter until=<duration|timestamp>]")
+	}
+
+	var until time.Time
+	for _, filter := range filters {
+		key, value, _ := strings.Cut(filter, "=")
+		if key != "until" {
+			return fmt.Errorf("Invalid filter %q", filter)
+		}
+		until, err = parseUntil(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	repositories, err := store.loadRepositories()
+	if err != nil {
+		return err
+	}
+
+	// an image is old enough to be pruned when it was created before until
+	createdBefore := func(manifestDigest string) bool {
+		if until.IsZero() {
+			return true
+		}
+		manifest, err := store.readManifest(manifestDigest)
+		if err != nil {
+			return true
+		}
+		config, err := store.readConfig(manifest.Config.Digest)
+		return err != nil || config.Created.Before(until)
+	}
+
+	untagged := []string{}
+	manifests := []string{}
+	for key, digest := range repositories {
+		ref, err := parseReference(key)
+		dangling := err != nil || ref.tag == ""
+		if (*all || dangling) && createdBefore(digest) {
+			untagged = append(untagged, key)
+			manifests = append(manifests, digest)
+		}
+	}
+	for _, key := range untagged {
+		delete(repositories, key)
+	}
+	err = store.saveRepositories(repositories)
+	if err != nil {
+		return err
+	}
+
+	// manifests no reference points to anymore
+	referenced := store.referencedBlobs(repositories)
+	blobs, err := store.listBlobs()
+	if err != nil {
+		return err
+	}
+	for _, digest := range blobs {
+		if !referenced[digest] && store.isManifest(digest) && createdBefore(digest) {
+			manifests = append(manifests, digest)
+		}
+	}
+
+	deleted, reclaimed, err := store.deleteUnreferenced(manifests, repositories)
+	if err != nil {
+		return err
+	}
+
+	// blobs left behind by interrupted pulls don't belong to any image, they are
+	// only swept when no filter restricts what is pruned
+	if until.IsZero() {
+		swept, size, err := store.sweepBlobs(repositories)
+		if err != nil {
+			return err
+		}
+		deleted = append(deleted, swept...)
+		reclaimed += size
+	}
+	layers, size, err := store.deleteUnusedLayers(repositories)
+	if err != nil {
+		return err
+	}
+	deleted = append(deleted, layers...)
+	reclaimed += size
+
+	if len(untagged) > 0 || len(deleted) > 0 {
+		sort.Strings(untagged)
+		fmt.Println("Deleted Images:")
+		for _, key := range untagged {
+			fmt.Printf("untagged: %s\n", key)
+		}
+		for _, digest := range deleted {
+			fmt.Printf("deleted: %s\n", digest)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Total reclaimed space: %s\n", formatSize(reclaimed))
+	return nil
+}
+
+// The below function parses the value of an until filter, either a duration
+// relative to now like "24h" or a timestamp (RFC 3339, a date or unix seconds)
+func parseUntil(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid until filter %q: expected a duration or a timestamp", value)
+}
+
+// This function lists the digests of every blob in the store
+func (s *imageStore) listBlobs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, "blobs", "sha256"))
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{}
+	for _, entry := range entries {
+		digests = append(digests, "sha256:"+entry.Name())
+	}
+	return digests, nil
+}
+
+// The below function reports whether the blob is an image manifest, layers are
+// never opened further than their first byte
+func (s *imageStore) isManifest(digest string) bool {
+	file, err := os.Open(s.blobPath(digest))
+	if err != nil {
+		return false
+	}
+	first := make([]byte, 1)
+	_, err = file.Read(first)
+	file.Close()
+	if err != nil || first[0] != '{' {
+		return false
+	}
+	manifest, err := s.readManifest(digest)
+	return err == nil && manifest.Config.Digest != "" && manifest.Layers != nil
+}
+
+// This function removes the blobs no image uses along with the temporary files
+// of downloads that never finished
+func (s *imageStore) sweepBlobs(repositories map[string]string) ([]string, int64, error) {
+	referenced := s.referencedBlobs(repositories)
+	blobs, err := s.listBlobs()
+	if err != nil {
+		return nil, 0, err
+	}
+	deleted := []string{}
+	reclaimed := int64(0)
+	for _, digest := range blobs {
+		if referenced[digest] {
+			continue
+		}
+		info, err := os.Stat(s.blobPath(digest))
+		if err != nil {
+			continue
+		}
+		err = os.Remove(s.blobPath(digest))
+		if err != nil {
+			return deleted, reclaimed, err
+		}
+		deleted = append(deleted, digest)
+		reclaimed += info.Size()
+	}
+
+	// temporary files are given an hour, they could belong to a pull in progress
+	temporary, _ := filepath.Glob(filepath.Join(s.root, "blobs", "tmp-*"))
+	for _, path := range temporary {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < time.Hour {
+			continue
+		}
+		if os.Remove(path) == nil {
+			reclaimed += info.Size()
+		}
+	}
+	return deleted, reclaimed, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// This function pulls the image from its registry into the image store and returns
+// its manifest, layers that are already in the store are not downloaded again
+func pullImage(store *imageStore, ref reference) (*ManifestResponse, error) {
+	if offline {
+		return nil, fmt.Errorf("Cannot pull %s: running in offline mode", ref)
+	}
+
+	// authenticate
+	reg, err := connectRegistry(ref, "pull")
+	if err != nil {
+		return nil, err
+	}
+	// get manifest, from a manifest list the one of the target platform
+	identifier := ref.identifier()
+	raw, mediaType, err := reg.fetchRawManifest(ref.path, identifier, allManifestTypes)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting manifest: %v", err)
+	}
+	if isManifestList(mediaType) {
+		identifier, err = selectPlatform(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting manifest of %s: %v", ref, err)
+		}
+	}
+	manifest, rawManifest, err := reg.getManifest(ref.path, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting manifest: %v", err)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(rawManifest))
+	err = imageLock.check(ref.String(), digest)
+	if err != nil {
+		return nil, err
+	}
+	err = checkDigests(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting manifest: %v", err)
+	}
+
+	// pull layers
+	for _, layer := range manifest.Layers {
+		if store.hasBlob(layer.Digest) {
+			continue
+		}
+		err = reg.pullBlob(store, ref.path, layer.Digest, layer.Size)
+		if err != nil {
+			return nil, fmt.Errorf("Error pulling layer: %v", err)
+		}
+	}
+
+	// pull config, it has the env, entrypoint, cmd etc. of the image
+	if !store.hasBlob(manifest.Config.Digest) {
+		err = reg.pullBlob(store, ref.path, manifest.Config.Digest, manifest.Config.Size)
+		if err != nil {
+			return nil, fmt.Errorf("Error pulling config: %v", err)
+		}
+	}
+
+	// the manifest is saved last so that a tag never points to an incomplete image
+	_, err = store.putBlob(rawManifest)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving manifest: %v", err)
+	}
+	err = store.setTag(ref.String(), digest)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving tag: %v", err)
+	}
+	err = imageLock.record(ref.String(), digest)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving lock file: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// Usage: your_docker.sh pull <image>
+func pullCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: pull <image>")
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+
+	ref, err := parseReference(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: Pulling from %s\n", ref.identifier(), ref.name())
+	manifest, err := pullImage(store, ref)
+	if err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		fmt.Printf("%s: Pull complete\n", shortID(layer.Digest))
+	}
+	digest, _, err := store.resolve(ref)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Digest: %s\n", digest)
+	fmt.Printf("Status: Downloaded image for %s\n", ref)
+	fmt.Println(ref.canonical())
+	return nil
+}
+
+// pull policies accepted by run --pull
+const (
+	pullAlways  = "always"
+	pullMissing = "missing"
+	pullNever   = "never"
+)
+
+// This function returns the manifest of the image following the pull policy,
+// "always" pulls the image, "missing" only pulls when it's not in the store and
+// "never" fails when it's not in the store. In offline mode the policy is always never
+func getImage(store *imageStore, ref reference, policy string) (*ManifestResponse, error) {
+	switch policy {
+	case pullAlways, pullMissing, pullNever:
+	default:
+		return nil, fmt.Errorf("Invalid pull policy %q, expected always, missing or never", policy)
+	}
+	if offline {
+		policy = pullNever
+	}
+	if policy == pullAlways {
+		return pullImage(store, ref)
+	}
+
+	manifest, err := localImage(store, ref)
+	if errors.Is(err, errNotInStore) && policy == pullMissing {
+		return pullImage(store, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the image in the store may have been pulled for another platform
+	if policy == pullMissing {
+		config, err := store.readConfig(manifest.Config.Digest)
+		if err == nil && config.Architecture != "" && !config.platform().matches(targetPlatform) {
+			return pullImage(store, ref)
+		}
+	}
+
+	// the image in the store has to match the lock file as well
+	digest, _, err := store.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	err = imageLock.check(ref.String(), digest)
+	if err != nil {
+		return nil, err
+	}
+	err = imageLock.record(ref.String(), digest)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving lock file: %v", err)
+	}
+	return manifest, nil
+}
+
+// errNotInStore is returned when an image, or one of its blobs, was never pulled
+var errNotInStore = errors.New("not found in the local image store")
+
+// The below function returns the manifest of the image if it's complete in the
+// store, the error names the image or the layer that is missing
+func localImage(store *imageStore, ref reference) (*ManifestResponse, error) {
+	digest, ok, err := store.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Image %s %w", ref, errNotInStore)
+	}
+	if !store.hasBlob(digest) {
+		return nil, fmt.Errorf("Manifest %s of image %s %w", digest, ref, errNotInStore)
+	}
+	manifest, err := store.readManifest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if !store.hasBlob(manifest.Config.Digest) {
+		return nil, fmt.Errorf("Config %s of image %s %w", manifest.Config.Digest, ref, errNotInStore)
+	}
+	for _, layer := range manifest.Layers {
+		if !store.hasBlob(layer.Digest) {
+			return nil, fmt.Errorf("Layer %s of image %s %w", layer.Digest, ref, errNotInStore)
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// blobs bigger than this are uploaded in chunks with PATCH requests, smaller ones
+// in a single PUT
+const uploadChunkSize = 16 << 20
+
+// Usage: your_docker.sh push <image>
+func pushCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: push <image>")
+	}
+	if offline {
+		return fmt.Errorf("Cannot push %s: running in offline mode", args[0])
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+
+	ref, err := parseReference(args[0])
+	if err != nil {
+		return err
+	}
+	manifest, err := localImage(store, ref)
+	if err != nil {
+		return err
+	}
+	digest, _, err := store.resolve(ref)
+	if err != nil {
+		return err
+	}
+	rawManifest, err := store.readBlob(digest)
+	if err != nil {
+		return fmt.Errorf("Error reading manifest: %v", err)
+	}
+
+	reg, err := connectRegistry(ref, "pull,push")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The push refers to repository [%s/%s]\n", ref.domain, ref.path)
+	for _, layer := range manifest.Layers {
+		pushed, err := pushBlob(store, reg, ref.path, layer.Digest)
+		if err != nil {
+			return fmt.Errorf("Error pushing layer %s: %v", layer.Digest, err)
+		}
+		if pushed {
+			fmt.Printf("%s: Pushed\n", shortID(layer.Digest))
+		} else {
+			fmt.Printf("%s: Layer already exists\n", shortID(layer.Digest))
+		}
+	}
+
+	// the config and the manifest go last, the registry checks that everything
+	// the manifest references is already there
+	_, err = pushBlob(store, reg, ref.path, manifest.Config.Digest)
+	if err != nil {
+		return fmt.Errorf("Error pushing config: %v", err)
+	}
+	err = putManifest(reg, ref.path, ref.identifier(), manifest.MediaType, rawManifest)
+	if err != nil {
+		return fmt.Errorf("Error pushing manifest: %v", err)
+	}
+
+	fmt.Printf("%s: digest: %s size: %d\n", ref.identifier(), digest, len(rawManifest))
+	return nil
+}
+
+// The below function uploads a blob from the store unless the registry already
+// has it, it returns false when the upload was skipped
+func pushBlob(store *imageStore, reg *registry, repository, digest string) (bool, error) {
+	exists, err := blobExists(reg, repository, digest)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	file, err := os.Open(store.blobPath(digest))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// start an upload session, the registry answers with the url to send data to
+	location, err := registryRequest(reg, "POST", reg.url(fmt.Sprintf("/v2/%s/blobs/uploads/", repository)), nil, -1, nil, http.StatusAccepted)
+	if err != nil {
+		return false, err
+	}
+
+	var body io.Reader = file
+	size := info.Size()
+	if size > uploadChunkSize {
+		// chunked upload, every PATCH sends the next range and returns the new location
+		buffer := make([]byte, uploadChunkSize)
+		for offset := int64(0); offset < size; {
+			n, err := io.ReadFull(file, buffer)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return false, err
+			}
+			headers := map[string]string{
+				"Content-Type":  "application/octet-stream",
+				"Content-Range": fmt.Sprintf("%d-%d", offset, offset+int64(n)-1),
+			}
+			location, err = registryRequest(reg, "PATCH", location, bytes.NewReader(buffer[:n]), int64(n), headers, http.StatusAccepted)
+			if err != nil {
+				return false, err
+			}
+			offset += int64(n)
+		}
+		body = nil
+		size = 0
+	}
+
+	// close the upload with the digest, for a monolithic upload it carries the whole blob
+	uploadURL, err := url.Parse(location)
+	if err != nil {
+		return false, err
+	}
+	query := uploadURL.Query()
+	query.Set("digest", digest)
+	uploadURL.RawQuery = query.Encode()
+	headers := map[string]string{"Content-Type": "application/octet-stream"}
+	_, err = registryRequest(reg, "PUT", uploadURL.String(), body, size, headers, http.StatusCreated)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// This function checks with a HEAD request whether the registry has the blob
+func blobExists(reg *registry, repository, digest string) (bool, error) {
+	req, err := http.NewRequest("HEAD", reg.url(fmt.Sprintf(getBlobURL, repository, digest)), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := reg.do(httpClient, req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// This function uploads the manifest under the tag
+func putManifest(reg *registry, repository, tag, mediaType string, manifest []byte) error {
+	if mediaType == "" {
+		mediaType = contentTypeHeader
+	}
+	headers := map[string]string{"Content-Type": mediaType}
+	_, err := registryRequest(reg, "PUT", reg.url(fmt.Sprintf(getManifestURL, repository, tag)), bytes.NewReader(manifest), int64(len(manifest)), headers, http.StatusCreated)
+	return err
+}
+
+// The below function sends an authorized request to the registry, checks the
+// status and returns the absolute url of the Location header if there is one
+func registryRequest(reg *registry, method, rawURL string, body io.Reader, size int64, headers map[string]string, expectedStatus int) (string, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+
+	resp, err := reg.do(blobClient, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s %s: %v %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(message))
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", nil
+	}
+	// the location can be relative to the registry
+	locationURL, err := req.URL.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return locationURL.String(), nil
+}
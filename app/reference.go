@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultDomain is the registry of references that don't name one
+	defaultDomain = "docker.io"
+	// officialRepoPrefix is the namespace of single component docker hub names
+	officialRepoPrefix = "library/"
+	defaultTag         = "latest"
+	maxNameLength      = 255
+)
+
+var (
+	// a path component: lowercase alphanumerics separated by ".", "_", "__" or dashes
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	// a domain component, host names or IPs optionally followed by a port
+	domainRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[0-9a-fA-F:]+\])(?::[0-9]+)?$`)
+	tagRegexp    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+	sha256Regexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// reference is a parsed image reference: [domain[:port]/]path[:tag][@digest]
+//
+// parseReference fills in the defaults, so "ubuntu" has the domain "docker.io",
+// the path "library/ubuntu" and the tag "latest"
+type reference struct {
+	domain string
+	path   string
+	tag    string
+	digest string
+}
+
+// The below function parses and validates an image reference the way docker
+// does. The first component of the name is a registry domain if it contains a
+// "." or a ":" or is "localhost", otherwise the image is on docker hub
+func parseReference(s string) (reference, error) {
+	var ref reference
+	if s == "" {
+		return ref, fmt.Errorf("Invalid reference format: empty reference")
+	}
+
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+		if !digestRegexp.MatchString(ref.digest) {
+			return ref, fmt.Errorf("Invalid reference format %q: invalid digest %q", s, ref.digest)
+		}
+		if strings.HasPrefix(ref.digest, "sha256:") && !sha256Regexp.MatchString(ref.digest) {
+			return ref, fmt.Errorf("Invalid reference format %q: invalid sha256 digest %q", s, ref.digest)
+		}
+	}
+
+	// the tag is after the last ":" that isn't part of the domain
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.tag) {
+			return ref, fmt.Errorf("Invalid reference format %q: invalid tag %q", s, ref.tag)
+		}
+	}
+
+	ref.domain = defaultDomain
+	ref.path = name
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.domain, ref.path = first, name[i+1:]
+			if !domainRegexp.MatchString(ref.domain) {
+				return ref, fmt.Errorf("Invalid reference format %q: invalid registry %q", s, ref.domain)
+			}
+		}
+	}
+	if ref.domain == "index.docker.io" || ref.domain == "registry-1.docker.io" {
+		ref.domain = defaultDomain
+	}
+
+	if ref.path == "" {
+		return ref, fmt.Errorf("Invalid reference format %q: missing repository name", s)
+	}
+	for _, component := range strings.Split(ref.path, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			if strings.ToLower(component) != component {
+				return ref, fmt.Errorf("Invalid reference format %q: repository name must be lowercase", s)
+			}
+			return ref, fmt.Errorf("Invalid reference format %q: invalid repository name component %q", s, component)
+		}
+	}
+	if ref.domain == defaultDomain && !strings.Contains(ref.path, "/") {
+		ref.path = officialRepoPrefix + ref.path
+	}
+	if len(ref.domain)+1+len(ref.path) > maxNameLength {
+		return ref, fmt.Errorf("Invalid reference format %q: repository name must not be more than %d characters", s, maxNameLength)
+	}
+
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = defaultTag
+	}
+	return ref, nil
+}
+
+// This function returns the repository name the way docker shows it, without
+// docker.io/ and library/ for docker hub images
+func (r reference) name() string {
+	if r.domain != defaultDomain {
+		return r.domain + "/" + r.path
+	}
+	return strings.TrimPrefix(r.path, officialRepoPrefix)
+}
+
+// The below function returns the short form of the reference, e.g. "ubuntu:latest",
+// which is also the key images are saved under in the image store
+func (r reference) String() string {
+	s := r.name()
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// This function returns the fully qualified reference, e.g. "docker.io/library/ubuntu:latest"
+func (r reference) canonical() string {
+	s := r.domain + "/" + r.path
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// The below function returns the tag or digest to ask the registry for, the
+// digest wins when the reference has both
+func (r reference) identifier() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:4bcff63911fcb4448bd4fdacec207030997caf25e9bea4045fa6c8c44de311d1"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		input      string
+		domain     string
+		path       string
+		tag        string
+		digest     string
+		canonical  string
+		identifier string
+	}{
+		{
+			input:      "registry.example.com:5000/team/app:v1.2@" + testDigest,
+			domain:     "registry.example.com:5000",
+			path:       "team/app",
+			tag:        "v1.2",
+			digest:     testDigest,
+			canonical:  "registry.example.com:5000/team/app:v1.2@" + testDigest,
+			identifier: testDigest,
+		},
+		{
+			input:      "ubuntu",
+			domain:     "docker.io",
+			path:       "library/ubuntu",
+			tag:        "latest",
+			canonical:  "docker.io/library/ubuntu:latest",
+			identifier: "latest",
+		},
+		{
+			input:      "bitnami/redis:7.2",
+			domain:     "docker.io",
+			path:       "bitnami/redis",
+			tag:        "7.2",
+			canonical:  "docker.io/bitnami/redis:7.2",
+			identifier: "7.2",
+		},
+		{
+			input:      "index.docker.io/ubuntu@" + testDigest,
+			domain:     "docker.io",
+			path:       "library/ubuntu",
+			digest:     testDigest,
+			canonical:  "docker.io/library/ubuntu@" + testDigest,
+			identifier: testDigest,
+		},
+		{
+			input:      "localhost/app",
+			domain:     "localhost",
+			path:       "app",
+			tag:        "latest",
+			canonical:  "localhost/app:latest",
+			identifier: "latest",
+		},
+	}
+	for _, test := range tests {
+		ref, err := parseReference(test.input)
+		if err != nil {
+			t.Errorf("parseReference(%q): %v", test.input, err)
+			continue
+		}
+		if ref.domain != test.domain || ref.path != test.path || ref.tag != test.tag || ref.digest != test.digest {
+			t.Errorf("parseReference(%q) = %+v, want domain %q, path %q, tag %q, digest %q", test.input, ref, test.domain, test.path, test.tag, test.digest)
+		}
+		if got := ref.canonical(); got != test.canonical {
+			t.Errorf("parseReference(%q).canonical() = %q, want %q", test.input, got, test.canonical)
+		}
+		if got := ref.identifier(); got != test.identifier {
+			t.Errorf("parseReference(%q).identifier() = %q, want %q", test.input, got, test.identifier)
+		}
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"Ubuntu", "must be lowercase"},
+		{"registry.example.com/Team/app", "must be lowercase"},
+		{"ubuntu@sha256:abc", "invalid digest"},
+		{"ubuntu@sha256:" + strings.Repeat("A", 64), "invalid sha256 digest"},
+		{"ubuntu@sha256:" + strings.Repeat("a", 63), "invalid sha256 digest"},
+		{"", "empty reference"},
+		{"ubuntu:", "invalid tag"},
+	}
+	for _, test := range tests {
+		_, err := parseReference(test.input)
+		if err == nil {
+			t.Errorf("parseReference(%q) succeeded, want an error", test.input)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseReference(%q) = %v, want an error with %q", test.input, err, test.err)
+		}
+	}
+}
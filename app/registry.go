@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type ManifestResponse struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type TokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+const (
+	getManifestURL    = "/v2/%s/manifests/%s"
+	getBlobURL        = "/v2/%s/blobs/%s"
+	contentTypeHeader = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// This function is used to get the manifest from the registry, the raw bytes are
+// returned as well so that the manifest can be saved as it is in the image store
+func (r *registry) getManifest(repository, reference string) (*ManifestResponse, []byte, error) {
+	bytes, _, err := r.fetchRawManifest(repository, reference, contentTypeHeader+", "+mediaTypeOCIManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifestResponse ManifestResponse
+	err = json.Unmarshal(bytes, &manifestResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &manifestResponse, bytes, nil
+}
+
+// The below function fetches the manifest for reference (a tag or a digest) as
+// it is, accept lists the media types we understand, the returned string is the
+// media type the registry picked. Manifests fetched by digest are verified
+func (r *registry) fetchRawManifest(repository, reference, accept string) ([]byte, string, error) {
+	resp, err := r.get(r.url(fmt.Sprintf(getManifestURL, repository, reference)), accept)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Error getting manifest: %v", resp.Status)
+	}
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		if got := fmt.Sprintf("sha256:%x", sha256.Sum256(bytes)); got != reference {
+			return nil, "", fmt.Errorf("Digest mismatch: expected %s, got %s", reference, got)
+		}
+	}
+	return bytes, resp.Header.Get("Content-Type"), nil
+}
+
+// The below function will pull a blob (layer or config) from the registry and save it into the image store
+func (r *registry) pullBlob(store *imageStore, repository, digest string, size int64) error {
+	err := downloadBlob(store, r.url(fmt.Sprintf(getBlobURL, repository, digest)), r.authorization, digest, size)
+	if err != nil {
+		return fmt.Errorf("Error getting blob %s: %v", digest, err)
+	}
+	return nil
+}
+
+// This function checks with a HEAD request whether the registry has a manifest
+// for reference, without downloading it
+func (r *registry) manifestExists(repository, reference string) (bool, error) {
+	resp, err := r.headManifest(repository, reference)
+	if err != nil {
+		return false, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Error checking manifest: %v", resp.Status)
+	}
+}
+
+// This function resolves reference (usually a tag) to the digest of its manifest
+// with a HEAD request
+func (r *registry) manifestDigest(repository, reference string) (string, error) {
+	resp, err := r.headManifest(repository, reference)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error resolving %s: %v", reference, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("Registry did not return a digest for %s", reference)
+	}
+	return digest, nil
+}
+
+// The below function sends a HEAD request for the manifest, accepting any kind of manifest
+func (r *registry) headManifest(repository, reference string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", r.url(fmt.Sprintf(getManifestURL, repository, reference)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", allManifestTypes)
+	resp, err := r.do(httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// The below function downloads a small blob into memory and verifies its digest
+func (r *registry) fetchBlob(repository, digest string) ([]byte, error) {
+	resp, err := getBlob(r.url(fmt.Sprintf(getBlobURL, repository, digest)), r.authorization, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error getting blob %s: %v", digest, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); got != digest {
+		return nil, fmt.Errorf("Digest mismatch: expected %s, got %s", digest, got)
+	}
+	return data, nil
+}
+
+// dockerHubAuthKey is the key `docker login` saves docker hub credentials under
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// The below function reads the credentials for registry from the docker config
+// file ($DOCKER_CONFIG/config.json or ~/.docker/config.json), empty if there are none
+func registryCredentials(registry string) (string, string, error) {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return "", "", fmt.Errorf("Error parsing %s: %v", filepath.Join(configDir, "config.json"), err)
+	}
+	// docker saves some registries with the scheme and some without
+	entry, ok := config.Auths[registry]
+	if !ok {
+		entry, ok = config.Auths["https://"+registry]
+	}
+	if !ok || entry.Auth == "" {
+		return "", "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid credentials for %s: %v", registry, err)
+	}
+	username, password, _ := strings.Cut(string(decoded), ":")
+	return username, password, nil
+}
+
+// This function returns the url of the next page from the Link header of a
+// paginated registry response, empty when it was the last page
+func nextPageURL(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return "", nil
+	}
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("Invalid Link header: %s", link)
+	}
+	next, err := resp.Request.URL.Parse(link[start+1 : end])
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Usage: your_docker.sh rm [-v] <container> ...
+// removes containers that exited, their config, log and writable layer. -v
+// removes the anonymous volumes they were given too
+func rmCommand(args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	volumes := flags.Bool("v", false, "remove the anonymous volumes of the containers")
+	flags.BoolVar(volumes, "volumes", false, "remove the anonymous volumes of the containers")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: rm [-v] <container> ...")
+	}
+	for _, id := range flags.Args() {
+		container, err := findContainer(id)
+		if err != nil {
+			return err
+		}
+		// a container whose run was killed stays running in its config
+		if container.State.Running && processExists(container.State.Pid) {
+			return fmt.Errorf("Error removing container %s: the container is running", container.Id)
+		}
+		err = os.RemoveAll(containerDir(container.Id))
+		if err != nil {
+			return fmt.Errorf("Error removing container %s: %v", container.Id, err)
+		}
+		if *volumes {
+			err = container.removeAnonymousVolumes()
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println(id)
+	}
+	return nil
+}
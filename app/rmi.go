@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Usage: your_docker.sh rmi [-f] <image|id> ...
+func rmiCommand(args []string) error {
+	flags := flag.NewFlagSet("rmi", flag.ContinueOnError)
+	force := flags.Bool("f", false, "remove an image id even if it has several tags")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: rmi [-f] <image|id> ...")
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	for _, name := range flags.Args() {
+		err = removeImage(store, name, *force)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The below function untags the image and deletes its blobs that no other image
+// uses. name is a reference, or an (abbreviated) image id or manifest digest in
+// which case every reference to that image is removed
+func removeImage(store *imageStore, name string, force bool) error {
+	repositories, err := store.loadRepositories()
+	if err != nil {
+		return err
+	}
+
+	keys, err := store.matchImage(repositories, name)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 1 && !force {
+		return fmt.Errorf("Unable to delete %s: image is referenced in multiple repositories, use -f", name)
+	}
+
+	manifests := []string{}
+	for _, key := range keys {
+		manifests = append(manifests, repositories[key])
+		delete(repositories, key)
+	}
+	err = store.saveRepositories(repositories)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Printf("Untagged: %s\n", key)
+	}
+
+	deleted, _, err := store.deleteUnreferenced(manifests, repositories)
+	for _, digest := range deleted {
+		fmt.Printf("Deleted: %s\n", digest)
+	}
+	if err != nil {
+		return err
+	}
+	layers, _, err := store.deleteUnusedLayers(repositories)
+	for _, diffID := range layers {
+		fmt.Printf("Deleted: %s\n", diffID)
+	}
+	return err
+}
+
+// This function finds the references name stands for: the reference itself if
+// it's in the store, otherwise all the references to the image whose id or
+// manifest digest starts with name
+func (s *imageStore) matchImage(repositories map[string]string, name string) ([]string, error) {
+	if ref, err := parseReference(name); err == nil {
+		if _, ok := repositories[ref.String()]; ok {
+			return []string{ref.String()}, nil
+		}
+	}
+
+	prefix := strings.TrimPrefix(name, "sha256:")
+	if len(prefix) == 0 {
+		return nil, fmt.Errorf("No such image: %s", name)
+	}
+	keys := []string{}
+	ids := map[string]bool{}
+	for key, digest := range repositories {
+		id := ""
+		if manifest, err := s.readManifest(digest); err == nil {
+			id = manifest.Config.Digest
+		}
+		if strings.HasPrefix(strings.TrimPrefix(id, "sha256:"), prefix) || strings.HasPrefix(strings.TrimPrefix(digest, "sha256:"), prefix) {
+			keys = append(keys, key)
+			ids[id] = true
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No such image: %s", name)
+	}
+	if len(ids) > 1 {
+		return nil, fmt.Errorf("Ambiguous image id %s, it matches %d images", name, len(ids))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
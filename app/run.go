@@ -0,0 +1,890 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Usage: your_docker.sh run [options] <image> [command] [arg1] [arg2] ...
+// without a command the entrypoint and cmd of the image are run. The image can
+// also be read from a tarball or a layout, e.g. docker-archive:img.tar or oci:./layout:tag
+func runCommand(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	pullPolicy := flags.String("pull", pullMissing, "pull image before running (always, missing, never)")
+	var envFlags, envFiles stringList
+	flags.Var(&envFlags, "e", "set an environment variable, KEY=value or KEY to take it from our environment")
+	flags.Var(&envFlags, "env", "set an environment variable, KEY=value or KEY to take it from our environment")
+	flags.Var(&envFiles, "env-file", "read environment variables from a file, a KEY=value or KEY per line")
+	userFlag := flags.String("user", "", "user of the container process, <user>[:<group>] by name or id")
+	flags.StringVar(userFlag, "u", "", "user of the container process, <user>[:<group>] by name or id")
+	var groupAdd stringList
+	flags.Var(&groupAdd, "group-add", "another group of the container process, by name or id")
+	initFlag := flags.Bool("init", false, "run an init as PID 1 of the container, forwarding signals and reaping zombies")
+	var entrypoint *string
+	flags.Func("entrypoint", "overwrite the default entrypoint of the image", func(value string) error {
+		entrypoint = &value
+		return nil
+	})
+	policy := &verifyPolicy{}
+	flags.StringVar(&policy.keyPath, "verify-key", "", "only run images signed with this public key")
+	flags.StringVar(&policy.identity, "certificate-identity", "", "only run images signed keyless by this identity")
+	flags.StringVar(&policy.issuer, "certificate-oidc-issuer", "", "only run images signed keyless through this OIDC issuer")
+	flags.StringVar(&policy.rootsPath, "certificate-chain", "", "root certificates keyless signatures have to chain up to")
+	skipVerify := flags.Bool("insecure-skip-verify", false, "run the image without verifying its signature")
+	shmSize := flags.String("shm-size", "64m", "size of /dev/shm, e.g. 1g")
+	usernsMode := flags.String("userns", "", "host to run without a user namespace, root only")
+	var mountFlags stringList
+	networkFlag := flags.String("network", "", "bridge, host or none")
+	flags.StringVar(networkFlag, "net", "", "bridge, host or none")
+	var aliases stringList
+	flags.Var(&aliases, "network-alias", "another name of the container on its network")
+	name := flags.String("name", "", "name of the container")
+	var resources Resources
+	memoryFlag := flags.String("memory", "", "memory limit of the container, e.g. 512m")
+	flags.StringVar(memoryFlag, "m", "", "memory limit of the container, e.g. 512m")
+	memorySwapFlag := flags.String("memory-swap", "", "memory and swap limit of the container, -1 for unlimited swap")
+	swappinessFlag := flags.Int64("memory-swappiness", -1, "how eagerly the memory of the container is swapped, 0 to 100")
+	cpusFlag := flags.String("cpus", "", "number of cpus the container may use, e.g. 1.5")
+	flags.Int64Var(&resources.CPUPeriod, "cpu-period", 0, "period of the cpu quota in microseconds")
+	flags.Int64Var(&resources.CPUQuota, "cpu-quota", 0, "cpu time in microseconds the container may use every period")
+	flags.Int64Var(&resources.CPUShares, "cpu-shares", 0, "cpu weight of the container against the others, 1024 by default")
+	flags.Int64Var(&resources.CPUShares, "c", 0, "cpu weight of the container against the others, 1024 by default")
+	flags.StringVar(&resources.CpusetCpus, "cpuset-cpus", "", "cpus the container runs on, e.g. 0-3,5")
+	flags.StringVar(&resources.CpusetMems, "cpuset-mems", "", "memory nodes the container allocates on, e.g. 0,1")
+	flags.Int64Var(&resources.PidsLimit, "pids-limit", 0, "how many processes the container may have, -1 for unlimited")
+	throttleFlags := map[string]*stringList{}
+	for _, flag := range []string{"device-read-bps", "device-write-bps", "device-read-iops", "device-write-iops"} {
+		throttleFlags[flag] = &stringList{}
+		flags.Var(throttleFlags[flag], flag, "limit the "+strings.TrimPrefix(flag, "device-")+" of a block device, <device>:<rate>")
+	}
+	ipcFlag := flags.String("ipc", "", "private, shareable, host or container:<id>")
+	var capAdd, capDrop stringList
+	flags.Var(&capAdd, "cap-add", "give the container a capability, ALL for every one")
+	flags.Var(&capDrop, "cap-drop", "take a capability from the container, ALL for every one")
+	var securityOptFlags stringList
+	flags.Var(&securityOptFlags, "security-opt", "security option of the container, seccomp=unconfined, seccomp=<profile.json>, no-new-privileges=false, apparmor=<profile>, label=<option> or systempaths=unconfined")
+	var clockOffsetFlags stringList
+	flags.Var(&clockOffsetFlags, "clock-offset", "move a clock of the container, monotonic=<duration> or boottime=<duration>")
+	cgroupnsFlag := flags.String("cgroupns", "", "host or private, private by default on cgroup v2")
+	readOnly := flags.Bool("read-only", false, "mount the root file system of the container read only")
+	hostnameFlag := flags.String("hostname", "", "hostname of the container")
+	flags.StringVar(hostnameFlag, "h", "", "hostname of the container")
+	var addHostFlags stringList
+	flags.Var(&addHostFlags, "add-host", "add a line to /etc/hosts, name:ip or name:host-gateway")
+	var dns dnsConfig
+	flags.Var((*stringList)(&dns.Servers), "dns", "name server of the container instead of the ones of the host")
+	flags.Var((*stringList)(&dns.Search), "dns-search", "search domain of the container instead of the ones of the host, . for none")
+	flags.Var((*stringList)(&dns.Options), "dns-option", "resolver option of the container instead of the ones of the host")
+	ipFlag := flags.String("ip", "", "IPv4 address of the container on its network")
+	ip6Flag := flags.String("ip6", "", "IPv6 address of the container on its network")
+	macFlag := flags.String("mac-address", "", "MAC address of the eth0 of the container, e.g. 92:d0:c6:0a:29:33")
+	var publishFlags stringList
+	flags.Var(&publishFlags, "p", "publish a port of the container on the host, [[hostIP:][hostPort]:]containerPort[/protocol]")
+	flags.Var(&publishFlags, "publish", "publish a port of the container on the host")
+	publishAll := flags.Bool("P", false, "publish every exposed port on a random port of the host")
+	flags.BoolVar(publishAll, "publish-all", false, "publish every exposed port on a random port of the host")
+	var volumeFlags stringList
+	flags.Var(&volumeFlags, "v", "bind mount a file, directory or volume, <host path or volume>:<container path>[:<options>]")
+	flags.Var(&volumeFlags, "volume", "bind mount a file, directory or volume, <host path or volume>:<container path>[:<options>]")
+	volumeDriver := flags.String("volume-driver", defaultVolumeDriver, "driver of the volumes created for the container")
+	var tmpfsFlags stringList
+	flags.Var(&tmpfsFlags, "tmpfs", "mount a tmpfs in the container, <path>[:<options>]")
+	flags.Var(&mountFlags, "mount", "bind mount a file or directory, type=bind,source=<path>,target=<path>")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	shmBytes, err := parseSize(*shmSize)
+	if err != nil || shmBytes <= 0 {
+		return fmt.Errorf("Invalid --shm-size %q: expected a size like 64m", *shmSize)
+	}
+	if *memoryFlag != "" {
+		resources.Memory, err = parseSize(*memoryFlag)
+		if err != nil || resources.Memory <= 0 {
+			return fmt.Errorf("Invalid --memory %q: expected a size like 512m", *memoryFlag)
+		}
+		if resources.Memory < minMemory {
+			return fmt.Errorf("Minimum memory limit allowed is 6MB")
+		}
+	}
+	if *memorySwapFlag == "-1" {
+		resources.MemorySwap = -1
+	} else if *memorySwapFlag != "" {
+		resources.MemorySwap, err = parseSize(*memorySwapFlag)
+		if err != nil || resources.MemorySwap <= 0 {
+			return fmt.Errorf("Invalid --memory-swap %q: expected a size like 1g or -1", *memorySwapFlag)
+		}
+	}
+	if *swappinessFlag != -1 {
+		resources.MemorySwappiness = swappinessFlag
+	}
+	err = resources.validateMemory()
+	if err != nil {
+		return err
+	}
+	if *cpusFlag != "" {
+		cpus, err := strconv.ParseFloat(*cpusFlag, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid --cpus %q: expected a number like 1.5", *cpusFlag)
+		}
+		resources.NanoCPUs = int64(cpus * 1e9)
+	}
+	if resources.CPUShares < 0 {
+		return fmt.Errorf("Invalid --cpu-shares %d: expected a positive weight", resources.CPUShares)
+	}
+	err = resources.validateCPU()
+	if err != nil {
+		return err
+	}
+	throttles := map[string]*[]ThrottleDevice{
+		"device-read-bps":   &resources.BlkioDeviceReadBps,
+		"device-write-bps":  &resources.BlkioDeviceWriteBps,
+		"device-read-iops":  &resources.BlkioDeviceReadIOps,
+		"device-write-iops": &resources.BlkioDeviceWriteIOps,
+	}
+	for flag, devices := range throttles {
+		for _, value := range *throttleFlags[flag] {
+			device, err := parseThrottleDevice(flag, value)
+			if err != nil {
+				return err
+			}
+			*devices = append(*devices, device)
+		}
+	}
+	if resources.CpusetCpus != "" {
+		err = validateCpuset("cpuset-cpus", resources.CpusetCpus, "/sys/devices/system/cpu/online")
+		if err != nil {
+			return err
+		}
+	}
+	if resources.CpusetMems != "" {
+		err = validateCpuset("cpuset-mems", resources.CpusetMems, "/sys/devices/system/node/online")
+		if err != nil {
+			return err
+		}
+	}
+	if resources.MemorySwappiness != nil && cgroupV2() {
+		// cgroup v2 swaps the memory of every cgroup alike
+		fmt.Fprintf(os.Stderr, "[Warning] Your kernel does not support memory swappiness capabilities or the cgroup is not mounted. Memory swappiness discarded.\n")
+		resources.MemorySwappiness = nil
+	}
+	// like docker, containers on cgroup v1 share the cgroup namespace of the
+	// host unless they ask for one
+	cgroupNamespace := cgroupV2()
+	switch *cgroupnsFlag {
+	case "":
+	case "host":
+		cgroupNamespace = false
+	case "private":
+		cgroupNamespace = true
+	default:
+		return fmt.Errorf("Invalid --cgroupns %q: expected host or private", *cgroupnsFlag)
+	}
+	var clockOffsets []clockOffset
+	for _, value := range clockOffsetFlags {
+		offset, err := parseClockOffset(value)
+		if err != nil {
+			return err
+		}
+		clockOffsets = append(clockOffsets, offset)
+	}
+	capabilities, err := containerCapabilities(capAdd, capDrop)
+	if err != nil {
+		return err
+	}
+	security, err := parseSecurityOpts(securityOptFlags)
+	if err != nil {
+		return err
+	}
+	appArmorProfile, err := containerAppArmorProfile(security.AppArmor)
+	if err != nil {
+		return err
+	}
+	processLabel, mountLabel, err := containerLabels(security.Label)
+	if err != nil {
+		return err
+	}
+	var seccomp []syscall.SockFilter
+	if security.Seccomp != nil {
+		seccomp, err = compileSeccomp(security.Seccomp, capabilities)
+		if err != nil {
+			return err
+		}
+	}
+	userNamespace, err := parseUserns(*usernsMode)
+	if err != nil {
+		return err
+	}
+	networkMode, err := parseNetworkMode(*networkFlag)
+	if err != nil {
+		return err
+	}
+	ipcMode, err := parseIpcMode(*ipcFlag)
+	if err != nil {
+		return err
+	}
+	if len(aliases) > 0 && !userDefinedNetwork(networkMode) {
+		return fmt.Errorf("Network-scoped aliases are only supported for networks made with network create")
+	}
+	if (*ipFlag != "" || *ip6Flag != "") && !userDefinedNetwork(networkMode) {
+		return fmt.Errorf("User specified IP addresses are only supported for networks made with network create")
+	}
+	if ip := net.ParseIP(*ipFlag); *ipFlag != "" && (ip == nil || ip.To4() == nil) {
+		return fmt.Errorf("Invalid --ip %q: expected an IPv4 address", *ipFlag)
+	}
+	if ip := net.ParseIP(*ip6Flag); *ip6Flag != "" && (ip == nil || ip.To4() != nil) {
+		return fmt.Errorf("Invalid --ip6 %q: expected an IPv6 address", *ip6Flag)
+	}
+	if *macFlag != "" {
+		if networkMode != defaultNetworkName && !userDefinedNetwork(networkMode) {
+			return fmt.Errorf("Conflicting options: mac-address and the %s network mode", networkMode)
+		}
+		mac, err := net.ParseMAC(*macFlag)
+		// a multicast address can't be the one of an interface
+		if err != nil || len(mac) != 6 || mac[0]&1 != 0 {
+			return fmt.Errorf("Invalid --mac-address %q: expected a unicast MAC address, e.g. 92:d0:c6:0a:29:33", *macFlag)
+		}
+		*macFlag = mac.String()
+	}
+	for _, alias := range aliases {
+		if !validName(alias) {
+			return fmt.Errorf("Invalid --network-alias %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", alias)
+		}
+	}
+	if *hostnameFlag != "" && strings.HasPrefix(networkMode, "container:") {
+		return fmt.Errorf("Conflicting options: hostname and the container network mode")
+	}
+	if *hostnameFlag != "" && !validHostname(*hostnameFlag) {
+		return fmt.Errorf("Invalid --hostname %q: expected letters, digits, - and . only, at most 64 of them", *hostnameFlag)
+	}
+	if *name != "" {
+		err = checkContainerName(*name)
+		if err != nil {
+			return err
+		}
+	}
+	var hosts []hostEntry
+	for _, value := range addHostFlags {
+		entry, err := parseAddHost(value)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, entry)
+	}
+	if len(hosts) > 0 && strings.HasPrefix(networkMode, "container:") {
+		return fmt.Errorf("Conflicting options: custom host-to-IP mapping and the container network mode")
+	}
+	for _, server := range dns.Servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("Invalid --dns %q: expected an IP address", server)
+		}
+	}
+	if dns.given() && strings.HasPrefix(networkMode, "container:") {
+		return fmt.Errorf("Conflicting options: dns and the container network mode")
+	}
+	var ports []PortBinding
+	for _, value := range publishFlags {
+		binding, err := parsePublish(value)
+		if err != nil {
+			return err
+		}
+		ports = append(ports, binding)
+	}
+	userEnv, err := parseEnv(envFiles, envFlags)
+	if err != nil {
+		return err
+	}
+	var mounts []containerMount
+	for _, value := range volumeFlags {
+		mount, err := parseVolume(value)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+	for _, value := range mountFlags {
+		mount, err := parseMount(value)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+	for _, value := range tmpfsFlags {
+		mount, err := parseTmpfs(value)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: run [options] <image> [command] [arg1] [arg2] ...")
+	}
+	image := args[0]
+	args = args[1:]
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+
+	var manifest *ManifestResponse
+	if transport, rest, ok := cutTransport(image); ok {
+		// images from archives and layouts never come from a registry
+		if policy.enabled() && !*skipVerify {
+			return fmt.Errorf("Cannot verify the signature of %s: signatures are kept in registries", image)
+		}
+		manifest, err = transportImage(store, transport, rest)
+		if err != nil {
+			return fmt.Errorf("Error getting image: %v", err)
+		}
+	} else {
+		ref, err := parseReference(image)
+		if err != nil {
+			return err
+		}
+
+		// get the image, pulling it if the policy asks for it
+		manifest, err = getImage(store, ref, *pullPolicy)
+		if err != nil {
+			return fmt.Errorf("Error getting image: %v", err)
+		}
+
+		// refuse unsigned images when a signature policy is given
+		if policy.enabled() && !*skipVerify {
+			err = verifyImage(store, ref, policy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	config, err := store.readConfig(manifest.Config.Digest)
+	if err != nil {
+		return fmt.Errorf("Error reading image config: %v", err)
+	}
+	if *publishAll {
+		exposed, err := exposedPortBindings(config.Config.ExposedPorts)
+		if err != nil {
+			return err
+		}
+		for _, binding := range exposed {
+			if !hasContainerPort(ports, binding) {
+				ports = append(ports, binding)
+			}
+		}
+	}
+	if len(ports) > 0 && strings.HasPrefix(networkMode, "container:") {
+		return fmt.Errorf("Conflicting options: port publishing and the container network mode")
+	}
+	if len(ports) > 0 && networkMode != defaultNetworkName && !userDefinedNetwork(networkMode) {
+		// the ports of the container are the ones of the host, or nobody's
+		fmt.Fprintf(os.Stderr, "[Warning] Published ports are discarded when using %s network mode\n", networkMode)
+		ports = nil
+	}
+
+	// the container keeps its state and output under the data root, its root
+	// file system only lives as long as it runs
+	container, err := createContainer(image, manifest)
+	if err != nil {
+		return fmt.Errorf("Error creating container: %v", err)
+	}
+	defer container.removeRootfs()
+	container.Name = *name
+	container.Resources = resources
+	container.ProcessLabel, container.MountLabel = processLabel, mountLabel
+	// the VOLUME paths of the image get an anonymous volume each
+	mounts = append(mounts, imageVolumes(config.Config.Volumes, mounts)...)
+	unmountVolumes, err := mountVolumes(container, mounts, *volumeDriver)
+	if err != nil {
+		return err
+	}
+	defer unmountVolumes()
+	for _, mount := range mounts {
+		if mount.Relabel != "" {
+			err = relabel(mount.Source, mountLabel, mount.Relabel == "shared")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	container.Hostname, err = containerHostname(container.Id, networkMode, *hostnameFlag)
+	if err != nil {
+		return err
+	}
+
+	if ipcMode == "shareable" && !rootless {
+		err = mountShm(container.Id, shmBytes)
+		if err != nil {
+			return err
+		}
+		defer unmountShm(container.Id)
+	}
+
+	// the root file system of the container is only mounted in a mount
+	// namespace of its own, which belongs to this thread and not to the whole
+	// process. The container gets the rest of its namespaces from execContainer
+	runtime.LockOSThread()
+	err = isolateProcess()
+	if err != nil {
+		return fmt.Errorf("Error isolating process: %v", err)
+	}
+
+	// the storage driver builds the root file system out of the layers, the
+	// container writes to a directory of its own
+	driver, err := selectStorageDriver()
+	if err != nil {
+		return err
+	}
+	container.Driver = driver.name()
+	rootfs, err := driver.mount(store, manifest, config, containerDir(container.Id), container.MountLabel)
+	if err != nil {
+		return err
+	}
+	defer driver.unmount(rootfs)
+	for _, mount := range mounts {
+		if mount.Type == "volume" {
+			err = populateVolume(rootfs, mount)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the working directory is created if the image doesn't have it, like docker does
+	workDir := config.Config.WorkingDir
+	if workDir == "" {
+		workDir = "/"
+	}
+	err = os.MkdirAll(filepath.Join(rootfs, workDir), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating working directory: %v", err)
+	}
+
+	// the user is resolved against the passwd and group files of the image,
+	// -u replaces the one of the image
+	user := config.Config.User
+	if *userFlag != "" {
+		user = *userFlag
+	}
+	var credential *syscall.Credential
+	home := "/"
+	if user != "" {
+		credential, home, err = resolveUser(rootfs, user)
+		if err != nil {
+			return fmt.Errorf("Error resolving user: %v", err)
+		}
+	} else if entry, err := lookupPasswd(rootfs, "0"); err == nil {
+		home = entry.home
+	}
+	// --group-add gives the user more groups, root being the user without one
+	if len(groupAdd) > 0 && credential == nil {
+		credential, _, err = resolveUser(rootfs, "0")
+		if err != nil {
+			return fmt.Errorf("Error resolving user: %v", err)
+		}
+	}
+	for _, group := range groupAdd {
+		gid, err := lookupGroup(rootfs, group)
+		if err != nil {
+			return fmt.Errorf("Error resolving --group-add %s: %v", group, err)
+		}
+		credential.Groups = append(credential.Groups, gid)
+	}
+
+	// what -e and --env-file set goes over the env of the image, HOME is the
+	// one of the user unless something set it
+	env := append([]string{}, config.Config.Env...)
+	for _, kv := range userEnv {
+		key, value, _ := strings.Cut(kv, "=")
+		env = setEnv(env, key, value)
+	}
+	if _, set := lookupEnv(env, "HOME"); !set {
+		env = append(env, "HOME="+home)
+	}
+	env = containerEnv(env)
+	argv := containerArgs(config.Config, entrypoint, args)
+	if len(argv) == 0 {
+		return fmt.Errorf("No command specified and image %s has no entrypoint or cmd", image)
+	}
+
+	log, err := container.openLog()
+	if err != nil {
+		return fmt.Errorf("Error opening container log: %v", err)
+	}
+	defer log.Close()
+	container.Path = argv[0]
+	container.Args = argv[1:]
+	container.State = ContainerState{Running: true, StartedAt: time.Now().UTC()}
+	err = container.save()
+	if err != nil {
+		return err
+	}
+
+	process := &initConfig{Rootfs: rootfs, Args: argv, Env: env, WorkDir: workDir, User: credential, ShmSize: shmBytes, Mounts: mounts, UserNamespace: userNamespace, Hostname: container.Hostname, CgroupNamespace: cgroupNamespace, ClockOffsets: clockOffsets, Seccomp: seccomp, Capabilities: capabilities, NoNewPrivileges: security.NoNewPrivileges, AppArmorProfile: appArmorProfile, ProcessLabel: processLabel, MountLabel: mountLabel, MaskSystemPaths: security.MaskSystemPaths, ReadonlyRootfs: *readOnly, Init: *initFlag}
+	container.NetworkMode = networkMode
+	container.IpcMode = ipcMode
+	err = setupIPC(container, process)
+	if err != nil {
+		container.State.Running = false
+		container.save()
+		return err
+	}
+	network, disconnect, err := connectContainer(container, process, ports, endpointConfig{Aliases: aliases, IPv4Address: *ipFlag, IPv6Address: *ip6Flag, MacAddress: *macFlag, DNS: dns.Servers})
+	if err != nil {
+		container.State.Running = false
+		container.save()
+		return err
+	}
+	defer disconnect()
+	etc, err := etcMounts(container, network, container.Hostname, hosts, dns)
+	if err != nil {
+		container.State.Running = false
+		container.save()
+		return err
+	}
+	// the mounts asked for come later, they may be over these files
+	process.Mounts = append(etc, process.Mounts...)
+	var group *cgroup
+	if resources.given() {
+		group, err = createCgroup(container.Id, resources)
+		if err != nil {
+			container.State.Running = false
+			container.save()
+			return err
+		}
+		defer func() {
+			err := group.remove()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[Warning] %v\n", err)
+			}
+		}()
+	}
+	err = execContainer(process, log, func(pid int) error {
+		container.State.Pid = pid
+		// the init is still waiting for its config, the container process
+		// and everything it starts are in the cgroup
+		if group != nil {
+			err := group.add(pid)
+			if err != nil {
+				return err
+			}
+		}
+		if network != nil {
+			err := network.attach(container.NetworkSettings, pid)
+			if err != nil {
+				return fmt.Errorf("Error connecting to network %s: %v", network.Name, err)
+			}
+		}
+		return container.save()
+	})
+
+	container.State.Running = false
+	container.State.FinishedAt = time.Now().UTC()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		container.State.ExitCode = exitError.ExitCode()
+		err = exitStatus(exitError.ExitCode())
+	} else if err != nil {
+		// the command could not be started, like docker we report 127
+		container.State.ExitCode = 127
+		container.State.Error = err.Error()
+	}
+	if saveErr := container.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// The below function runs the container process config describes. We start
+// ourselves again as the container init (see initCommand) in new pid, mount,
+// uts and user namespaces, the init pivots into the root file system and becomes
+// the container process, which that way is the first process of the pid
+// namespace. Its output goes to ours and to the container log if there is one.
+// started is called with the pid of the init before it gets its config, run
+// plugs the network namespace of the container into its network there
+func execContainer(config *initConfig, log *containerLog, started func(pid int) error) error {
+	configReader, configWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer configWriter.Close()
+	errorReader, errorWriter, err := os.Pipe()
+	if err != nil {
+		configReader.Close()
+		return err
+	}
+	defer errorReader.Close()
+
+	cmd := exec.Command("/proc/self/exe", "init")
+	cmd.Env = []string{}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if log != nil {
+		cmd.Stdout = io.MultiWriter(os.Stdout, log.writer("stdout"))
+		cmd.Stderr = io.MultiWriter(os.Stderr, log.writer("stderr"))
+	}
+	cmd.Stdin = os.Stdin
+	cmd.ExtraFiles = []*os.File{configReader, errorWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS}
+	var uids, gids []syscall.SysProcIDMap
+	helperMappings := false
+	if config.Network != nil {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if !config.HostIPC && config.IPCNamespace == "" {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWIPC
+	}
+	if config.UserNamespace {
+		// the new user namespace owns the other ones, they are created in it
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		if rootless {
+			uids, gids, helperMappings = subordinateMappings()
+		}
+		if helperMappings {
+			cmd.Args = append(cmd.Args, initReexecArg)
+		}
+		if !helperMappings {
+			mappedUIDs, mappedGIDs, setgroups := userNamespaceMappings()
+			cmd.SysProcAttr.UidMappings = mappedUIDs
+			cmd.SysProcAttr.GidMappings = mappedGIDs
+			cmd.SysProcAttr.GidMappingsEnableSetgroups = setgroups
+		}
+	}
+	err = cmd.Start()
+	configReader.Close()
+	errorWriter.Close()
+	if err != nil {
+		return fmt.Errorf("Err: %v", err)
+	}
+	// the init waits for the mappings to be written, see waitIDMappings
+	if helperMappings {
+		err = writeIDMappings(cmd.Process.Pid, uids, gids)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		_, err = configWriter.Write([]byte("\n"))
+		if err != nil {
+			return fmt.Errorf("Err: %v", err)
+		}
+	}
+	if started != nil {
+		err = started(cmd.Process.Pid)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+
+	err = json.NewEncoder(configWriter).Encode(config)
+	configWriter.Close()
+	// the error pipe is closed without a word once the container process runs
+	message, _ := io.ReadAll(errorReader)
+	waitErr := cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("Err: %v", err)
+	}
+	if len(message) > 0 {
+		return fmt.Errorf("Err: %s", message)
+	}
+	if waitErr != nil {
+		if _, ok := waitErr.(*exec.ExitError); ok {
+			return waitErr
+		}
+		return fmt.Errorf("Err: %v", waitErr)
+	}
+	return nil
+}
+
+// exitStatus is returned by commands that exit with the status of the container
+// process, main exits with it without printing anything
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// defaultPath is the PATH given to containers whose image doesn't set one
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// This function returns the environment of the container, the image env with PATH
+// defaulted when the image doesn't set it
+func containerEnv(imageEnv []string) []string {
+	env := append([]string{}, imageEnv...)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			return env
+		}
+	}
+	return append(env, "PATH="+defaultPath)
+}
+
+// The below function returns the variables of the --env-file files and then
+// of -e, as KEY=value, the later ones winning. A KEY without a value takes the
+// one of our environment, and is left out when we don't have it. The lines of
+// an env file are taken as they are, without quotes or expansion, the empty
+// ones and the ones starting with # are skipped
+func parseEnv(files, values []string) ([]string, error) {
+	var lines []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading env file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimLeft(strings.TrimSuffix(line, "\r"), " \t")
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	var env []string
+	for _, kv := range append(lines, values...) {
+		key, value, ok := strings.Cut(kv, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("Invalid environment variable %q", kv)
+		}
+		if !ok {
+			value, ok = os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// The below function builds the argv of the container process following docker's rules:
+//   - args given on the command line replace the image cmd
+//   - the cmd (or the args) is appended to the entrypoint
+//   - an entrypoint override replaces the image entrypoint and drops the image cmd,
+//     an empty override removes the entrypoint
+//   - a shell form entrypoint (/bin/sh -c "...") gets the cmd and the args
+//     appended too, the shell sees them as $0, $1... and its command ignores
+//     them unless it uses them. An exec form entrypoint running sh -c is the
+//     same argv, so it can't be told apart and must not be
+func containerArgs(config ContainerConfig, entrypoint *string, args []string) []string {
+	cmd := config.Cmd
+	argv := append([]string{}, config.Entrypoint...)
+	if entrypoint != nil {
+		cmd = nil
+		argv = nil
+		if *entrypoint != "" {
+			argv = []string{*entrypoint}
+		}
+	}
+
+	if len(args) > 0 {
+		return append(argv, args...)
+	}
+	return append(argv, cmd...)
+}
+
+// This function finds the executable for file in the PATH of env, the same as
+// exec.LookPath but using the container's PATH instead of ours
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	pathEnv := defaultPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			pathEnv = kv[len("PATH="):]
+		}
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in $PATH", file)
+}
+
+// This function moves the calling thread into a mount namespace of its own, the
+// root file systems mounted from now on are not seen by the host. The other
+// namespaces of the container come with the container init
+func isolateProcess() error {
+	// a user may not create a mount namespace outside of a user namespace.
+	// The root file systems it can mount are fuse ones, which are its own
+	if rootless {
+		return nil
+	}
+	if syscall.Unshare(syscall.CLONE_NEWNS) != nil {
+		return fmt.Errorf("Error unshareing")
+	}
+	// mounts made from now on must not propagate back to the host, the ones
+	// of the host keep coming to us
+	return syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, "")
+}
+
+// This is for previous stages of the project where isolated binary was required since
+// we were not pulling any image from docker hub, in final stage we are pulling image
+// so we use only chroot
+func isolateFileSystemWithBinary(tempDir, binaryPath string) error {
+	// now we copy the binary to the temporary directory
+	destinationPath := filepath.Join(tempDir, binaryPath)
+
+	err := os.MkdirAll(filepath.Dir(destinationPath), 0600) // 0600 means only the owner can read/write
+	if err != nil {
+		fmt.Printf("Error creating directory: %v\n", err)
+		return err
+	}
+
+	// copy the binary to the temporary directory
+	binarySrc, err := os.Open(binaryPath)
+	if err != nil {
+		fmt.Printf("Error opening binary: %v\n", err)
+		return err
+	}
+	defer binarySrc.Close()
+
+	binaryDest, err := os.Create(destinationPath)
+	if err != nil {
+		fmt.Printf("Error creating binary: %v\n", err)
+		return err
+	}
+	defer binaryDest.Close()
+
+	// setting permissons for destination file
+	err = binaryDest.Chmod(0100)
+	if err != nil {
+		fmt.Printf("Error setting permissions: %v\n", err)
+		return err
+	}
+
+	// now we copy the binary to the temporary directory
+	_, err = io.Copy(binaryDest, binarySrc)
+	if err != nil {
+		fmt.Printf("Error copying binary: %v\n", err)
+		return err
+	}
+
+	// now we chroot into the temporary directory
+	err = syscall.Chroot(tempDir)
+	if err != nil {
+		fmt.Printf("Error chrooting: %v\n", err)
+		return err
+	}
+
+	return nil
+}
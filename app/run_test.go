@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContainerArgs(t *testing.T) {
+	empty, shell := "", "/bin/bash"
+	tests := []struct {
+		name       string
+		config     ContainerConfig
+		entrypoint *string
+		args       []string
+		want       []string
+	}{
+		{"cmd", ContainerConfig{Cmd: []string{"nginx", "-g", "daemon off;"}}, nil, nil, []string{"nginx", "-g", "daemon off;"}},
+		{"args replace the cmd", ContainerConfig{Cmd: []string{"nginx"}}, nil, []string{"ls", "-l"}, []string{"ls", "-l"}},
+		{"cmd after the entrypoint", ContainerConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"postgres"}}, nil, nil, []string{"/entrypoint.sh", "postgres"}},
+		{"args after the entrypoint", ContainerConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"postgres"}}, nil, []string{"bash"}, []string{"/entrypoint.sh", "bash"}},
+		{"entrypoint override drops the cmd", ContainerConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"postgres"}}, &shell, nil, []string{"/bin/bash"}},
+		{"entrypoint override with args", ContainerConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"postgres"}}, &shell, []string{"-c", "id"}, []string{"/bin/bash", "-c", "id"}},
+		{"empty entrypoint override", ContainerConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"postgres"}}, &empty, []string{"id"}, []string{"id"}},
+		// an exec form entrypoint running sh -c gets the cmd as $0, $1...
+		{"sh -c entrypoint gets the cmd", ContainerConfig{Entrypoint: []string{"/bin/sh", "-c", `exec "$0" "$@"`}, Cmd: []string{"echo", "hi"}}, nil, nil, []string{"/bin/sh", "-c", `exec "$0" "$@"`, "echo", "hi"}},
+		{"sh -c entrypoint gets the args", ContainerConfig{Entrypoint: []string{"/bin/sh", "-c", `exec "$0" "$@"`}, Cmd: []string{"echo", "hi"}}, nil, []string{"id"}, []string{"/bin/sh", "-c", `exec "$0" "$@"`, "id"}},
+	}
+	for _, test := range tests {
+		got := containerArgs(test.config, test.entrypoint, test.args)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: containerArgs = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
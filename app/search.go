@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+const searchURL = "https://index.docker.io/v1/search?q=%s&n=%d"
+
+// SearchResult is one repository returned by the docker hub search api, the
+// field names are the ones available to --format
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StarCount   int    `json:"star_count"`
+	IsOfficial  bool   `json:"is_official"`
+	IsAutomated bool   `json:"is_automated"`
+}
+
+// Usage: your_docker.sh search [--limit n] [--format template] <term>
+func searchCommand(args []string) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	limit := flags.Int("limit", 25, "max number of search results")
+	format := flags.String("format", "", "pretty-print results using a Go template, e.g. {{.Name}}")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: search [--limit n] [--format template] <term>")
+	}
+	if *limit < 1 || *limit > 100 {
+		return fmt.Errorf("Limit %d is outside the range of [1, 100]", *limit)
+	}
+	if offline {
+		return fmt.Errorf("Cannot search: running in offline mode")
+	}
+
+	results, err := searchDockerHub(flags.Arg(0), *limit)
+	if err != nil {
+		return fmt.Errorf("Error searching: %v", err)
+	}
+
+	if *format != "" {
+		tmpl, err := template.New("format").Parse(*format)
+		if err != nil {
+			return fmt.Errorf("Invalid format: %v", err)
+		}
+		for _, result := range results {
+			err = tmpl.Execute(os.Stdout, result)
+			if err != nil {
+				return err
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tDESCRIPTION\tSTARS\tOFFICIAL\tAUTOMATED")
+	for _, result := range results {
+		description := strings.Join(strings.Fields(result.Description), " ")
+		if len(description) > 45 {
+			description = description[:42] + "..."
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", result.Name, description, result.StarCount, checkMark(result.IsOfficial), checkMark(result.IsAutomated))
+	}
+	return writer.Flush()
+}
+
+// This function queries the docker hub search api
+func searchDockerHub(term string, limit int) ([]SearchResult, error) {
+	resp, err := httpClient.Get(fmt.Sprintf(searchURL, url.QueryEscape(term), limit))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error querying docker hub: %v", resp.Status)
+	}
+
+	var response struct {
+		Results []SearchResult `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Results) > limit {
+		response.Results = response.Results[:limit]
+	}
+	return response.Results, nil
+}
+
+// The below function prints boolean columns the way docker does
+func checkMark(value bool) string {
+	if value {
+		return "[OK]"
+	}
+	return ""
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Containers run with a seccomp filter that makes the system calls only the
+// host should make fail with EPERM: mounting, rebooting, loading kernel
+// modules, setting the clock and the like. The filter is a BPF program the
+// container init loads right before executing the container process, which
+// keeps it and passes it on to what it starts.
+// --security-opt seccomp=unconfined runs the container without one,
+// seccomp=<profile.json> with the one of a profile in the format of docker's
+
+// seccompProfile is a seccomp profile, in the format of the profiles of docker.
+// Filters are only made for the architecture we run on, the system calls of
+// the other architectures of the profile fail
+type seccompProfile struct {
+	DefaultAction   string          `json:"defaultAction"`
+	DefaultErrnoRet *uint           `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string        `json:"architectures,omitempty"`
+	ArchMap         json.RawMessage `json:"archMap,omitempty"`
+	Syscalls        []seccompRule   `json:"syscalls,omitempty"`
+}
+
+// seccompRule is what the system calls of names do, when their arguments
+// match args. Includes and excludes limit the rule to some containers
+type seccompRule struct {
+	Name     string          `json:"name,omitempty"` // a single name, the old format
+	Names    []string        `json:"names,omitempty"`
+	Action   string          `json:"action"`
+	ErrnoRet *uint           `json:"errnoRet,omitempty"`
+	Args     []seccompArg    `json:"args,omitempty"`
+	Includes seccompSelector `json:"includes,omitempty"`
+	Excludes seccompSelector `json:"excludes,omitempty"`
+}
+
+// seccompArg compares an argument of a system call, the index-th, to value.
+// SCMP_CMP_MASKED_EQ compares it masked with value to valueTwo
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// seccompSelector picks the containers a rule is for, by their capabilities,
+// the architecture and the version of the kernel
+type seccompSelector struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// cloneNamespaceFlags are the flags of clone making new namespaces: mount,
+// cgroup, uts, ipc, user, pid and network
+const cloneNamespaceFlags = syscall.CLONE_NEWNS | cloneNewCgroup | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET
+
+// enosys is the errno of the system calls the kernel doesn't have
+var enosys = uint(syscall.ENOSYS)
+
+// defaultSeccompProfile is what containers may not do, the system calls the
+// default profile of docker leaves out. Most of them are for containers
+// without a capability, the one that lets the kernel do them.
+// clone3 fails as if the kernel didn't have it, the C libraries fall back to
+// clone then. clone itself is allowed only without the flags of new
+// namespaces, or unshare would be one clone away
+var defaultSeccompProfile = &seccompProfile{
+	DefaultAction: "SCMP_ACT_ALLOW",
+	Syscalls: []seccompRule{
+		{
+			Names: []string{
+				"add_key", "bpf", "create_module", "get_kernel_syms", "keyctl",
+				"lookup_dcookie", "nfsservctl", "perf_event_open", "query_module",
+				"request_key", "sysfs", "_sysctl", "uselib", "userfaultfd", "ustat",
+				"vm86", "vm86old",
+			},
+			Action: "SCMP_ACT_ERRNO",
+		},
+		{
+			Names: []string{
+				"fsconfig", "fsmount", "fsopen", "fspick", "mount", "mount_setattr",
+				"move_mount", "name_to_handle_at", "open_tree", "pivot_root",
+				"quotactl", "quotactl_fd", "setns", "umount", "umount2", "unshare",
+			},
+			Action:   "SCMP_ACT_ERRNO",
+			Excludes: seccompSelector{Caps: []string{"CAP_SYS_ADMIN"}},
+		},
+		{
+			Names:    []string{"clone"},
+			Action:   "SCMP_ACT_ALLOW",
+			Args:     []seccompArg{{Index: 0, Value: cloneNamespaceFlags, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}},
+			Excludes: seccompSelector{Caps: []string{"CAP_SYS_ADMIN"}},
+		},
+		{Names: []string{"clone"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_ADMIN"}}},
+		{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &enosys, Excludes: seccompSelector{Caps: []string{"CAP_SYS_ADMIN"}}},
+		{Names: []string{"reboot"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_BOOT"}}},
+		{Names: []string{"delete_module", "finit_module", "init_module", "kexec_file_load", "kexec_load"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_MODULE"}}},
+		{Names: []string{"clock_adjtime", "clock_settime", "settimeofday", "stime"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_TIME"}}},
+		{Names: []string{"kcmp", "process_vm_readv", "process_vm_writev"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_PTRACE"}}},
+		{Names: []string{"acct"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_PACCT"}}},
+		{Names: []string{"ioperm", "iopl"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_RAWIO"}}},
+		{Names: []string{"swapoff", "swapon", "syslog", "vhangup"}, Action: "SCMP_ACT_ERRNO", Excludes: seccompSelector{Caps: []string{"CAP_SYS_ADMIN"}}},
+	},
+}
+
+// auditArches are the AUDIT_ARCH_* values the kernel gives seccomp filters
+// for the system calls of the architectures of syscallNumbers
+var auditArches = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+// scmpArches are the names profiles give the architectures of auditArches
+var scmpArches = map[string]string{
+	"amd64": "SCMP_ARCH_X86_64",
+	"arm64": "SCMP_ARCH_AARCH64",
+}
+
+// the return values of seccomp filters
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// x32SyscallBit is set in the numbers of the system calls of the x32 ABI,
+// which amd64 filters see as their own
+const x32SyscallBit = 0x40000000
+
+// The below function reads the seccomp profile at path
+func loadSeccompProfile(path string) (*seccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Opening seccomp profile (%s) failed: %v", path, err)
+	}
+	var profile seccompProfile
+	err = json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("Decoding seccomp profile (%s) failed: %v", path, err)
+	}
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("Invalid seccomp profile (%s): no defaultAction", path)
+	}
+	return &profile, nil
+}
+
+// The below function returns what a filter returns for action, the name of
+// a libseccomp action the way profiles give it. errnoRet is the errno of the
+// errno actions, EPERM when the profile doesn't give one
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | errno&0xffff, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace | errno&0xffff, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	}
+	return 0, fmt.Errorf("Unknown seccomp action %s", action)
+}
+
+// The below function compiles profile into the BPF program of a seccomp
+// filter for the architecture we run on, for a container with the
+// capabilities caps. The program checks the system call
+// comes from that architecture, then goes through a block of instructions per
+// system call of each rule, which returns the action of the rule when the
+// number and the arguments match. The system calls the architecture doesn't
+// have are left out
+func compileSeccomp(profile *seccompProfile, caps []string) ([]syscall.SockFilter, error) {
+	numbers, ok := syscallNumbers[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("Seccomp profiles are not supported on %s, run with --security-opt seccomp=unconfined", runtime.GOARCH)
+	}
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first field of seccomp_data is the number, the second the architecture
+	program := []syscall.SockFilter{
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, auditArches[runtime.GOARCH], 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.ENOSYS)),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+	}
+	if runtime.GOARCH == "amd64" {
+		program = append(program,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.ENOSYS)))
+	}
+	for _, rule := range profile.Syscalls {
+		if !rule.applies(caps) {
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		for _, arg := range rule.Args {
+			if _, ok := conditionSizes[arg.Op]; !ok || arg.Index > 5 {
+				return nil, fmt.Errorf("Invalid seccomp rule for %v: unknown comparison %s of argument %d", rule.names(), arg.Op, arg.Index)
+			}
+		}
+		// like runc, the conditions of a rule must all match, unless some
+		// are on the same argument: then any of them may
+		conditions := [][]seccompArg{rule.Args}
+		if repeatsArgument(rule.Args) {
+			conditions = nil
+			for _, arg := range rule.Args {
+				conditions = append(conditions, []seccompArg{arg})
+			}
+		}
+		for _, name := range rule.names() {
+			number, ok := numbers[name]
+			if !ok {
+				continue
+			}
+			for _, args := range conditions {
+				program = append(program, seccompBlock(number, args, action)...)
+			}
+		}
+	}
+	program = append(program, bpfStmt(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+	// the kernel takes at most BPF_MAXINSNS instructions
+	if len(program) > 4096 {
+		return nil, fmt.Errorf("The seccomp profile is too large, %d instructions", len(program))
+	}
+	return program, nil
+}
+
+// This function returns the names of the system calls of the rule
+func (r seccompRule) names() []string {
+	if r.Name != "" {
+		return append([]string{r.Name}, r.Names...)
+	}
+	return r.Names
+}
+
+// The below function reports whether the rule is for a container with the
+// capabilities caps: it has every capability the rule includes and none it
+// excludes
+func (r seccompRule) applies(caps []string) bool {
+	arch := scmpArches[runtime.GOARCH]
+	if len(r.Includes.Arches) > 0 && !containsString(r.Includes.Arches, arch) {
+		return false
+	}
+	if containsString(r.Excludes.Arches, arch) {
+		return false
+	}
+	for _, c := range r.Includes.Caps {
+		if !containsString(caps, c) {
+			return false
+		}
+	}
+	for _, c := range r.Excludes.Caps {
+		if containsString(caps, c) {
+			return false
+		}
+	}
+	if r.Includes.MinKernel != "" && !kernelAtLeast(r.Includes.MinKernel) {
+		return false
+	}
+	if r.Excludes.MinKernel != "" && kernelAtLeast(r.Excludes.MinKernel) {
+		return false
+	}
+	return true
+}
+
+// This function reports whether args compare an argument more than once
+func repeatsArgument(args []seccompArg) bool {
+	seen := map[uint]bool{}
+	for _, arg := range args {
+		if seen[arg.Index] {
+			return true
+		}
+		seen[arg.Index] = true
+	}
+	return false
+}
+
+// conditionSizes are the comparisons of arguments seccompBlock makes, with the
+// number of instructions each takes
+var conditionSizes = map[string]int{
+	"SCMP_CMP_EQ":        4,
+	"SCMP_CMP_NE":        4,
+	"SCMP_CMP_LT":        5,
+	"SCMP_CMP_LE":        5,
+	"SCMP_CMP_GT":        5,
+	"SCMP_CMP_GE":        5,
+	"SCMP_CMP_MASKED_EQ": 6,
+}
+
+// The below function returns the instructions that return action when the
+// system call is number and its arguments match args. The accumulator holds
+// the number when they start, and again when they fall through to the next
+// block. Arguments are 64 bits, BPF compares 32: the high halves are compared
+// first and the low ones when those are equal
+func seccompBlock(number int, args []seccompArg, action uint32) []syscall.SockFilter {
+	size := 2
+	for _, arg := range args {
+		size += conditionSizes[arg.Op]
+	}
+	var block []syscall.SockFilter
+	// the offset of a jump from the next instruction to target, the block
+	// fails to size: the end of the block, or the reload of the number
+	jump := func(target int) uint8 {
+		return uint8(target - len(block) - 1)
+	}
+	load := func(offset uint) syscall.SockFilter {
+		return bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, uint32(offset))
+	}
+	cmp := func(op uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return bpfJump(syscall.BPF_JMP|op|syscall.BPF_K, k, jt, jf)
+	}
+
+	block = append(block, cmp(syscall.BPF_JEQ, uint32(number), 0, jump(size)))
+	for _, arg := range args {
+		// the arguments of seccomp_data start at 16, little endian
+		low, high := 16+8*arg.Index, 20+8*arg.Index
+		value := arg.Value
+		if arg.Op == "SCMP_CMP_MASKED_EQ" {
+			value = arg.ValueTwo
+		}
+		valueLow, valueHigh := uint32(value), uint32(value>>32)
+		matched := len(block) + conditionSizes[arg.Op]
+		switch arg.Op {
+		case "SCMP_CMP_EQ":
+			block = append(block, load(high))
+			block = append(block, cmp(syscall.BPF_JEQ, valueHigh, 0, jump(size)))
+			block = append(block, load(low))
+			block = append(block, cmp(syscall.BPF_JEQ, valueLow, 0, jump(size)))
+		case "SCMP_CMP_NE":
+			block = append(block, load(high))
+			block = append(block, cmp(syscall.BPF_JEQ, valueHigh, 0, jump(matched)))
+			block = append(block, load(low))
+			block = append(block, cmp(syscall.BPF_JEQ, valueLow, jump(size), 0))
+		case "SCMP_CMP_GT", "SCMP_CMP_GE":
+			block = append(block, load(high))
+			block = append(block, cmp(syscall.BPF_JGT, valueHigh, jump(matched), 0))
+			block = append(block, cmp(syscall.BPF_JEQ, valueHigh, 0, jump(size)))
+			block = append(block, load(low))
+			op := uint16(syscall.BPF_JGT)
+			if arg.Op == "SCMP_CMP_GE" {
+				op = syscall.BPF_JGE
+			}
+			block = append(block, cmp(op, valueLow, 0, jump(size)))
+		case "SCMP_CMP_LT", "SCMP_CMP_LE":
+			block = append(block, load(high))
+			block = append(block, cmp(syscall.BPF_JGT, valueHigh, jump(size), 0))
+			block = append(block, cmp(syscall.BPF_JEQ, valueHigh, 0, jump(matched)))
+			block = append(block, load(low))
+			op := uint16(syscall.BPF_JGE)
+			if arg.Op == "SCMP_CMP_LE" {
+				op = syscall.BPF_JGT
+			}
+			block = append(block, cmp(op, valueLow, jump(size), 0))
+		case "SCMP_CMP_MASKED_EQ":
+			maskLow, maskHigh := uint32(arg.Value), uint32(arg.Value>>32)
+			block = append(block, load(high))
+			block = append(block, bpfStmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, maskHigh))
+			block = append(block, cmp(syscall.BPF_JEQ, valueHigh, 0, jump(size)))
+			block = append(block, load(low))
+			block = append(block, bpfStmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, maskLow))
+			block = append(block, cmp(syscall.BPF_JEQ, valueLow, 0, jump(size)))
+		}
+	}
+	block = append(block, bpfStmt(syscall.BPF_RET|syscall.BPF_K, action))
+	if len(args) > 0 {
+		block = append(block, load(0))
+	}
+	return block
+}
+
+// The below function reports whether the kernel we run on is version or a
+// later one, version being like 4.8
+func kernelAtLeast(version string) bool {
+	var uts syscall.Utsname
+	if syscall.Uname(&uts) != nil {
+		return false
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	var major, minor, wantMajor, wantMinor int
+	fmt.Sscanf(string(release), "%d.%d", &major, &minor)
+	fmt.Sscanf(version, "%d.%d", &wantMajor, &wantMinor)
+	return major > wantMajor || major == wantMajor && minor >= wantMinor
+}
+
+// bpfStmt and bpfJump make BPF instructions, like the macros of linux/filter.h
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// The below function loads the seccomp filter of program on the calling
+// thread, which the caller locks and executes the container process from.
+// Without no_new_privs only a process with CAP_SYS_ADMIN may load one, the
+// container init has it in its user namespace
+func loadSeccomp(program []syscall.SockFilter) error {
+	prog := syscall.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("Error loading the seccomp filter: %v", errno)
+	}
+	return nil
+}
+
+// seccompModeFilter is SECCOMP_MODE_FILTER, a filter given as a BPF program
+const seccompModeFilter = 2
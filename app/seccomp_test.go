@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// seccompData is the seccomp_data the kernel runs filters on
+type seccompData struct {
+	nr   int32
+	arch uint32
+	args [6]uint64
+}
+
+// The below function runs the BPF program of a seccomp filter on data the
+// way the kernel does, with the instructions compileSeccomp makes, and
+// returns what it returns
+func runSeccomp(t *testing.T, program []syscall.SockFilter, data seccompData) uint32 {
+	t.Helper()
+	raw := make([]byte, 64)
+	binary.LittleEndian.PutUint32(raw[0:], uint32(data.nr))
+	binary.LittleEndian.PutUint32(raw[4:], data.arch)
+	for i, arg := range data.args {
+		binary.LittleEndian.PutUint64(raw[16+8*i:], arg)
+	}
+	var acc uint32
+	for pc := 0; pc < len(program); pc++ {
+		inst := program[pc]
+		switch inst.Code {
+		case syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS:
+			if int(inst.K)+4 > len(raw) {
+				t.Fatalf("instruction %d loads out of seccomp_data at %d", pc, inst.K)
+			}
+			acc = binary.LittleEndian.Uint32(raw[inst.K:])
+		case syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K:
+			acc &= inst.K
+		case syscall.BPF_RET | syscall.BPF_K:
+			return inst.K
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K,
+			syscall.BPF_JMP | syscall.BPF_JGT | syscall.BPF_K,
+			syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K:
+			var taken bool
+			switch inst.Code &^ (syscall.BPF_JMP | syscall.BPF_K) {
+			case syscall.BPF_JEQ:
+				taken = acc == inst.K
+			case syscall.BPF_JGT:
+				taken = acc > inst.K
+			case syscall.BPF_JGE:
+				taken = acc >= inst.K
+			}
+			if taken {
+				pc += int(inst.Jt)
+			} else {
+				pc += int(inst.Jf)
+			}
+			if pc+1 >= len(program) {
+				t.Fatalf("instruction %d jumps past the end of the program", pc)
+			}
+		default:
+			t.Fatalf("instruction %d has an unknown code %#x", pc, inst.Code)
+		}
+	}
+	t.Fatalf("the program ends without returning")
+	return 0
+}
+
+// The below function runs the block of seccompBlock for the system call 7
+// with args, followed by a block for the system call 8 and a default return,
+// so a block that fails has to leave the number in the accumulator. Blocks
+// start with the number loaded, like in compileSeccomp
+func runBlock(t *testing.T, args []seccompArg, data seccompData) uint32 {
+	program := []syscall.SockFilter{bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0)}
+	program = append(program, seccompBlock(7, args, seccompRetErrno|1)...)
+	program = append(program, seccompBlock(8, nil, seccompRetErrno|2)...)
+	program = append(program, bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+	return runSeccomp(t, program, data)
+}
+
+func TestSeccompBlockComparisons(t *testing.T) {
+	const matched, next, allowed = seccompRetErrno | 1, seccompRetErrno | 2, seccompRetAllow
+	// values whose low halves order the other way than the whole values, a
+	// comparison of the low halves alone gets them wrong
+	const big, small = 0x1_0000_0000, 0xffff_ffff
+	tests := []struct {
+		name string
+		args []seccompArg
+		arg  uint64
+		want uint32
+	}{
+		{"eq", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_EQ"}}, big, matched},
+		{"eq low half", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_EQ"}}, 0, allowed},
+		{"eq high half", []seccompArg{{Index: 1, Value: 5, Op: "SCMP_CMP_EQ"}}, 1<<32 | 5, allowed},
+		{"ne", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_NE"}}, big, allowed},
+		{"ne high half", []seccompArg{{Index: 1, Value: 5, Op: "SCMP_CMP_NE"}}, 1<<32 | 5, matched},
+		{"ne low half", []seccompArg{{Index: 1, Value: 5, Op: "SCMP_CMP_NE"}}, 6, matched},
+		{"gt", []seccompArg{{Index: 1, Value: small, Op: "SCMP_CMP_GT"}}, big, matched},
+		{"gt equal", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_GT"}}, big, allowed},
+		{"gt less", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_GT"}}, small, allowed},
+		{"ge equal", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_GE"}}, big, matched},
+		{"ge less", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_GE"}}, small, allowed},
+		{"lt", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_LT"}}, small, matched},
+		{"lt equal", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_LT"}}, big, allowed},
+		{"lt greater", []seccompArg{{Index: 1, Value: small, Op: "SCMP_CMP_LT"}}, big, allowed},
+		{"le equal", []seccompArg{{Index: 1, Value: big, Op: "SCMP_CMP_LE"}}, big, matched},
+		{"le greater", []seccompArg{{Index: 1, Value: small, Op: "SCMP_CMP_LE"}}, big, allowed},
+		{"masked eq", []seccompArg{{Index: 1, Value: 0xff00_0000_00f0, ValueTwo: 0x1200_0000_0030, Op: "SCMP_CMP_MASKED_EQ"}}, 0x1234_0000_0035, matched},
+		{"masked eq high half", []seccompArg{{Index: 1, Value: 0xff00_0000_00f0, ValueTwo: 0x1200_0000_0030, Op: "SCMP_CMP_MASKED_EQ"}}, 0x1300_0000_0030, allowed},
+		{"masked eq low half", []seccompArg{{Index: 1, Value: 0xff00_0000_00f0, ValueTwo: 0x1200_0000_0030, Op: "SCMP_CMP_MASKED_EQ"}}, 0x1200_0000_0040, allowed},
+		{"every argument", []seccompArg{{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"}, {Index: 1, Value: big, Op: "SCMP_CMP_GE"}}, big, matched},
+		{"one argument of two", []seccompArg{{Index: 0, Value: 2, Op: "SCMP_CMP_EQ"}, {Index: 1, Value: big, Op: "SCMP_CMP_GE"}}, big, allowed},
+	}
+	for _, test := range tests {
+		data := seccompData{nr: 7, args: [6]uint64{1, test.arg}}
+		if got := runBlock(t, test.args, data); got != test.want {
+			t.Errorf("%s: the filter returns %#x for %#x, want %#x", test.name, got, test.arg, test.want)
+		}
+		// a failed block falls through to the next one with the number
+		data.nr = 8
+		if got := runBlock(t, test.args, data); got != next {
+			t.Errorf("%s: the filter returns %#x for the next system call, want %#x", test.name, got, uint32(next))
+		}
+	}
+}
+
+func TestCompileDefaultSeccompProfile(t *testing.T) {
+	numbers, ok := syscallNumbers[runtime.GOARCH]
+	if !ok {
+		t.Skipf("no system call numbers for %s", runtime.GOARCH)
+	}
+	arch := auditArches[runtime.GOARCH]
+	eperm := seccompRetErrno | uint32(syscall.EPERM)
+	tests := []struct {
+		name    string
+		caps    []string
+		syscall string
+		arg0    uint64
+		want    uint32
+	}{
+		{"clone of a thread", defaultCapabilities, "clone", syscall.CLONE_VM | syscall.CLONE_THREAD, seccompRetAllow},
+		{"clone of a user namespace", defaultCapabilities, "clone", syscall.CLONE_NEWUSER | uint64(syscall.SIGCHLD), eperm},
+		{"clone of a network namespace", defaultCapabilities, "clone", syscall.CLONE_NEWNET, eperm},
+		{"clone of a cgroup namespace", defaultCapabilities, "clone", cloneNewCgroup, eperm},
+		{"clone of a namespace with CAP_SYS_ADMIN", []string{"CAP_SYS_ADMIN"}, "clone", syscall.CLONE_NEWUSER, seccompRetAllow},
+		{"unshare", defaultCapabilities, "unshare", syscall.CLONE_NEWUSER, eperm},
+		{"clone3", defaultCapabilities, "clone3", 0, seccompRetErrno | uint32(syscall.ENOSYS)},
+		{"reboot", defaultCapabilities, "reboot", 0, eperm},
+		{"read", defaultCapabilities, "read", 0, seccompRetAllow},
+	}
+	for _, test := range tests {
+		program, err := compileSeccomp(defaultSeccompProfile, test.caps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := seccompData{nr: int32(numbers[test.syscall]), arch: arch, args: [6]uint64{test.arg0}}
+		if got := runSeccomp(t, program, data); got != test.want {
+			t.Errorf("%s: the filter returns %#x, want %#x", test.name, got, test.want)
+		}
+	}
+
+	program, err := compileSeccomp(defaultSeccompProfile, defaultCapabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := seccompData{nr: int32(numbers["read"]), arch: arch + 1}
+	if got, want := runSeccomp(t, program, data), seccompRetErrno|uint32(syscall.ENOSYS); got != want {
+		t.Errorf("the filter returns %#x for another architecture, want %#x", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// securityOptions are the --security-opt options of a container
+type securityOptions struct {
+	// the seccomp profile of the container, nil for none
+	Seccomp *seccompProfile
+	// whether the container process and what it executes are kept from
+	// gaining privileges, by setuid programs or file capabilities
+	NoNewPrivileges bool
+	// the AppArmor profile asked for, unconfined for none and empty for the
+	// default one
+	AppArmor string
+	// the SELinux label options, like user:<user> or disable
+	Label []string
+	// whether the paths of /proc and /sys about the host are masked
+	MaskSystemPaths bool
+}
+
+// The below function parses the values of --security-opt, key=value each the
+// way docker takes them. Containers get the default seccomp profile unless
+// seccomp=unconfined or the path of another profile is given, no new
+// privileges unless no-new-privileges=false is and the paths of /proc and
+// /sys about the host masked unless systempaths=unconfined is
+func parseSecurityOpts(values []string) (securityOptions, error) {
+	options := securityOptions{Seccomp: defaultSeccompProfile, NoNewPrivileges: true, MaskSystemPaths: true}
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok && key != "no-new-privileges" {
+			return securityOptions{}, fmt.Errorf("Invalid --security-opt %q: expected key=value", value)
+		}
+		switch key {
+		case "no-new-privileges":
+			if !ok {
+				val = "true"
+			}
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return securityOptions{}, fmt.Errorf("Invalid --security-opt %q: expected no-new-privileges=true or false", value)
+			}
+			options.NoNewPrivileges = enabled
+		case "apparmor":
+			if val == "" {
+				return securityOptions{}, fmt.Errorf("Invalid --security-opt %q: expected apparmor=<profile> or apparmor=unconfined", value)
+			}
+			options.AppArmor = val
+		case "label":
+			options.Label = append(options.Label, val)
+		case "systempaths":
+			if val != "unconfined" {
+				return securityOptions{}, fmt.Errorf("Invalid --security-opt %q: only systempaths=unconfined is supported", value)
+			}
+			options.MaskSystemPaths = false
+		case "seccomp":
+			if val == "unconfined" {
+				options.Seccomp = nil
+				continue
+			}
+			profile, err := loadSeccompProfile(val)
+			if err != nil {
+				return securityOptions{}, err
+			}
+			options.Seccomp = profile
+		default:
+			return securityOptions{}, fmt.Errorf("Invalid --security-opt %q: unknown option %s", value, key)
+		}
+	}
+	return options, nil
+}
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS, which the syscall package doesn't have
+const prSetNoNewPrivs = 38
+
+// The below function sets no_new_privs on the calling thread, which the
+// caller locks and executes the container process from. It can't be unset,
+// what the process executes keeps it
+func setNoNewPrivileges() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("Error setting no_new_privs: %v", errno)
+	}
+	return nil
+}
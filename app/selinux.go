@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// On hosts with SELinux, containers run with the process label of containers
+// of the policy, container_t, and their files have the file label of
+// containers, container_file_t. Each container gets a level with a pair of
+// categories of its own, s0:c<a>,c<b>, so a container can't reach the files
+// of another even though they are of the same type. The root file system and
+// the tmpfs of a container are mounted with its file label, the bind mounts
+// asked to be relabeled, with relabel=shared or private or the :z and :Z of
+// -v, are given it on the host. --security-opt label=user:, role:, type: and level:
+// change the labels, label=disable runs the container unlabeled
+
+// the labels of containers when the policy doesn't give them in lxc_contexts
+const (
+	defaultProcessLabel = "system_u:system_r:container_t:s0"
+	defaultFileLabel    = "system_u:object_r:container_file_t:s0"
+)
+
+// This function reports whether the host runs SELinux, its file system is
+// mounted then
+func selinuxEnabled() bool {
+	var stat syscall.Statfs_t
+	// SELINUX_MAGIC
+	return syscall.Statfs("/sys/fs/selinux", &stat) == nil && stat.Type == 0xf97cff8c
+}
+
+// The below function returns the process and file labels of containers the
+// policy the host runs gives in its lxc_contexts, the defaults otherwise
+func policyContainerLabels() (string, string) {
+	processLabel, fileLabel := defaultProcessLabel, defaultFileLabel
+	policy := "targeted"
+	if data, err := os.ReadFile("/etc/selinux/config"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(line), "SELINUXTYPE="); ok {
+				policy = value
+			}
+		}
+	}
+	file, err := os.Open(filepath.Join("/etc/selinux", policy, "contexts", "lxc_contexts"))
+	if err != nil {
+		return processLabel, fileLabel
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "process":
+			processLabel = value
+		case "file":
+			fileLabel = value
+		}
+	}
+	return processLabel, fileLabel
+}
+
+// The below function returns the process and mount labels of a container run
+// with the label options of --security-opt, empty without SELinux or with
+// label=disable. The level is a random pair of categories no running
+// container has, unless level: gives one
+func containerLabels(options []string) (string, string, error) {
+	if !selinuxEnabled() {
+		return "", "", nil
+	}
+	processLabel, mountLabel := policyContainerLabels()
+	process := strings.SplitN(processLabel, ":", 4)
+	mount := strings.SplitN(mountLabel, ":", 4)
+	if len(process) < 4 || len(mount) < 4 {
+		return "", "", fmt.Errorf("Invalid SELinux labels of containers %s and %s", processLabel, mountLabel)
+	}
+	level := ""
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, ":")
+		if option == "disable" {
+			return "", "", nil
+		}
+		if !ok || value == "" {
+			return "", "", fmt.Errorf("Invalid --security-opt label=%s: expected user:, role:, type:, filetype:, level: or disable", option)
+		}
+		switch key {
+		case "user":
+			process[0] = value
+		case "role":
+			process[1] = value
+		case "type":
+			process[2] = value
+		case "filetype":
+			mount[2] = value
+		case "level":
+			level = value
+		default:
+			return "", "", fmt.Errorf("Invalid --security-opt label=%s: expected user:, role:, type:, filetype:, level: or disable", option)
+		}
+	}
+	if level == "" {
+		var err error
+		level, err = uniqueLevel()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	process[3], mount[3] = level, level
+	return strings.Join(process, ":"), strings.Join(mount, ":"), nil
+}
+
+// The below function picks a level with two categories, s0:c<a>,c<b>, no
+// running container has
+func uniqueLevel() (string, error) {
+	used := map[string]bool{}
+	dirs, err := filepath.Glob(filepath.Join(dataRoot, "containers", "*"))
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		container, err := findContainer(filepath.Base(dir))
+		if err != nil || !container.State.Running || !processExists(container.State.Pid) {
+			continue
+		}
+		if parts := strings.SplitN(container.MountLabel, ":", 4); len(parts) == 4 {
+			used[parts[3]] = true
+		}
+	}
+	for {
+		a, b := rand.Intn(1024), rand.Intn(1024)
+		if a == b {
+			continue
+		}
+		if a > b {
+			a, b = b, a
+		}
+		level := fmt.Sprintf("s0:c%d,c%d", a, b)
+		if !used[level] {
+			return level, nil
+		}
+	}
+}
+
+// The below function adds the SELinux context of label to the options of a
+// mount, options being like the data argument of mount
+func mountLabelOption(options, label string) string {
+	if label == "" {
+		return options
+	}
+	context := fmt.Sprintf(`context="%s"`, label)
+	if options == "" {
+		return context
+	}
+	return options + "," + context
+}
+
+// protectedRelabelPaths are the directories of the host docker refuses to
+// relabel, the host would stop working
+var protectedRelabelPaths = []string{"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64", "/proc", "/root", "/sbin", "/sys", "/usr", "/var"}
+
+// The below function gives path and what is below it the file label of a
+// container. A shared one is relabeled without the categories, like :z, so
+// every container may use it, a private one keeps them, like :Z
+func relabel(path, label string, shared bool) error {
+	if label == "" {
+		return nil
+	}
+	clean := filepath.Clean(path)
+	if containsString(protectedRelabelPaths, clean) {
+		return fmt.Errorf("Relabeling %s is not allowed", path)
+	}
+	if shared {
+		parts := strings.SplitN(label, ":", 4)
+		if len(parts) == 4 {
+			parts[3] = "s0"
+			label = strings.Join(parts, ":")
+		}
+	}
+	return filepath.Walk(clean, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// setxattr follows symlinks, what they point to is relabeled on its own
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		err = syscall.Setxattr(file, "security.selinux", []byte(label), 0)
+		if err != nil {
+			return fmt.Errorf("Error relabeling %s: %v", file, err)
+		}
+		return nil
+	})
+}
+
+// The below function makes the calling thread change to the SELinux process
+// label when it executes the container process
+func applyProcessLabel(label string) error {
+	err := os.WriteFile("/proc/thread-self/attr/exec", []byte(label), 0)
+	if err != nil {
+		return fmt.Errorf("Error setting the process label %s: %v", label, err)
+	}
+	return nil
+}
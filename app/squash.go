@@ -0,0 +1,31 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// The below function creates a single layer with the whole file system at
+// root, the merged layers of an image or the root file system of a container,
+// and makes it the only layer of config. The history is kept with every entry
+// marked as empty, the caller adds the one of the squashed layer
+func (s *imageStore) squash(root string, config *ImageConfig) (Descriptor, error) {
+	layer, diffID, err := s.createLayer(func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		err := writeLayerTar(tw, root)
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("Error creating layer: %v", err)
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{diffID}
+	for i := range config.History {
+		config.History[i].EmptyLayer = true
+	}
+	return layer, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StorageDriver builds the root file system of a container out of the layers
+// of its image
+type StorageDriver interface {
+	name() string
+	// supported reports whether the driver can be used on this system
+	supported() bool
+	// mount makes the root file system available under dir, which belongs to
+	// the container, with the SELinux file label of the container if it has
+	// one, and returns its path
+	mount(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir, mountLabel string) (string, error)
+	// mountImage makes the file system of the image alone available under dir,
+	// read only, and returns its path
+	mountImage(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir string) (string, error)
+	// unmount undoes mount and mountImage, what is under dir is left to the caller
+	unmount(path string) error
+}
+
+// storageDrivers are the drivers we know of, the first supported one is used
+// unless --storage-driver picks another
+var storageDrivers = []StorageDriver{&overlayDriver{}, &fuseOverlayDriver{}, &vfsDriver{}}
+
+// storageDriverName is set by --storage-driver
+var storageDriverName string
+
+// The below function returns the storage driver named by --storage-driver, or
+// the first one the kernel and the installed tools support
+func selectStorageDriver() (StorageDriver, error) {
+	for _, driver := range storageDrivers {
+		if storageDriverName == "" && driver.supported() || driver.name() == storageDriverName {
+			return driver, nil
+		}
+	}
+	names := []string{}
+	for _, driver := range storageDrivers {
+		names = append(names, driver.name())
+	}
+	return nil, fmt.Errorf("Unknown storage driver %s, expected one of %s", storageDriverName, strings.Join(names, ", "))
+}
+
+// This function returns the storage driver with the given name
+func storageDriverByName(name string) (StorageDriver, error) {
+	for _, driver := range storageDrivers {
+		if driver.name() == name {
+			return driver, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown storage driver %s", name)
+}
+
+// This function reports whether the kernel supports the file system, as listed
+// in /proc/filesystems
+func kernelHasFilesystem(name string) bool {
+	file, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// vfsDriver copies the layers on top of each other, it works everywhere but
+// every container gets a full copy of its image
+type vfsDriver struct{}
+
+func (d *vfsDriver) name() string {
+	return "vfs"
+}
+
+func (d *vfsDriver) supported() bool {
+	return true
+}
+
+func (d *vfsDriver) mount(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir, mountLabel string) (string, error) {
+	// a container that ran before has its copy already, with its changes
+	rootfs := filepath.Join(dir, "rootfs")
+	if _, err := os.Stat(rootfs); err == nil {
+		return rootfs, nil
+	}
+	err := os.MkdirAll(rootfs, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = store.assembleRootfs(manifest, config, rootfs)
+	if err != nil {
+		return "", err
+	}
+	// the copy is the container's, it is labeled like a volume of its own
+	err = relabel(rootfs, mountLabel, false)
+	if err != nil {
+		return "", err
+	}
+	return rootfs, nil
+}
+
+func (d *vfsDriver) mountImage(store *imageStore, manifest *ManifestResponse, config *ImageConfig, dir string) (string, error) {
+	image := filepath.Join(dir, "image")
+	err := os.MkdirAll(image, 0755)
+	if err != nil {
+		return "", err
+	}
+	return image, store.assembleRootfs(manifest, config, image)
+}
+
+func (d *vfsDriver) unmount(rootfs string) error {
+	// nothing is mounted, the copy goes away with the container
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dataRoot is the directory where everything that has to outlive a single run is
+// kept: images, containers, their logs and volumes. --data-root changes it
+var dataRoot = defaultDataRoot()
+
+// This function returns the data root of the user: /var/lib/mydocker for root and
+// $XDG_DATA_HOME/mydocker (~/.local/share/mydocker) for everyone else
+func defaultDataRoot() string {
+	if os.Geteuid() == 0 {
+		return "/var/lib/mydocker"
+	}
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "mydocker")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "/var/lib/mydocker"
+	}
+	return filepath.Join(home, ".local", "share", "mydocker")
+}
+
+// imageStore keeps pulled blobs and the tags pointing to them on disk, so that an
+// image only has to be downloaded once
+//
+// layout:
+//
+//	<root>/blobs/sha256/<hex>   manifests, configs and compressed layers
+//	<root>/layers/sha256/<hex>  extracted layers, by diff id (see layer.go)
+//	<root>/repositories.json    "image:tag" (or "image@digest") -> manifest digest
+type imageStore struct {
+	root string
+}
+
+// This function opens the image store under the data root, creating it if needed
+func openImageStore() (*imageStore, error) {
+	store := &imageStore{root: filepath.Join(dataRoot, "image")}
+	err := os.MkdirAll(filepath.Join(store.root, "blobs", "sha256"), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// The below function returns the path of a blob inside the store, digest is in
+// the form "sha256:<hex>". Digests come from manifests, anything else gets no
+// path so it never leads out of the store
+func (s *imageStore) blobPath(digest string) string {
+	if !sha256Regexp.MatchString(digest) {
+		return ""
+	}
+	return filepath.Join(s.root, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// This function reports whether the blob is already present in the store
+func (s *imageStore) hasBlob(digest string) bool {
+	path := s.blobPath(digest)
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// The below function writes the blob to the store, the content is written to a
+// temporary file first and only renamed into place if it matches the digest
+func (s *imageStore) writeBlob(digest string, r io.Reader) error {
+	if !sha256Regexp.MatchString(digest) {
+		return fmt.Errorf("Unsupported digest: %s", digest)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Join(s.root, "blobs"), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), r)
+	if err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("Digest mismatch: expected %s, got %s", digest, got)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.blobPath(digest))
+}
+
+// The below function writes raw bytes to the store and returns their digest
+func (s *imageStore) putBlob(data []byte) (string, error) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if s.hasBlob(digest) {
+		return digest, nil
+	}
+	return digest, s.writeBlob(digest, bytes.NewReader(data))
+}
+
+// This function reads the whole blob from the store
+func (s *imageStore) readBlob(digest string) ([]byte, error) {
+	return os.ReadFile(s.blobPath(digest))
+}
+
+// The below function loads the tag -> manifest digest mapping
+func (s *imageStore) loadRepositories() (map[string]string, error) {
+	repositories := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(s.root, "repositories.json"))
+	if os.IsNotExist(err) {
+		return repositories, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &repositories)
+	if err != nil {
+		return nil, err
+	}
+	return repositories, nil
+}
+
+// The below function saves the tag -> manifest digest mapping
+func (s *imageStore) saveRepositories(repositories map[string]string) error {
+	data, err := json.MarshalIndent(repositories, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(s.root, "repositories.json.tmp")
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(s.root, "repositories.json"))
+}
+
+// This function points the given reference at a manifest digest
+func (s *imageStore) setTag(name, digest string) error {
+	repositories, err := s.loadRepositories()
+	if err != nil {
+		return err
+	}
+	repositories[name] = digest
+	return s.saveRepositories(repositories)
+}
+
+// This function returns the manifest digest saved for the reference, and false if
+// the image was never pulled
+func (s *imageStore) lookupTag(name string) (string, bool, error) {
+	repositories, err := s.loadRepositories()
+	if err != nil {
+		return "", false, err
+	}
+	digest, ok := repositories[name]
+	return digest, ok, nil
+}
+
+// The below function returns the manifest digest of the reference, references
+// with a digest are found by their digest and the others by their tag
+func (s *imageStore) resolve(ref reference) (string, bool, error) {
+	if ref.digest != "" {
+		return ref.digest, s.hasBlob(ref.digest), nil
+	}
+	return s.lookupTag(ref.String())
+}
+
+// The below function reads and parses a manifest kept in the store
+func (s *imageStore) readManifest(digest string) (*ManifestResponse, error) {
+	data, err := s.readBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ManifestResponse
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// The below function checks the digests of the config and the layers of the
+// manifest, they name blobs of the store and only sha256 ones are taken
+func checkDigests(manifest *ManifestResponse) error {
+	digests := []string{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, digest := range digests {
+		if !sha256Regexp.MatchString(digest) {
+			return fmt.Errorf("Invalid digest %q in manifest", digest)
+		}
+	}
+	return nil
+}
+
+// The below function shortens a digest to the 12 characters shown to the user
+func shortID(digest string) string {
+	id := strings.TrimPrefix(digest, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// The below function returns the blobs (manifests, configs and layers) used by
+// the images the repositories point to
+func (s *imageStore) referencedBlobs(repositories map[string]string) map[string]bool {
+	referenced := map[string]bool{}
+	for _, digest := range repositories {
+		referenced[digest] = true
+		manifest, err := s.readManifest(digest)
+		if err != nil {
+			continue
+		}
+		referenced[manifest.Config.Digest] = true
+		for _, layer := range manifest.Layers {
+			referenced[layer.Digest] = true
+		}
+	}
+	return referenced
+}
+
+// This function deletes the given manifests, with their config and layers, as
+// long as no image in repositories still uses them. It returns the deleted blobs
+// and the space they took
+func (s *imageStore) deleteUnreferenced(manifests []string, repositories map[string]string) ([]string, int64, error) {
+	referenced := s.referencedBlobs(repositories)
+	deleted := []string{}
+	reclaimed := int64(0)
+	for _, digest := range manifests {
+		candidates := []string{digest}
+		if manifest, err := s.readManifest(digest); err == nil {
+			candidates = append(candidates, manifest.Config.Digest)
+			for _, layer := range manifest.Layers {
+				candidates = append(candidates, layer.Digest)
+			}
+		}
+		for _, candidate := range candidates {
+			if referenced[candidate] {
+				continue
+			}
+			info, err := os.Stat(s.blobPath(candidate))
+			if err != nil {
+				continue
+			}
+			err = os.Remove(s.blobPath(candidate))
+			if err != nil {
+				return deleted, reclaimed, err
+			}
+			deleted = append(deleted, candidate)
+			reclaimed += info.Size()
+		}
+	}
+	return deleted, reclaimed, nil
+}
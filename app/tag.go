@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Usage: your_docker.sh tag <source image|id> <target image>
+// the target is one more reference to the same manifest, no blob is copied
+func tagCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: tag <source image|id> <target image>")
+	}
+	target, err := parseReference(args[1])
+	if err != nil {
+		return err
+	}
+	if target.digest != "" {
+		return fmt.Errorf("Refusing to create a tag with a digest reference: %s", args[1])
+	}
+
+	store, err := openImageStore()
+	if err != nil {
+		return fmt.Errorf("Error opening image store: %v", err)
+	}
+	repositories, err := store.loadRepositories()
+	if err != nil {
+		return err
+	}
+	keys, err := store.matchImage(repositories, args[0])
+	if err != nil {
+		return err
+	}
+	return store.setTag(target.String(), repositories[keys[0]])
+}
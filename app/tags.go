@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+// Usage: your_docker.sh tags [--page-size n] <image>
+func tagsCommand(args []string) error {
+	flags := flag.NewFlagSet("tags", flag.ContinueOnError)
+	pageSize := flags.Int("page-size", 100, "number of tags asked for in every request")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: tags [--page-size n] <image>")
+	}
+	if offline {
+		return fmt.Errorf("Cannot list tags of %s: running in offline mode", flags.Arg(0))
+	}
+
+	ref, err := parseReference(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	reg, err := connectRegistry(ref, "pull")
+	if err != nil {
+		return err
+	}
+
+	return listTags(reg, ref.path, *pageSize, func(tag string) {
+		fmt.Println(tag)
+	})
+}
+
+// The below function walks all the pages of /v2/<name>/tags/list and calls
+// found for every tag
+func listTags(reg *registry, repository string, pageSize int, found func(tag string)) error {
+	pageURL := reg.url(fmt.Sprintf("/v2/%s/tags/list?n=%d", repository, pageSize))
+	for pageURL != "" {
+		resp, err := reg.get(pageURL, "")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("Error listing tags: %v", resp.Status)
+		}
+
+		var page struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, tag := range page.Tags {
+			found(tag)
+		}
+
+		pageURL, err = nextPageURL(resp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --clock-offset gives the container a time namespace of its own, where the
+// monotonic and boottime clocks are the ones of the host moved by an offset.
+// Uptimes and timeouts measured by the container then start where the test
+// asks for, e.g. a machine that has been up for 200 days. The wall clock is
+// not namespaced, it stays the one of the host
+
+// cloneNewTime is CLONE_NEWTIME, which the syscall package doesn't have. It
+// can only be given to unshare, clone uses the bit for the exit signal
+const cloneNewTime = 0x80
+
+// clockIDs are the clocks a time namespace offsets, by the name --clock-offset
+// takes, with the ids timens_offsets wants
+var clockIDs = map[string]int{
+	"monotonic": 1, // CLOCK_MONOTONIC
+	"boottime":  7, // CLOCK_BOOTTIME
+}
+
+// clockOffset is how far a clock of the container is from the one of the host
+type clockOffset struct {
+	Clock  string        `json:"clock"`
+	Offset time.Duration `json:"offset"`
+}
+
+// The below function parses the value of --clock-offset, <clock>=<duration>
+// with the clock monotonic or boottime, e.g. boottime=4800h or monotonic=-1m
+func parseClockOffset(value string) (clockOffset, error) {
+	clock, duration, ok := strings.Cut(value, "=")
+	if _, known := clockIDs[clock]; !ok || !known {
+		return clockOffset{}, fmt.Errorf("Invalid --clock-offset %q: expected monotonic=<duration> or boottime=<duration>", value)
+	}
+	offset, err := time.ParseDuration(duration)
+	if err != nil {
+		return clockOffset{}, fmt.Errorf("Invalid --clock-offset %q: expected a duration like 48h or -10m", value)
+	}
+	return clockOffset{Clock: clock, Offset: offset}, nil
+}
+
+// The below function creates the time namespace of the container with the
+// offsets. unshare leaves the caller where it is, the offsets have to be
+// written before any process is in the new namespace: the container process
+// enters it when the init executes it, from the calling thread which the caller
+// locks. The container init is root in the user namespace that owns the new
+// one, which is what writing them takes
+func unshareTime(offsets []clockOffset) error {
+	err := syscall.Unshare(cloneNewTime)
+	if err != nil {
+		return fmt.Errorf("Error creating the time namespace: %v", err)
+	}
+	var lines strings.Builder
+	for _, offset := range offsets {
+		// the nanoseconds can't be negative, the seconds carry the sign
+		seconds := int64(offset.Offset / time.Second)
+		nanoseconds := int64(offset.Offset % time.Second)
+		if nanoseconds < 0 {
+			seconds--
+			nanoseconds += int64(time.Second)
+		}
+		fmt.Fprintf(&lines, "%d %d %d\n", clockIDs[offset.Clock], seconds, nanoseconds)
+	}
+	err = os.WriteFile("/proc/thread-self/timens_offsets", []byte(lines.String()), 0)
+	if err != nil {
+		return fmt.Errorf("Error setting the clock offsets: %v", err)
+	}
+	return nil
+}
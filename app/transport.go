@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// transports images can be run from without a registry, like skopeo names them
+var localTransports = []string{"docker-archive", "oci-archive", "oci"}
+
+// This function splits a transport prefixed image like "oci:./layout:tag" into
+// the transport and the rest, ok is false for plain references
+func cutTransport(name string) (string, string, bool) {
+	for _, transport := range localTransports {
+		if strings.HasPrefix(name, transport+":") {
+			return transport, name[len(transport)+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// The below function splits the rest of a transport prefixed image into the
+// path of the archive or layout and the image picked in it. The path may
+// contain ":" itself, so it is the longest prefix that exists
+func splitTransportPath(rest string) (string, string, error) {
+	if _, err := os.Stat(rest); err == nil {
+		return rest, "", nil
+	}
+	for i := len(rest) - 1; i > 0; i-- {
+		if rest[i] != ':' {
+			continue
+		}
+		if _, err := os.Stat(rest[:i]); err == nil {
+			return rest[:i], rest[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("No such file or directory: %s", rest)
+}
+
+// The below function adds the image of an archive or OCI layout to the store,
+// without tagging it, and returns its manifest. Archives with several images
+// need the image to be named: a reference for docker-archive and a ref.name
+// (usually a tag) or reference for OCI layouts
+func transportImage(store *imageStore, transport, rest string) (*ManifestResponse, error) {
+	path, name, err := splitTransportPath(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []loadedImage
+	if transport == "oci" {
+		images, err = loadOCILayout(store, path)
+	} else {
+		var file *os.File
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		images, err = loadArchive(store, file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	picked := []loadedImage{}
+	for _, image := range images {
+		if name == "" || image.refName == name || imageHasName(image, name) {
+			picked = append(picked, image)
+		}
+	}
+	switch {
+	case len(picked) == 0 && name != "":
+		return nil, fmt.Errorf("No image %s in %s", name, path)
+	case len(picked) == 0:
+		return nil, fmt.Errorf("No image in %s", path)
+	case len(picked) > 1:
+		return nil, fmt.Errorf("%s has %d images, pick one with %s:%s:<name>", path, len(picked), transport, path)
+	}
+	return store.readManifest(picked[0].digest)
+}
+
+// This function reports whether the loaded image is known by the reference name
+func imageHasName(image loadedImage, name string) bool {
+	ref, err := parseReference(name)
+	if err != nil {
+		return false
+	}
+	for _, n := range image.names {
+		if n == ref.String() {
+			return true
+		}
+	}
+	return false
+}
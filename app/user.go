@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The below function resolves a user spec (user, uid, user:group or uid:gid) to
+// numeric ids, names are looked up in /etc/passwd and /etc/group of the rootfs.
+// The user gets the groups the group file lists it in as supplementary groups.
+// The home directory of the user is returned too, / when it has no entry
+func resolveUser(rootfs, spec string) (*syscall.Credential, string, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" {
+		return nil, "", fmt.Errorf("Invalid user %q: no user", spec)
+	}
+
+	entry, err := lookupPasswd(rootfs, userPart)
+	if err != nil {
+		return nil, "", err
+	}
+	credential := &syscall.Credential{Uid: entry.uid, Gid: entry.gid}
+	if hasGroup {
+		credential.Gid, err = lookupGroup(rootfs, groupPart)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if entry.name != "" {
+		credential.Groups, err = supplementaryGroups(rootfs, entry.name, credential.Gid)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return credential, entry.home, nil
+}
+
+// passwdEntry is a user of the passwd file
+type passwdEntry struct {
+	name     string
+	uid, gid uint32
+	home     string
+}
+
+// This function finds the uid and primary gid of a user name or uid in the
+// passwd file, a numeric uid that has no entry gets gid 0 like in docker
+func lookupPasswd(rootfs, user string) (passwdEntry, error) {
+	var found []string
+	err := scanImageFile(rootfs, "etc/passwd", func(fields []string) bool {
+		if len(fields) >= 4 && (fields[0] == user || fields[2] == user) {
+			found = fields
+			return true
+		}
+		return false
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return passwdEntry{}, err
+	}
+
+	if found == nil {
+		uid, err := strconv.ParseUint(user, 10, 32)
+		if err != nil {
+			return passwdEntry{}, fmt.Errorf("Unable to find user %s: no matching entries in passwd file", user)
+		}
+		return passwdEntry{uid: uint32(uid), home: "/"}, nil
+	}
+	uid, err := strconv.ParseUint(found[2], 10, 32)
+	if err != nil {
+		return passwdEntry{}, fmt.Errorf("Invalid uid %q for user %s", found[2], user)
+	}
+	gid, err := strconv.ParseUint(found[3], 10, 32)
+	if err != nil {
+		return passwdEntry{}, fmt.Errorf("Invalid gid %q for user %s", found[3], user)
+	}
+	entry := passwdEntry{name: found[0], uid: uint32(uid), gid: uint32(gid), home: "/"}
+	if len(found) >= 6 && found[5] != "" {
+		entry.home = found[5]
+	}
+	return entry, nil
+}
+
+// The below function returns the gids of the groups the group file lists the
+// user as a member of, but the primary group gid
+func supplementaryGroups(rootfs, user string, gid uint32) ([]uint32, error) {
+	var groups []uint32
+	err := scanImageFile(rootfs, "etc/group", func(fields []string) bool {
+		if len(fields) < 4 || !containsString(strings.Split(fields[3], ","), user) {
+			return false
+		}
+		group, err := strconv.ParseUint(fields[2], 10, 32)
+		if err == nil && uint32(group) != gid {
+			groups = append(groups, uint32(group))
+		}
+		return false
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// This function finds the gid of a group name or gid in the group file
+func lookupGroup(rootfs, group string) (uint32, error) {
+	var found []string
+	err := scanImageFile(rootfs, "etc/group", func(fields []string) bool {
+		if len(fields) >= 3 && (fields[0] == group || fields[2] == group) {
+			found = fields
+			return true
+		}
+		return false
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	value := group
+	if found != nil {
+		value = found[2]
+	}
+	gid, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find group %s: no matching entries in group file", group)
+	}
+	return uint32(gid), nil
+}
+
+// The below function scans the colon separated file at path of the image with
+// scanColonFile. We read it from the host side, the symlinks on the way are
+// resolved inside rootfs so an image can't make us read the files of the host
+func scanImageFile(rootfs, path string, match func(fields []string) bool) error {
+	resolved, err := secureJoin(rootfs, path)
+	if err != nil {
+		return err
+	}
+	return scanColonFile(resolved, match)
+}
+
+// The below function calls match with the fields of every line of a colon
+// separated file like /etc/passwd, until match returns true
+func scanColonFile(path string, match func(fields []string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if match(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
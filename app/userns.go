@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rootless tells whether we run without root, containers then only get the
+// privileges a user namespace gives and the storage drivers that do without
+// mounting as root
+var rootless = os.Geteuid() != 0
+
+// The below function parses the value of --userns. Containers get a user
+// namespace of their own unless it's host, which needs root: a user can't
+// create the other namespaces of a container without one
+func parseUserns(value string) (bool, error) {
+	switch value {
+	case "":
+		return true, nil
+	case "host":
+		if rootless {
+			return false, fmt.Errorf("--userns=host needs root, containers of other users run in a user namespace")
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid --userns %q: only host is supported", value)
+	}
+}
+
+// The below function returns the uid and gid mappings of the user namespace of
+// a container and whether it may call setgroups. For root the ids are the
+// ones of the host, root in the container just has no privileges outside of
+// its namespaces. A user without subordinate ids (see subordinateMappings) can
+// only map itself, it becomes root in the container and the files it owns are
+// owned by root there
+func userNamespaceMappings() ([]syscall.SysProcIDMap, []syscall.SysProcIDMap, bool) {
+	if !rootless {
+		all := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 1<<32 - 1}}
+		return all, all, true
+	}
+	// without setgroups denied the kernel doesn't let us write the gid map
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+		[]syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}, false
+}
+
+// The below function returns the mappings of a user namespace of a user that
+// has subordinate ids in /etc/subuid and /etc/subgid: root in the container is
+// the user and the ids from 1 on are its subordinate ones, so images that
+// chown files or switch users work. Only newuidmap and newgidmap, which are
+// setuid root, may write such mappings. It reports false when the user has no
+// subordinate ids or the helpers are missing
+func subordinateMappings() ([]syscall.SysProcIDMap, []syscall.SysProcIDMap, bool) {
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			return nil, nil, false
+		}
+	}
+	uid, gid := os.Geteuid(), os.Getegid()
+	name := strconv.Itoa(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	subUID, ok := subordinateRange("/etc/subuid", name, uid)
+	if !ok {
+		return nil, nil, false
+	}
+	subGID, ok := subordinateRange("/etc/subgid", name, uid)
+	if !ok {
+		return nil, nil, false
+	}
+	subUID.ContainerID, subGID.ContainerID = 1, 1
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}, subUID},
+		[]syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}, subGID}, true
+}
+
+// This function finds the first range of subordinate ids of the user in a file
+// like /etc/subuid, where lines are name:start:count or uid:start:count
+func subordinateRange(path, name string, uid int) (syscall.SysProcIDMap, bool) {
+	var found syscall.SysProcIDMap
+	scanColonFile(path, func(fields []string) bool {
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(uid)) {
+			return false
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return false
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			return false
+		}
+		found = syscall.SysProcIDMap{HostID: start, Size: count}
+		return true
+	})
+	return found, found.Size > 0
+}
+
+// The below function writes the mappings of the user namespace of the process
+// with newuidmap and newgidmap
+func writeIDMappings(pid int, uids, gids []syscall.SysProcIDMap) error {
+	for _, helper := range []struct {
+		name     string
+		mappings []syscall.SysProcIDMap
+	}{{"newuidmap", uids}, {"newgidmap", gids}} {
+		args := []string{strconv.Itoa(pid)}
+		for _, mapping := range helper.mappings {
+			args = append(args, strconv.Itoa(mapping.ContainerID), strconv.Itoa(mapping.HostID), strconv.Itoa(mapping.Size))
+		}
+		output, err := exec.Command(helper.name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Error running %s: %v: %s", helper.name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// This function reports whether the process may call setgroups, in a user
+// namespace created by a user it can't
+func setgroupsAllowed() bool {
+	data, err := os.ReadFile("/proc/self/setgroups")
+	return err != nil || strings.TrimSpace(string(data)) != "deny"
+}
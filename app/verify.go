@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// annotations cosign puts on the layers of a signature manifest
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+)
+
+// fulcio certificate extensions holding the OIDC issuer of the signer
+var (
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// verifyPolicy says which signatures are accepted for an image, either the ones
+// made with a public key or keyless ones whose certificate matches an identity
+type verifyPolicy struct {
+	keyPath   string
+	identity  string
+	issuer    string
+	rootsPath string
+}
+
+// This function reports whether any verification was asked for
+func (p *verifyPolicy) enabled() bool {
+	return p.keyPath != "" || p.identity != "" || p.issuer != ""
+}
+
+// simpleSigningPayload is what cosign signs, it names the manifest digest
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// The below function looks for cosign signatures of the image in the registry
+// and returns nil as soon as one of them is valid under the policy.
+//
+// The signatures are read from the "sha256-<hex>.sig" tag of the manifest we
+// have in the store, and of the digest the tag currently resolves to when that
+// is a manifest list containing it. The transparency log is not consulted, so
+// keyless certificates are checked at the time they were issued
+func verifyImage(store *imageStore, ref reference, policy *verifyPolicy) error {
+	if offline {
+		return fmt.Errorf("Cannot verify the signature of %s: running in offline mode", ref)
+	}
+
+	localDigest, _, err := store.resolve(ref)
+	if err != nil {
+		return err
+	}
+	reg, err := connectRegistry(ref, "pull")
+	if err != nil {
+		return err
+	}
+
+	digests := []string{localDigest}
+	remoteDigest, err := reg.manifestDigest(ref.path, ref.identifier())
+	if err == nil && remoteDigest != localDigest && manifestListContains(reg, ref.path, remoteDigest, localDigest) {
+		digests = append(digests, remoteDigest)
+	}
+
+	var lastErr error
+	for _, digest := range digests {
+		lastErr = verifyDigest(reg, ref.path, digest, policy)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Image %s is not signed according to the policy: %v", ref, lastErr)
+}
+
+// This function checks that the manifest list listDigest points to digest
+func manifestListContains(reg *registry, repository, listDigest, digest string) bool {
+	raw, mediaType, err := reg.fetchRawManifest(repository, listDigest, allManifestTypes)
+	if err != nil || !isManifestList(mediaType) {
+		return false
+	}
+	var list ManifestList
+	if json.Unmarshal(raw, &list) != nil {
+		return false
+	}
+	for _, manifest := range list.Manifests {
+		if manifest.Digest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// The below function verifies the signatures attached to the manifest digest
+func verifyDigest(reg *registry, repository, digest string, policy *verifyPolicy) error {
+	signatureTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	raw, _, err := reg.fetchRawManifest(repository, signatureTag, mediaTypeOCIManifest+", "+mediaTypeDockerManifest)
+	if err != nil {
+		return fmt.Errorf("no signature found for %s", digest)
+	}
+	var signatures ArtifactManifest
+	err = json.Unmarshal(raw, &signatures)
+	if err != nil {
+		return err
+	}
+
+	err = fmt.Errorf("no signature found for %s", digest)
+	for _, layer := range signatures.Layers {
+		if layer.Annotations[cosignSignatureAnnotation] == "" {
+			continue
+		}
+		err = verifySignature(reg, repository, digest, layer, policy)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// The below function verifies one signature layer: the payload has to name the
+// digest and the signature over it has to match the key or the certificate
+func verifySignature(reg *registry, repository, digest string, layer Descriptor, policy *verifyPolicy) error {
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	payload, err := reg.fetchBlob(repository, layer.Digest)
+	if err != nil {
+		return err
+	}
+
+	var publicKey crypto.PublicKey
+	if policy.keyPath != "" {
+		publicKey, err = loadPublicKey(policy.keyPath)
+	} else {
+		publicKey, err = verifyCertificate(layer.Annotations, policy)
+	}
+	if err != nil {
+		return err
+	}
+	err = checkSignature(publicKey, payload, signature)
+	if err != nil {
+		return err
+	}
+
+	var signed simpleSigningPayload
+	err = json.Unmarshal(payload, &signed)
+	if err != nil {
+		return fmt.Errorf("invalid signature payload: %v", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s, not %s", signed.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
+
+// This function reads a PEM encoded public key like cosign.pub
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// The below function checks the signing certificate of a keyless signature: it
+// has to chain up to the roots of the policy and name the expected identity and
+// issuer. The public key of the certificate is returned
+func verifyCertificate(annotations map[string]string, policy *verifyPolicy) (crypto.PublicKey, error) {
+	if policy.rootsPath == "" {
+		return nil, fmt.Errorf("keyless verification needs --certificate-chain with the root certificates")
+	}
+	block, _ := pem.Decode([]byte(annotations[cosignCertificateAnnotation]))
+	if block == nil {
+		return nil, fmt.Errorf("signature has no certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rootsPEM, err := os.ReadFile(policy.rootsPath)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificates in %s", policy.rootsPath)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(annotations[cosignChainAnnotation]))
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   certificate.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted certificate: %v", err)
+	}
+
+	if policy.identity != "" && !certificateHasIdentity(certificate, policy.identity) {
+		return nil, fmt.Errorf("certificate is not issued to %s", policy.identity)
+	}
+	if policy.issuer != "" {
+		issuer := certificateIssuer(certificate)
+		if issuer != policy.issuer {
+			return nil, fmt.Errorf("certificate issuer %q is not %s", issuer, policy.issuer)
+		}
+	}
+	return certificate.PublicKey, nil
+}
+
+// This function reports whether the certificate is issued to identity, an email
+// address or a URI subject alternative name
+func certificateHasIdentity(certificate *x509.Certificate, identity string) bool {
+	for _, email := range certificate.EmailAddresses {
+		if email == identity {
+			return true
+		}
+	}
+	for _, uri := range certificate.URIs {
+		if uri.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// This function returns the OIDC issuer fulcio recorded in the certificate
+func certificateIssuer(certificate *x509.Certificate) string {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oidIssuerV2) {
+			var issuer string
+			if _, err := asn1.Unmarshal(extension.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+		if extension.Id.Equal(oidIssuerV1) {
+			return string(extension.Value)
+		}
+	}
+	return ""
+}
+
+// The below function verifies the signature of payload with an ECDSA, RSA or
+// ed25519 public key
+func checkSignature(publicKey crypto.PublicKey, payload, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+		if err != nil {
+			err = rsa.VerifyPSS(key, crypto.SHA256, hash[:], signature, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Volume plugins keep the data of volumes for us, a volume created with
+// -d <plugin> is the plugin's. They speak the volume plugin protocol of
+// docker, a JSON request and a JSON response for each of VolumeDriver.Create,
+// .Remove, .Mount, .Unmount and the like, so the plugins written for docker
+// work as they are. A plugin is found by its name:
+//
+//	/run/docker/plugins/<name>.sock                 a plugin listening on a unix socket
+//	/run/docker/plugins/<name>/<name>.sock
+//	/etc/docker/plugins/<name>.spec                 the address of a plugin, unix:// or tcp://
+//	/usr/lib/docker/plugins/<name>.spec
+//	<data root>/plugins/<name>                      an executable plugin
+//
+// Plugins on sockets are spoken to over http, the request is the body of a
+// POST to /<method>. An executable plugin is run for each request with the
+// method as its argument, the request on its stdin and the response on its
+// stdout, which makes a shell script a plugin
+
+// pluginContentType is the media type of the requests and responses of plugins
+const pluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+// pluginTimeout is how long a plugin may take to answer, mounting a volume
+// of the network may be slow
+const pluginTimeout = 2 * time.Minute
+
+// pluginSocketDirs and pluginSpecDirs are where the plugins of the host are
+var (
+	pluginSocketDirs = []string{"/run/docker/plugins"}
+	pluginSpecDirs   = []string{"/etc/docker/plugins", "/usr/lib/docker/plugins"}
+)
+
+// volumePlugin is a volume driver out of our process
+type volumePlugin struct {
+	pluginName string
+	// the client of a plugin on a socket, and the address it is at
+	client  *http.Client
+	address string
+	// the executable of an executable plugin
+	executable string
+}
+
+// The below function finds the plugin with the name and checks it is a
+// volume driver
+func findVolumePlugin(name string) (*volumePlugin, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("Invalid volume driver name %q", name)
+	}
+	plugin, err := findPlugin(name)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Implements []string
+	}
+	err = plugin.call("Plugin.Activate", struct{}{}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Error activating plugin %s: %v", name, err)
+	}
+	if !containsString(response.Implements, "VolumeDriver") {
+		return nil, fmt.Errorf("Plugin %s is not a volume driver", name)
+	}
+	return plugin, nil
+}
+
+// This function looks for the plugin with the name in the directories of
+// plugins, in the order of the comment above
+func findPlugin(name string) (*volumePlugin, error) {
+	for _, dir := range pluginSocketDirs {
+		for _, path := range []string{filepath.Join(dir, name+".sock"), filepath.Join(dir, name, name+".sock")} {
+			if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+				return newSocketPlugin(name, "unix", path), nil
+			}
+		}
+	}
+	for _, dir := range pluginSpecDirs {
+		for _, ext := range []string{".spec", ".json"} {
+			data, err := os.ReadFile(filepath.Join(dir, name+ext))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			address := strings.TrimSpace(string(data))
+			if ext == ".json" {
+				// the json spec of docker, {"Name": ..., "Addr": ...}
+				var spec struct {
+					Addr string
+				}
+				err = json.Unmarshal(data, &spec)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid spec of plugin %s: %v", name, err)
+				}
+				address = spec.Addr
+			}
+			u, err := url.Parse(address)
+			if err != nil || (u.Scheme != "unix" && u.Scheme != "tcp") {
+				return nil, fmt.Errorf("Invalid address of plugin %s: %q", name, address)
+			}
+			if u.Scheme == "unix" {
+				return newSocketPlugin(name, "unix", u.Path), nil
+			}
+			return newSocketPlugin(name, "tcp", u.Host), nil
+		}
+	}
+	path := filepath.Join(dataRoot, "plugins", name)
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+		return &volumePlugin{pluginName: name, executable: path}, nil
+	}
+	return nil, fmt.Errorf("Error looking up volume plugin %s: plugin %s not found", name, name)
+}
+
+// The below function returns the plugin listening on the address of the network
+func newSocketPlugin(name, network, address string) *volumePlugin {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	return &volumePlugin{pluginName: name, client: &http.Client{Transport: transport, Timeout: pluginTimeout}, address: address}
+}
+
+// The below function sends the request of method to the plugin and reads its
+// response into response. The error a plugin answers with is in the Err of
+// the response
+func (p *volumePlugin) call(method string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if p.executable != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, p.executable, method)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Stderr = os.Stderr
+		data, err = cmd.Output()
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+	} else {
+		// the host of the url means nothing, the transport dials the plugin
+		req, err := http.NewRequest("POST", "http://plugin/"+method, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", pluginContentType)
+		req.Header.Set("Content-Type", pluginContentType)
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		defer resp.Body.Close()
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			var failure struct {
+				Err string
+			}
+			if json.Unmarshal(data, &failure) == nil && failure.Err != "" {
+				return fmt.Errorf("%s", failure.Err)
+			}
+			return fmt.Errorf("%s: %s", method, resp.Status)
+		}
+	}
+	// plugins may answer nothing when they have nothing to say
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	var failure struct {
+		Err string
+	}
+	if json.Unmarshal(data, &failure) == nil && failure.Err != "" {
+		return fmt.Errorf("%s", failure.Err)
+	}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return fmt.Errorf("%s: invalid response: %v", method, err)
+	}
+	return nil
+}
+
+func (p *volumePlugin) name() string {
+	return p.pluginName
+}
+
+func (p *volumePlugin) create(name string, options map[string]string) error {
+	request := struct {
+		Name string
+		Opts map[string]string
+	}{name, options}
+	return p.call("VolumeDriver.Create", request, &struct{}{})
+}
+
+func (p *volumePlugin) remove(name string) error {
+	request := struct {
+		Name string
+	}{name}
+	return p.call("VolumeDriver.Remove", request, &struct{}{})
+}
+
+func (p *volumePlugin) mount(name, id string) (string, error) {
+	request := struct {
+		Name string
+		ID   string
+	}{name, id}
+	var response struct {
+		Mountpoint string
+	}
+	err := p.call("VolumeDriver.Mount", request, &response)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(response.Mountpoint) {
+		return "", fmt.Errorf("plugin %s gave no absolute mountpoint for volume %s: %q", p.pluginName, name, response.Mountpoint)
+	}
+	return response.Mountpoint, nil
+}
+
+func (p *volumePlugin) unmount(name, id string) error {
+	request := struct {
+		Name string
+		ID   string
+	}{name, id}
+	return p.call("VolumeDriver.Unmount", request, &struct{}{})
+}
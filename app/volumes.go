@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Volumes keep data apart from the root file system of containers, a volume
+// outlives the containers it is mounted in. They are kept under the data root:
+//
+//	<data root>/volumes/<name>/volume.json   the volume, its driver and options
+//	<data root>/volumes/<name>/_data         the data of a volume of the local driver
+//
+// The data of a volume is its driver's, the local one keeps it in _data and
+// plugins (see volumeplugin.go) wherever they want: NFS, an encrypted tmpfs,
+// a disk of a cloud. A driver gives the path of the host the volume is at
+// when a container mounts it, which is bind mounted in the container
+
+// Volume is the volume.json of a volume
+type Volume struct {
+	Name      string
+	Driver    string
+	CreatedAt time.Time
+	Options   map[string]string `json:",omitempty"`
+	// where the data of a volume of the local driver is
+	Mountpoint string `json:",omitempty"`
+	Scope      string
+}
+
+// VolumeDriver keeps the data of volumes
+type VolumeDriver interface {
+	name() string
+	// create makes the volume with the options of volume create -o
+	create(name string, options map[string]string) error
+	// remove removes the volume and its data
+	remove(name string) error
+	// mount makes the volume available on the host for the container with
+	// the id, and returns the path it is at
+	mount(name, id string) (string, error)
+	// unmount tells the driver the container doesn't use the volume anymore
+	unmount(name, id string) error
+}
+
+// defaultVolumeDriver is the driver of volumes when none is given
+const defaultVolumeDriver = "local"
+
+// The below function returns the volume driver with the name, local or a
+// plugin
+func volumeDriverByName(name string) (VolumeDriver, error) {
+	if name == "" || name == defaultVolumeDriver {
+		return localVolumeDriver{}, nil
+	}
+	return findVolumePlugin(name)
+}
+
+// This function returns the directory of a volume
+func volumeDir(name string) string {
+	return filepath.Join(dataRoot, "volumes", name)
+}
+
+// The below function creates a volume with the driver and its options, and
+// records it. A volume with the name already there is returned as it is when
+// it has the same driver
+func createVolume(name, driverName string, options map[string]string) (*Volume, error) {
+	if !validName(name) || len(name) < 2 {
+		return nil, fmt.Errorf("Invalid volume name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed, at least 2 of them", name)
+	}
+	if driverName == "" {
+		driverName = defaultVolumeDriver
+	}
+	if volume, err := readVolume(name); err == nil {
+		if volume.Driver != driverName {
+			return nil, fmt.Errorf("Volume %s already exists with driver %s", name, volume.Driver)
+		}
+		return volume, nil
+	}
+	driver, err := volumeDriverByName(driverName)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(volumeDir(name), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = driver.create(name, options)
+	if err != nil {
+		os.RemoveAll(volumeDir(name))
+		return nil, fmt.Errorf("Error creating volume %s: %v", name, err)
+	}
+	volume := &Volume{Name: name, Driver: driverName, CreatedAt: time.Now().UTC(), Options: options, Scope: "local"}
+	if driverName == defaultVolumeDriver {
+		volume.Mountpoint = filepath.Join(volumeDir(name), "_data")
+	}
+	return volume, volume.save()
+}
+
+// This function reads a volume
+func readVolume(name string) (*Volume, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("No such volume: %s", name)
+	}
+	data, err := os.ReadFile(filepath.Join(volumeDir(name), "volume.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No such volume: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var volume Volume
+	err = json.Unmarshal(data, &volume)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid volume %s: %v", name, err)
+	}
+	return &volume, nil
+}
+
+// The below function writes the volume.json of the volume
+func (v *Volume) save() error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(volumeDir(v.Name), "volume.json"), data, 0600)
+}
+
+// This function returns every volume of the data root, sorted by name
+func listVolumes() ([]*Volume, error) {
+	paths, err := filepath.Glob(filepath.Join(dataRoot, "volumes", "*", "volume.json"))
+	if err != nil {
+		return nil, err
+	}
+	volumes := []*Volume{}
+	for _, path := range paths {
+		volume, err := readVolume(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// The below function returns the ids of the running containers the volume is
+// mounted in
+func (v *Volume) users() ([]string, error) {
+	dirs, err := filepath.Glob(filepath.Join(dataRoot, "containers", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, dir := range dirs {
+		container, err := findContainer(filepath.Base(dir))
+		if err != nil || !container.State.Running || !processExists(container.State.Pid) {
+			continue
+		}
+		for _, mount := range container.Volumes {
+			if mount.Name == v.Name {
+				ids = append(ids, container.Id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// The below function removes the volume with its driver, and its record
+func (v *Volume) remove() error {
+	driver, err := volumeDriverByName(v.Driver)
+	if err != nil {
+		return err
+	}
+	err = driver.remove(v.Name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(volumeDir(v.Name))
+}
+
+// VolumeMount is a volume mounted in a container
+type VolumeMount struct {
+	Name        string
+	Driver      string
+	Destination string
+	// an anonymous volume was created for the container, rm -v removes it
+	// with the container
+	Anonymous bool `json:",omitempty"`
+}
+
+// The below function mounts the volumes of mounts, the ones of -v and --mount
+// with a name for a source, for the container: they are created with the
+// driver when they don't exist and their source is made the path the driver
+// gives. The ones without a name are anonymous volumes, created with a random
+// name. The returned function unmounts them
+func mountVolumes(container *Container, mounts []containerMount, driverName string) (func(), error) {
+	var mounted []*Volume
+	unmount := func() {
+		for _, volume := range mounted {
+			driver, err := volumeDriverByName(volume.Driver)
+			if err == nil {
+				err = driver.unmount(volume.Name, container.Id)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[Warning] Error unmounting volume %s: %v\n", volume.Name, err)
+			}
+		}
+	}
+	for i := range mounts {
+		if mounts[i].Type != "volume" {
+			continue
+		}
+		anonymous := mounts[i].Name == ""
+		if anonymous {
+			id, err := randomID()
+			if err != nil {
+				unmount()
+				return nil, err
+			}
+			mounts[i].Name = id
+		}
+		volume, err := readVolume(mounts[i].Name)
+		if err != nil {
+			volume, err = createVolume(mounts[i].Name, driverName, nil)
+		}
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+		driver, err := volumeDriverByName(volume.Driver)
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+		path, err := driver.mount(volume.Name, container.Id)
+		if err != nil {
+			unmount()
+			return nil, fmt.Errorf("Error mounting volume %s: %v", volume.Name, err)
+		}
+		mounted = append(mounted, volume)
+		mounts[i].Source = path
+		container.Volumes = append(container.Volumes, VolumeMount{Name: volume.Name, Driver: volume.Driver, Destination: mounts[i].Target, Anonymous: anonymous})
+	}
+	return unmount, nil
+}
+
+// The below function returns the mounts of the anonymous volumes of the
+// VOLUME paths of the image config, except the ones mounts already mount
+// something on
+func imageVolumes(volumes map[string]struct{}, mounts []containerMount) []containerMount {
+	var paths []string
+	for path := range volumes {
+		path = filepath.Clean(path)
+		if !filepath.IsAbs(path) || path == "/" {
+			continue
+		}
+		mounted := false
+		for _, mount := range mounts {
+			mounted = mounted || filepath.Clean(mount.Target) == path
+		}
+		if !mounted {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	var imageMounts []containerMount
+	for _, path := range paths {
+		imageMounts = append(imageMounts, containerMount{Type: "volume", Target: path, Propagation: "rprivate"})
+	}
+	return imageMounts
+}
+
+// The below function copies what the image has at the target of the volume
+// mount into the volume when it is empty, like docker does, so that a volume
+// starts with the files the image put there. rootfs is the root file system
+// of the container, mounted in the mount namespace of the calling thread
+func populateVolume(rootfs string, mount containerMount) error {
+	entries, err := os.ReadDir(mount.Source)
+	if err != nil || len(entries) > 0 {
+		return err
+	}
+	path, err := secureJoin(rootfs, mount.Target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	err = copyPath(path, true, mount.Source, "", -1, -1)
+	if err != nil {
+		return fmt.Errorf("Error copying %s to volume %s: %v", mount.Target, mount.Name, err)
+	}
+	// the volume gets the owner and mode of the directory of the image
+	stat := info.Sys().(*syscall.Stat_t)
+	err = os.Chown(mount.Source, int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return err
+	}
+	return os.Chmod(mount.Source, info.Mode().Perm())
+}
+
+// The below function removes the anonymous volumes of the container no
+// running container uses, for rm -v
+func (c *Container) removeAnonymousVolumes() error {
+	for _, mount := range c.Volumes {
+		if !mount.Anonymous {
+			continue
+		}
+		volume, err := readVolume(mount.Name)
+		if err != nil {
+			// removed with volume rm already
+			continue
+		}
+		users, err := volume.users()
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			fmt.Fprintf(os.Stderr, "[Warning] Volume %s is in use by %s, it is kept\n", volume.Name, strings.Join(users, ", "))
+			continue
+		}
+		err = volume.remove()
+		if err != nil {
+			return fmt.Errorf("Error removing volume %s: %v", volume.Name, err)
+		}
+	}
+	return nil
+}
+
+// localVolumeDriver keeps the data of volumes in their directory of the data root
+type localVolumeDriver struct{}
+
+func (d localVolumeDriver) name() string {
+	return defaultVolumeDriver
+}
+
+func (d localVolumeDriver) create(name string, options map[string]string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("the local driver takes no options")
+	}
+	return os.Mkdir(filepath.Join(volumeDir(name), "_data"), 0755)
+}
+
+func (d localVolumeDriver) remove(name string) error {
+	return os.RemoveAll(filepath.Join(volumeDir(name), "_data"))
+}
+
+func (d localVolumeDriver) mount(name, id string) (string, error) {
+	return filepath.Join(volumeDir(name), "_data"), nil
+}
+
+func (d localVolumeDriver) unmount(name, id string) error {
+	return nil
+}
+
+// Usage: your_docker.sh volume create|ls|inspect|rm ...
+func volumeCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: volume create|ls|inspect|rm ...")
+	}
+	switch args[0] {
+	case "create":
+		return volumeCreateCommand(args[1:])
+	case "ls", "list":
+		return volumeLsCommand(args[1:])
+	case "inspect":
+		return volumeInspectCommand(args[1:])
+	case "rm", "remove":
+		return volumeRmCommand(args[1:])
+	default:
+		return fmt.Errorf("Unknown volume command: %s", args[0])
+	}
+}
+
+// Usage: your_docker.sh volume create [-d driver] [-o key=value] [name]
+// without a name the volume gets a random one
+func volumeCreateCommand(args []string) error {
+	flags := flag.NewFlagSet("volume create", flag.ContinueOnError)
+	driver := flags.String("driver", defaultVolumeDriver, "driver of the volume, local or a plugin")
+	flags.StringVar(driver, "d", defaultVolumeDriver, "driver of the volume, local or a plugin")
+	var optionFlags stringList
+	flags.Var(&optionFlags, "o", "driver option, key=value")
+	flags.Var(&optionFlags, "opt", "driver option, key=value")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("Usage: volume create [-d driver] [-o key=value] [name]")
+	}
+	name := flags.Arg(0)
+	if name == "" {
+		name, err = randomID()
+		if err != nil {
+			return err
+		}
+	}
+	var options map[string]string
+	for _, option := range optionFlags {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return fmt.Errorf("Invalid option %q: expected key=value", option)
+		}
+		if options == nil {
+			options = map[string]string{}
+		}
+		options[key] = value
+	}
+	volume, err := createVolume(name, *driver, options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(volume.Name)
+	return nil
+}
+
+// Usage: your_docker.sh volume ls [-q]
+func volumeLsCommand(args []string) error {
+	flags := flag.NewFlagSet("volume ls", flag.ContinueOnError)
+	quiet := flags.Bool("q", false, "only show volume names")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: volume ls [-q]")
+	}
+	volumes, err := listVolumes()
+	if err != nil {
+		return err
+	}
+	if *quiet {
+		for _, volume := range volumes {
+			fmt.Println(volume.Name)
+		}
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(writer, "DRIVER\tVOLUME NAME")
+	for _, volume := range volumes {
+		fmt.Fprintf(writer, "%s\t%s\n", volume.Driver, volume.Name)
+	}
+	return writer.Flush()
+}
+
+// Usage: your_docker.sh volume inspect <volume> ...
+func volumeInspectCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: volume inspect <volume> ...")
+	}
+	volumes := []*Volume{}
+	for _, name := range args {
+		volume, err := readVolume(name)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, volume)
+	}
+	data, err := json.Marshal(volumes)
+	if err != nil {
+		return err
+	}
+	return printJSON(data)
+}
+
+// Usage: your_docker.sh volume rm [-f] <volume> ...
+// volumes mounted in running containers are kept, -f doesn't fail on the
+// volumes that don't exist
+func volumeRmCommand(args []string) error {
+	flags := flag.NewFlagSet("volume rm", flag.ContinueOnError)
+	force := flags.Bool("f", false, "ignore volumes that don't exist")
+	flags.BoolVar(force, "force", false, "ignore volumes that don't exist")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: volume rm [-f] <volume> ...")
+	}
+	for _, name := range flags.Args() {
+		volume, err := readVolume(name)
+		if err != nil {
+			if *force {
+				continue
+			}
+			return err
+		}
+		users, err := volume.users()
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("Error removing volume %s: volume is in use by %s", name, strings.Join(users, ", "))
+		}
+		err = volume.remove()
+		if err != nil {
+			return fmt.Errorf("Error removing volume %s: %v", name, err)
+		}
+		fmt.Println(name)
+	}
+	return nil
+}